@@ -0,0 +1,148 @@
+/*
+ * Filename: activity.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tracks what the daemon is doing right now for runtime introspection.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Scheduler phases
+const (
+	phaseStarting   = "starting"
+	phaseConnecting = "connecting"
+	phaseRefreshing = "refreshing"
+	phaseChecking   = "checking"
+	phaseSleeping   = "sleeping"
+	phaseDone       = "done" // --once
+)
+
+// 'activity' type represents a snapshot of the daemon's current work
+type activity struct {
+	mu sync.Mutex
+
+	Started             time.Time                    `json:"started"`
+	CommandsOutstanding int                          `json:"commands_outstanding"`
+	Resources           resourceUsage                `json:"resources"`
+	Firewalls           map[string]*firewallActivity `json:"firewalls"`
+}
+
+// 'firewallActivity' type represents what one firewall's scheduler is doing
+type firewallActivity struct {
+	Env           string     `json:"environment"`
+	Iteration     int        `json:"iteration"`
+	Phase         string     `json:"phase"`
+	PhaseSince    time.Time  `json:"phase_since"`
+	Customer      string     `json:"customer,omitempty"`
+	Command       string     `json:"command,omitempty"`
+	Queue         int        `json:"queue"` // refresh steps left this iteration
+	Connection    string     `json:"connection"`
+	NextIteration *time.Time `json:"next_iteration,omitempty"`
+}
+
+// The running daemon's activity
+var current = &activity{Started: time.Now(), Firewalls: map[string]*firewallActivity{}}
+
+// Update a firewall's activity under the lock
+func (a *activity) update(firewall string, f func(fa *firewallActivity)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fa, ok := a.Firewalls[firewall]
+	if !ok {
+		fa = &firewallActivity{Phase: phaseStarting, PhaseSince: time.Now()}
+		a.Firewalls[firewall] = fa
+	}
+	f(fa)
+}
+
+// Register a firewall's scheduler
+func (a *activity) register(firewall, env string) {
+	a.update(firewall, func(fa *firewallActivity) { fa.Env = env })
+}
+
+// Enter a new phase, clearing per-step details
+func (a *activity) setPhase(firewall, phase string) {
+	a.update(firewall, func(fa *firewallActivity) {
+		fa.Phase, fa.PhaseSince = phase, time.Now()
+		fa.Customer, fa.Command = "", ""
+		fa.NextIteration = nil
+	})
+}
+
+// Start an iteration
+func (a *activity) startIteration(firewall string, n int) {
+	a.update(firewall, func(fa *firewallActivity) { fa.Iteration = n })
+}
+
+// Current iteration of a firewall
+func (a *activity) iteration(firewall string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if fa, ok := a.Firewalls[firewall]; ok {
+		return fa.Iteration
+	}
+	return 0
+}
+
+// Record when the next iteration starts
+func (a *activity) sleepUntil(firewall string, t time.Time) {
+	a.setPhase(firewall, phaseSleeping)
+	a.update(firewall, func(fa *firewallActivity) { fa.NextIteration = &t })
+}
+
+// Record the customer and command in flight
+func (a *activity) setStep(firewall, customer, command string) {
+	a.update(firewall, func(fa *firewallActivity) { fa.Customer, fa.Command = customer, command })
+}
+
+// Set the number of refresh steps left on a firewall
+func (a *activity) setQueue(firewall string, n int) {
+	a.update(firewall, func(fa *firewallActivity) { fa.Queue = n })
+}
+
+// Record a firewall connection state
+func (a *activity) setConnection(firewall, state string) {
+	a.update(firewall, func(fa *firewallActivity) { fa.Connection = state })
+}
+
+// Adjust the number of commands sent but not yet answered
+func (a *activity) addOutstanding(n int) {
+	a.mu.Lock()
+	a.CommandsOutstanding += n
+	a.mu.Unlock()
+}
+
+// Record the latest resource self-check
+func (a *activity) setResources(u resourceUsage) {
+	a.mu.Lock()
+	a.Resources = u
+	a.mu.Unlock()
+}
+
+// Report whether every scheduler is sleeping between iterations
+func (a *activity) idle() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, fa := range a.Firewalls {
+		if fa.Phase != phaseSleeping {
+			return false
+		}
+	}
+	return len(a.Firewalls) > 0
+}
+
+// Consistent JSON snapshot
+func (a *activity) MarshalJSON() ([]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	type snapshot activity
+	return json.Marshal((*snapshot)(a))
+}
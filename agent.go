@@ -0,0 +1,72 @@
+/*
+ * Filename: agent.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: SSH agent authentication when SSH_AUTH_SOCK is set.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Connection to the running SSH agent, opened on first use
+var (
+	agentOnce   sync.Once
+	agentClient agent.ExtendedAgent
+	agentErr    error
+)
+
+// Whether an SSH agent is advertised in the environment
+func agentAvailable() bool {
+	return os.Getenv("SSH_AUTH_SOCK") != ""
+}
+
+// Connect to the SSH agent, reusing the connection across dials
+func sshAgent() (agent.ExtendedAgent, error) {
+	agentOnce.Do(func() {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			agentErr = fmt.Errorf("ssh agent %s: %w", sock, err)
+			return
+		}
+		agentClient = agent.NewClient(conn)
+	})
+	return agentClient, agentErr
+}
+
+// Authentication methods for a firewall login: agent keys first, then the password
+func authMethods(password string) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if agentAvailable() {
+		if a, err := sshAgent(); err != nil {
+			logger.Warn(err.Error(), "error", err)
+		} else {
+			methods = append(methods, ssh.PublicKeysCallback(a.Signers))
+		}
+	}
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	return methods
+}
+
+// Number of keys the SSH agent holds
+func agentKeys() (int, error) {
+	a, err := sshAgent()
+	if err != nil {
+		return 0, err
+	}
+	keys, err := a.List()
+	return len(keys), err
+}
@@ -0,0 +1,301 @@
+// tfresh control-plane API, served by 'tfresh serve -grpc'.
+//
+// Regenerate the Go stubs with 'go generate' from the repository root.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/v1/tfresh.proto
+
+package tfreshv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Tfresh_RefreshCustomer_FullMethodName = "/tfresh.v1.Tfresh/RefreshCustomer"
+	Tfresh_RefreshAll_FullMethodName      = "/tfresh.v1.Tfresh/RefreshAll"
+	Tfresh_GetStatus_FullMethodName       = "/tfresh.v1.Tfresh/GetStatus"
+	Tfresh_ListCustomers_FullMethodName   = "/tfresh.v1.Tfresh/ListCustomers"
+	Tfresh_WatchRefresh_FullMethodName    = "/tfresh.v1.Tfresh/WatchRefresh"
+)
+
+// TfreshClient is the client API for Tfresh service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TfreshClient interface {
+	// Refresh one customer on every firewall it is on.
+	RefreshCustomer(ctx context.Context, in *RefreshCustomerRequest, opts ...grpc.CallOption) (*RefreshResponse, error)
+	// Refresh every customer, on one firewall or all of them.
+	RefreshAll(ctx context.Context, in *RefreshAllRequest, opts ...grpc.CallOption) (*RefreshResponse, error)
+	// Last refresh, quarantine and last API result of every customer.
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*GetStatusResponse, error)
+	// The configured customers.
+	ListCustomers(ctx context.Context, in *ListCustomersRequest, opts ...grpc.CallOption) (*ListCustomersResponse, error)
+	// Refresh customers, streaming each one's progress as it happens.
+	// The stream ends with a DONE event once every customer has a result.
+	WatchRefresh(ctx context.Context, in *WatchRefreshRequest, opts ...grpc.CallOption) (Tfresh_WatchRefreshClient, error)
+}
+
+type tfreshClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTfreshClient(cc grpc.ClientConnInterface) TfreshClient {
+	return &tfreshClient{cc}
+}
+
+func (c *tfreshClient) RefreshCustomer(ctx context.Context, in *RefreshCustomerRequest, opts ...grpc.CallOption) (*RefreshResponse, error) {
+	out := new(RefreshResponse)
+	err := c.cc.Invoke(ctx, Tfresh_RefreshCustomer_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tfreshClient) RefreshAll(ctx context.Context, in *RefreshAllRequest, opts ...grpc.CallOption) (*RefreshResponse, error) {
+	out := new(RefreshResponse)
+	err := c.cc.Invoke(ctx, Tfresh_RefreshAll_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tfreshClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*GetStatusResponse, error) {
+	out := new(GetStatusResponse)
+	err := c.cc.Invoke(ctx, Tfresh_GetStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tfreshClient) ListCustomers(ctx context.Context, in *ListCustomersRequest, opts ...grpc.CallOption) (*ListCustomersResponse, error) {
+	out := new(ListCustomersResponse)
+	err := c.cc.Invoke(ctx, Tfresh_ListCustomers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *tfreshClient) WatchRefresh(ctx context.Context, in *WatchRefreshRequest, opts ...grpc.CallOption) (Tfresh_WatchRefreshClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Tfresh_ServiceDesc.Streams[0], Tfresh_WatchRefresh_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &tfreshWatchRefreshClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Tfresh_WatchRefreshClient interface {
+	Recv() (*RefreshEvent, error)
+	grpc.ClientStream
+}
+
+type tfreshWatchRefreshClient struct {
+	grpc.ClientStream
+}
+
+func (x *tfreshWatchRefreshClient) Recv() (*RefreshEvent, error) {
+	m := new(RefreshEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// TfreshServer is the server API for Tfresh service.
+// All implementations must embed UnimplementedTfreshServer
+// for forward compatibility
+type TfreshServer interface {
+	// Refresh one customer on every firewall it is on.
+	RefreshCustomer(context.Context, *RefreshCustomerRequest) (*RefreshResponse, error)
+	// Refresh every customer, on one firewall or all of them.
+	RefreshAll(context.Context, *RefreshAllRequest) (*RefreshResponse, error)
+	// Last refresh, quarantine and last API result of every customer.
+	GetStatus(context.Context, *GetStatusRequest) (*GetStatusResponse, error)
+	// The configured customers.
+	ListCustomers(context.Context, *ListCustomersRequest) (*ListCustomersResponse, error)
+	// Refresh customers, streaming each one's progress as it happens.
+	// The stream ends with a DONE event once every customer has a result.
+	WatchRefresh(*WatchRefreshRequest, Tfresh_WatchRefreshServer) error
+	mustEmbedUnimplementedTfreshServer()
+}
+
+// UnimplementedTfreshServer must be embedded to have forward compatible implementations.
+type UnimplementedTfreshServer struct {
+}
+
+func (UnimplementedTfreshServer) RefreshCustomer(context.Context, *RefreshCustomerRequest) (*RefreshResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RefreshCustomer not implemented")
+}
+func (UnimplementedTfreshServer) RefreshAll(context.Context, *RefreshAllRequest) (*RefreshResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RefreshAll not implemented")
+}
+func (UnimplementedTfreshServer) GetStatus(context.Context, *GetStatusRequest) (*GetStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedTfreshServer) ListCustomers(context.Context, *ListCustomersRequest) (*ListCustomersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCustomers not implemented")
+}
+func (UnimplementedTfreshServer) WatchRefresh(*WatchRefreshRequest, Tfresh_WatchRefreshServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRefresh not implemented")
+}
+func (UnimplementedTfreshServer) mustEmbedUnimplementedTfreshServer() {}
+
+// UnsafeTfreshServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TfreshServer will
+// result in compilation errors.
+type UnsafeTfreshServer interface {
+	mustEmbedUnimplementedTfreshServer()
+}
+
+func RegisterTfreshServer(s grpc.ServiceRegistrar, srv TfreshServer) {
+	s.RegisterService(&Tfresh_ServiceDesc, srv)
+}
+
+func _Tfresh_RefreshCustomer_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshCustomerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TfreshServer).RefreshCustomer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tfresh_RefreshCustomer_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TfreshServer).RefreshCustomer(ctx, req.(*RefreshCustomerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tfresh_RefreshAll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshAllRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TfreshServer).RefreshAll(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tfresh_RefreshAll_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TfreshServer).RefreshAll(ctx, req.(*RefreshAllRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tfresh_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TfreshServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tfresh_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TfreshServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tfresh_ListCustomers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCustomersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TfreshServer).ListCustomers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Tfresh_ListCustomers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TfreshServer).ListCustomers(ctx, req.(*ListCustomersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Tfresh_WatchRefresh_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRefreshRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TfreshServer).WatchRefresh(m, &tfreshWatchRefreshServer{stream})
+}
+
+type Tfresh_WatchRefreshServer interface {
+	Send(*RefreshEvent) error
+	grpc.ServerStream
+}
+
+type tfreshWatchRefreshServer struct {
+	grpc.ServerStream
+}
+
+func (x *tfreshWatchRefreshServer) Send(m *RefreshEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Tfresh_ServiceDesc is the grpc.ServiceDesc for Tfresh service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Tfresh_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tfresh.v1.Tfresh",
+	HandlerType: (*TfreshServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "RefreshCustomer",
+			Handler:    _Tfresh_RefreshCustomer_Handler,
+		},
+		{
+			MethodName: "RefreshAll",
+			Handler:    _Tfresh_RefreshAll_Handler,
+		},
+		{
+			MethodName: "GetStatus",
+			Handler:    _Tfresh_GetStatus_Handler,
+		},
+		{
+			MethodName: "ListCustomers",
+			Handler:    _Tfresh_ListCustomers_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRefresh",
+			Handler:       _Tfresh_WatchRefresh_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/v1/tfresh.proto",
+}
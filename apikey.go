@@ -0,0 +1,138 @@
+/*
+ * Filename: apikey.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: XML API key generation from the firewall credentials, cached per firewall.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// API keys generated from PAN_USERNAME/PAN_PASSWORD, by firewall host
+	apiKeyCache = "tfresh.apikeys.json"
+
+	// Serializes key cache updates across schedulers
+	apiKeyMu sync.Mutex
+)
+
+// Generate an API key on the firewall with the 'keygen' request
+func (a *apiClient) keygen(user, pass string) (string, error) {
+	form := url.Values{"type": {"keygen"}, "user": {user}, "password": {pass}}
+	req, err := http.NewRequest(http.MethodPost, "https://"+a.host+"/api/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	inner, err := a.do(req)
+	if err != nil {
+		return "", err
+	}
+
+	var r struct {
+		Key string `xml:"key"`
+	}
+	if err := xml.Unmarshal([]byte("<result>"+inner+"</result>"), &r); err != nil || r.Key == "" {
+		return "", fmt.Errorf("%s: keygen returned no key", a.host)
+	}
+	return r.Key, nil
+}
+
+// Use a cached API key for the firewall, generating and caching one when there is none
+func (a *apiClient) login(user, pass string) error {
+	a.user, a.pass = user, pass
+	apiKeyMu.Lock()
+	defer apiKeyMu.Unlock()
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		logger.Warn(fmt.Sprint("api key cache: ", err), "error", err)
+	}
+	if key := keys[a.host]; key != "" {
+		a.setKey(key)
+		return nil
+	}
+	return a.rekey(keys)
+}
+
+// Generate a new API key, replacing the cached one
+func (a *apiClient) rekey(keys map[string]string) error {
+	key, err := a.keygen(a.user, a.pass)
+	if err != nil {
+		return err
+	}
+	a.setKey(key)
+	if keys == nil {
+		keys = map[string]string{}
+	}
+	keys[a.host] = key
+	if err := saveAPIKeys(keys); err != nil {
+		logger.Warn(fmt.Sprint("api key cache: ", err), "error", err)
+	}
+	return nil
+}
+
+// Replace a key the firewall rejected, e.g. after the account's password changed
+func (a *apiClient) renew(rejected string) error {
+	apiKeyMu.Lock()
+	defer apiKeyMu.Unlock()
+	if a.apiKey() != rejected {
+		// Another request already renewed it
+		return nil
+	}
+	keys, _ := loadAPIKeys()
+	return a.rekey(keys)
+}
+
+// Current API key
+func (a *apiClient) apiKey() string {
+	a.keyMu.RLock()
+	defer a.keyMu.RUnlock()
+	return a.key
+}
+
+// Replace the API key used by new requests
+func (a *apiClient) setKey(key string) {
+	a.keyMu.Lock()
+	a.key = key
+	a.keyMu.Unlock()
+}
+
+// Read the API key cache; a missing file is an empty cache
+func loadAPIKeys() (map[string]string, error) {
+	b, err := os.ReadFile(apiKeyCache)
+	if errors.Is(err, os.ErrNotExist) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return map[string]string{}, err
+	}
+	keys := map[string]string{}
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return map[string]string{}, fmt.Errorf("%s: %w", apiKeyCache, err)
+	}
+	return keys, nil
+}
+
+// Write the API key cache readable only by the owner
+func saveAPIKeys(keys map[string]string) error {
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Temporary files are created owner-only, so the cache never becomes world-readable
+	return writeFileAtomic(apiKeyCache, b, ".tfresh-apikeys-*")
+}
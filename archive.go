@@ -0,0 +1,141 @@
+/*
+ * Filename: archive.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Archives per-iteration transcripts and reports to object storage with retention.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Archived objects older than this are deleted (0 keeps them forever)
+	archiveRetentionDays = 365
+
+	// Transcript archiver; nil when archiving is disabled
+	archive *archiver
+)
+
+// How often expired archive objects are swept
+const archiveSweepEvery = 24 * time.Hour
+
+// 'archiver' type represents an object storage destination for transcripts
+type archiver struct {
+	store  objectStore
+	prefix string
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// 'iterationReport' type represents the archived summary of one iteration
+type iterationReport struct {
+	Firewall  string         `json:"firewall"`
+	Iteration int            `json:"iteration"`
+	Started   time.Time      `json:"started"`
+	Duration  float64        `json:"duration_seconds"`
+	Results   []reportResult `json:"results"`
+}
+
+// 'reportResult' type represents one refresh step in a report
+type reportResult struct {
+	Customer string   `json:"customer,omitempty"`
+	Kind     string   `json:"kind"`
+	Commands []string `json:"commands"`
+	Result   string   `json:"result"`
+	Error    string   `json:"error,omitempty"`
+	Duration float64  `json:"duration_seconds"`
+}
+
+// Create an archiver for an object storage URL
+func newArchiver(rawURL string) (*archiver, error) {
+	store, prefix, err := openObjectStore(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &archiver{store: store, prefix: prefix}, nil
+}
+
+// Build the report of an iteration
+func newIterationReport(firewall string, iteration int, started time.Time, results []stepResult) iterationReport {
+	r := iterationReport{Firewall: firewall, Iteration: iteration, Started: started, Duration: time.Since(started).Seconds()}
+	for _, res := range results {
+		rr := reportResult{Customer: res.step.customer, Kind: res.step.kind, Result: res.result, Duration: res.duration.Seconds()}
+		for _, c := range res.step.cmds {
+			rr.Commands = append(rr.Commands, c.String())
+		}
+		if res.err != nil {
+			rr.Error = res.err.Error()
+		}
+		r.Results = append(r.Results, rr)
+	}
+	return r
+}
+
+// Upload an iteration's transcript and report, then sweep expired objects.
+// Failures are logged; archiving never stops a refresh.
+func (a *archiver) upload(firewall string, iteration int, started time.Time, transcript []byte, results []stepResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*objTimeout)
+	defer cancel()
+
+	ts := started.UTC()
+	base := fmt.Sprintf("%s%s/%s/%s-iteration-%d", a.prefix, firewall, ts.Format("2006/01/02"), ts.Format("20060102T150405Z"), iteration)
+
+	if err := a.store.Put(ctx, base+".log", transcript, "text/plain; charset=utf-8"); err != nil {
+		logger.Error(fmt.Sprint("archive transcript: ", err), "firewall", firewall, "error", err)
+	}
+	report, _ := json.MarshalIndent(newIterationReport(firewall, iteration, started, results), "", "  ")
+	if err := a.store.Put(ctx, base+".json", report, "application/json"); err != nil {
+		logger.Error(fmt.Sprint("archive report: ", err), "firewall", firewall, "error", err)
+	}
+
+	a.sweep(ctx)
+}
+
+// Delete archived objects past the retention period, at most once per sweep interval
+func (a *archiver) sweep(ctx context.Context) {
+	if archiveRetentionDays <= 0 {
+		return
+	}
+	a.mu.Lock()
+	if time.Since(a.lastSweep) < archiveSweepEvery {
+		a.mu.Unlock()
+		return
+	}
+	a.lastSweep = time.Now()
+	a.mu.Unlock()
+
+	objects, err := a.store.List(ctx, a.prefix)
+	if err != nil {
+		logger.Error(fmt.Sprint("archive retention: ", err), "error", err)
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -archiveRetentionDays)
+	deleted := 0
+	for _, o := range objects {
+		if o.Modified.IsZero() || o.Modified.After(cutoff) {
+			continue
+		}
+		if err := a.store.Delete(ctx, o.Key); err != nil {
+			logger.Error(fmt.Sprint("archive retention: ", err), "error", err)
+			return
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		logger.Info(fmt.Sprintf("Archive retention: deleted %d objects older than %d days", deleted, archiveRetentionDays), "deleted", deleted)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+ * Filename: blackout.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Maintenance windows during which refreshes are suppressed.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 'blackoutWindow' type represents a maintenance window: either a one-off start and
+// end, or a recurring cron schedule opening the window for a duration
+type blackoutWindow struct {
+	Start    time.Time     `yaml:"start,omitempty" json:"start,omitempty"`
+	End      time.Time     `yaml:"end,omitempty" json:"end,omitempty"`
+	Schedule string        `yaml:"schedule,omitempty" json:"schedule,omitempty"` // e.g. '0 22 * * SAT'
+	Duration time.Duration `yaml:"duration,omitempty" json:"duration,omitempty"` // e.g. 6h
+	Reason   string        `yaml:"reason,omitempty" json:"reason,omitempty"`
+}
+
+// Blackout windows from the config's firewalls section, by host
+var firewallBlackouts = map[string][]blackoutWindow{}
+
+// Check the window is one of the two forms
+func (w blackoutWindow) check() error {
+	switch {
+	case w.Schedule != "":
+		if !w.Start.IsZero() || !w.End.IsZero() {
+			return errors.New("blackout: use either schedule and duration or start and end")
+		}
+		if _, err := parseCron(w.Schedule); err != nil {
+			return fmt.Errorf("blackout: %w", err)
+		}
+		if w.Duration <= 0 {
+			return errors.New("blackout: schedule needs a positive duration")
+		}
+	case w.Start.IsZero() || w.End.IsZero():
+		return errors.New("blackout: needs start and end, or schedule and duration")
+	case !w.End.After(w.Start):
+		return fmt.Errorf("blackout: end %s is not after start %s", w.End.Format(time.RFC3339), w.Start.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// When the window covering t ends, or the zero time when t is outside it
+func (w blackoutWindow) until(t time.Time) time.Time {
+	if w.Schedule == "" {
+		if !t.Before(w.Start) && t.Before(w.End) {
+			return w.End
+		}
+		return time.Time{}
+	}
+	sched, err := parseCron(w.Schedule)
+	if err != nil {
+		return time.Time{}
+	}
+	// The latest opening within the duration before t, if any
+	var end time.Time
+	for f := sched.next(t.Add(-w.Duration)); !f.IsZero() && !f.After(t); f = sched.next(f) {
+		end = f.Add(w.Duration)
+	}
+	if !end.After(t) {
+		return time.Time{}
+	}
+	return end
+}
+
+// The window covering t with the latest end, if any
+func activeBlackout(windows []blackoutWindow, t time.Time) (blackoutWindow, time.Time, bool) {
+	var found blackoutWindow
+	var end time.Time
+	for _, w := range windows {
+		if u := w.until(t); u.After(end) {
+			found, end = w, u
+		}
+	}
+	return found, end, !end.IsZero()
+}
+
+// Describe a window for logs and notifications
+func (w blackoutWindow) String() string {
+	s := "from " + w.Start.Format(time.RFC3339)
+	if w.Schedule != "" {
+		s = fmt.Sprintf("'%s' for %v", w.Schedule, w.Duration)
+	}
+	if w.Reason != "" {
+		s += " (" + w.Reason + ")"
+	}
+	return s
+}
+
+// Hold back customers in a blackout window of their own or of the scheduler's firewall
+func (sc *scheduler) splitBlackedOut(customers []customer, log *blockLog) (active []customer) {
+	now := time.Now()
+	if w, end, ok := activeBlackout(firewallBlackouts[sc.firewall], now); ok {
+		sc.enterBlackout(fmt.Sprintf("firewall blackout %s until %s", w, end.Format(time.RFC3339)))
+		if len(customers) > 0 {
+			log.Printf("Suppressing %d refreshes on %s: blackout %s until %s", len(customers), sc.firewall, w, end.Format(time.RFC3339))
+		}
+		return nil
+	}
+	sc.enterBlackout("")
+	for _, c := range customers {
+		if w, end, ok := activeBlackout(c.Blackouts, now); ok {
+			log.Printf("Suppressing refresh of %s: blackout %s until %s", c.Name, w, end.Format(time.RFC3339))
+			continue
+		}
+		active = append(active, c)
+	}
+	return active
+}
+
+// Notify when the firewall enters or leaves a blackout; an empty description means it is outside one
+func (sc *scheduler) enterBlackout(desc string) {
+	if desc == sc.blackout {
+		return
+	}
+	switch {
+	case desc != "":
+		notify(event{Type: "blackout_started", Severity: sevInfo, Firewall: sc.firewall, Message: "refreshes suppressed: " + desc})
+	case sc.blackout != "":
+		notify(event{Type: "blackout_ended", Severity: sevInfo, Firewall: sc.firewall, Message: "refreshes resumed after " + sc.blackout})
+	}
+	sc.blackout = desc
+}
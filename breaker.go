@@ -0,0 +1,155 @@
+/*
+ * Filename: breaker.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Circuit breaker that stops refreshing a firewall failing every customer.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// Consecutive failed customers on a firewall that open its circuit; 0 disables the breaker
+	breakerThreshold = 0
+
+	// How long an open circuit skips the firewall before a probe refresh
+	breakerCooldown = 5 * time.Minute
+)
+
+// Circuit states
+const (
+	circuitClosed   = "closed"    // refreshing as usual
+	circuitOpen     = "open"      // skipping the firewall until the cooldown ends
+	circuitHalfOpen = "half-open" // one probe refresh decides whether to close
+)
+
+// 'breaker' type represents the circuit breaker of one firewall
+type breaker struct {
+	mu       sync.Mutex
+	firewall string
+	state    string
+	failures int // consecutive failed customers
+	openedAt time.Time
+	probing  bool // the half-open probe is in flight
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*breaker{} // by firewall
+)
+
+// The firewall's breaker, nil when the breaker is disabled
+func breakerFor(firewall string) *breaker {
+	if breakerThreshold <= 0 {
+		return nil
+	}
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[firewall]
+	if b == nil {
+		b = &breaker{firewall: firewall, state: circuitClosed}
+		breakers[firewall] = b
+	}
+	return b
+}
+
+// Report whether the circuit is open with its cooldown still running, and when the cooldown ends
+func (b *breaker) cooling() (until time.Time, ok bool) {
+	if b == nil {
+		return time.Time{}, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	until = b.openedAt.Add(breakerCooldown)
+	return until, b.state == circuitOpen && time.Now().Before(until)
+}
+
+// Report whether a customer may be refreshed now. Once the cooldown ends the
+// circuit half-opens and lets a single probe through.
+func (b *breaker) allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if time.Since(b.openedAt) < breakerCooldown {
+			return false
+		}
+		b.state = circuitHalfOpen
+		logger.Info(fmt.Sprintf("Circuit half-open on %s, probing with one customer", b.firewall), "firewall", b.firewall)
+	}
+	if b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Record a customer's refresh result, opening or closing the circuit
+func (b *breaker) record(result string) {
+	if b == nil || (result != resultFailed && result != resultSuccess && result != resultSent) {
+		return
+	}
+	b.mu.Lock()
+	var e *event
+	// The API transport refreshes without asking allow(), so an expired cooldown also makes a probe
+	probe := b.state == circuitHalfOpen || (b.state == circuitOpen && time.Since(b.openedAt) >= breakerCooldown)
+	b.probing = false
+	switch {
+	case result != resultFailed:
+		b.failures = 0
+		if b.state != circuitClosed {
+			b.state = circuitClosed
+			e = &event{Type: "circuit_closed", Severity: sevInfo, Firewall: b.firewall, Message: "probe refresh succeeded, refreshing the firewall again"}
+		}
+	case probe:
+		b.failures++
+		b.state, b.openedAt = circuitOpen, time.Now()
+		e = &event{Type: "circuit_open", Severity: sevError, Firewall: b.firewall,
+			Message: fmt.Sprintf("probe refresh failed, skipping the firewall for another %v", breakerCooldown)}
+	default:
+		b.failures++
+		if b.state == circuitClosed && b.failures >= breakerThreshold {
+			b.state, b.openedAt = circuitOpen, time.Now()
+			e = &event{Type: "circuit_open", Severity: sevError, Firewall: b.firewall,
+				Message: fmt.Sprintf("%d consecutive customers failed, skipping the firewall for %v", b.failures, breakerCooldown)}
+		}
+	}
+	b.mu.Unlock()
+
+	// Backends may be slow; don't hold the breaker meanwhile
+	if e != nil {
+		notify(*e)
+	}
+}
+
+// Hold back every customer while the firewall's circuit is open
+func (sc *scheduler) splitOpenCircuit(customers []customer, log *blockLog) []customer {
+	until, ok := breakerFor(sc.firewall).cooling()
+	if !ok {
+		return customers
+	}
+	if len(customers) > 0 {
+		log.Printf("Suppressing %d refreshes on %s: circuit open until %s", len(customers), sc.firewall, until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Result of a step the open circuit held back
+func skipOpenCircuit(firewall string, step refreshStep) stepResult {
+	log := newStepLog(firewall, step)
+	log.Printf("Skipping %s: circuit open on %s", step.customer, firewall)
+	log.Flush()
+	return stepResult{step: step, firewall: firewall, result: resultSkipped}
+}
@@ -0,0 +1,162 @@
+/*
+ * Filename: canary.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Canary customer refreshed and verified before the rest of an iteration.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+var (
+	// Canary customer name, 'random', or empty to disable
+	canaryName = ""
+
+	// How long a canary's IPsec SA has to come up
+	canaryWait = 30 * time.Second
+)
+
+// Interval between SA polls while verifying refreshes
+const saPoll = 5 * time.Second
+
+var errCanaryFailed = errors.New("canary failed, iteration aborted")
+
+// Choose the canary step, or -1 when there is none
+func pickCanary(steps []refreshStep) int {
+	var candidates []int
+	for i, step := range steps {
+		if step.kind != stepTunnel {
+			continue
+		}
+		if canaryName != "random" && (customer{Name: step.customer}).key() == (customer{Name: canaryName}).key() {
+			return i
+		}
+		candidates = append(candidates, i)
+	}
+	if canaryName != "random" || len(candidates) == 0 {
+		return -1
+	}
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// Refresh the canary first and verify it. On failure the remaining steps are
+// reported as skipped and aborted is set; err is a transport failure.
+func (sc *scheduler) canary(steps []refreshStep, log *blockLog) (rest []refreshStep, results []stepResult, aborted bool, err error) {
+	i := pickCanary(steps)
+	if i < 0 {
+		if canaryName != "random" {
+			log.Printf("Canary %q is not refreshed on %s this iteration", canaryName, sc.firewall)
+		}
+		return steps, nil, false, nil
+	}
+	step := steps[i]
+	rest = append(append([]refreshStep{}, steps[:i]...), steps[i+1:]...)
+
+	log.Println("Canary:", step.customer)
+	log.Flush()
+	if results, err = sc.refresh([]refreshStep{step}); err != nil {
+		return nil, results, false, err
+	}
+	if verr := sc.verifyCanary(step, results); verr != nil {
+		results[0].result, results[0].err = resultFailed, verr
+		msg := fmt.Sprintf("canary %s failed on %s, skipping %d steps: %v", step.customer, sc.firewall, len(rest), verr)
+		notify(event{Type: "canary_failed", Severity: sevError, Firewall: sc.firewall, Customer: step.customer, Message: msg})
+		for _, s := range rest {
+			results = append(results, stepResult{step: s, firewall: sc.firewall, result: resultSkipped, err: errCanaryFailed})
+		}
+		return nil, results, true, nil
+	}
+	log.Println("Canary verified:", step.customer)
+	return rest, results, false, nil
+}
+
+// Check the canary's refresh result and, over SSH, that its IPsec SA came up
+func (sc *scheduler) verifyCanary(step refreshStep, results []stepResult) error {
+	if len(results) == 0 || results[0].result == resultFailed {
+		if len(results) > 0 && results[0].err != nil {
+			return results[0].err
+		}
+		return errors.New("refresh failed")
+	}
+	c, _ := sc.customer(step.customer)
+	tunnel := c.Tunnel
+	if sc.api != nil || tunnel == "" {
+		return nil
+	}
+
+	down, err := sc.waitTunnels([]string{tunnel}, canaryWait)
+	if err != nil {
+		return err
+	}
+	if len(down) > 0 {
+		return fmt.Errorf("no IPsec SA for tunnel %s after %v", tunnel, canaryWait)
+	}
+	return nil
+}
+
+// Poll the firewall's IPsec SAs until every tunnel is up or the wait expires, returning those still down
+func (sc *scheduler) waitTunnels(tunnels []string, wait time.Duration) ([]string, error) {
+	drv := driverFor(sc.firewall)
+	cli, err := drv.Connect(sc.client)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	deadline := time.Now().Add(wait)
+	for {
+		down, err := sc.downTunnels(drv, cli, tunnels)
+		if err != nil {
+			return nil, err
+		}
+		if len(down) == 0 || time.Now().After(deadline) {
+			return down, nil
+		}
+		if !sleepCtx(saPoll) {
+			// Stopping: leave the SAs unverified rather than failing the customers
+			return nil, nil
+		}
+	}
+}
+
+// Tunnels without an IPsec SA; PAN-OS lists them all at once, other vendors are asked per tunnel
+func (sc *scheduler) downTunnels(drv driver, cli *cliSession, tunnels []string) ([]string, error) {
+	var down []string
+	if drv.Name() != driverPANOS {
+		for _, t := range tunnels {
+			c := customer{Tunnel: t}
+			for _, cust := range sc.assigned() {
+				if cust.Tunnel == t {
+					c = cust
+					break
+				}
+			}
+			up, err := drv.Status(cli, c)
+			if err != nil {
+				return nil, err
+			}
+			if !up {
+				down = append(down, t)
+			}
+		}
+		return down, nil
+	}
+
+	sas, err := listIPsecSAs(cli)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tunnels {
+		if _, ok := sas[t]; !ok {
+			down = append(down, t)
+		}
+	}
+	return down, nil
+}
@@ -0,0 +1,97 @@
+/*
+ * Filename: cli.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Subcommand table, top-level usage and 'tfresh help'.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// 'subcommand' type represents one 'tfresh <name>' command
+type subcommand struct {
+	name    string
+	summary string
+	run     func(args []string)
+}
+
+// Every subcommand, in the order 'tfresh help' lists them. 'run' is the daemon itself.
+var subcommands = []subcommand{
+	{"run", "Refresh customer tunnels every interval, or once with --once", nil},
+	{"validate", "Check a configuration file without connecting to anything", validateCommand},
+	{"lint", "Report style and risk findings in a configuration file", lintCommand},
+	{"list", "Show the parsed customers", listCommand},
+	{"search", "Find customers by name, gateway, tunnel, peer or tag", searchCommand},
+	{"describe", "Show everything tfresh resolves for one customer", describeCommand},
+	{"status", "Show the state store, or query SA states with -live", statusCommand},
+	{"history", "Query the refresh attempts recorded with -history-db", historyCommand},
+	{"discover", "List VPN tunnels on a firewall and the customers they would become", discoverCommand},
+	{"import", "Generate customer entries from the tunnels on a firewall", importCommand},
+	{"inventory", "Compare the configuration to a firewall's tunnels", inventoryCommand},
+	{"preflight", "Check firewalls are reachable and accept the credentials", preflightCommand},
+	{"doctor", "Diagnose the environment with remediation hints", doctorCommand},
+	{"mock", "Serve a mock PAN-OS firewall over SSH for testing", mockCommand},
+	{"inspect", "Query a running daemon's control listener", inspectCommand},
+	{"shell", "Interactive console for a running daemon", shellCommand},
+	{"tui", "Live dashboard of a firewall's customers with force-refresh", tuiCommand},
+	{"serve", "HTTP and gRPC APIs for refreshing customers on demand", serveCommand},
+	{"operator", "Kubernetes controller refreshing TunnelRefresh resources", operatorCommand},
+	{"service", "Install and control the daemon as a Windows service", serviceCommand},
+	{"cutover", "Shift customers between firewall environments at runtime", cutoverCommand},
+	{"config", "Configuration history, rollback and diff", configCommand},
+}
+
+// Find a subcommand by name
+func lookupSubcommand(name string) (subcommand, bool) {
+	for _, c := range subcommands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return subcommand{}, false
+}
+
+// Print the subcommands
+func printSubcommands() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range subcommands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(os.Stderr, "  help       Show this list, or a command's flags with 'help <command>'")
+}
+
+// Usage of the daemon's flags, which also run without the 'run' command
+func runUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s run [flags]\n\nRun '%s help' for the other commands.\n\nFlags:\n", os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+	printEnvUsage(flag.CommandLine)
+	fmt.Fprintf(os.Stderr, "\nExit codes:\n  %d  every customer refreshed (--once), or stopped by a signal\n  %d  other errors\n  %d  some customers failed (--once)\n  %d  bad flags, configuration or missing credentials\n  %d  a firewall rejected the credentials\n  %d  a firewall couldn't be reached or the connection was lost\n",
+		exitOK, exitFailure, exitPartial, exitConfig, exitAuth, exitConnectivity)
+}
+
+// Handle 'tfresh help [command]', reporting whether the daemon's flags were asked for
+func helpCommand(args []string) (daemon bool) {
+	if len(args) == 0 {
+		printSubcommands()
+		return false
+	}
+	c, ok := lookupSubcommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown command %q.\n", args[0])
+		printSubcommands()
+		os.Exit(1)
+	}
+	if c.run == nil {
+		// The daemon's flags are registered by main
+		return true
+	}
+	c.run([]string{"-h"})
+	return false
+}
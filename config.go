@@ -0,0 +1,767 @@
+/*
+ * Filename: config.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Configuration file loading and the 'tfresh config' subcommand.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// 'customer' type represents a customer VPN connection
+type customer struct {
+	Name        string   `yaml:"customer_name" json:"customer_name"`
+	Description string   `yaml:"customer_description" json:"customer_description"`
+	Gateway     string   `yaml:"customer_gateway" json:"customer_gateway"`
+	Tunnel      string   `yaml:"customer_tunnel" json:"customer_tunnel"`
+	Peer        string   `yaml:"customer_peer,omitempty" json:"customer_peer,omitempty"`
+	Tags        []string `yaml:"customer_tags" json:"customer_tags"`
+
+	// Firewall name overriding -e
+	Firewall string `yaml:"customer_firewall,omitempty" json:"customer_firewall,omitempty"`
+
+	// Tunnel interface (e.g. tunnel.12) and expected prefixes over it, enables route checks
+	Interface string   `yaml:"customer_tunnel_interface,omitempty" json:"customer_tunnel_interface,omitempty"`
+	Routes    []string `yaml:"customer_routes,omitempty" json:"customer_routes,omitempty"`
+
+	// Skipped by the daemon while kept in the config
+	Disabled bool `yaml:"customer_disabled,omitempty" json:"customer_disabled,omitempty"`
+
+	// Minutes between refreshes, defaults to the customer's tag tier or -i
+	Interval int `yaml:"customer_interval,omitempty" json:"customer_interval,omitempty"`
+
+	// Cron expression overriding the interval, e.g. '*/10 8-18 * * MON-FRI'; defaults to -schedule
+	Schedule string `yaml:"customer_schedule,omitempty" json:"customer_schedule,omitempty"`
+
+	// Maintenance windows during which the customer isn't refreshed
+	Blackouts []blackoutWindow `yaml:"customer_blackout,omitempty" json:"customer_blackout,omitempty"`
+
+	// Entry type, site-to-site (default) or globalprotect, and the GlobalProtect component to restart
+	Type        string `yaml:"customer_type,omitempty" json:"customer_type,omitempty"`
+	GPComponent string `yaml:"customer_gp_component,omitempty" json:"customer_gp_component,omitempty"`
+}
+
+// 'configDoc' type represents a configuration file. The file is either a plain
+// list of customers or a mapping with 'include', 'firewalls', 'notifications', 'credentials' and 'customers' sections.
+type configDoc struct {
+	Include       []string           `yaml:"include,omitempty"` // further files or globs, relative to this one
+	Firewalls     []firewallDef      `yaml:"firewalls"`
+	Notifications notificationConfig `yaml:"notifications"`
+	Credentials   *credentialsConfig `yaml:"credentials,omitempty"`
+	Customers     []customer         `yaml:"customers"`
+}
+
+// 'firewallDef' type represents a firewall defined in the configuration file
+type firewallDef struct {
+	Name        string           `yaml:"name" json:"name"`                                   // selected with -e and customer_firewall
+	Host        string           `yaml:"host" json:"host"`                                   // management hostname or address
+	Addresses   []string         `yaml:"addresses,omitempty" json:"addresses,omitempty"`     // further management addresses tried in order when host can't be reached
+	Port        int              `yaml:"port,omitempty" json:"port,omitempty"`               // SSH port, defaults to -ssh-port
+	Environment string           `yaml:"environment,omitempty" json:"environment,omitempty"` // label -e can select, e.g. prod
+	Peer        string           `yaml:"peer,omitempty" json:"peer,omitempty"`               // HA peer's management address; the active member is refreshed
+	Jump        string           `yaml:"jump,omitempty" json:"jump,omitempty"`               // bastion, '[user@]host[:port]' or 'none', overriding -jump
+	Proxy       string           `yaml:"proxy,omitempty" json:"proxy,omitempty"`             // SOCKS5 or HTTP proxy URL or 'none', overriding -proxy
+	Profile     string           `yaml:"profile,omitempty" json:"profile,omitempty"`         // credentials file profile, overriding -profile
+	Driver      string           `yaml:"driver,omitempty" json:"driver,omitempty"`           // vendor: panos (default), asa, fortigate or srx
+	Blackouts   []blackoutWindow `yaml:"blackout,omitempty" json:"blackout,omitempty"`       // maintenance windows without refreshes
+}
+
+// Load and parse a configuration file, returning the customers and the raw file contents.
+// A firewalls section or $TFRESH_FIREWALL_HOST replaces the built-in firewalls.
+func loadConfig(filename string) ([]customer, []byte, error) {
+	doc, fBytes, err := loadConfigDoc(filename)
+	return doc.Customers, fBytes, err
+}
+
+// Load, parse and check a whole configuration document and the raw file contents
+func loadConfigDoc(filename string) (configDoc, []byte, error) {
+	doc, fBytes, err := readConfigTree(filename)
+	if _, ok := err.(*os.PathError); ok {
+		// The file itself can't be read
+		return configDoc{}, nil, err
+	}
+	if err == nil {
+		err = applyFirewalls(append(doc.Firewalls, envFirewalls()...))
+	}
+	if err == nil && doc.Credentials != nil {
+		err = doc.Credentials.validate()
+	}
+	if err == nil && doc.Notifications.SMTP != nil {
+		err = doc.Notifications.SMTP.validate()
+	}
+	if err == nil {
+		smtpSettings = doc.Notifications.SMTP
+	}
+	if err != nil {
+		return configDoc{}, nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return doc, fBytes, nil
+}
+
+// Load only the firewalls section of a configuration file, keeping the built-in
+// firewalls when the file doesn't exist
+func loadFirewalls(filename string) error {
+	_, _, err := loadConfig(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Parse raw configuration file contents
+func parseConfig(fBytes []byte) ([]customer, error) {
+	doc, err := parseConfigDoc(fBytes)
+	return doc.Customers, err
+}
+
+// Configuration format forced with -config-format; empty picks it by extension or contents
+var configFormat = ""
+
+// Format of a configuration file: -config-format, its extension, or a guess from its contents
+func configFormatOf(filename string, fBytes []byte) string {
+	if configFormat != "" {
+		return configFormat
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	case ".yml", ".yaml":
+		return "yaml"
+	}
+	return sniffConfigFormat(fBytes)
+}
+
+// Guess the format of configuration contents: JSON, TOML tables or keys, or YAML
+func sniffConfigFormat(fBytes []byte) string {
+	if json.Valid(fBytes) {
+		return "json"
+	}
+	for _, line := range strings.Split(string(fBytes), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if tomlLineRE.MatchString(line) {
+			return "toml"
+		}
+		break
+	}
+	return "yaml"
+}
+
+// First line of a TOML document: a table header or a key = value pair
+var tomlLineRE = regexp.MustCompile(`^(\[\[?\s*[A-Za-z0-9_."'-]+\s*\]\]?|[A-Za-z0-9_."'-]+\s*=)`)
+
+// Convert JSON or TOML configuration contents into YAML the decoder reads with the same schema
+func configAsYAML(fBytes []byte, format string) ([]byte, error) {
+	switch format {
+	case "yaml":
+		return fBytes, nil
+	case "json":
+		var v any
+		if err := json.Unmarshal(fBytes, &v); err != nil {
+			return nil, err
+		}
+		// Compact JSON is YAML
+		return json.Marshal(v)
+	case "toml":
+		v, err := parseTOML(fBytes)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	}
+	return nil, fmt.Errorf("unknown config format %q (yaml, json, toml)", format)
+}
+
+// Parse raw configuration file contents in any layout and format, decrypting them first if needed
+func parseConfigFile(filename string, fBytes []byte) (configDoc, error) {
+	fBytes, err := decryptConfig(fBytes)
+	if err != nil {
+		return configDoc{}, err
+	}
+	return decodeConfigDoc(fBytes, configFormatOf(filename, fBytes))
+}
+
+// Parse raw configuration file contents in either layout, decrypting them first if needed.
+// Without -config-format, JSON and TOML contents are recognized.
+func parseConfigDoc(fBytes []byte) (configDoc, error) {
+	fBytes, err := decryptConfig(fBytes)
+	if err != nil {
+		return configDoc{}, err
+	}
+	format := configFormat
+	if format == "" {
+		format = sniffConfigFormat(fBytes)
+	}
+	return decodeConfigDoc(fBytes, format)
+}
+
+// Decode decrypted configuration contents of a format
+func decodeConfigDoc(fBytes []byte, format string) (configDoc, error) {
+	var doc configDoc
+	fBytes, err := configAsYAML(fBytes, format)
+	if err != nil {
+		return doc, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(fBytes, &root); err != nil {
+		return doc, err
+	}
+	if len(root.Content) > 0 {
+		var err error
+		if root.Content[0].Kind == yaml.MappingNode {
+			err = root.Content[0].Decode(&doc)
+		} else {
+			err = root.Content[0].Decode(&doc.Customers)
+		}
+		if err != nil {
+			return doc, err
+		}
+	}
+
+	for i := range doc.Customers {
+		doc.Customers[i].Name = normalizeName(doc.Customers[i].Name)
+	}
+	if err := checkNameCollisions(doc.Customers); err != nil {
+		return doc, err
+	}
+	return doc, nil
+}
+
+// Replace the built-in firewalls with those defined in the configuration file
+func applyFirewalls(defs []firewallDef) error {
+	if len(defs) == 0 {
+		return nil
+	}
+	hosts := map[string]string{}
+	envs := map[string]string{}
+	ports := map[string]int{}
+	peers := map[string]string{}
+	blackouts := map[string][]blackoutWindow{}
+	jumps := map[string]string{}
+	proxies := map[string]string{}
+	profiles := map[string]string{}
+	drvs := map[string]string{}
+	addrs := map[string][]string{}
+	for i, d := range defs {
+		switch {
+		case d.Name == "":
+			return fmt.Errorf("firewall #%d: name is blank", i+1)
+		case d.Name == "all":
+			return fmt.Errorf("firewall #%d: 'all' is reserved", i+1)
+		case d.Host == "":
+			return fmt.Errorf("firewall %q: host is blank", d.Name)
+		case d.Port < 0 || d.Port > 65535:
+			return fmt.Errorf("firewall %q: invalid port %d", d.Name, d.Port)
+		case d.Peer == d.Host:
+			return fmt.Errorf("firewall %q: peer is the host itself", d.Name)
+		}
+		if _, dup := hosts[d.Name]; dup {
+			return fmt.Errorf("firewall %q is defined twice", d.Name)
+		}
+		for _, a := range d.Addresses {
+			if a == "" || a == d.Host {
+				return fmt.Errorf("firewall %q: addresses must be set and differ from host", d.Name)
+			}
+		}
+		if len(d.Addresses) > 0 {
+			addrs[d.Host] = d.Addresses
+		}
+		for _, w := range d.Blackouts {
+			if err := w.check(); err != nil {
+				return fmt.Errorf("firewall %q: %w", d.Name, err)
+			}
+		}
+		if len(d.Blackouts) > 0 {
+			blackouts[d.Host] = d.Blackouts
+		}
+		if d.Jump != "" {
+			if _, err := parseJump(d.Jump); d.Jump != "none" && err != nil {
+				return fmt.Errorf("firewall %q: %w", d.Name, err)
+			}
+			jumps[d.Host] = d.Jump
+			if d.Peer != "" {
+				jumps[d.Peer] = d.Jump
+			}
+		}
+		if d.Driver != "" && d.Driver != driverPANOS {
+			if _, ok := drivers[d.Driver]; !ok {
+				return fmt.Errorf("firewall %q: unknown driver %q (%s)", d.Name, d.Driver, driverNames())
+			}
+			if d.Peer != "" {
+				return fmt.Errorf("firewall %q: HA peers need the %s driver", d.Name, driverPANOS)
+			}
+			drvs[d.Host] = d.Driver
+		}
+		if d.Profile != "" {
+			profiles[d.Host] = d.Profile
+			if d.Peer != "" {
+				profiles[d.Peer] = d.Profile
+			}
+		}
+		if d.Proxy != "" {
+			if _, err := parseProxy(d.Proxy); d.Proxy != "none" && err != nil {
+				return fmt.Errorf("firewall %q: %w", d.Name, err)
+			}
+			proxies[d.Host] = d.Proxy
+			if d.Peer != "" {
+				proxies[d.Peer] = d.Proxy
+			}
+		}
+		hosts[d.Name], envs[d.Name] = d.Host, d.Environment
+		if d.Port != 0 {
+			ports[d.Host] = d.Port
+		}
+		if d.Peer != "" {
+			peers[d.Host] = d.Peer
+			if d.Port != 0 {
+				ports[d.Peer] = d.Port
+			}
+		}
+	}
+	firewalls, firewallEnvs, sshPorts, haPeers = hosts, envs, ports, peers
+	firewallBlackouts, firewallJumps, firewallProxies, firewallProfiles = blackouts, jumps, proxies, profiles
+	firewallDrivers, firewallAddresses = drvs, addrs
+	return nil
+}
+
+// SSH address of a firewall host
+func sshAddr(host string) string {
+	if port, ok := sshPorts[host]; ok {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		// 'host: fw01:2222'
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(sshPort))
+}
+
+// Trim and collapse whitespace in a customer name
+func normalizeName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// Refresh intervals by tag (-tier), for customers without customer_interval
+var intervalTiers = tierFlag{}
+
+// Effective refresh interval of the customer and where it comes from:
+// customer_interval, then the shortest tier among its tags, then -i
+func (c customer) interval() (time.Duration, string) {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval) * time.Minute, "customer_interval"
+	}
+	var best time.Duration
+	source := ""
+	for _, tag := range c.Tags {
+		if d, ok := intervalTiers[strings.ToLower(tag)]; ok && (best == 0 || d < best) {
+			best, source = d, "tier "+strings.ToLower(tag)
+		}
+	}
+	if best > 0 {
+		return best, source
+	}
+	return time.Duration(iTime) * time.Minute, "default -i"
+}
+
+// Customer types
+const (
+	typeSiteToSite    = "site-to-site"
+	typeGlobalProtect = "globalprotect"
+)
+
+// Report whether the entry is a GlobalProtect component rather than a site-to-site tunnel
+func (c customer) isGlobalProtect() bool {
+	return c.Type == typeGlobalProtect
+}
+
+// Case-folded identity of a customer, used to match customers across configs
+func (c customer) key() string {
+	return strings.ToLower(normalizeName(c.Name))
+}
+
+// Slug of the customer name, safe for use in metrics labels and filenames
+func (c customer) slug() string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(c.Name) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			dash = false
+		case !dash && b.Len() > 0:
+			b.WriteByte('_')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "_")
+}
+
+// Report customers whose names collide once normalized or slugged
+func checkNameCollisions(customers []customer) error {
+	var collisions []string
+	keys := map[string]string{}
+	slugs := map[string]string{}
+	for _, c := range customers {
+		// Blank names are reported by validation
+		if c.key() == "" {
+			continue
+		}
+		if prev, ok := keys[c.key()]; ok {
+			collisions = append(collisions, fmt.Sprintf("%q collides with %q", c.Name, prev))
+			continue
+		}
+		keys[c.key()] = c.Name
+		if prev, ok := slugs[c.slug()]; ok && c.slug() != "" {
+			collisions = append(collisions, fmt.Sprintf("%q collides with %q (slug %q)", c.Name, prev, c.slug()))
+			continue
+		}
+		slugs[c.slug()] = c.Name
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("customer name collisions: %s", strings.Join(collisions, "; "))
+	}
+	return nil
+}
+
+// 'firewallGroup' type represents the customers refreshed on one firewall
+type firewallGroup struct {
+	env       string
+	customers []customer
+}
+
+// Group enabled customers by firewall environment, in a stable order.
+// Customers without customer_firewall are refreshed on every default environment.
+func groupByFirewall(customers []customer, defaultEnvs []string) ([]firewallGroup, error) {
+	byEnv := map[string][]customer{}
+	for _, c := range customers {
+		if c.Disabled {
+			continue
+		}
+		envs := defaultEnvs
+		if c.Firewall != "" {
+			envs = []string{c.Firewall}
+		}
+		if len(envs) == 0 {
+			return nil, fmt.Errorf("customer %q has no customer_firewall and no default firewall environment (-e) is set", c.Name)
+		}
+		for _, env := range envs {
+			if _, ok := firewalls[env]; !ok {
+				return nil, fmt.Errorf("customer %q: unknown firewall environment %q", c.Name, env)
+			}
+			byEnv[env] = append(byEnv[env], c)
+		}
+	}
+
+	groups := make([]firewallGroup, 0, len(byEnv))
+	for env, cs := range byEnv {
+		groups = append(groups, firewallGroup{env: env, customers: cs})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].env < groups[j].env })
+	return groups, nil
+}
+
+// Narrow the customers to those named (case-insensitively) or matching the pattern;
+// either may be empty. Unknown names are an error, so a typo doesn't refresh nothing.
+func selectCustomers(customers []customer, names []string, pattern string) ([]customer, error) {
+	if len(names) == 0 && pattern == "" {
+		return customers, nil
+	}
+	var re *regexp.Regexp
+	if pattern != "" {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid -match pattern: %w", err)
+		}
+	}
+	wanted := map[string]bool{}
+	for _, n := range names {
+		wanted[customer{Name: n}.key()] = false
+	}
+
+	var selected []customer
+	for _, c := range customers {
+		_, named := wanted[c.key()]
+		if named {
+			wanted[c.key()] = true
+		}
+		if named || re != nil && re.MatchString(c.Name) {
+			selected = append(selected, c)
+		}
+	}
+	for _, n := range names {
+		if !wanted[customer{Name: n}.key()] {
+			return nil, fmt.Errorf("unknown customer %q", n)
+		}
+	}
+	if len(selected) == 0 {
+		return nil, fmt.Errorf("no customers match %q", pattern)
+	}
+	return selected, nil
+}
+
+// 'stringList' type is a repeatable, comma-separated string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// 'tierFlag' type is a repeatable tag=interval flag, e.g. '-tier critical=5m,bulk=60m'
+type tierFlag map[string]time.Duration
+
+func (t tierFlag) String() string {
+	tags := make([]string, 0, len(t))
+	for tag := range t {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	for i, tag := range tags {
+		tags[i] = tag + "=" + t[tag].String()
+	}
+	return strings.Join(tags, ",")
+}
+
+func (t tierFlag) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		tag, interval, ok := strings.Cut(s, "=")
+		if !ok || strings.TrimSpace(tag) == "" {
+			return fmt.Errorf("tier %q: expected tag=interval", s)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(interval))
+		if err != nil || d <= 0 {
+			return fmt.Errorf("tier %q: interval must be a positive duration such as 5m", s)
+		}
+		t[strings.ToLower(strings.TrimSpace(tag))] = d
+	}
+	return nil
+}
+
+// Resolve -e values to known firewalls. A value is a firewall name, an
+// environment label selecting every firewall with it, or 'all'.
+func expandEnvs(values []string) ([]string, error) {
+	seen := map[string]bool{}
+	var envs []string
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			envs = append(envs, name)
+		}
+	}
+	for _, v := range values {
+		if _, ok := firewalls[v]; ok {
+			add(v)
+			continue
+		}
+		matched := false
+		for name, env := range firewallEnvs {
+			if v == "all" || env == v {
+				add(name)
+				matched = true
+			}
+		}
+		if v == "all" {
+			for name := range firewalls {
+				add(name)
+			}
+			continue
+		}
+		if !matched {
+			return nil, fmt.Errorf("unknown firewall environment %q", v)
+		}
+	}
+	sort.Strings(envs)
+	return envs, nil
+}
+
+// Resolve a single optional -e value, selecting every firewall when empty
+func selectFirewalls(value string) ([]string, error) {
+	if value == "" {
+		value = "all"
+	}
+	return expandEnvs([]string{value})
+}
+
+// Add empty groups for environments refreshed without configured customers
+func addBatchGroups(groups []firewallGroup, batch map[string]bool) []firewallGroup {
+	have := map[string]bool{}
+	for _, g := range groups {
+		have[g.env] = true
+	}
+	for env := range batch {
+		if !have[env] {
+			groups = append(groups, firewallGroup{env: env})
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].env < groups[j].env })
+	return groups
+}
+
+// Whether two config filenames name the same file, compared by path when either is missing
+func sameFile(a, b string) bool {
+	ai, aErr := os.Stat(a)
+	bi, bErr := os.Stat(b)
+	if aErr == nil && bErr == nil {
+		return os.SameFile(ai, bi)
+	}
+	absA, aErr := filepath.Abs(a)
+	absB, bErr := filepath.Abs(b)
+	return aErr == nil && bErr == nil && absA == absB
+}
+
+// Handle 'tfresh config <action>'
+func configCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s config <history|rollback|diff> [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s config diff [-json] [old.yml] new.yml\n", os.Args[0])
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fs.StringVar(&stateFile, "s", stateFile, "State file (default is tfresh.state.json)")
+	jsonOut := fs.Bool("json", false, "Output in JSON format (diff only)")
+	force := fs.Bool("force", false, "Roll back even when the version was loaded from another file (rollback only)")
+	fs.Parse(args[1:])
+
+	st, err := loadState(stateFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "history":
+		if len(st.ConfigVersions) == 0 {
+			fmt.Println("No config versions recorded in", stateFile)
+			return
+		}
+		for i := len(st.ConfigVersions) - 1; i >= 0; i-- {
+			marker := " "
+			if i == len(st.ConfigVersions)-1 {
+				marker = "*"
+			}
+			fmt.Printf("%s %s  %s\n", marker, st.ConfigVersions[i], st.ConfigVersions[i].Source)
+		}
+	case "rollback":
+		// Only a single local file can be rewritten from a recorded version
+		if info, err := os.Stat(configFile); isRemoteConfig(configFile) || configFile == envConfigName || err == nil && info.IsDir() {
+			fmt.Fprintf(os.Stderr, "[ERROR]: %s is not a single local file; roll it back at its source.\n", configFile)
+			os.Exit(1)
+		}
+		prev, err := st.rollbackConfig()
+		if err == nil {
+			err = multiFileVersion(prev)
+		}
+		if err == nil && (isRemoteConfig(prev.Source) || prev.Source == envConfigName) {
+			err = fmt.Errorf("config version %.12s was loaded from %s, not a local file; restore it there", prev.Hash, prev.Source)
+		}
+		if err == nil && !*force && !sameFile(prev.Source, configFile) {
+			err = fmt.Errorf("config version %.12s was loaded from %s, not %s; use -c %s, or -force to write it to %s anyway",
+				prev.Hash, prev.Source, configFile, prev.Source, configFile)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(1)
+		}
+		if _, err = parseConfig(prev.Content); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]: previous config version does not parse:", err)
+			os.Exit(1)
+		}
+		if err = os.WriteFile(configFile, prev.Content, 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err = st.save(stateFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Rolled back %s to config version %s.\n", configFile, prev)
+		fmt.Println("Restart tfresh to apply the restored configuration.")
+	case "diff":
+		var oldDoc, newDoc configDoc
+		switch fs.NArg() {
+		case 1:
+			// Diff against the currently loaded (active) version
+			n := len(st.ConfigVersions)
+			if n == 0 {
+				fmt.Fprintln(os.Stderr, "[ERROR]: no config version loaded yet; specify both files")
+				os.Exit(1)
+			}
+			if err = multiFileVersion(st.ConfigVersions[n-1]); err != nil {
+				fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+				os.Exit(1)
+			}
+			if oldDoc, err = parseConfigDoc(st.ConfigVersions[n-1].Content); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if newDoc, _, err = loadConfigDoc(fs.Arg(0)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		case 2:
+			if oldDoc, _, err = loadConfigDoc(fs.Arg(0)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if newDoc, _, err = loadConfigDoc(fs.Arg(1)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		default:
+			usage()
+			os.Exit(1)
+		}
+
+		d := diffConfigs(oldDoc, newDoc)
+		if *jsonOut {
+			if err = d.writeJSON(os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+		d.writeText(os.Stdout)
+	default:
+		usage()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+ * Filename: config_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the 'tfresh config' subcommands.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A rollback writes a recorded version only to the file it was loaded from
+func TestRollbackSourceMatch(t *testing.T) {
+	dir := t.TempDir()
+	path := func(name string) string { return filepath.Join(dir, name) }
+	for _, name := range []string{"config.yml", "staging.yml"} {
+		if err := os.WriteFile(path(name), []byte("firewalls: {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		source, configFile string
+		want               bool
+	}{
+		{path("config.yml"), path("config.yml"), true},
+		{path("sub/../config.yml"), path("config.yml"), true},
+		{path("staging.yml"), path("config.yml"), false},
+		{path("removed.yml"), path("removed.yml"), true},
+		{path("removed.yml"), path("config.yml"), false},
+	} {
+		if got := sameFile(tc.source, tc.configFile); got != tc.want {
+			t.Errorf("sameFile(%q, %q) = %v, want %v", tc.source, tc.configFile, got, tc.want)
+		}
+	}
+}
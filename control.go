@@ -0,0 +1,107 @@
+/*
+ * Filename: control.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Daemon control listener and the 'tfresh inspect' client.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+)
+
+// Control listener address; empty disables it
+var listenAddr = "127.0.0.1:9470"
+
+// Control listener routes
+var controlMux = http.NewServeMux()
+
+func init() {
+	controlMux.HandleFunc("/inspect", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(current)
+	})
+	controlMux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		writeMetrics(w)
+	})
+}
+
+// Start the control listener in the background
+func startControlServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("control listener (is another tfresh running?): %w", err)
+	}
+	srv := &http.Server{Handler: controlMux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Error(fmt.Sprint("control listener: ", err), "error", err)
+		}
+	}()
+	return nil
+}
+
+// Handle 'tfresh inspect'
+func inspectCommand(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	addr := fs.String("addr", listenAddr, "Control listener address of the running daemon")
+	jsonOut := fs.Bool("json", false, "Output raw JSON")
+	fs.Parse(args)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + *addr + "/inspect")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]: is tfresh running?", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	if *jsonOut {
+		io.Copy(os.Stdout, resp.Body)
+		return
+	}
+
+	var a activity
+	if err = json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Uptime:      %v\n", time.Since(a.Started).Round(time.Second))
+	fmt.Printf("Outstanding: %d commands\n", a.CommandsOutstanding)
+	fmt.Printf("Resources:   %d goroutines, %d SSH sessions, %d MiB heap\n", a.Resources.Goroutines, a.Resources.Sessions, a.Resources.HeapMiB)
+
+	fws := make([]string, 0, len(a.Firewalls))
+	for fw := range a.Firewalls {
+		fws = append(fws, fw)
+	}
+	sort.Strings(fws)
+	for _, fw := range fws {
+		f := a.Firewalls[fw]
+		fmt.Printf("\nFirewall %s (%s): %s\n", fw, f.Env, f.Connection)
+		fmt.Printf("  Iteration: #%d\n", f.Iteration)
+		fmt.Printf("  Phase:     %s for %v\n", f.Phase, time.Since(f.PhaseSince).Round(time.Second))
+		if f.Customer != "" {
+			fmt.Printf("  Customer:  %s\n", f.Customer)
+		}
+		if f.Command != "" {
+			fmt.Printf("  Command:   %s\n", f.Command)
+		}
+		fmt.Printf("  Queue:     %d steps\n", f.Queue)
+		if f.NextIteration != nil {
+			fmt.Printf("  Next run:  %s (in %v)\n", f.NextIteration.Format(time.RFC3339), time.Until(*f.NextIteration).Round(time.Second))
+		}
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Filename: credfile.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Named credential profiles in ~/.tfresh/credentials.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	// Credentials file with one [profile] section per account
+	credentialsFile = defaultCredentialsFile()
+
+	// Profile used instead of the environment variables, from -profile
+	profileName = os.Getenv("TFRESH_PROFILE")
+
+	// Profiles set by the config's firewalls section, by host
+	firewallProfiles = map[string]string{}
+
+	// Warn about a readable credentials file once
+	credentialsPermOnce sync.Once
+)
+
+// $TFRESH_CREDENTIALS_FILE, or ~/.tfresh/credentials
+func defaultCredentialsFile() string {
+	if f := os.Getenv("TFRESH_CREDENTIALS_FILE"); f != "" {
+		return f
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".tfresh", "credentials")
+}
+
+// Parse the credentials file:
+//
+//	[prod]
+//	username = svc-tfresh
+//	password = ...
+//	api_key = ...
+func loadProfiles(filename string) (map[string]secretCredentials, error) {
+	fBytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(filename); err == nil && info.Mode().Perm()&0o077 != 0 {
+		credentialsPermOnce.Do(func() {
+			fmt.Fprintf(os.Stderr, "[WARN]: %s is accessible by other users; chmod 600 it.\n", filename)
+		})
+	}
+
+	profiles := map[string]secretCredentials{}
+	var name string
+	scanner := bufio.NewScanner(bytes.NewReader(fBytes))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name = strings.TrimSpace(line[1 : len(line)-1])
+			if _, dup := profiles[name]; dup {
+				return nil, fmt.Errorf("%s:%d: profile %q is defined twice", filename, n, name)
+			}
+			profiles[name] = secretCredentials{}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected [profile] or key = value", filename, n)
+		}
+		p := profiles[name]
+		switch strings.TrimSpace(key) {
+		case "username":
+			p.Username = strings.TrimSpace(value)
+		case "password":
+			p.Password = strings.TrimSpace(value)
+		case "api_key":
+			p.APIKey = strings.TrimSpace(value)
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown key %q (username, password, api_key)", filename, n, strings.TrimSpace(key))
+		}
+		profiles[name] = p
+	}
+	return profiles, nil
+}
+
+// Credentials of one profile. The password may be left out when an SSH agent holds the keys.
+func profileCredentials(name string) (secretCredentials, error) {
+	if credentialsFile == "" {
+		return secretCredentials{}, fmt.Errorf("profile %q: no credentials file; set TFRESH_CREDENTIALS_FILE", name)
+	}
+	profiles, err := loadProfiles(credentialsFile)
+	if err != nil {
+		return secretCredentials{}, fmt.Errorf("profile %q: %w", name, err)
+	}
+	p, ok := profiles[name]
+	switch {
+	case !ok:
+		return p, fmt.Errorf("profile %q is not in %s", name, credentialsFile)
+	case p.Username == "" && p.APIKey == "":
+		return p, fmt.Errorf("profile %q in %s has no username", name, credentialsFile)
+	}
+	return p, nil
+}
+
+// The API key of -profile, or of the default profile
+func profileAPIKey() string {
+	name := profileName
+	if name == "" {
+		name = "default"
+	}
+	p, err := profileCredentials(name)
+	if err != nil {
+		return ""
+	}
+	return p.APIKey
+}
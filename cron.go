@@ -0,0 +1,180 @@
+/*
+ * Filename: cron.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Cron-expression refresh schedules, e.g. '0 8-18 * * MON-FRI'.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 'cronSchedule' type represents a five-field cron expression, evaluated in local time
+type cronSchedule struct {
+	expr                         string
+	minute, hour, dom, month     uint64 // bit n set when the field matches n
+	dow                          uint64 // 0 is Sunday
+	domRestricted, dowRestricted bool
+}
+
+// Field names and ranges, in expression order
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}},
+	{"day of week", 0, 7, []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}},
+}
+
+// Parse 'minute hour day-of-month month day-of-week'. Fields take '*', numbers, names,
+// ranges, lists and steps; day of week 7 is Sunday too.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("schedule %q: want 5 fields (minute hour day-of-month month day-of-week), got %d", expr, len(fields))
+	}
+	s := &cronSchedule{expr: expr}
+	bits := []*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow}
+	for i, f := range fields {
+		b, err := parseCronField(f, i)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %s: %w", expr, cronFields[i].name, err)
+		}
+		*bits[i] = b
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted, s.dowRestricted = fields[2] != "*", fields[4] != "*"
+	return s, nil
+}
+
+// Parse one comma-separated field into a bit set
+func parseCronField(field string, i int) (uint64, error) {
+	spec := cronFields[i]
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+
+		lo, hi := spec.min, spec.max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = cronValue(a, spec.names, spec.min); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = cronValue(b, spec.names, spec.min); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = spec.max
+			}
+		}
+		if lo < spec.min || hi > spec.max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, spec.min, spec.max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// A number or, where the field has them, a three-letter name
+func cronValue(s string, names []string, first int) (int, error) {
+	for i, n := range names {
+		if strings.EqualFold(s, n) {
+			return first + i, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return n, nil
+}
+
+// Whether the day matches. As in cron, when both day fields are restricted either may match.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// First fire time strictly after t, or the zero time when there is none within five years
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *cronSchedule) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.expr
+}
+
+// Flag form: -schedule '*/10 8-18 * * MON-FRI'
+func (s *cronSchedule) Set(v string) error {
+	parsed, err := parseCron(v)
+	if err != nil {
+		return err
+	}
+	*s = *parsed
+	return nil
+}
+
+// Refresh schedule for customers without customer_schedule; empty when -schedule is unset
+var globalSchedule = &cronSchedule{}
+
+// The customer's cron schedule: customer_schedule, then -schedule; nil when it runs on an interval
+func (c customer) schedule() *cronSchedule {
+	if c.Schedule != "" {
+		if s, err := parseCron(c.Schedule); err == nil {
+			return s
+		}
+	}
+	if globalSchedule.expr != "" {
+		return globalSchedule
+	}
+	return nil
+}
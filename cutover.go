@@ -0,0 +1,206 @@
+/*
+ * Filename: cutover.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Blue/green firewall cutover: a shiftable split of one firewall's customers onto its replacement.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 'cutoverPlan' type represents the migration of customers from an old firewall to a new one
+type cutoverPlan struct {
+	mu      sync.Mutex
+	Old     string `json:"old"` // environment names
+	New     string `json:"new"`
+	Percent int    `json:"percent"`       // share of the old firewall's customers moved
+	Tag     string `json:"tag,omitempty"` // customers with this tag always move
+
+	customers []customer // the old firewall's customers
+}
+
+// Active cutover; nil when none is configured
+var cutover *cutoverPlan
+
+// Parse '-cutover old=new'
+func newCutoverPlan(spec string, percent int, tag string) (*cutoverPlan, error) {
+	oldEnv, newEnv, ok := strings.Cut(spec, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid -cutover %q, expected old=new", spec)
+	}
+	for _, env := range []string{oldEnv, newEnv} {
+		if _, ok := firewalls[env]; !ok {
+			return nil, fmt.Errorf("-cutover: unknown firewall environment %q", env)
+		}
+	}
+	if oldEnv == newEnv {
+		return nil, fmt.Errorf("-cutover: old and new firewall are both %q", oldEnv)
+	}
+	p := &cutoverPlan{Old: oldEnv, New: newEnv, Tag: tag}
+	return p, p.setPercent(percent)
+}
+
+// Shift the split
+func (p *cutoverPlan) setPercent(percent int) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("cutover percent %d outside 0-100", percent)
+	}
+	p.mu.Lock()
+	p.Percent = percent
+	p.mu.Unlock()
+	return nil
+}
+
+// Report whether a customer is refreshed on the new firewall. Customers are
+// bucketed by a hash of their name so each one stays put as the percentage grows.
+func (p *cutoverPlan) moved(c customer) bool {
+	for _, t := range c.Tags {
+		if p.Tag != "" && strings.EqualFold(t, p.Tag) {
+			return true
+		}
+	}
+	h := fnv.New32a()
+	io.WriteString(h, c.key())
+	return int(h.Sum32()%100) < p.Percent
+}
+
+// Return the customers a firewall refreshes under the current split
+func (p *cutoverPlan) customersFor(env string, own []customer) []customer {
+	if p == nil || (env != p.Old && env != p.New) {
+		return own
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var out []customer
+	if env == p.New {
+		out = append(out, own...)
+	}
+	for _, c := range p.customers {
+		if p.moved(c) == (env == p.New) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Counts of customers on each side
+func (p *cutoverPlan) split() (old, moved int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.customers {
+		if p.moved(c) {
+			moved++
+		} else {
+			old++
+		}
+	}
+	return old, moved
+}
+
+// Replace the old firewall's customers after a config reload
+func (p *cutoverPlan) setCustomers(customers []customer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.customers = customers
+}
+
+// Prepare the groups: the old group's customers come under the plan and the new firewall gets a scheduler
+func (p *cutoverPlan) apply(groups []firewallGroup) []firewallGroup {
+	for i, g := range groups {
+		if g.env == p.Old {
+			p.customers = g.customers
+			groups[i].customers = nil
+		}
+	}
+	return addBatchGroups(groups, map[string]bool{p.Old: true, p.New: true})
+}
+
+func init() {
+	controlMux.HandleFunc("/cutover", func(w http.ResponseWriter, r *http.Request) {
+		if cutover == nil {
+			http.Error(w, "no cutover configured", http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPost {
+			percent, err := strconv.Atoi(r.FormValue("percent"))
+			if err == nil {
+				err = cutover.setPercent(percent)
+			}
+			if err != nil {
+				http.Error(w, "percent must be 0-100", http.StatusBadRequest)
+				return
+			}
+			old, moved := cutover.split()
+			notify(event{Type: "cutover", Severity: sevInfo, Message: fmt.Sprintf("cutover %s -> %s shifted to %d%% (%d moved, %d remaining) from the next iteration",
+				cutover.Old, cutover.New, percent, moved, old)})
+		}
+		old, moved := cutover.split()
+		cutover.mu.Lock()
+		defer cutover.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			*cutoverPlan
+			OnOld int `json:"on_old"`
+			OnNew int `json:"on_new"`
+		}{cutover, old, moved})
+	})
+}
+
+// Handle 'tfresh cutover'
+func cutoverCommand(args []string) {
+	fs := flag.NewFlagSet("cutover", flag.ExitOnError)
+	addr := fs.String("addr", listenAddr, "Control listener address of the running daemon")
+	percent := fs.Int("percent", -1, "Shift this percentage of customers to the new firewall; omit to show the split")
+	fs.Parse(args)
+
+	client := http.Client{Timeout: 5 * time.Second}
+	var resp *http.Response
+	var err error
+	if *percent >= 0 {
+		resp, err = client.PostForm("http://"+*addr+"/cutover", url.Values{"percent": {strconv.Itoa(*percent)}})
+	} else {
+		resp, err = client.Get("http://" + *addr + "/cutover")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]: is tfresh running?", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		fmt.Fprintln(os.Stderr, "[ERROR]:", strings.TrimSpace(string(msg)))
+		os.Exit(1)
+	}
+
+	var st struct {
+		Old, New, Tag string
+		Percent       int
+		OnOld         int `json:"on_old"`
+		OnNew         int `json:"on_new"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Cutover %s -> %s: %d%%", st.Old, st.New, st.Percent)
+	if st.Tag != "" {
+		fmt.Printf(" plus customers tagged %q", st.Tag)
+	}
+	fmt.Printf("\n  %d customers on %s, %d on %s\n", st.OnOld, st.Old, st.OnNew, st.New)
+}
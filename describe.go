@@ -0,0 +1,281 @@
+/*
+ * Filename: describe.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Customer search and resolved configuration ('tfresh search', 'tfresh describe').
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 'customerDescription' type represents everything tfresh resolves for one customer
+type customerDescription struct {
+	Customer   customer             `json:"customer"`
+	Enabled    bool                 `json:"enabled"`
+	Quarantine *quarantine          `json:"quarantine,omitempty"`
+	Firewalls  []string             `json:"firewalls"`
+	Source     string               `json:"firewall_source"` // customer_firewall or -e
+	Interval   string               `json:"interval"`
+	Blackout   string               `json:"blackout,omitempty"` // window in effect now
+	Strategy   string               `json:"strategy"`
+	Commands   []string             `json:"commands"`
+	History    []customerRefreshLog `json:"history"`
+	Drift      []string             `json:"drift,omitempty"`
+}
+
+// 'customerRefreshLog' type represents the last refresh of a customer on one firewall
+type customerRefreshLog struct {
+	Firewall      string     `json:"firewall"`
+	LastRefreshed *time.Time `json:"last_refreshed,omitempty"`
+	SA            string     `json:"sa,omitempty"`
+	SACheckedAt   *time.Time `json:"sa_checked_at,omitempty"`
+	Failures      int        `json:"failures,omitempty"`
+	FailingSince  *time.Time `json:"failing_since,omitempty"`
+}
+
+// Resolve a customer's effective configuration and recorded history
+func describeCustomer(c customer, envs []string, st *state) customerDescription {
+	d := customerDescription{Customer: c, Enabled: !c.Disabled, Source: "-e", Firewalls: []string{}, History: []customerRefreshLog{}}
+	if c.Firewall != "" {
+		envs, d.Source = []string{c.Firewall}, "customer_firewall"
+	}
+	for _, env := range envs {
+		d.Firewalls = append(d.Firewalls, fmt.Sprintf("%s (%s)", env, firewalls[env]))
+	}
+
+	if q, ok := st.Quarantined[c.key()]; ok {
+		d.Quarantine = &q
+	}
+	if w, end, ok := activeBlackout(c.Blackouts, time.Now()); ok {
+		d.Blackout = fmt.Sprintf("%s until %s", w, end.Format(time.RFC3339))
+	}
+
+	interval, source := c.interval()
+	d.Interval = fmt.Sprintf("%v (%s)", interval, source)
+	if sched := c.schedule(); sched != nil {
+		d.Interval = fmt.Sprintf("cron '%s', next %s", sched, sched.next(time.Now()).Format(time.RFC3339))
+	}
+
+	drv := driver(panosDriver{})
+	if len(envs) > 0 {
+		drv = driverFor(firewalls[envs[0]])
+	}
+	steps := planRefresh(drv, []customer{c}, false)
+	switch {
+	case c.isGlobalProtect():
+		d.Strategy = "GlobalProtect " + c.gpComponent() + " restart, once per firewall per iteration"
+	case c.Gateway == "" || c.Tunnel == "":
+		d.Strategy = "partial tunnel refresh"
+	default:
+		d.Strategy = "tunnel refresh (IKE and IPsec SA)"
+	}
+	for _, step := range steps {
+		for _, cmd := range step.cmds {
+			d.Commands = append(d.Commands, cmd.String())
+		}
+	}
+
+	for _, env := range envs {
+		fw := firewalls[env]
+		h := customerRefreshLog{Firewall: fw}
+		if last, ok := st.LastRefreshed[fw][c.key()]; ok {
+			h.LastRefreshed = &last
+		}
+		if cs := st.Customers[fw][c.key()]; cs != nil {
+			h.SA, h.SACheckedAt, h.Failures, h.FailingSince = cs.SA, cs.SACheckedAt, cs.Failures, cs.FailingSince
+		}
+		if h.LastRefreshed != nil || h.SA != "" || h.Failures > 0 {
+			d.History = append(d.History, h)
+		}
+		report, ok := st.Drift[fw]
+		if !ok {
+			continue
+		}
+		for _, m := range append(append([]string{}, report.MissingGateways...), report.MissingTunnels...) {
+			if strings.HasPrefix(m, c.Name+":") {
+				d.Drift = append(d.Drift, fmt.Sprintf("%s: %s (checked %s)", fw, strings.TrimSpace(strings.TrimPrefix(m, c.Name+":")), report.CheckedAt.Format(time.RFC3339)))
+			}
+		}
+	}
+	return d
+}
+
+// Print a description for operators
+func (d customerDescription) print() {
+	c := d.Customer
+	kind := c.Type
+	if kind == "" {
+		kind = typeSiteToSite
+	}
+	fmt.Printf("Customer:    %s\n", c.Name)
+	if c.Description != "" {
+		fmt.Printf("Description: %s\n", c.Description)
+	}
+	fmt.Printf("Type:        %s\n", kind)
+	fmt.Printf("Enabled:     %t\n", d.Enabled)
+	if d.Quarantine != nil {
+		fmt.Printf("Quarantined: since %s %s\n", d.Quarantine.Since.Format(time.RFC3339), d.Quarantine.Reason)
+	}
+	fmt.Printf("Firewalls:   %s (from %s)\n", dash(strings.Join(d.Firewalls, ", ")), d.Source)
+	fmt.Printf("Interval:    %s\n", d.Interval)
+	if len(c.Blackouts) > 0 {
+		fmt.Printf("Blackouts:   %d configured, in effect: %s\n", len(c.Blackouts), dash(d.Blackout))
+	}
+	fmt.Printf("Strategy:    %s\n", d.Strategy)
+	for _, cmd := range d.Commands {
+		fmt.Printf("  > %s\n", cmd)
+	}
+	if c.Peer != "" {
+		fmt.Printf("Peer:        %s\n", c.Peer)
+	}
+	if len(c.Tags) > 0 {
+		fmt.Printf("Tags:        %s\n", strings.Join(c.Tags, ", "))
+	}
+	if c.Interface != "" {
+		fmt.Printf("Routes:      %s via %s\n", dash(strings.Join(c.Routes, ", ")), c.Interface)
+	}
+
+	fmt.Println("History:")
+	if len(d.History) == 0 {
+		fmt.Println("  no refresh recorded")
+	}
+	for _, h := range d.History {
+		if h.LastRefreshed != nil {
+			fmt.Printf("  %s: last refreshed %s (%v ago)\n", h.Firewall, h.LastRefreshed.Format(time.RFC3339), time.Since(*h.LastRefreshed).Round(time.Second))
+		} else {
+			fmt.Printf("  %s: never refreshed\n", h.Firewall)
+		}
+		if h.SA != "" {
+			fmt.Printf("  %s: SAs %s as of %s\n", h.Firewall, h.SA, h.SACheckedAt.Format(time.RFC3339))
+		}
+		if h.Failures > 0 {
+			fmt.Printf("  %s: %d consecutive failures since %s\n", h.Firewall, h.Failures, h.FailingSince.Format(time.RFC3339))
+		}
+	}
+	for _, dr := range d.Drift {
+		fmt.Printf("  drift on %s\n", dr)
+	}
+}
+
+// Report whether any of a customer's fields contains the term
+func (c customer) contains(term string) bool {
+	term = strings.ToLower(term)
+	fields := append([]string{c.Name, c.Description, c.Gateway, c.Tunnel, c.Peer, c.Firewall, c.Interface}, c.Tags...)
+	fields = append(fields, c.Routes...)
+	for _, f := range fields {
+		if strings.Contains(strings.ToLower(f), term) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load the config for search/describe
+func loadCustomersOrExit() []customer {
+	customers, _, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return customers
+}
+
+// Handle 'tfresh search <term>'
+func searchCommand(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	format := fs.String("format", "table", "Output format (table, json)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s search [flags] <term>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	var matches []customer
+	for _, c := range loadCustomersOrExit() {
+		if c.contains(fs.Arg(0)) {
+			matches = append(matches, c)
+		}
+	}
+	write := writeCustomerTable
+	if *format == "json" {
+		write = writeCustomerJSON
+	}
+	if err := write(os.Stdout, matches); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(matches) == 0 {
+		os.Exit(1)
+	}
+}
+
+// Handle 'tfresh describe <customer>'
+func describeCommand(args []string) {
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fs.StringVar(&stateFile, "s", stateFile, "State file (default is tfresh.state.json)")
+	var fwEnvs stringList
+	fs.Var(&fwEnvs, "e", "Default firewall environments the daemon runs with (prod, test, all); repeatable")
+	fs.IntVar(&iTime, "i", iTime, "Default interval the daemon runs with (default 15 minutes)")
+	fs.Var(globalSchedule, "schedule", "Cron schedule the daemon runs with")
+	fs.Var(intervalTiers, "tier", "Interval tiers the daemon runs with, e.g. 'critical=5m,bulk=60m'; repeatable")
+	jsonOut := fs.Bool("json", false, "Output in JSON format")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s describe [flags] <customer>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	customers := loadCustomersOrExit()
+	envs, err := expandEnvs(fwEnvs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	st, err := loadState(stateFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	want := customer{Name: normalizeName(fs.Arg(0))}.key()
+	for _, c := range customers {
+		if c.key() != want {
+			continue
+		}
+		d := describeCustomer(c, envs, st)
+		if *jsonOut {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(d)
+			return
+		}
+		d.print()
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "[ERROR]: no customer %q in %s\n", fs.Arg(0), configFile)
+	var similar []string
+	for _, c := range customers {
+		if c.contains(fs.Arg(0)) {
+			similar = append(similar, c.Name)
+		}
+	}
+	if len(similar) > 0 {
+		sort.Strings(similar)
+		fmt.Fprintln(os.Stderr, "Did you mean:", strings.Join(similar, ", "))
+	}
+	os.Exit(1)
+}
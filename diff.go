@@ -0,0 +1,191 @@
+/*
+ * Filename: diff.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Compares two configuration versions for change review.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// 'configDiff' type represents the differences between two configurations
+type configDiff struct {
+	Added   []customer     `json:"added"`
+	Removed []customer     `json:"removed"`
+	Changed []customerDiff `json:"changed"`
+
+	FirewallsAdded   []firewallDef  `json:"firewalls_added"`
+	FirewallsRemoved []firewallDef  `json:"firewalls_removed"`
+	FirewallsChanged []firewallDiff `json:"firewalls_changed"`
+}
+
+// 'customerDiff' type represents a customer present in both configurations with changed fields
+type customerDiff struct {
+	Name   string      `json:"customer_name"`
+	Fields []fieldDiff `json:"fields"`
+}
+
+// 'firewallDiff' type represents a firewall present in both configurations with changed settings
+type firewallDiff struct {
+	Name   string      `json:"name"`
+	Fields []fieldDiff `json:"fields"`
+}
+
+// 'fieldDiff' type represents a single changed field
+type fieldDiff struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+// Compare two configurations' customers, matched by normalized name, and firewalls, matched by name
+func diffConfigs(oldDoc, newDoc configDoc) configDiff {
+	d := diffFirewalls(oldDoc.Firewalls, newDoc.Firewalls)
+	old, new := oldDoc.Customers, newDoc.Customers
+
+	oldByName := make(map[string]customer, len(old))
+	for _, c := range old {
+		oldByName[c.key()] = c
+	}
+	newByName := make(map[string]customer, len(new))
+	for _, c := range new {
+		newByName[c.key()] = c
+	}
+
+	for _, c := range old {
+		if _, ok := newByName[c.key()]; !ok {
+			d.Removed = append(d.Removed, c)
+		}
+	}
+	for _, c := range new {
+		o, ok := oldByName[c.key()]
+		if !ok {
+			d.Added = append(d.Added, c)
+			continue
+		}
+		if fields := diffFields(o, c); len(fields) > 0 {
+			d.Changed = append(d.Changed, customerDiff{Name: c.Name, Fields: fields})
+		}
+	}
+	return d
+}
+
+// Compare two firewall lists, e.g. a firewall's host, user or environment
+func diffFirewalls(old, new []firewallDef) configDiff {
+	var d configDiff
+	oldByName := make(map[string]firewallDef, len(old))
+	for _, f := range old {
+		oldByName[f.Name] = f
+	}
+	newByName := make(map[string]firewallDef, len(new))
+	for _, f := range new {
+		newByName[f.Name] = f
+	}
+	for _, f := range old {
+		if _, ok := newByName[f.Name]; !ok {
+			d.FirewallsRemoved = append(d.FirewallsRemoved, f)
+		}
+	}
+	for _, f := range new {
+		o, ok := oldByName[f.Name]
+		if !ok {
+			d.FirewallsAdded = append(d.FirewallsAdded, f)
+			continue
+		}
+		if fields := diffFields(o, f); len(fields) > 0 {
+			d.FirewallsChanged = append(d.FirewallsChanged, firewallDiff{Name: f.Name, Fields: fields})
+		}
+	}
+	return d
+}
+
+// Compare the fields of two values of the same struct type, keyed by their YAML names
+func diffFields(old, new any) []fieldDiff {
+	var fields []fieldDiff
+	ov, nv := reflect.ValueOf(old), reflect.ValueOf(new)
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		o, n := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if !reflect.DeepEqual(o, n) {
+			fields = append(fields, fieldDiff{Field: name, Old: o, New: n})
+		}
+	}
+	return fields
+}
+
+// Report whether the diff has no changes
+func (d configDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 &&
+		len(d.FirewallsAdded) == 0 && len(d.FirewallsRemoved) == 0 && len(d.FirewallsChanged) == 0
+}
+
+// Write the diff in a human readable format
+func (d configDiff) writeText(w io.Writer) {
+	if d.empty() {
+		fmt.Fprintln(w, "No differences.")
+		return
+	}
+	for _, c := range d.Added {
+		fmt.Fprintf(w, "+ %s (gateway: %s, tunnel: %s)\n", c.Name, c.Gateway, c.Tunnel)
+	}
+	for _, c := range d.Removed {
+		fmt.Fprintf(w, "- %s (gateway: %s, tunnel: %s)\n", c.Name, c.Gateway, c.Tunnel)
+	}
+	for _, c := range d.Changed {
+		fmt.Fprintf(w, "~ %s\n", c.Name)
+		for _, f := range c.Fields {
+			fmt.Fprintf(w, "    %s: %s -> %s\n", f.Field, formatValue(f.Old), formatValue(f.New))
+		}
+	}
+	for _, f := range d.FirewallsAdded {
+		fmt.Fprintf(w, "+ firewall %s (host: %s)\n", f.Name, f.Host)
+	}
+	for _, f := range d.FirewallsRemoved {
+		fmt.Fprintf(w, "- firewall %s (host: %s)\n", f.Name, f.Host)
+	}
+	for _, f := range d.FirewallsChanged {
+		fmt.Fprintf(w, "~ firewall %s\n", f.Name)
+		for _, fd := range f.Fields {
+			fmt.Fprintf(w, "    %s: %s -> %s\n", fd.Field, formatValue(fd.Old), formatValue(fd.New))
+		}
+	}
+	fmt.Fprintf(w, "%d added, %d removed, %d changed\n", len(d.Added), len(d.Removed), len(d.Changed))
+	if n := len(d.FirewallsAdded) + len(d.FirewallsRemoved) + len(d.FirewallsChanged); n > 0 {
+		fmt.Fprintf(w, "Firewalls: %d added, %d removed, %d changed\n", len(d.FirewallsAdded), len(d.FirewallsRemoved), len(d.FirewallsChanged))
+	}
+}
+
+// Write the diff as JSON
+func (d configDiff) writeJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(d)
+}
+
+// Render a field value on a single line
+func formatValue(v any) string {
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "" || s == `""` {
+		return "(empty)"
+	}
+	return strings.ReplaceAll(s, "\n", ", ")
+}
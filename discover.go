@@ -0,0 +1,166 @@
+/*
+ * Filename: discover.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Discovers the gateways and tunnels configured on a firewall ('tfresh discover' and -auto-discover).
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+var (
+	// Refresh every tunnel found on the firewall, re-discovered each iteration
+	autoDiscover bool
+
+	// Gateway/tunnel patterns applied to discovered tunnels
+	discovery discoverFilter
+)
+
+// 'discoverFilter' type represents comma-separated globs matched against gateway and tunnel names
+type discoverFilter struct {
+	include []string
+	exclude []string
+}
+
+// Parse include and exclude pattern lists
+func newDiscoverFilter(include, exclude string) (discoverFilter, error) {
+	var f discoverFilter
+	for _, p := range []struct {
+		spec string
+		dst  *[]string
+	}{{include, &f.include}, {exclude, &f.exclude}} {
+		for _, pat := range strings.Split(p.spec, ",") {
+			if pat = strings.TrimSpace(pat); pat == "" {
+				continue
+			}
+			if _, err := path.Match(pat, ""); err != nil {
+				return f, fmt.Errorf("bad pattern %q: %w", pat, err)
+			}
+			*p.dst = append(*p.dst, pat)
+		}
+	}
+	return f, nil
+}
+
+// Whether a tunnel passes the filter: any include pattern matches (or there are none) and no exclude pattern does
+func (f discoverFilter) match(gateway, tunnel string) bool {
+	matches := func(pats []string) bool {
+		for _, p := range pats {
+			g, _ := path.Match(p, gateway)
+			t, _ := path.Match(p, tunnel)
+			if g || t {
+				return true
+			}
+		}
+		return false
+	}
+	return (len(f.include) == 0 || matches(f.include)) && !matches(f.exclude)
+}
+
+// Customers for the tunnels found on a firewall that pass the filter
+func discoveredCustomers(env string, gws []vpnGateway, tuns []vpnTunnel, f discoverFilter) []customer {
+	var customers []customer
+	for _, c := range importCustomers(env, gws, tuns) {
+		if !f.match(c.Gateway, c.Tunnel) {
+			continue
+		}
+		c.Firewall = env
+		c.Tags = []string{"discovered"}
+		customers = append(customers, c)
+	}
+	return customers
+}
+
+// Replace the scheduler's customers with the configured ones plus every tunnel found on the firewall.
+// A failed discovery keeps the previous list.
+func (sc *scheduler) discover(log *blockLog) {
+	var gws []vpnGateway
+	var tuns []vpnTunnel
+	var err error
+	if sc.api != nil {
+		gws, tuns, err = listVPNAPI(sc.api)
+	} else {
+		var cli *cliSession
+		if cli, err = openCLI(sc.client); err == nil {
+			gws, tuns, err = listVPN(cli)
+			cli.Close()
+		}
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprintf("discovery on %s failed, keeping %d customers: %v", sc.firewall, len(sc.customers), err), "firewall", sc.firewall, "error", err)
+		return
+	}
+	found := discoveredCustomers(sc.env, gws, tuns, discovery)
+	sc.customers = mergeDiscovered(append([]customer(nil), sc.configured...), found)
+	log.Printf("Discovered %d tunnels on %s (%d after filters), refreshing %d customers", len(tuns), sc.firewall, len(found), len(sc.customers))
+}
+
+// Handle 'tfresh discover'
+func discoverCommand(args []string) {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename, for its firewalls section (default is config.yml)")
+	fwEnv := fs.String("e", "", fmt.Sprintf("Firewall name (e.g. prod, test). Example: '%s discover -e prod -exclude \"*-lab\"'", os.Args[0]))
+	include := fs.String("include", "", "Only gateways or tunnels matching these comma-separated globs")
+	exclude := fs.String("exclude", "", "Skip gateways or tunnels matching these comma-separated globs")
+	format := fs.String("format", "table", "Output format (table, json)")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.Parse(args)
+
+	write := map[string]func(io.Writer, []customer) error{
+		"table": writeCustomerTable,
+		"json":  writeCustomerJSON,
+	}[*format]
+	if write == nil {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown output format %q.\n", *format)
+		os.Exit(1)
+	}
+	f, err := newDiscoverFilter(*include, *exclude)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	if err := loadFirewalls(configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	firewall, ok := firewalls[*fwEnv]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown firewall environment %q.\n", *fwEnv)
+		fs.Usage()
+		os.Exit(1)
+	}
+	username, password := checkEnvVars()
+
+	cli, err := connectCLI(firewall, username, password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	gws, tuns, err := listVPN(cli)
+	cli.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	customers := discoveredCustomers(*fwEnv, gws, tuns, f)
+	dedupeNames(customers)
+	if err = write(os.Stdout, customers); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Found %d of %d tunnels on %s.\n", len(customers), len(tuns), firewall)
+}
@@ -0,0 +1,191 @@
+/*
+ * Filename: doctor.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Environment diagnostics with remediation hints ('tfresh doctor').
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Doctor check outcomes
+const (
+	checkOK   = "OK"
+	checkWarn = "WARN"
+	checkFail = "FAIL"
+	checkSkip = "SKIP"
+)
+
+// Largest acceptable difference between local and firewall clocks
+const maxClockSkew = 30 * time.Second
+
+// Network timeout for doctor checks
+const doctorTimeout = 5 * time.Second
+
+// 'checkResult' type represents the outcome of one diagnostic check
+type checkResult struct {
+	Name   string
+	Status string
+	Detail string
+	Hint   string
+}
+
+// Run every diagnostic check for the given firewall environments
+func runDoctor(envs []string, listen string) []checkResult {
+	var results []checkResult
+
+	// Credentials
+	username, password, err := lookupCredentials()
+	if err != nil {
+		results = append(results, checkResult{"credentials", checkFail, err.Error(), "export PAN_USERNAME and PAN_PASSWORD (or load a key into ssh-agent) for the firewall service account"})
+	} else if password == "" {
+		results = append(results, checkResult{"credentials", checkOK, "PAN_USERNAME is set; using the SSH agent", ""})
+	} else {
+		results = append(results, checkResult{"credentials", checkOK, "PAN_USERNAME and PAN_PASSWORD are set", ""})
+	}
+	if agentAvailable() {
+		if n, err := agentKeys(); err != nil {
+			results = append(results, checkResult{"ssh agent", checkFail, err.Error(), "start ssh-agent or unset SSH_AUTH_SOCK"})
+		} else if n == 0 {
+			results = append(results, checkResult{"ssh agent", checkWarn, "the agent holds no keys", "add the firewall key with 'ssh-add'"})
+		} else {
+			results = append(results, checkResult{"ssh agent", checkOK, fmt.Sprintf("%d keys available", n), ""})
+		}
+	}
+
+	// Config validity
+	customers, _, err := loadConfig(configFile)
+	switch {
+	case err != nil:
+		results = append(results, checkResult{"config", checkFail, err.Error(), fmt.Sprintf("fix the file, or roll back with '%s config rollback'", os.Args[0])})
+	default:
+		if problems, _ := validateCustomers(customers); len(problems) > 0 {
+			results = append(results, checkResult{"config", checkWarn, fmt.Sprintf("%d problems, first: %s", len(problems), problems[0]), fmt.Sprintf("run '%s validate -c %s' for details", os.Args[0], configFile)})
+		} else {
+			results = append(results, checkResult{"config", checkOK, fmt.Sprintf("%s has %d customers", configFile, len(customers)), ""})
+		}
+	}
+
+	// State store health
+	if st, err := loadState(stateFile); err != nil {
+		results = append(results, checkResult{"state", checkFail, err.Error(), fmt.Sprintf("move the corrupt %s aside; it is recreated on the next run (config history is lost)", stateFile)})
+	} else if err = st.save(stateFile); err != nil {
+		results = append(results, checkResult{"state", checkFail, err.Error(), "make the state file and its directory writable by the tfresh user"})
+	} else {
+		results = append(results, checkResult{"state", checkOK, fmt.Sprintf("%s is readable and writable", stateFile), ""})
+	}
+
+	// Firewall reachability, authentication and clock skew
+	for _, env := range envs {
+		host := firewalls[env]
+		name := "firewall " + env
+
+		if err := resolveHost(host); err != nil {
+			results = append(results, checkResult{name, checkFail, err.Error(), "check DNS for the firewall management hostname"})
+			continue
+		}
+		conn, err := net.DialTimeout("tcp4", sshAddr(host), doctorTimeout)
+		if err != nil {
+			results = append(results, checkResult{name, checkFail, err.Error(), "check routing/ACLs to the management interface and that SSH is enabled in the management profile"})
+			continue
+		}
+		conn.Close()
+
+		if username == "" {
+			results = append(results, checkResult{name, checkWarn, sshAddr(host) + " is reachable; authentication not tested", "set credentials to test authentication"})
+		} else if r := preflight(env, host, username, password); r.Err != nil {
+			results = append(results, checkResult{name, checkFail, fmt.Sprintf("failed at %s: %v", r.Stage, r.Err), fmt.Sprintf("run '%s preflight -e %s' and check the account isn't locked out", os.Args[0], env)})
+		} else {
+			results = append(results, checkResult{name, checkOK, fmt.Sprintf("%s is reachable and accepts the credentials", host), ""})
+		}
+
+		results = append(results, checkClockSkew(env, host))
+	}
+
+	// Listener port availability
+	if listen == "" {
+		results = append(results, checkResult{"listener", checkSkip, "no listen address given", ""})
+	} else if ln, err := net.Listen("tcp", listen); err != nil {
+		results = append(results, checkResult{"listener", checkFail, err.Error(), "stop whatever holds the port (another tfresh?) or pick a different address"})
+	} else {
+		ln.Close()
+		results = append(results, checkResult{"listener", checkOK, listen + " is available", ""})
+	}
+
+	return results
+}
+
+// Compare the local clock to the Date header of the firewall's management web server
+func checkClockSkew(env, host string) checkResult {
+	name := "clock " + env
+	client := http.Client{
+		Timeout: doctorTimeout,
+		// Only the Date header is used, so the management certificate isn't verified
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Head("https://" + host + "/")
+	if err != nil {
+		return checkResult{name, checkSkip, "management web interface unreachable: " + err.Error(), ""}
+	}
+	resp.Body.Close()
+
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return checkResult{name, checkSkip, "no usable Date header", ""}
+	}
+	skew := time.Since(remote)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > maxClockSkew {
+		return checkResult{name, checkWarn, fmt.Sprintf("local clock differs from %s by %v", host, skew.Round(time.Second)), "enable NTP on this host and the firewall; skew makes logs and schedules hard to correlate"}
+	}
+	return checkResult{name, checkOK, fmt.Sprintf("skew %v", skew.Round(time.Second)), ""}
+}
+
+// Handle 'tfresh doctor'
+func doctorCommand(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fs.StringVar(&stateFile, "s", stateFile, "State file (default is tfresh.state.json)")
+	fwEnv := fs.String("e", "", "Firewall name or environment; all when empty")
+	listen := fs.String("listen", listenAddr, "Control listener address to check for availability, empty skips the check")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.Parse(args)
+
+	// A broken config file is reported by the config check
+	loadFirewalls(configFile)
+	envs, err := selectFirewalls(*fwEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, r := range runDoctor(envs, *listen) {
+		fmt.Printf("[%s] %s: %s\n", r.Status, r.Name, r.Detail)
+		if r.Hint != "" {
+			fmt.Printf("       hint: %s\n", r.Hint)
+		}
+		if r.Status == checkFail {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
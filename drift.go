@@ -0,0 +1,84 @@
+/*
+ * Filename: drift.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Detects drift between the customer list and the tunnels configured on the firewall.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 'driftReport' type represents the result of reconciling config against a firewall
+type driftReport struct {
+	Firewall         string    `json:"firewall"`
+	CheckedAt        time.Time `json:"checked_at"`
+	MissingGateways  []string  `json:"missing_gateways,omitempty"`  // "customer: gateway" entries not on the firewall
+	MissingTunnels   []string  `json:"missing_tunnels,omitempty"`   // "customer: tunnel" entries not on the firewall
+	UncoveredTunnels []string  `json:"uncovered_tunnels,omitempty"` // firewall tunnels no customer refreshes
+}
+
+// Report whether config and firewall agree
+func (r driftReport) clean() bool {
+	return len(r.MissingGateways) == 0 && len(r.MissingTunnels) == 0 && len(r.UncoveredTunnels) == 0
+}
+
+func (r driftReport) String() string {
+	if r.clean() {
+		return fmt.Sprintf("no drift on %s (checked %s)", r.Firewall, r.CheckedAt.Format(time.RFC3339))
+	}
+	var parts []string
+	if len(r.MissingGateways) > 0 {
+		parts = append(parts, "gateways missing on firewall: "+strings.Join(r.MissingGateways, ", "))
+	}
+	if len(r.MissingTunnels) > 0 {
+		parts = append(parts, "tunnels missing on firewall: "+strings.Join(r.MissingTunnels, ", "))
+	}
+	if len(r.UncoveredTunnels) > 0 {
+		parts = append(parts, "tunnels not covered by tfresh: "+strings.Join(r.UncoveredTunnels, ", "))
+	}
+	return fmt.Sprintf("drift on %s: %s", r.Firewall, strings.Join(parts, "; "))
+}
+
+// Compare configured customers with the firewall's gateways and tunnels
+func detectDrift(firewall string, customers []customer, gws []vpnGateway, tuns []vpnTunnel) driftReport {
+	r := driftReport{Firewall: firewall, CheckedAt: time.Now()}
+
+	for _, p := range missingNames(customers, gws, tuns) {
+		if p.kind == "gateway" {
+			r.MissingGateways = append(r.MissingGateways, p.customer+": "+p.name)
+		} else {
+			r.MissingTunnels = append(r.MissingTunnels, p.customer+": "+p.name)
+		}
+	}
+
+	covered := map[string]bool{}
+	for _, c := range customers {
+		if !c.isGlobalProtect() {
+			covered[c.Tunnel] = true
+		}
+	}
+	for _, t := range tuns {
+		name, _, _ := strings.Cut(t.Name, ":")
+		if !covered[name] {
+			covered[name] = true
+			r.UncoveredTunnels = append(r.UncoveredTunnels, name)
+		}
+	}
+	return r
+}
+
+// Reconcile customers against the firewall over an open CLI session
+func checkDrift(cli *cliSession, firewall string, customers []customer) (driftReport, error) {
+	gws, tuns, err := listVPN(cli)
+	if err != nil {
+		return driftReport{}, err
+	}
+	return detectDrift(firewall, customers, gws, tuns), nil
+}
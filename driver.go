@@ -0,0 +1,272 @@
+/*
+ * Filename: driver.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Vendor drivers for the SSH CLI: PAN-OS, Cisco ASA, FortiGate and Juniper SRX.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Firewall vendors
+const (
+	driverPANOS     = "panos"
+	driverASA       = "asa"
+	driverFortiGate = "fortigate"
+	driverSRX       = "srx"
+)
+
+// 'driver' interface is implemented by every firewall vendor's CLI
+type driver interface {
+	Name() string
+	Connect(client *ssh.Client) (*cliSession, error)
+	RefreshIKE(gateway string) opCommand
+	RefreshIPsec(tunnel string) opCommand
+	Status(cli *cliSession, c customer) (bool, error)
+	Check(out string) error
+}
+
+var (
+	drivers = map[string]driver{
+		driverPANOS:     panosDriver{},
+		driverASA:       asaDriver{},
+		driverFortiGate: fortigateDriver{},
+		driverSRX:       srxDriver{},
+	}
+
+	// Drivers set by the config's firewalls section, by host; PAN-OS without one
+	firewallDrivers = map[string]string{}
+)
+
+// Names of the known drivers
+func driverNames() string {
+	var names []string
+	for n := range drivers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// The driver for a firewall host
+func driverFor(host string) driver {
+	if d, ok := drivers[firewallDrivers[host]]; ok {
+		return d
+	}
+	return panosDriver{}
+}
+
+// Whether a firewall host runs PAN-OS, which the XML API, HA, batch mode, GlobalProtect and the checks need
+func isPANOS(host string) bool {
+	return driverFor(host).Name() == driverPANOS
+}
+
+// Reject settings another vendor's driver can't honor
+func checkDriver(host string, customers []customer, api, batch bool) error {
+	d := driverFor(host)
+	if d.Name() == driverPANOS {
+		return nil
+	}
+	switch {
+	case api:
+		return fmt.Errorf("%s: the api transport needs PAN-OS, not %s", host, d.Name())
+	case batch:
+		return fmt.Errorf("%s: batch mode needs PAN-OS, not %s", host, d.Name())
+	}
+	for _, c := range customers {
+		if c.isGlobalProtect() {
+			return fmt.Errorf("%s: GlobalProtect customer %q needs PAN-OS, not %s", host, c.Name, d.Name())
+		}
+	}
+	return nil
+}
+
+// Check a response against the vendor's failure messages as well as the generic ones
+func checkFailures(out string, failures ...string) error {
+	if err := checkOutput(out); err != nil {
+		return err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		lower := strings.ToLower(strings.TrimSpace(line))
+		for _, f := range failures {
+			if strings.Contains(lower, f) {
+				return fmt.Errorf("firewall responded: %s", strings.TrimSpace(line))
+			}
+		}
+	}
+	return nil
+}
+
+// Run a status command, failing on a rejected one
+func statusExec(cli *cliSession, d driver, cmd opCommand) (string, error) {
+	out, err := cli.exec(cmd.String(), promptTimeout)
+	if err == nil {
+		err = d.Check(out)
+	}
+	return out, err
+}
+
+// 'panosDriver' type represents Palo Alto Networks PAN-OS
+type panosDriver struct{}
+
+func (panosDriver) Name() string { return driverPANOS }
+
+func (panosDriver) Connect(client *ssh.Client) (*cliSession, error) { return openCLI(client) }
+
+func (panosDriver) RefreshIKE(gateway string) opCommand { return ikeSA.with(gateway) }
+
+func (panosDriver) RefreshIPsec(tunnel string) opCommand { return ipsecSA.with(tunnel) }
+
+func (panosDriver) Check(out string) error { return checkOutput(out) }
+
+func (panosDriver) Status(cli *cliSession, c customer) (bool, error) {
+	if c.Gateway != "" {
+		out, err := cli.exec(showIKESA.with(c.Gateway).String(), promptTimeout)
+		if err != nil || !ikeSAUp(out) {
+			return false, err
+		}
+	}
+	if c.Tunnel != "" {
+		out, err := cli.exec(showIPsecSA.with(c.Tunnel).String(), promptTimeout)
+		if err != nil || !ipsecSAUp(out, c.Tunnel) {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Cisco ASA prompt, e.g. 'asa01# ' or 'asa01/pri/act# '.
+// The account needs privilege level 15 to clear SAs.
+var asaPromptRE = regexp.MustCompile(`(^|\n)[\w.\-/]+(\([\w.\-]+\))?[>#] ?$`)
+
+// 'asaDriver' type represents Cisco ASA. Gateways and tunnels are the peer addresses.
+type asaDriver struct{}
+
+func (asaDriver) Name() string { return driverASA }
+
+func (asaDriver) Connect(client *ssh.Client) (*cliSession, error) {
+	return openShell(client, asaPromptRE, "terminal pager 0")
+}
+
+// Clearing the SAs makes the ASA renegotiate them
+func (asaDriver) RefreshIKE(gateway string) opCommand {
+	return opCommand{path: "clear crypto ikev2 sa", arg: gateway}
+}
+
+func (asaDriver) RefreshIPsec(tunnel string) opCommand {
+	return opCommand{path: "clear crypto ipsec sa peer", arg: tunnel}
+}
+
+func (asaDriver) Check(out string) error { return checkFailures(out, "% invalid", "% incomplete") }
+
+func (d asaDriver) Status(cli *cliSession, c customer) (bool, error) {
+	for _, peer := range []string{c.Gateway, c.Tunnel} {
+		if peer == "" {
+			continue
+		}
+		out, err := statusExec(cli, d, opCommand{path: "show vpn-sessiondb l2l filter name", arg: peer})
+		if err != nil || strings.Contains(strings.ToLower(out), "no active sessions") {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// FortiGate prompt, e.g. 'fgt01 # ' or 'fgt01 (root) # '.
+// The console output must be 'standard' so output never pages.
+var fortigatePromptRE = regexp.MustCompile(`(^|\n)[\w.\-]+( \([\w.\-]+\))? [#$] ?$`)
+
+// 'fortigateDriver' type represents Fortinet FortiGate. Gateways are phase 1 names, tunnels phase 2 names.
+type fortigateDriver struct{}
+
+func (fortigateDriver) Name() string { return driverFortiGate }
+
+func (fortigateDriver) Connect(client *ssh.Client) (*cliSession, error) {
+	return openShell(client, fortigatePromptRE)
+}
+
+func (fortigateDriver) RefreshIKE(gateway string) opCommand {
+	return opCommand{path: "diagnose vpn ike gateway flush name", arg: gateway}
+}
+
+func (fortigateDriver) RefreshIPsec(tunnel string) opCommand {
+	return opCommand{path: "diagnose vpn tunnel up", arg: tunnel}
+}
+
+func (fortigateDriver) Check(out string) error {
+	return checkFailures(out, "command fail", "unknown action", "return code -")
+}
+
+func (d fortigateDriver) Status(cli *cliSession, c customer) (bool, error) {
+	if c.Gateway == "" {
+		return false, errors.New("fortigate: status needs the customer_gateway (phase 1 name)")
+	}
+	out, err := statusExec(cli, d, opCommand{path: "diagnose vpn ike gateway list name", arg: c.Gateway})
+	if err != nil || !strings.Contains(out, "established") {
+		return false, err
+	}
+	if c.Tunnel == "" {
+		return true, nil
+	}
+	out, err = statusExec(cli, d, opCommand{path: "diagnose vpn tunnel list name", arg: c.Gateway})
+	if err != nil {
+		return false, err
+	}
+	// 'proxyid=<phase2> proto=0 sa=1 ref=2 ...'
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) > 0 && f[0] == "proxyid="+c.Tunnel && strings.Contains(line, " sa=1") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// 'srxDriver' type represents Juniper SRX. Gateways are IKE peer addresses, tunnels VPN names.
+type srxDriver struct{}
+
+func (srxDriver) Name() string { return driverSRX }
+
+// Junos operational mode prompts look like PAN-OS ones, e.g. 'admin@srx01> '
+func (srxDriver) Connect(client *ssh.Client) (*cliSession, error) {
+	return openShell(client, promptRE, "set cli screen-length 0")
+}
+
+func (srxDriver) RefreshIKE(gateway string) opCommand {
+	return opCommand{path: "clear security ike security-associations", arg: gateway}
+}
+
+func (srxDriver) RefreshIPsec(tunnel string) opCommand {
+	return opCommand{path: "clear security ipsec security-associations vpn-name", arg: tunnel}
+}
+
+func (srxDriver) Check(out string) error {
+	return checkFailures(out, "syntax error", "missing argument")
+}
+
+func (d srxDriver) Status(cli *cliSession, c customer) (bool, error) {
+	if c.Gateway != "" {
+		out, err := statusExec(cli, d, opCommand{path: "show security ike security-associations", arg: c.Gateway})
+		if err != nil || !strings.Contains(out, " UP ") {
+			return false, err
+		}
+	}
+	if c.Tunnel != "" {
+		out, err := statusExec(cli, d, opCommand{path: "show security ipsec security-associations vpn-name", arg: c.Tunnel})
+		if err != nil || strings.Contains(out, "Total active tunnels: 0") || !strings.Contains(out, "ESP:") {
+			return false, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,207 @@
+/*
+ * Filename: e2e_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: End-to-end tests of the SSH refresh flow against the mock PAN-OS firewall.
+ */
+
+package main
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"tfresh/internal/mockpanos"
+)
+
+// Start a mock firewall with two customers' gateways and tunnels and log in to it
+func startMock(t *testing.T, config mockpanos.Config) (*mockpanos.Server, *ssh.Client) {
+	t.Helper()
+	config.Users = map[string]string{"admin": "secret"}
+	config.Gateways = map[string]string{"gw-acme": "198.51.100.10", "gw-globex": "198.51.100.20"}
+	config.Tunnels = map[string]string{"tun-acme": "gw-acme", "tun-globex": "gw-globex"}
+	srv, err := mockpanos.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	client, err := ssh.Dial("tcp", srv.Addr(), &ssh.ClientConfig{
+		User:            "admin",
+		Auth:            []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: ssh.FixedHostKey(srv.HostKey()),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return srv, client
+}
+
+var e2eCustomers = []customer{
+	{Name: "Acme", Gateway: "gw-acme", Tunnel: "tun-acme"},
+	{Name: "Globex", Gateway: "gw-globex", Tunnel: "tun-globex"},
+}
+
+func TestE2EPromptDetection(t *testing.T) {
+	for _, ha := range []string{"", "active"} {
+		_, client := startMock(t, mockpanos.Config{Hostname: "fw-01.lab", HAState: ha})
+		cli, err := openCLI(client)
+		if err != nil {
+			t.Fatalf("HA %q: %v", ha, err)
+		}
+		want := "admin@fw-01.lab>"
+		if ha != "" {
+			want = "admin@fw-01.lab(" + ha + ")>"
+		}
+		if cli.prompt != want {
+			t.Errorf("HA %q: prompt %q, want %q", ha, cli.prompt, want)
+		}
+		// Output comes back without the echoed command or the next prompt
+		out, err := cli.exec("show high-availability state", promptTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(out, "show high-availability") || strings.Contains(out, "admin@") {
+			t.Errorf("HA %q: output kept the echo or prompt: %q", ha, out)
+		}
+		if ha == "" && out != "HA not enabled" {
+			t.Errorf("output %q, want %q", out, "HA not enabled")
+		}
+		cli.Close()
+	}
+}
+
+func TestE2ERefresh(t *testing.T) {
+	srv, client := startMock(t, mockpanos.Config{Down: []string{"tun-globex"}})
+	steps := planRefresh(panosDriver{}, e2eCustomers, false)
+	results, err := refreshFirewall(client, "mock-e2e", steps, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	if r := results[0]; r.step.customer != "Acme" || r.result != resultSuccess {
+		t.Errorf("Acme: %s %v", r.result, r.err)
+	}
+	// A tunnel whose SA doesn't come up is reported by the firewall as 'Initiate 0'
+	if r := results[1]; r.step.customer != "Globex" || r.result != resultFailed || !strings.Contains(r.err.Error(), "tun-globex") {
+		t.Errorf("Globex: %s %v, want a failed tun-globex", r.result, r.err)
+	}
+
+	want := []string{
+		"set cli pager off",
+		"test vpn ike-sa gateway gw-acme",
+		"test vpn ipsec-sa tunnel tun-acme",
+		"test vpn ike-sa gateway gw-globex",
+		"test vpn ipsec-sa tunnel tun-globex",
+	}
+	if got := srv.Commands(); !slices.Equal(got, want) {
+		t.Errorf("commands sent:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Once the tunnel may come up, the next refresh succeeds and the SA is listed
+	srv.SetDown("tun-globex", false)
+	results, err = refreshFirewall(client, "mock-e2e", steps[1:], time.Time{})
+	if err != nil || len(results) != 1 || results[0].result != resultSuccess {
+		t.Fatalf("Globex retry: %v %+v", err, results)
+	}
+	cli, err := openCLI(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	sas, err := listIPsecSAs(cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sa, ok := sas["tun-globex"]; !ok || sa.Peer != "198.51.100.20" {
+		t.Errorf("tun-globex has no IPsec SA to its peer after its refresh: %+v", sas)
+	}
+}
+
+func TestE2EBatchRefresh(t *testing.T) {
+	srv, client := startMock(t, mockpanos.Config{})
+	results, err := refreshFirewall(client, "mock-e2e", planRefresh(panosDriver{}, e2eCustomers, true), time.Time{})
+	if err != nil || len(results) != 1 || results[0].result != resultSuccess {
+		t.Fatalf("batch: %v %+v", err, results)
+	}
+	if got := srv.Commands(); !slices.Contains(got, "test vpn ike-sa") || !slices.Contains(got, "test vpn ipsec-sa") {
+		t.Errorf("batch commands: %v", got)
+	}
+}
+
+func TestE2ECommandTimeout(t *testing.T) {
+	old := commandTimeout
+	commandTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { commandTimeout = old })
+
+	srv, client := startMock(t, mockpanos.Config{RefreshDelay: time.Second})
+	results, err := refreshFirewall(client, "mock-e2e", planRefresh(panosDriver{}, e2eCustomers[:1], false), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].result != resultFailed || !errors.Is(results[0].err, errPromptTimeout) {
+		t.Fatalf("got %+v, want a prompt timeout", results)
+	}
+	// The CLI stuck mid-command is replaced, so the second command still goes out on a fresh session
+	if got := srv.Commands(); !slices.Contains(got, "test vpn ipsec-sa tunnel tun-acme") {
+		t.Errorf("commands after the timeout: %v", got)
+	}
+}
+
+func TestE2ERejectedLogin(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	old := dialRetry
+	dialRetry = retryPolicy{attempts: 5, base: time.Millisecond, max: time.Millisecond}
+	t.Cleanup(func() { dialRetry = old })
+
+	srv, _ := startMock(t, mockpanos.Config{})
+	before := srv.Logins()
+	sc := &scheduler{firewall: srv.Addr(), user: "admin", pass: "wrong"}
+	err := sc.connect()
+	if err == nil || !isAuthError(err) {
+		t.Errorf("got %v, want an authentication error", err)
+	}
+	if n := srv.Logins() - before; n != 1 {
+		t.Errorf("%d logins attempted, want 1 with no retry", n)
+	}
+}
+
+// Steps in flight when the connection drops are reported failed rather than dropped
+func TestE2EConnectionLostMidRefresh(t *testing.T) {
+	old := sshConcurrency
+	sshConcurrency = 2
+	t.Cleanup(func() { sshConcurrency = old })
+
+	var client *ssh.Client
+	_, client = startMock(t, mockpanos.Config{RefreshDelay: 200 * time.Millisecond, OnCommand: func(user, cmd string) {
+		if cmd == "test vpn ike-sa gateway gw-globex" {
+			go client.Close()
+		}
+	}})
+	results, err := refreshFirewall(client, "mock-e2e", planRefresh(panosDriver{}, e2eCustomers, false), time.Time{})
+	if err == nil {
+		t.Error("lost connection not reported")
+	}
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want both steps in flight: %+v", len(results), results)
+	}
+	for _, r := range results {
+		if r.result != resultFailed || r.err == nil {
+			t.Errorf("%s: %s %v, want failed", r.step.customer, r.result, r.err)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+/*
+ * Filename: encrypt.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Decrypts configuration files encrypted with age or SOPS (age keys) in memory.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	ageIntro      = "age-encryption.org/v1"
+	ageArmorBegin = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageArmorEnd   = "-----END AGE ENCRYPTED FILE-----"
+	ageChunkSize  = 64 * 1024
+)
+
+// Decrypt a configuration file encrypted with age, or the values of a SOPS file with
+// age recipients. Plaintext files are returned unchanged. Keys are read from
+// $TFRESH_AGE_KEY_FILE, $SOPS_AGE_KEY_FILE, $SOPS_AGE_KEY or ~/.config/sops/age/keys.txt.
+func decryptConfig(fBytes []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(fBytes)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte(ageIntro)), bytes.HasPrefix(trimmed, []byte(ageArmorBegin)):
+		ids, err := ageIdentities()
+		if err != nil {
+			return nil, err
+		}
+		return ageDecrypt(fBytes, ids)
+	case bytes.Contains(fBytes, []byte("ENC[AES256_GCM,")):
+		return sopsDecrypt(fBytes)
+	}
+	return fBytes, nil
+}
+
+// ---- age ----
+
+// Load the age X25519 identities that may decrypt the configuration
+func ageIdentities() ([]*ecdh.PrivateKey, error) {
+	var text, source string
+	for _, env := range []string{"TFRESH_AGE_KEY_FILE", "SOPS_AGE_KEY_FILE"} {
+		if path := os.Getenv(env); path != "" {
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("age identities: %w", err)
+			}
+			text, source = string(b), path
+			break
+		}
+	}
+	if source == "" {
+		if text = os.Getenv("SOPS_AGE_KEY"); text != "" {
+			source = "$SOPS_AGE_KEY"
+		}
+	}
+	if source == "" {
+		home, _ := os.UserHomeDir()
+		source = filepath.Join(home, ".config", "sops", "age", "keys.txt")
+		b, err := os.ReadFile(source)
+		if err != nil {
+			return nil, errors.New("the configuration is encrypted: set TFRESH_AGE_KEY_FILE to an age identity file")
+		}
+		text = string(b)
+	}
+
+	var ids []*ecdh.PrivateKey
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hrp, data, err := bech32Decode(line)
+		if err != nil || hrp != "age-secret-key-" || len(data) != 32 {
+			return nil, fmt.Errorf("age identities: %s: malformed AGE-SECRET-KEY line", source)
+		}
+		key, err := ecdh.X25519().NewPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("age identities: %s: %w", source, err)
+		}
+		ids = append(ids, key)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("age identities: no keys in %s", source)
+	}
+	return ids, nil
+}
+
+// Decrypt an age file, binary or armored
+func ageDecrypt(fBytes []byte, ids []*ecdh.PrivateKey) ([]byte, error) {
+	if t := bytes.TrimSpace(fBytes); bytes.HasPrefix(t, []byte(ageArmorBegin)) {
+		if !bytes.HasSuffix(t, []byte(ageArmorEnd)) {
+			return nil, errors.New("age: armored file has no end marker")
+		}
+		body := bytes.TrimSuffix(bytes.TrimPrefix(t, []byte(ageArmorBegin)), []byte(ageArmorEnd))
+		raw, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+		if err != nil {
+			return nil, fmt.Errorf("age: armor: %w", err)
+		}
+		fBytes = raw
+	}
+
+	r := bufio.NewReader(bytes.NewReader(fBytes))
+	var header bytes.Buffer
+	line := func() (string, error) {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return "", errors.New("age: truncated header")
+		}
+		header.WriteString(l)
+		return strings.TrimSuffix(l, "\n"), nil
+	}
+	if l, err := line(); err != nil || l != ageIntro {
+		return nil, errors.New("age: not an age v1 file")
+	}
+
+	var fileKey []byte
+	var mac string
+	for {
+		l, err := line()
+		if err != nil {
+			return nil, err
+		}
+		if rest, ok := strings.CutPrefix(l, "---"); ok {
+			// The MAC covers the header up to and including '---'
+			header.Truncate(header.Len() - len(l) - 1 + len("---"))
+			mac = strings.TrimSpace(rest)
+			break
+		}
+		args := strings.Fields(strings.TrimPrefix(l, "->"))
+		if !strings.HasPrefix(l, "-> ") || len(args) == 0 {
+			return nil, fmt.Errorf("age: malformed stanza %q", l)
+		}
+		// The stanza body ends with its first line shorter than 64 columns
+		var body string
+		for {
+			b, err := line()
+			if err != nil {
+				return nil, err
+			}
+			body += b
+			if len(b) < 64 {
+				break
+			}
+		}
+		if args[0] != "X25519" || fileKey != nil || len(args) != 2 {
+			continue
+		}
+		fileKey = unwrapX25519(args[1], body, ids)
+	}
+	if fileKey == nil {
+		return nil, errors.New("age: none of the identities can decrypt the configuration")
+	}
+
+	h := hmac.New(sha256.New, hkdfKey(fileKey, nil, "header"))
+	h.Write(header.Bytes())
+	want, err := base64.RawStdEncoding.DecodeString(mac)
+	if err != nil || !hmac.Equal(h.Sum(nil), want) {
+		return nil, errors.New("age: header MAC mismatch")
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, errors.New("age: truncated payload")
+	}
+	aead, _ := chacha20poly1305.New(hkdfKey(fileKey, nonce, "payload"))
+	payload, _ := io.ReadAll(r)
+
+	// STREAM: 64 KiB chunks, nonce is an 11-byte counter and a final-chunk flag
+	var out []byte
+	n := make([]byte, chacha20poly1305.NonceSize)
+	for counter := uint64(0); ; counter++ {
+		size := min(len(payload), ageChunkSize+aead.Overhead())
+		chunk := payload[:size]
+		payload = payload[size:]
+		for i := 0; i < 8; i++ {
+			n[10-i] = byte(counter >> (8 * i))
+		}
+		if len(payload) == 0 {
+			n[11] = 1
+		}
+		plain, err := aead.Open(nil, n, chunk, nil)
+		if err != nil {
+			return nil, errors.New("age: payload authentication failed")
+		}
+		out = append(out, plain...)
+		if len(payload) == 0 {
+			return out, nil
+		}
+	}
+}
+
+// Unwrap the file key from an X25519 stanza, nil when none of the identities match
+func unwrapX25519(share, body string, ids []*ecdh.PrivateKey) []byte {
+	shareBytes, err := base64.RawStdEncoding.DecodeString(share)
+	if err != nil {
+		return nil
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(shareBytes)
+	if err != nil {
+		return nil
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(body)
+	if err != nil {
+		return nil
+	}
+	for _, id := range ids {
+		shared, err := id.ECDH(ephemeral)
+		if err != nil {
+			continue
+		}
+		salt := append(append([]byte{}, shareBytes...), id.PublicKey().Bytes()...)
+		aead, _ := chacha20poly1305.New(hkdfKey(shared, salt, "age-encryption.org/v1/X25519"))
+		if key, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), wrapped, nil); err == nil && len(key) == 16 {
+			return key
+		}
+	}
+	return nil
+}
+
+// 32-byte HKDF-SHA256 key
+func hkdfKey(secret, salt []byte, info string) []byte {
+	key := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key)
+	return key
+}
+
+// Decode a Bech32 string, returning the lower-case human-readable part and the data
+func bech32Decode(s string) (string, []byte, error) {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, errors.New("bech32: no separator")
+	}
+	hrp, values := s[:pos], make([]byte, 0, len(s)-pos-1)
+	for _, c := range s[pos+1:] {
+		v := strings.IndexRune(charset, c)
+		if v < 0 {
+			return "", nil, errors.New("bech32: invalid character")
+		}
+		values = append(values, byte(v))
+	}
+
+	// Checksum over the expanded HRP and the values
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	polymod := func(v byte) {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	for i := 0; i < len(hrp); i++ {
+		polymod(hrp[i] >> 5)
+	}
+	polymod(0)
+	for i := 0; i < len(hrp); i++ {
+		polymod(hrp[i] & 31)
+	}
+	for _, v := range values {
+		polymod(v)
+	}
+	if chk != 1 {
+		return "", nil, errors.New("bech32: bad checksum")
+	}
+
+	// Regroup the 5-bit values, less the checksum, into bytes
+	var data []byte
+	acc, bits := uint32(0), uint(0)
+	for _, v := range values[:len(values)-6] {
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			data = append(data, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || acc&(1<<bits-1) != 0 {
+		return "", nil, errors.New("bech32: bad padding")
+	}
+	return hrp, data, nil
+}
+
+// ---- SOPS ----
+
+// SOPS encrypted value: ENC[AES256_GCM,data:...,iv:...,tag:...,type:str]
+var sopsValueRE = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:(\w+)\]$`)
+
+// Decrypt a SOPS YAML or JSON file's values with the data key wrapped for an age recipient,
+// returning the plaintext in the file's own format. Each value is authenticated by AES-GCM
+// and the file as a whole by the SOPS MAC, so removed, reordered or swapped values are caught.
+func sopsDecrypt(fBytes []byte) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(fBytes, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("sops: only the mapping layout has room for the sops metadata")
+	}
+	doc := root.Content[0]
+
+	var meta struct {
+		Age []struct {
+			Recipient string `yaml:"recipient"`
+			Enc       string `yaml:"enc"`
+		} `yaml:"age"`
+		LastModified     string `yaml:"lastmodified"`
+		MAC              string `yaml:"mac"`
+		MACOnlyEncrypted bool   `yaml:"mac_only_encrypted"`
+	}
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value == "sops" {
+			if err := doc.Content[i+1].Decode(&meta); err != nil {
+				return nil, fmt.Errorf("sops: metadata: %w", err)
+			}
+			doc.Content = append(doc.Content[:i], doc.Content[i+2:]...)
+			break
+		}
+	}
+	if len(meta.Age) == 0 {
+		return nil, errors.New("sops: no age recipients; decrypt the file with 'sops -d' first")
+	}
+
+	ids, err := ageIdentities()
+	if err != nil {
+		return nil, err
+	}
+	var dataKey []byte
+	for _, r := range meta.Age {
+		if dataKey, err = ageDecrypt([]byte(r.Enc), ids); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sops: data key: %w", err)
+	}
+	if len(dataKey) != 32 {
+		return nil, errors.New("sops: data key is not 32 bytes")
+	}
+
+	w := &sopsWalk{key: dataKey, mac: sha512.New(), macOnlyEncrypted: meta.MACOnlyEncrypted}
+	if err := w.node(doc, nil); err != nil {
+		return nil, err
+	}
+	if err := w.checkMAC(meta.MAC, meta.LastModified); err != nil {
+		return nil, err
+	}
+	if json.Valid(fBytes) {
+		var v any
+		if err := doc.Decode(&v); err != nil {
+			return nil, err
+		}
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return yaml.Marshal(&root)
+}
+
+// 'sopsWalk' type represents a pass decrypting a SOPS tree and hashing its values for the MAC
+type sopsWalk struct {
+	key              []byte
+	mac              hash.Hash
+	macOnlyEncrypted bool
+}
+
+// Decrypt the values under a node in place. Values are bound to their path of mapping keys.
+func (w *sopsWalk) node(n *yaml.Node, path []string) error {
+	// Encrypted comments would only get in the way, and aren't part of the MAC
+	n.HeadComment, n.LineComment, n.FootComment = "", "", ""
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			n.Content[i].HeadComment, n.Content[i].LineComment, n.Content[i].FootComment = "", "", ""
+			if err := w.node(n.Content[i+1], append(path, n.Content[i].Value)); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, c := range n.Content {
+			if err := w.node(c, path); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		m := sopsValueRE.FindStringSubmatch(n.Value)
+		if m == nil {
+			if !w.macOnlyEncrypted {
+				w.mac.Write(sopsMACBytes(n))
+			}
+			return nil
+		}
+		plain, err := sopsOpen(w.key, m[1], m[2], m[3], strings.Join(path, ":")+":")
+		if err != nil {
+			return fmt.Errorf("sops: %s: %w", strings.Join(path, "."), err)
+		}
+		// Encrypted values are hashed as they were encrypted, e.g. booleans as 'True'
+		w.mac.Write(plain)
+		n.Value, n.Style = string(plain), 0
+		switch m[4] {
+		case "int":
+			n.Tag = "!!int"
+		case "float":
+			n.Tag = "!!float"
+		case "bool":
+			n.Tag = "!!bool"
+			n.Value = strconv.FormatBool(strings.EqualFold(n.Value, "true"))
+		default:
+			n.Tag = "!!str"
+		}
+	}
+	return nil
+}
+
+// Compare the values' hash with the file's MAC, which is encrypted with the last-modified time as data
+func (w *sopsWalk) checkMAC(mac, lastModified string) error {
+	m := sopsValueRE.FindStringSubmatch(mac)
+	if m == nil {
+		return errors.New("sops: the file has no MAC")
+	}
+	if t, err := time.Parse(time.RFC3339, lastModified); err == nil {
+		lastModified = t.Format(time.RFC3339)
+	}
+	want, err := sopsOpen(w.key, m[1], m[2], m[3], lastModified)
+	if err != nil {
+		return fmt.Errorf("sops: MAC: %w", err)
+	}
+	if got := fmt.Sprintf("%X", w.mac.Sum(nil)); !hmac.Equal([]byte(got), want) {
+		return errors.New("sops: MAC mismatch (values were added, removed or moved)")
+	}
+	return nil
+}
+
+// Bytes a plaintext value contributes to the MAC, formatted the way SOPS formats it
+func sopsMACBytes(n *yaml.Node) []byte {
+	switch n.Tag {
+	case "!!int":
+		if i, err := strconv.ParseInt(n.Value, 10, 64); err == nil {
+			return []byte(strconv.FormatInt(i, 10))
+		}
+	case "!!float":
+		if f, err := strconv.ParseFloat(n.Value, 64); err == nil {
+			return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+		}
+	case "!!bool":
+		var b bool
+		if n.Decode(&b) == nil && b {
+			return []byte("True")
+		}
+		return []byte("False")
+	case "!!null":
+		return nil
+	}
+	return []byte(n.Value)
+}
+
+// Open one AES-256-GCM value; SOPS uses 32-byte IVs
+func sopsOpen(key []byte, data, iv, tag, aad string) ([]byte, error) {
+	ct, err1 := base64.StdEncoding.DecodeString(data)
+	nonce, err2 := base64.StdEncoding.DecodeString(iv)
+	t, err3 := base64.StdEncoding.DecodeString(tag)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(nonce))
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, nonce, append(ct, t...), []byte(aad))
+	if err != nil {
+		return nil, errors.New("value authentication failed (wrong key or tampered file)")
+	}
+	return plain, nil
+}
@@ -0,0 +1,168 @@
+/*
+ * Filename: encrypt_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Known-answer tests for age and SOPS decryption against the fixtures in testdata/encrypted.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// BIP-173 test vectors
+func TestBech32Decode(t *testing.T) {
+	valid := []struct{ in, hrp, data string }{
+		{"A12UEL5L", "a", ""},
+		{"a12uel5l", "a", ""},
+		{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", "abcdef", "00443214c74254b635cf84653a56d7c675be77df"},
+	}
+	for _, v := range valid {
+		hrp, data, err := bech32Decode(v.in)
+		if err != nil {
+			t.Errorf("%s: %v", v.in, err)
+			continue
+		}
+		if hrp != v.hrp || hex.EncodeToString(data) != v.data {
+			t.Errorf("%s: got %q %x, want %q %s", v.in, hrp, data, v.hrp, v.data)
+		}
+	}
+	for _, in := range []string{"a12uel5m", "1nwldj5", "x1b4n0q5v", "li1dgmt3", "pzry9x0s0muk"} {
+		if _, _, err := bech32Decode(in); err == nil {
+			t.Errorf("%s: decoded an invalid string", in)
+		}
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile("testdata/encrypted/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestAgeDecrypt(t *testing.T) {
+	t.Setenv("TFRESH_AGE_KEY_FILE", "testdata/encrypted/keys.txt")
+	want := readFixture(t, "config.yml")
+	for _, name := range []string{"config.yml.age", "config.yml.age.asc"} {
+		got, err := decryptConfig(readFixture(t, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestAgeDecryptRejectsTampering(t *testing.T) {
+	t.Setenv("TFRESH_AGE_KEY_FILE", "testdata/encrypted/keys.txt")
+	enc := readFixture(t, "config.yml.age")
+
+	payload := append([]byte{}, enc...)
+	payload[len(payload)-1] ^= 1
+	if _, err := decryptConfig(payload); err == nil || !strings.Contains(err.Error(), "payload") {
+		t.Errorf("flipped payload bit: got %v", err)
+	}
+	header := bytes.Replace(enc, []byte("-> X25519 "), []byte("-> X25519 A"), 1)
+	if _, err := decryptConfig(header); err == nil {
+		t.Error("altered header: decrypted")
+	}
+	truncated := enc[:len(enc)-20]
+	if _, err := decryptConfig(truncated); err == nil {
+		t.Error("truncated payload: decrypted")
+	}
+}
+
+func TestAgeDecryptWrongIdentity(t *testing.T) {
+	other, err := ecdh.X25519().NewPrivateKey(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ageDecrypt(readFixture(t, "config.yml.age"), []*ecdh.PrivateKey{other}); err == nil {
+		t.Error("decrypted with the wrong identity")
+	}
+}
+
+func TestSOPSDecrypt(t *testing.T) {
+	t.Setenv("TFRESH_AGE_KEY_FILE", "testdata/encrypted/keys.txt")
+	want, err := decodeConfigDoc(readFixture(t, "config.yml"), "yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ name, format string }{{"config.sops.yml", "yaml"}, {"config.sops.json", "json"}} {
+		plain, err := decryptConfig(readFixture(t, tc.name))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := json.Valid(plain); got != (tc.format == "json") {
+			t.Errorf("%s: decrypted to %q, want %s", tc.name, plain, tc.format)
+		}
+		doc, err := decodeConfigDoc(plain, tc.format)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(doc.Customers, want.Customers) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, doc.Customers, want.Customers)
+		}
+	}
+}
+
+func TestSOPSDecryptChecksMAC(t *testing.T) {
+	t.Setenv("TFRESH_AGE_KEY_FILE", "testdata/encrypted/keys.txt")
+	lines := strings.Split(string(readFixture(t, "config.sops.yml")), "\n")
+	find := func(prefix string, nth int) int {
+		for i, l := range lines {
+			if strings.HasPrefix(strings.TrimLeft(l, " -"), prefix) {
+				if nth == 0 {
+					return i
+				}
+				nth--
+			}
+		}
+		t.Fatalf("no %s #%d in the fixture", prefix, nth)
+		return 0
+	}
+	edit := func(f func(l []string) []string) []byte {
+		l := f(append([]string{}, lines...))
+		return []byte(strings.Join(l, "\n"))
+	}
+
+	// Values under the same path pass AES-GCM wherever they are; only the MAC notices
+	swapped := edit(func(l []string) []string {
+		a, b := find("customer_gateway:", 0), find("customer_gateway:", 1)
+		_, va, _ := strings.Cut(l[a], ": ")
+		_, vb, _ := strings.Cut(l[b], ": ")
+		l[a] = strings.Replace(l[a], va, vb, 1)
+		l[b] = strings.Replace(l[b], vb, va, 1)
+		return l
+	})
+	removed := edit(func(l []string) []string {
+		i := find("customer_tunnel:", 1)
+		return append(l[:i], l[i+1:]...)
+	})
+	noMAC := edit(func(l []string) []string {
+		i := find("mac:", 0)
+		return append(l[:i], l[i+1:]...)
+	})
+	for name, in := range map[string][]byte{"swapped": swapped, "removed": removed, "no mac": noMAC} {
+		if _, err := decryptConfig(in); err == nil || !strings.Contains(err.Error(), "MAC") {
+			t.Errorf("%s values: got %v, want a MAC error", name, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Filename: endpoints.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Fails over between a firewall's management addresses, e.g. out-of-band and in-band.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+var (
+	// Management addresses tried after the host itself, by host
+	firewallAddresses = map[string][]string{}
+
+	// The address a firewall was last reached on, tried first next time
+	endpointsMu  sync.Mutex
+	lastEndpoint = map[string]string{} // by host
+)
+
+// A firewall's management addresses in the order they're tried: the one that last
+// worked, then the host, then the config's addresses
+func endpoints(host string) []string {
+	endpointsMu.Lock()
+	last := lastEndpoint[host]
+	endpointsMu.Unlock()
+	var addrs []string
+	if last != "" {
+		addrs = append(addrs, last)
+	}
+	for _, a := range append([]string{host}, firewallAddresses[host]...) {
+		if a != last {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs
+}
+
+// Remember the address a firewall was reached on, logging a switch to another one
+func useEndpoint(host, address string) {
+	endpointsMu.Lock()
+	prev := lastEndpoint[host]
+	lastEndpoint[host] = address
+	endpointsMu.Unlock()
+	if prev == "" && address == host || prev == address {
+		return
+	}
+	logger.Warn(fmt.Sprintf("%s: reached on %s, used until it fails", host, address), "firewall", host, "address", address)
+}
+
+// SSH address of one of a firewall's management addresses, on the host's port
+// unless the address has its own
+func endpointAddr(host, address string) string {
+	if address == host {
+		return sshAddr(host)
+	}
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+	if port, ok := sshPorts[host]; ok {
+		return net.JoinHostPort(address, strconv.Itoa(port))
+	}
+	return net.JoinHostPort(address, strconv.Itoa(sshPort))
+}
+
+// Dial one of a firewall's management addresses after another until one answers.
+// Rejected credentials end the failover, since every address would reject them.
+func dialEndpoints[T any](host string, dial func(address string) (T, error)) (T, error) {
+	var errs []error
+	for _, a := range endpoints(host) {
+		v, err := dial(a)
+		if err == nil {
+			useEndpoint(host, a)
+			return v, nil
+		}
+		if isAuthError(err) || isHostKeyError(err) || rootCtx.Err() != nil {
+			return v, err
+		}
+		if a != host {
+			err = fmt.Errorf("%s: %w", a, err)
+		}
+		errs = append(errs, err)
+	}
+	var zero T
+	return zero, errors.Join(errs...)
+}
+
+// XML API dialer failing over between a firewall's management addresses on the API port.
+// Connections to anything else, such as a proxy, are dialed as they are.
+func apiDialer(host string, d *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		h, port, err := net.SplitHostPort(addr)
+		if err != nil || h != host || len(firewallAddresses[host]) == 0 {
+			return d.DialContext(ctx, network, addr)
+		}
+		return dialEndpoints(host, func(address string) (net.Conn, error) {
+			if a, _, err := net.SplitHostPort(address); err == nil {
+				address = a
+			}
+			return d.DialContext(ctx, network, net.JoinHostPort(address, port))
+		})
+	}
+}
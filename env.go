@@ -0,0 +1,113 @@
+/*
+ * Filename: env.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Daemon configuration from TFRESH_* environment variables, for containers without a mounted config file.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Configuration source name of an inline $TFRESH_CONFIG
+const envConfigName = "$TFRESH_CONFIG"
+
+// Firewall defined by $TFRESH_FIREWALL_HOST
+const envFirewallName = "main"
+
+// Environment variables of flags whose derived names would be cryptic
+var envFlagAliases = map[string]string{
+	"c": "TFRESH_CONFIG_FILE",
+	"e": "TFRESH_FIREWALL",
+	"i": "TFRESH_INTERVAL",
+	"s": "TFRESH_STATE_FILE",
+	"v": "TFRESH_VERBOSE",
+	"q": "TFRESH_QUIET",
+}
+
+// Environment variable setting a flag: an alias, or TFRESH_ and the upper-cased name with '-' as '_'
+func envFlagName(name string) string {
+	if env, ok := envFlagAliases[name]; ok {
+		return env
+	}
+	return "TFRESH_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Set the flags not given on the command line from their environment variables.
+// Precedence is flags, then TFRESH_* variables, then the config file and defaults.
+func applyEnvFlags(fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var problems []string
+	fs.VisitAll(func(f *flag.Flag) {
+		env := envFlagName(f.Name)
+		v, ok := os.LookupEnv(env)
+		if !ok || given[f.Name] {
+			return
+		}
+		// Variables named after flags may already be their defaults, e.g. $TFRESH_PROXY
+		if v == f.Value.String() {
+			return
+		}
+		if err := fs.Set(f.Name, v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", env, err))
+		}
+	})
+	// An inline config stands in for the file unless one was named
+	if _, ok := os.LookupEnv("TFRESH_CONFIG"); ok && !given["c"] && os.Getenv(envFlagName("c")) == "" {
+		configFile = envConfigName
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Read a configuration source: a file, a URL, or the inline $TFRESH_CONFIG
+func readConfigSource(filename string) ([]byte, error) {
+	if isRemoteConfig(filename) {
+		return fetchRemoteConfig(filename)
+	}
+	if filename == envConfigName {
+		v := os.Getenv("TFRESH_CONFIG")
+		if strings.TrimSpace(v) == "" {
+			return nil, errors.New("TFRESH_CONFIG is empty")
+		}
+		return []byte(v), nil
+	}
+	return os.ReadFile(filename)
+}
+
+// The firewall $TFRESH_FIREWALL_HOST defines, if any
+func envFirewalls() []firewallDef {
+	host := strings.TrimSpace(os.Getenv("TFRESH_FIREWALL_HOST"))
+	if host == "" {
+		return nil
+	}
+	return []firewallDef{{Name: envFirewallName, Host: host}}
+}
+
+// Help text listing the environment variables, appended to 'tfresh run -h'
+func printEnvUsage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "\nEnvironment:\n  Every flag can be set with TFRESH_ and its name upper-cased with '-' as '_',\n  e.g. TFRESH_LOG_LEVEL=debug or TFRESH_TRANSPORT=api; flags on the command line win.\n")
+	var aliases []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if env, ok := envFlagAliases[f.Name]; ok {
+			aliases = append(aliases, fmt.Sprintf("  %-22s -%s", env, f.Name))
+		}
+	})
+	fmt.Fprintln(os.Stderr, strings.Join(aliases, "\n"))
+	fmt.Fprintf(os.Stderr, "  %-22s configuration (YAML or JSON) used instead of a file when -c isn't set\n", "TFRESH_CONFIG")
+	fmt.Fprintf(os.Stderr, "  %-22s management host of a firewall named %q, the default -e\n", "TFRESH_FIREWALL_HOST", envFirewallName)
+}
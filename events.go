@@ -0,0 +1,238 @@
+/*
+ * Filename: events.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Machine-readable NDJSON event stream ('--output ndjson').
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	evIterationStart   = "iteration_start"
+	evRefreshStart     = "refresh_start"
+	evRefreshResult    = "refresh_result"
+	evIterationSummary = "iteration_summary"
+	evShutdown         = "shutdown"
+)
+
+// Refresh results
+const (
+	resultSuccess = "success"
+	resultFailed  = "failed"
+	resultSent    = "sent" // the SSH transport doesn't read command output
+
+	// Not run this iteration
+	resultSkipped     = "skipped"     // already refreshed before a restart
+	resultQuarantined = "quarantined" // held back by an operator
+	resultHealthy     = "healthy"     // SAs already established, not refreshed
+)
+
+// Number of slowest customers reported in an iteration summary
+const slowestCustomers = 3
+
+var (
+	// Output format, text or ndjson
+	outputFormat = "text"
+
+	// Destination of human readable output; stderr when stdout carries events
+	humanOut io.Writer = os.Stdout
+
+	// In-process subscribers to the events, such as gRPC WatchRefresh streams
+	watchMu  sync.Mutex
+	watchers = map[chan ndjsonEvent]bool{}
+)
+
+// 'ndjsonEvent' type represents one line of the event stream
+type ndjsonEvent struct {
+	Event       string        `json:"event"`
+	Time        string        `json:"time"`
+	Iteration   int           `json:"iteration,omitempty"`
+	Firewall    string        `json:"firewall,omitempty"`
+	Customer    string        `json:"customer,omitempty"`
+	Kind        string        `json:"kind,omitempty"`
+	Commands    []string      `json:"commands,omitempty"`
+	Result      string        `json:"result,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	DurationMS  int64         `json:"duration_ms,omitempty"`
+	Succeeded   *int          `json:"succeeded,omitempty"`
+	Failed      *int          `json:"failed,omitempty"`
+	Sent        *int          `json:"sent,omitempty"`
+	Skipped     *int          `json:"skipped,omitempty"`
+	Quarantined *int          `json:"quarantined,omitempty"`
+	Healthy     *int          `json:"healthy,omitempty"`
+	Slowest     []slowestStep `json:"slowest,omitempty"`
+	Reason      string        `json:"reason,omitempty"`
+	Failing     []string      `json:"failing,omitempty"`
+}
+
+// 'slowestStep' type represents one of an iteration's slowest customers
+type slowestStep struct {
+	Customer   string `json:"customer"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// 'iterationSummary' type represents the outcome of one iteration on a firewall
+type iterationSummary struct {
+	firewall  string
+	iteration int
+	duration  time.Duration
+	counts    map[string]int // by result
+	slowest   []stepResult
+}
+
+// 'stepResult' type represents the outcome of one refresh step
+type stepResult struct {
+	step     refreshStep
+	firewall string
+	result   string
+	err      error
+	duration time.Duration
+}
+
+// Switch output to NDJSON events on stdout, moving human output to stderr
+func enableNDJSON() {
+	outputFormat = "ndjson"
+	humanOut = os.Stderr
+}
+
+// Write one event line when NDJSON output is enabled, and forward it to Splunk
+func emit(e ndjsonEvent) {
+	now := time.Now().UTC()
+	e.Time = now.Format(time.RFC3339Nano)
+	splunkEvent(now, e)
+	publishEvent(e)
+	if outputFormat != "ndjson" {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	outputMu.Lock()
+	os.Stdout.Write(append(b, '\n'))
+	outputMu.Unlock()
+}
+
+// Subscribe to events until cancel is called
+func subscribeEvents() (events <-chan ndjsonEvent, cancel func()) {
+	ch := make(chan ndjsonEvent, 256)
+	watchMu.Lock()
+	watchers[ch] = true
+	watchMu.Unlock()
+	return ch, func() {
+		watchMu.Lock()
+		delete(watchers, ch)
+		watchMu.Unlock()
+	}
+}
+
+// Hand an event to every subscriber, dropping it for those that fell behind
+func publishEvent(e ndjsonEvent) {
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	for ch := range watchers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Emit the start of a refresh step
+func emitRefreshStart(firewall string, step refreshStep) {
+	cmds := make([]string, len(step.cmds))
+	for i, c := range step.cmds {
+		cmds[i] = c.String()
+	}
+	emit(ndjsonEvent{Event: evRefreshStart, Firewall: firewall, Customer: step.customer, Kind: step.kind, Commands: cmds})
+}
+
+// Emit the result of a refresh step
+func emitRefreshResult(r stepResult) {
+	e := ndjsonEvent{
+		Event:      evRefreshResult,
+		Firewall:   r.firewall,
+		Customer:   r.step.customer,
+		Kind:       r.step.kind,
+		Result:     r.result,
+		DurationMS: r.duration.Milliseconds(),
+	}
+	if r.err != nil {
+		e.Error = r.err.Error()
+	}
+	emit(e)
+	recordHistory(r)
+}
+
+// Summarize an iteration's step results
+func summarizeIteration(firewall string, iteration int, results []stepResult, duration time.Duration) iterationSummary {
+	sum := iterationSummary{firewall: firewall, iteration: iteration, duration: duration, counts: map[string]int{}}
+	var ran []stepResult
+	for _, r := range results {
+		sum.counts[r.result]++
+		if r.step.customer != "" && r.duration > 0 {
+			ran = append(ran, r)
+		}
+	}
+	sort.SliceStable(ran, func(i, j int) bool { return ran[i].duration > ran[j].duration })
+	if len(ran) > slowestCustomers {
+		ran = ran[:slowestCustomers]
+	}
+	sum.slowest = ran
+	return sum
+}
+
+// One-line summary for the log
+func (s iterationSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Iteration # %d on %s complete in %v: %d succeeded, %d failed, %d sent, %d skipped, %d quarantined, %d healthy",
+		s.iteration, s.firewall, s.duration.Round(time.Millisecond), s.counts[resultSuccess], s.counts[resultFailed],
+		s.counts[resultSent], s.counts[resultSkipped], s.counts[resultQuarantined], s.counts[resultHealthy])
+	for i, r := range s.slowest {
+		if i == 0 {
+			b.WriteString("; slowest: ")
+		} else {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s (%v)", r.step.customer, r.duration.Round(time.Millisecond))
+	}
+	return b.String()
+}
+
+// Emit the iteration summary
+func emitIterationSummary(s iterationSummary) {
+	count := func(result string) *int {
+		n := s.counts[result]
+		return &n
+	}
+	e := ndjsonEvent{
+		Event:       evIterationSummary,
+		Iteration:   s.iteration,
+		Firewall:    s.firewall,
+		DurationMS:  s.duration.Milliseconds(),
+		Succeeded:   count(resultSuccess),
+		Failed:      count(resultFailed),
+		Sent:        count(resultSent),
+		Skipped:     count(resultSkipped),
+		Quarantined: count(resultQuarantined),
+		Healthy:     count(resultHealthy),
+	}
+	for _, r := range s.slowest {
+		e.Slowest = append(e.Slowest, slowestStep{Customer: r.step.customer, DurationMS: r.duration.Milliseconds()})
+	}
+	emit(e)
+}
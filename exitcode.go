@@ -0,0 +1,42 @@
+/*
+ * Filename: exitcode.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Exit codes wrappers and CI pipelines can branch on.
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Daemon exit codes; --once runs end with exitOK or exitPartial when nothing else went wrong
+const (
+	exitOK           = 0
+	exitFailure      = 1 // anything else, e.g. a second signal or the resource cap
+	exitPartial      = 2 // the iteration finished but some customers failed
+	exitConfig       = 3 // bad flags, configuration or missing credentials
+	exitAuth         = 4 // a firewall rejected the credentials
+	exitConnectivity = 5 // a firewall couldn't be reached or the connection was lost
+)
+
+// Whether a firewall rejected the credentials, over SSH or the XML API
+func isAuthError(err error) bool {
+	if errors.Is(err, errAPIForbidden) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "unable to authenticate") || strings.Contains(msg, "Invalid Credential")
+}
+
+// Exit code for a failed connection to a firewall
+func connectExitCode(err error) int {
+	if isAuthError(err) {
+		return exitAuth
+	}
+	return exitConnectivity
+}
@@ -0,0 +1,25 @@
+/*
+ * Filename: globalprotect.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: GlobalProtect component restarts for entries of type 'globalprotect'.
+ */
+
+package main
+
+// Palo commands to restart GlobalProtect components, by component.
+// These restart the process for every gateway/portal on the firewall and disconnect active users.
+var globalProtectCommands = map[string]opCommand{
+	"gateway": {path: "debug software restart process", arg: "rasmgr"},
+	"portal":  {path: "debug software restart process", arg: "sslvpn-web-server"},
+}
+
+// GlobalProtect component to restart, defaulting to the gateway
+func (c customer) gpComponent() string {
+	if c.GPComponent == "" {
+		return "gateway"
+	}
+	return c.GPComponent
+}
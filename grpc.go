@@ -0,0 +1,262 @@
+/*
+ * Filename: grpc.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: gRPC control-plane API of 'tfresh serve', with streaming refresh progress.
+ */
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative api/v1/tfresh.proto
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	tfreshv1 "tfresh/api/v1"
+)
+
+// 'grpcServer' type represents the gRPC face of the 'tfresh serve' API
+type grpcServer struct {
+	tfreshv1.UnimplementedTfreshServer
+	api *apiServer
+}
+
+// Check the bearer token in the request metadata, when one is required
+func (g *grpcServer) authorize(ctx context.Context) error {
+	if g.api.token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(v, "Bearer ")), []byte(g.api.token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong bearer token")
+}
+
+// Start the gRPC listener in the background
+func startGRPCServer(addr string, api *apiServer) (*grpc.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	g := &grpcServer{api: api}
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, h grpc.UnaryHandler) (any, error) {
+			if err := g.authorize(ctx); err != nil {
+				return nil, err
+			}
+			logger.Info("gRPC "+info.FullMethod, "method", info.FullMethod)
+			return h(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+			if err := g.authorize(ss.Context()); err != nil {
+				return err
+			}
+			logger.Info("gRPC "+info.FullMethod, "method", info.FullMethod)
+			return h(srv, ss)
+		}),
+	)
+	tfreshv1.RegisterTfreshServer(srv, g)
+	logger.Info(fmt.Sprintf("Serving gRPC on %s", ln.Addr()), "addr", ln.Addr().String())
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			logger.Error(fmt.Sprint("gRPC listener: ", err), "error", err)
+		}
+	}()
+	return srv, nil
+}
+
+// Map selection errors to gRPC codes
+func grpcError(err error) error {
+	if errors.Is(err, errNoCustomer) || errors.Is(err, errNoFirewall) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Timestamp, nil for the zero time
+func protoTime(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func (r serveResult) proto() *tfreshv1.RefreshResult {
+	return &tfreshv1.RefreshResult{
+		Customer:   r.Customer,
+		Firewall:   r.Firewall,
+		Result:     r.Result,
+		Error:      r.Error,
+		DurationMs: r.DurationMS,
+		Time:       protoTime(r.Time),
+	}
+}
+
+func refreshResponse(results []serveResult, errs map[string]string) *tfreshv1.RefreshResponse {
+	resp := &tfreshv1.RefreshResponse{Errors: errs}
+	for _, r := range results {
+		resp.Results = append(resp.Results, r.proto())
+	}
+	return resp
+}
+
+func (g *grpcServer) RefreshCustomer(ctx context.Context, req *tfreshv1.RefreshCustomerRequest) (*tfreshv1.RefreshResponse, error) {
+	if req.Customer == "" {
+		return nil, status.Error(codes.InvalidArgument, "customer is required")
+	}
+	selected, err := g.api.selectCustomers(g.api.envs, []string{req.Customer})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	results, errs := g.api.refreshSelected(selected)
+	for env, msg := range errs {
+		return nil, status.Errorf(codes.Unavailable, "%s: %s", env, msg)
+	}
+	return refreshResponse(results, nil), nil
+}
+
+func (g *grpcServer) RefreshAll(ctx context.Context, req *tfreshv1.RefreshAllRequest) (*tfreshv1.RefreshResponse, error) {
+	envs, err := g.api.selectEnvs(req.Firewall)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	selected, _ := g.api.selectCustomers(envs, nil)
+	return refreshResponse(g.api.refreshSelected(selected)), nil
+}
+
+func (g *grpcServer) GetStatus(ctx context.Context, req *tfreshv1.GetStatusRequest) (*tfreshv1.GetStatusResponse, error) {
+	statuses, err := g.api.statuses()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := &tfreshv1.GetStatusResponse{}
+	for _, cs := range statuses {
+		p := &tfreshv1.CustomerStatus{Customer: cs.Customer, Environment: cs.Environment, Firewall: cs.Firewall}
+		if cs.LastRefreshed != nil {
+			p.LastRefreshed = protoTime(*cs.LastRefreshed)
+		}
+		if cs.Quarantined != nil {
+			p.Quarantined, p.QuarantineReason = true, cs.Quarantined.Reason
+		}
+		if cs.LastResult != nil {
+			p.LastResult = cs.LastResult.proto()
+		}
+		resp.Customers = append(resp.Customers, p)
+	}
+	return resp, nil
+}
+
+func (g *grpcServer) ListCustomers(ctx context.Context, req *tfreshv1.ListCustomersRequest) (*tfreshv1.ListCustomersResponse, error) {
+	resp := &tfreshv1.ListCustomersResponse{}
+	for _, c := range g.api.allCustomers() {
+		resp.Customers = append(resp.Customers, &tfreshv1.Customer{
+			Name:        c.Name,
+			Description: c.Description,
+			Gateway:     c.Gateway,
+			Tunnel:      c.Tunnel,
+			Peer:        c.Peer,
+			Tags:        c.Tags,
+			Firewall:    c.Firewall,
+			Type:        c.Type,
+		})
+	}
+	return resp, nil
+}
+
+// Refresh customers, forwarding each one's start and result events as the refresh emits them
+func (g *grpcServer) WatchRefresh(req *tfreshv1.WatchRefreshRequest, stream tfreshv1.Tfresh_WatchRefreshServer) error {
+	envs, err := g.api.selectEnvs(req.Firewall)
+	if err != nil {
+		return grpcError(err)
+	}
+	selected, err := g.api.selectCustomers(envs, req.Customers)
+	if err != nil {
+		return grpcError(err)
+	}
+	// Only this request's customers; other clients may be refreshing the same firewalls
+	watched := map[string]bool{}
+	for env, customers := range selected {
+		for _, c := range customers {
+			watched[firewalls[env]+"\x00"+c.Name] = true
+		}
+	}
+
+	events, cancel := subscribeEvents()
+	defer cancel()
+	type outcome struct {
+		results []serveResult
+		errs    map[string]string
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		results, errs := g.api.refreshSelected(selected)
+		done <- outcome{results, errs}
+	}()
+
+	send := func(e ndjsonEvent) error {
+		if !watched[e.Firewall+"\x00"+e.Customer] {
+			return nil
+		}
+		ev := &tfreshv1.RefreshEvent{Firewall: e.Firewall, Customer: e.Customer, Time: timestamppb.Now()}
+		switch e.Event {
+		case evRefreshStart:
+			ev.Type, ev.Commands = tfreshv1.RefreshEvent_REFRESH_START, e.Commands
+		case evRefreshResult:
+			ev.Type = tfreshv1.RefreshEvent_REFRESH_RESULT
+			ev.Result = &tfreshv1.RefreshResult{Customer: e.Customer, Firewall: e.Firewall, Result: e.Result, Error: e.Error, DurationMs: e.DurationMS, Time: ev.Time}
+		default:
+			return nil
+		}
+		return stream.Send(ev)
+	}
+
+	for {
+		select {
+		case e := <-events:
+			if err := send(e); err != nil {
+				return err
+			}
+		case out := <-done:
+			// Results are published before the refresh returns; flush what is queued
+			for len(events) > 0 {
+				if err := send(<-events); err != nil {
+					return err
+				}
+			}
+			ev := &tfreshv1.RefreshEvent{Type: tfreshv1.RefreshEvent_DONE, Time: timestamppb.Now()}
+			for env, msg := range out.errs {
+				ev.Error += fmt.Sprintf("%s: %s; ", env, msg)
+			}
+			ev.Error = strings.TrimSuffix(ev.Error, "; ")
+			// Quarantined customers never start, so they only appear here
+			for _, r := range out.results {
+				if r.Result == resultSkipped {
+					if err := stream.Send(&tfreshv1.RefreshEvent{Type: tfreshv1.RefreshEvent_REFRESH_RESULT, Firewall: r.Firewall, Customer: r.Customer, Result: r.proto(), Time: ev.Time}); err != nil {
+						return err
+					}
+				}
+			}
+			return stream.Send(ev)
+		case <-stream.Context().Done():
+			// The refresh carries on without a watcher
+			return stream.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Filename: ha.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Finds the active member of an HA pair and follows failovers between iterations.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Palo command showing the member's HA state
+var showHAState = opCommand{path: "show high-availability state"}
+
+// The HA state test commands take effect in
+const haActive = "active"
+
+var (
+	// 'State: active (last 3 days)' under 'Local Information:' in the CLI output
+	haStateRE = regexp.MustCompile(`(?s)Local Information:.*?State:\s*([\w-]+)`)
+
+	// <local-info><state>active</state> in the XML API result
+	haStateXMLRE = regexp.MustCompile(`(?s)<local-info>.*?<state>([^<]+)</state>`)
+)
+
+// Local HA state in 'show high-availability state' output; empty when HA is not enabled
+func parseHAState(out string) string {
+	if m := haStateRE.FindStringSubmatch(out); m != nil {
+		return strings.ToLower(m[1])
+	}
+	if m := haStateXMLRE.FindStringSubmatch(out); m != nil {
+		return strings.ToLower(strings.TrimSpace(m[1]))
+	}
+	return ""
+}
+
+// Query a member's HA state over SSH
+func cliHAState(client *ssh.Client) (string, error) {
+	cli, err := openCLI(client)
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+	out, err := cli.exec(showHAState.String(), promptTimeout)
+	return parseHAState(out), err
+}
+
+// Explain why a member isn't refreshed
+func notActive(member, state string) error {
+	if state == "" {
+		return fmt.Errorf("%s: HA is not enabled", member)
+	}
+	return fmt.Errorf("%s is %s", member, state)
+}
+
+// The firewall's HA members, the one last found active first
+func (sc *scheduler) members() []string {
+	peer := haPeers[sc.firewall]
+	if sc.member == peer {
+		return []string{peer, sc.firewall}
+	}
+	return []string{sc.firewall, peer}
+}
+
+// Record the active member, reporting failovers
+func (sc *scheduler) setMember(member string) {
+	if sc.member != "" && sc.member != member {
+		notify(event{Type: "ha_failover", Severity: sevWarning, Firewall: sc.firewall,
+			Message: fmt.Sprintf("HA failover: %s is now active instead of %s", member, sc.member)})
+	}
+	if sc.member != member {
+		logger.Info(fmt.Sprintf("Refreshing %s through its active HA member %s", sc.firewall, member), "firewall", sc.firewall, "member", member)
+	}
+	sc.member = member
+}
+
+// Dial the firewall or, when it has an HA peer, whichever member is active
+func (sc *scheduler) dialActive() (*ssh.Client, error) {
+	user, pass := sc.credentials()
+	if haPeers[sc.firewall] == "" {
+		return dialFirewall(sc.firewall, user, pass)
+	}
+	var errs []error
+	for _, m := range sc.members() {
+		client, err := dialFirewall(m, user, pass)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		state, err := cliHAState(client)
+		if err == nil && state == haActive {
+			sc.setMember(m)
+			return client, nil
+		}
+		client.Close()
+		if err == nil {
+			err = notActive(m, state)
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("no active HA member: %w", errors.Join(errs...))
+}
+
+// Whether the connected HA member stopped being active since the last iteration.
+// Failed queries are left to the keepalives.
+func (sc *scheduler) failedOver() bool {
+	if haPeers[sc.firewall] == "" {
+		return false
+	}
+	sc.mu.Lock()
+	client := sc.client
+	sc.mu.Unlock()
+	state, err := cliHAState(client)
+	if err != nil || state == haActive {
+		return false
+	}
+	logger.Warn(fmt.Sprintf("%s: %v, switching HA members", sc.firewall, notActive(sc.member, state)), "firewall", sc.firewall, "member", sc.member, "state", state)
+	return true
+}
+
+// Point the api transport at the active HA member. Panorama targets are left to Panorama.
+func (sc *scheduler) ensureActiveAPI() error {
+	if haPeers[sc.firewall] == "" || sc.api.target != "" {
+		return nil
+	}
+	var errs []error
+	for _, m := range sc.members() {
+		api := sc.api
+		if api.host != m {
+			api = newAPIClient(m, sc.api.apiKey())
+			if sc.api.user != "" {
+				if err := api.login(sc.api.user, sc.api.pass); err != nil {
+					errs = append(errs, err)
+					continue
+				}
+			}
+		}
+		out, err := api.op(showHAState)
+		state := parseHAState(out)
+		if err == nil && state == haActive {
+			sc.api = api
+			sc.setMember(m)
+			return nil
+		}
+		if err == nil {
+			err = notActive(m, state)
+		}
+		errs = append(errs, err)
+	}
+	return fmt.Errorf("no active HA member: %w", errors.Join(errs...))
+}
@@ -0,0 +1,105 @@
+/*
+ * Filename: health.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Skips customers whose IKE and IPsec SAs are already established.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Refresh every customer, even those whose tunnels are up
+var forceRefresh bool
+
+// Palo commands to show the SAs of one gateway or tunnel
+var (
+	showIKESA   = opCommand{path: "show vpn ike-sa gateway"}
+	showIPsecSA = opCommand{path: "show vpn ipsec-sa tunnel"}
+)
+
+// Whether 'show vpn ike-sa gateway' output lists an SA
+func ikeSAUp(out string) bool {
+	return len(parseTable(out)) > 0
+}
+
+// Whether 'show vpn ipsec-sa tunnel' output lists an SA for the tunnel
+func ipsecSAUp(out, tunnel string) bool {
+	sas, err := parseIPsecSAs(out)
+	_, ok := sas[tunnel]
+	return err == nil && ok
+}
+
+// Split tunnel steps into those needing a refresh and those whose SAs are all established.
+// A failed probe counts as down, so a flaky check never prevents a refresh.
+func (sc *scheduler) skipHealthy(steps []refreshStep, log *blockLog) (down, healthy []refreshStep) {
+	probe, done, err := sc.saProbe()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("SA check on %s failed, refreshing every customer: %v", sc.firewall, err), "firewall", sc.firewall, "error", err)
+		return steps, nil
+	}
+	defer done()
+
+	for _, step := range steps {
+		c, ok := sc.customer(step.customer)
+		if step.kind != stepTunnel || !ok || (c.Gateway == "" && c.Tunnel == "") {
+			down = append(down, step)
+			continue
+		}
+		up, err := probe(c)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("SA check for %s failed: %v", c.Name, err), "firewall", sc.firewall, "customer", c.Name, "error", err)
+		} else {
+			stateMu.Lock()
+			sc.st.recordSA(sc.firewall, c.Name, up)
+			stateMu.Unlock()
+		}
+		if !up {
+			down = append(down, step)
+			continue
+		}
+		healthy = append(healthy, step)
+	}
+	if len(healthy) > 0 {
+		log.Printf("Skipping %d customers with established SAs on %s", len(healthy), sc.firewall)
+	}
+	return down, healthy
+}
+
+// Probe for a customer's SAs over the scheduler's transport
+func (sc *scheduler) saProbe() (probe func(customer) (bool, error), done func(), err error) {
+	if sc.api != nil {
+		// The XML API lists SAs as <entry> elements
+		probe = func(c customer) (bool, error) {
+			if c.Gateway != "" {
+				out, err := sc.api.op(showIKESA.with(c.Gateway))
+				if err != nil || !strings.Contains(out, "<entry") {
+					return false, err
+				}
+			}
+			if c.Tunnel != "" {
+				out, err := sc.api.op(showIPsecSA.with(c.Tunnel))
+				if err != nil || !strings.Contains(out, "<entry") {
+					return false, err
+				}
+			}
+			return true, nil
+		}
+		return probe, func() {}, nil
+	}
+
+	drv := driverFor(sc.firewall)
+	cli, err := drv.Connect(sc.client)
+	if err != nil {
+		return nil, nil, err
+	}
+	probe = func(c customer) (bool, error) {
+		return drv.Status(cli, c)
+	}
+	return probe, func() { cli.Close() }, nil
+}
@@ -0,0 +1,47 @@
+/*
+ * Filename: heartbeat.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Dead man's switch pings (healthchecks.io, Dead Man's Snitch) around each iteration.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// Heartbeat URL; '{firewall}' is replaced per firewall. Empty disables pings
+	heartbeatURL = ""
+
+	// Also ping '<url>/start' and '<url>/fail' (healthchecks.io style)
+	heartbeatStart = true
+)
+
+// Timeout for one ping
+const heartbeatTimeout = 10 * time.Second
+
+// Ping the heartbeat URL; suffix is "", "/start" or "/fail"
+func heartbeat(firewall, suffix string) {
+	if heartbeatURL == "" || (suffix != "" && !heartbeatStart) {
+		return
+	}
+	u := strings.ReplaceAll(heartbeatURL, "{firewall}", firewall)
+	u = strings.TrimRight(u, "/") + suffix
+	client := http.Client{Timeout: heartbeatTimeout}
+	resp, err := client.Get(u)
+	if err != nil {
+		logger.Warn(fmt.Sprint("heartbeat: ", err), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logger.Warn(fmt.Sprintf("heartbeat: %s returned %s", u, resp.Status), "status", resp.StatusCode)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * Filename: history.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: SQLite history of every refresh attempt, queried with 'tfresh history'.
+ */
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLite database refresh attempts are recorded to; empty disables it
+var historyDB = os.Getenv("TFRESH_HISTORY_DB")
+
+var (
+	historyMu sync.Mutex
+	history   *sql.DB
+)
+
+// One row per refresh attempt, retries included
+const historySchema = `
+CREATE TABLE IF NOT EXISTS refreshes (
+	id          INTEGER PRIMARY KEY,
+	time        TEXT NOT NULL,
+	firewall    TEXT NOT NULL,
+	customer    TEXT NOT NULL,
+	kind        TEXT NOT NULL,
+	commands    TEXT NOT NULL,
+	result      TEXT NOT NULL,
+	error       TEXT NOT NULL DEFAULT '',
+	duration_ms INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS refreshes_time ON refreshes (time);
+CREATE INDEX IF NOT EXISTS refreshes_customer ON refreshes (customer, time);
+`
+
+// Times are stored as UTC RFC 3339 so they sort and compare as text
+const historyTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// 'historyEntry' type represents one recorded refresh attempt
+type historyEntry struct {
+	Time       time.Time `json:"time"`
+	Firewall   string    `json:"firewall"`
+	Customer   string    `json:"customer"`
+	Kind       string    `json:"kind"`
+	Commands   []string  `json:"commands"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Open the history database, creating it and its table if needed
+func openHistory(filename string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", filename)
+	if err != nil {
+		return nil, err
+	}
+	// One writer at a time; concurrent schedulers wait for the lock instead of failing
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec("PRAGMA busy_timeout = 5000"); err == nil {
+		_, err = db.Exec(historySchema)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return db, nil
+}
+
+// Start recording to -history-db, exiting when it can't be opened
+func enableHistory() {
+	if historyDB == "" {
+		return
+	}
+	db, err := openHistory(historyDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]: history database:", err)
+		os.Exit(1)
+	}
+	historyMu.Lock()
+	history = db
+	historyMu.Unlock()
+}
+
+// Record a refresh attempt. Failures are logged; the history never stops a refresh.
+func recordHistory(r stepResult) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if history == nil || r.step.customer == "" {
+		return
+	}
+	cmds := make([]string, len(r.step.cmds))
+	for i, c := range r.step.cmds {
+		cmds[i] = c.String()
+	}
+	errText := ""
+	if r.err != nil {
+		errText = r.err.Error()
+	}
+	started := time.Now().Add(-r.duration).UTC()
+	_, err := history.Exec("INSERT INTO refreshes (time, firewall, customer, kind, commands, result, error, duration_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		started.Format(historyTimeFormat), r.firewall, r.step.customer, r.step.kind, strings.Join(cmds, "\n"), r.result, errText, r.duration.Milliseconds())
+	if err != nil {
+		logger.Warn(fmt.Sprint("history database: ", err), "firewall", r.firewall, "customer", r.step.customer, "error", err)
+	}
+}
+
+// 'historyQuery' type represents the filters of 'tfresh history'
+type historyQuery struct {
+	customer, firewall, result string
+	since, until               time.Time
+	limit                      int
+}
+
+// Return the matching attempts, newest first
+func queryHistory(db *sql.DB, q historyQuery) ([]historyEntry, error) {
+	where, args := []string{"1 = 1"}, []any{}
+	if q.customer != "" {
+		where, args = append(where, "customer = ? COLLATE NOCASE"), append(args, normalizeName(q.customer))
+	}
+	if q.firewall != "" {
+		where, args = append(where, "firewall = ?"), append(args, q.firewall)
+	}
+	if q.result != "" {
+		where, args = append(where, "result = ?"), append(args, q.result)
+	}
+	if !q.since.IsZero() {
+		where, args = append(where, "time >= ?"), append(args, q.since.UTC().Format(historyTimeFormat))
+	}
+	if !q.until.IsZero() {
+		where, args = append(where, "time < ?"), append(args, q.until.UTC().Format(historyTimeFormat))
+	}
+	query := "SELECT time, firewall, customer, kind, commands, result, error, duration_ms FROM refreshes WHERE " +
+		strings.Join(where, " AND ") + " ORDER BY time DESC, id DESC"
+	if q.limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", q.limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []historyEntry
+	for rows.Next() {
+		var e historyEntry
+		var ts, cmds string
+		if err = rows.Scan(&ts, &e.Firewall, &e.Customer, &e.Kind, &cmds, &e.Result, &e.Error, &e.DurationMS); err != nil {
+			return nil, err
+		}
+		if e.Time, err = time.Parse(historyTimeFormat, ts); err != nil {
+			return nil, fmt.Errorf("bad time %q in history: %w", ts, err)
+		}
+		e.Commands = []string{}
+		if cmds != "" {
+			e.Commands = strings.Split(cmds, "\n")
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Parse a -since/-until value: a duration back from now, a date or an RFC 3339 time
+func parseHistoryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q: want a duration (e.g. 24h), a date (2006-01-02) or an RFC 3339 time", value)
+}
+
+// Handle 'tfresh history'
+func historyCommand(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	fs.StringVar(&historyDB, "db", historyDB, "History database written by -history-db (default $TFRESH_HISTORY_DB)")
+	var q historyQuery
+	fs.StringVar(&q.customer, "customer", "", "Only this customer")
+	fs.StringVar(&q.firewall, "firewall", "", "Only this firewall host")
+	fs.StringVar(&q.result, "result", "", "Only this result (success, failed, sent)")
+	since := fs.String("since", "", "Only attempts since this time, e.g. 24h, 2023-06-01 or 2023-06-01T14:00:00Z")
+	until := fs.String("until", "", "Only attempts before this time, in the same formats as -since")
+	fs.IntVar(&q.limit, "limit", 100, "Most attempts to show; 0 shows all")
+	jsonOut := fs.Bool("json", false, "Print the attempts as a JSON array")
+	fs.Parse(args)
+
+	var err error
+	if q.since, err = parseHistoryTime(*since); err == nil {
+		q.until, err = parseHistoryTime(*until)
+	}
+	if err == nil && historyDB == "" {
+		err = errors.New("no history database, set -db or $TFRESH_HISTORY_DB")
+	}
+	if err == nil {
+		_, err = os.Stat(historyDB)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+
+	db, err := openHistory(historyDB)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+	entries, err := queryHistory(db, q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+
+	if *jsonOut {
+		if entries == nil {
+			entries = []historyEntry{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return
+	}
+	if len(entries) == 0 {
+		fmt.Println("No refresh attempts recorded.")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tCUSTOMER\tFIREWALL\tRESULT\tDURATION\tCOMMANDS")
+	for _, e := range entries {
+		detail := strings.Join(e.Commands, "; ")
+		if e.Error != "" {
+			detail += " (" + strings.ReplaceAll(e.Error, "\n", "; ") + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%v\t%s\n", e.Time.Local().Format(time.RFC3339), e.Customer, e.Firewall, e.Result,
+			time.Duration(e.DurationMS)*time.Millisecond, detail)
+	}
+	tw.Flush()
+}
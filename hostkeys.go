@@ -0,0 +1,135 @@
+/*
+ * Filename: hostkeys.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Firewall host key verification against a known_hosts file.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	// known_hosts file checked on every SSH connection; host keys aren't verified when empty
+	knownHostsFile string
+
+	// Trust and record the key of a host missing from the known_hosts file
+	knownHostsTOFU bool
+
+	// Serializes known_hosts updates across schedulers
+	knownHostsMu sync.Mutex
+)
+
+// Host key check used for firewall SSH connections
+func hostKeyCallback() ssh.HostKeyCallback {
+	if knownHostsFile == "" {
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return verifyHostKey
+}
+
+// Whether a connection failed host key verification, which no retry or other address fixes
+func isHostKeyError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "HOST KEY CHANGED") || strings.Contains(msg, "unknown host key") ||
+		strings.Contains(msg, "known hosts:") || strings.Contains(msg, "host key mismatch")
+}
+
+// Host key algorithms to negotiate with addr: those of the keys the known_hosts file has for it,
+// so a firewall with several host keys presents the one that verifies. Nil, letting the firewall
+// choose, when host keys aren't verified or the host isn't known yet
+func hostKeyAlgorithms(addr string) []string {
+	if knownHostsFile == "" {
+		return nil
+	}
+	knownHostsMu.Lock()
+	check, err := knownhosts.New(knownHostsFile)
+	knownHostsMu.Unlock()
+	if err != nil {
+		return nil
+	}
+
+	// A key of a type no entry has makes the check list every known key for the host
+	var keyErr *knownhosts.KeyError
+	if !errors.As(check(addr, &net.TCPAddr{IP: net.IPv4zero}, unknownKeyType{}), &keyErr) {
+		return nil
+	}
+	var algos []string
+	for _, known := range keyErr.Want {
+		switch typ := known.Key.Type(); typ {
+		case ssh.KeyAlgoRSA:
+			// An RSA key signs with any of its algorithms; prefer the SHA-2 ones
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algos = append(algos, typ)
+		}
+	}
+	return algos
+}
+
+// 'unknownKeyType' type represents a public key matching no known_hosts entry
+type unknownKeyType struct{}
+
+func (unknownKeyType) Type() string                        { return "tfresh-unknown-key-type" }
+func (unknownKeyType) Marshal() []byte                     { return []byte("tfresh-unknown-key-type") }
+func (unknownKeyType) Verify([]byte, *ssh.Signature) error { return errors.New("unknown key type") }
+
+// Check a host key against the known_hosts file, recording it on first connect in TOFU mode
+func verifyHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	// Reloaded on every connection so keys recorded by other schedulers are seen
+	check, err := knownhosts.New(knownHostsFile)
+	if errors.Is(err, os.ErrNotExist) && knownHostsTOFU {
+		check, err = func(string, net.Addr, ssh.PublicKey) error {
+			return &knownhosts.KeyError{}
+		}, nil
+	}
+	if err != nil {
+		return fmt.Errorf("known hosts: %w", err)
+	}
+
+	err = check(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+	if len(keyErr.Want) > 0 {
+		want := keyErr.Want[0]
+		return fmt.Errorf("HOST KEY CHANGED for %s: got %s %s, but %s:%d has %s; possible man-in-the-middle, remove the old entry only if the firewall was rebuilt",
+			hostname, key.Type(), ssh.FingerprintSHA256(key), want.Filename, want.Line, ssh.FingerprintSHA256(want.Key))
+	}
+	if !knownHostsTOFU {
+		return fmt.Errorf("unknown host key for %s (%s %s); add it to %s or connect once with -known-hosts-tofu",
+			hostname, key.Type(), ssh.FingerprintSHA256(key), knownHostsFile)
+	}
+	return recordHostKey(hostname, key)
+}
+
+// Append a host key to the known_hosts file
+func recordHostKey(hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(knownHostsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("known hosts: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+		return fmt.Errorf("known hosts: %w", err)
+	}
+	logger.Warn(fmt.Sprintf("trusting new host key for %s (%s %s), recorded in %s", hostname, key.Type(), ssh.FingerprintSHA256(key), knownHostsFile),
+		"host", hostname, "fingerprint", ssh.FingerprintSHA256(key))
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Filename: hostkeys_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of host key verification against a known_hosts file.
+ */
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"tfresh/internal/mockpanos"
+)
+
+func TestHostKeyAlgorithmsFromKnownHosts(t *testing.T) {
+	srv, _ := startMock(t, mockpanos.Config{})
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := ssh.NewPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(edPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := knownHostsFile
+	knownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	t.Cleanup(func() { knownHostsFile = old })
+	lines := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr())}, rsaPub) + "\n" +
+		knownhosts.Line([]string{knownhosts.Normalize(srv.Addr())}, srv.HostKey()) + "\n" +
+		knownhosts.Line([]string{"fw2.example.com"}, otherKey) + "\n"
+	if err := os.WriteFile(knownHostsFile, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	got := hostKeyAlgorithms(srv.Addr())
+	slices.Sort(got)
+	want := []string{ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoED25519, ssh.KeyAlgoRSA}
+	if !slices.Equal(got, want) {
+		t.Errorf("known host: %v, want %v", got, want)
+	}
+	if got := hostKeyAlgorithms("fw3.example.com:22"); got != nil {
+		t.Errorf("unknown host: %v, want the firewall's choice", got)
+	}
+
+	// The handshake negotiates a known key type and verifies it
+	conn, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := sshHandshake(conn, srv.Addr(), &ssh.ClientConfig{
+		User:            "admin",
+		Auth:            authMethods("secret"),
+		HostKeyCallback: hostKeyCallback(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	knownHostsFile = ""
+	if got := hostKeyAlgorithms(srv.Addr()); got != nil {
+		t.Errorf("no known_hosts file: %v", got)
+	}
+}
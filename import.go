@@ -0,0 +1,187 @@
+/*
+ * Filename: import.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Generates customer entries from the tunnels configured on a firewall ('tfresh import').
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Common gateway/tunnel naming affixes stripped when guessing customer names
+var nameAffixes = []string{"ike-gw", "ikegw", "gateway", "gw", "ipsec", "tunnel", "tun", "vpn", "s2s"}
+
+// Guess a customer name from a gateway or tunnel object name, e.g. 'gw-acme-corp' -> 'Acme Corp'
+func guessCustomerName(object string) string {
+	words := strings.FieldsFunc(strings.ToLower(object), func(r rune) bool {
+		return r == '-' || r == '_' || r == '.' || r == ' '
+	})
+
+	isAffix := func(w string) bool {
+		for _, a := range nameAffixes {
+			if w == a {
+				return true
+			}
+		}
+		return false
+	}
+	for len(words) > 1 && isAffix(words[0]) {
+		words = words[1:]
+	}
+	for len(words) > 1 && isAffix(words[len(words)-1]) {
+		words = words[:len(words)-1]
+	}
+
+	for i, w := range words {
+		words[i] = strings.ToUpper(w[:1]) + w[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// Build customer entries for every tunnel, pairing each with its gateway
+func importCustomers(env string, gws []vpnGateway, tuns []vpnTunnel) []customer {
+	peers := map[string]string{}
+	for _, gw := range gws {
+		peers[gw.Name] = gw.Peer
+	}
+
+	var customers []customer
+	for _, t := range tuns {
+		// Tunnels with proxy IDs are listed as 'tunnel:proxy-id'
+		name, _, _ := strings.Cut(t.Name, ":")
+		c := customer{
+			Name:        guessCustomerName(t.Gateway),
+			Description: fmt.Sprintf("Imported from %s firewall", env),
+			Gateway:     t.Gateway,
+			Tunnel:      name,
+			Tags:        []string{"imported"},
+		}
+		if peer := peers[t.Gateway]; peer != "" && peer != "dynamic" {
+			c.Peer = peer
+		}
+		customers = append(customers, c)
+	}
+	return customers
+}
+
+// Drop customers already covered by a config, and duplicate tunnels
+func skipExisting(customers, existing []customer) []customer {
+	seen := map[string]bool{}
+	for _, c := range existing {
+		seen[c.Gateway+"\x00"+c.Tunnel] = true
+	}
+	var out []customer
+	for _, c := range customers {
+		k := c.Gateway + "\x00" + c.Tunnel
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		out = append(out, c)
+	}
+	return out
+}
+
+// Ask the operator to confirm or replace each guessed name
+func promptNames(customers []customer, in io.Reader, out io.Writer) {
+	r := bufio.NewReader(in)
+	for i := range customers {
+		fmt.Fprintf(out, "Customer name for %s / %s [%s]: ", customers[i].Gateway, customers[i].Tunnel, customers[i].Name)
+		line, _ := r.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			customers[i].Name = line
+		}
+	}
+}
+
+// Make guessed names unique so the output passes collision checks
+func dedupeNames(customers []customer) {
+	used := map[string]int{}
+	for i := range customers {
+		k := customers[i].key()
+		used[k]++
+		if used[k] > 1 {
+			customers[i].Name = fmt.Sprintf("%s %d", customers[i].Name, used[k])
+		}
+	}
+}
+
+// Handle 'tfresh import <source>'
+func importCommand(args []string) {
+	if len(args) == 0 || args[0] != "firewall" {
+		fmt.Fprintf(os.Stderr, "Usage: %s import firewall -e <env> [-o file] [-interactive]\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("import firewall", flag.ExitOnError)
+	fwEnv := fs.String("e", "", fmt.Sprintf("Firewall name (e.g. prod, test). Example: '%s import firewall -e prod'", os.Args[0]))
+	output := fs.String("o", "", "Write generated entries to this file instead of stdout")
+	interactive := fs.Bool("interactive", false, "Prompt for each customer name")
+	fs.StringVar(&configFile, "c", configFile, "Existing configuration; tunnels it already covers are skipped")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.Parse(args[1:])
+
+	if err := loadFirewalls(configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	firewall, ok := firewalls[*fwEnv]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown firewall environment %q.\n", *fwEnv)
+		fs.Usage()
+		os.Exit(1)
+	}
+	username, password := checkEnvVars()
+
+	cli, err := connectCLI(firewall, username, password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	gws, tuns, err := listVPN(cli)
+	cli.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	customers := importCustomers(*fwEnv, gws, tuns)
+	if existing, _, err := loadConfig(configFile); err == nil {
+		customers = skipExisting(customers, existing)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "[WARN]: not skipping existing customers:", err)
+	}
+	if *interactive {
+		promptNames(customers, os.Stdin, os.Stderr)
+	}
+	dedupeNames(customers)
+
+	fBytes, err := yaml.Marshal(customers)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if *output == "" {
+		os.Stdout.Write(fBytes)
+	} else if err = os.WriteFile(*output, fBytes, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d customers from %d gateways and %d tunnels on %s.\n", len(customers), len(gws), len(tuns), firewall)
+}
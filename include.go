@@ -0,0 +1,203 @@
+/*
+ * Filename: include.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Configuration split over several files: 'include:' directives and config directories.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Read a configuration source and every file it includes, merged into one document.
+// The returned bytes are what config versions record: the source itself, followed by
+// a comment naming each included file and its checksum, so editing any of them is a new version.
+func readConfigTree(filename string) (configDoc, []byte, error) {
+	m := &configMerge{origin: map[string]string{}, stack: map[string]bool{}}
+	doc, fBytes, err := m.load(filename)
+	if err != nil {
+		return doc, nil, err
+	}
+	if len(m.files) == 0 {
+		return doc, fBytes, nil
+	}
+	var b bytes.Buffer
+	b.Write(fBytes)
+	if len(fBytes) > 0 && fBytes[len(fBytes)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	for _, f := range m.files {
+		fmt.Fprintf(&b, "# included %s sha256:%x\n", f.name, f.sum)
+	}
+	return doc, b.Bytes(), nil
+}
+
+// Trailer line readConfigTree adds for each included file
+var includedLineRE = regexp.MustCompile(`(?m)^# included .+ sha256:[0-9a-f]{64}$`)
+
+// Report why a recorded config version can't stand in for the configuration on its own:
+// its content is only the main file when it was merged from includes or a directory
+func multiFileVersion(v configVersion) error {
+	if includedLineRE.Match(v.Content) {
+		return fmt.Errorf("config version %.12s was merged from several files (include: or -config-dir) and only records the main one; restore the files from version control", v.Hash)
+	}
+	return nil
+}
+
+// 'configMerge' type represents the files read while resolving includes
+type configMerge struct {
+	files  []includedFile
+	origin map[string]string // file each customer came from, by key
+	stack  map[string]bool   // files being loaded, to catch include cycles
+}
+
+// 'includedFile' type represents one file merged into the configuration
+type includedFile struct {
+	name string
+	sum  [sha256.Size]byte
+}
+
+// Load one source and, depth first, the files it includes. A directory includes its .yml and .yaml files.
+func (m *configMerge) load(filename string) (configDoc, []byte, error) {
+	var doc configDoc
+	dir := "."
+	if filename != envConfigName && !isRemoteConfig(filename) {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return doc, nil, err
+		}
+		if info.IsDir() {
+			var files []string
+			for _, ext := range []string{"*.yml", "*.yaml"} {
+				matches, err := expandInclude(filename, ext)
+				if err != nil {
+					return doc, nil, err
+				}
+				files = append(files, matches...)
+			}
+			sort.Strings(files)
+			return doc, nil, m.mergeAll(&doc, filename, files)
+		}
+		dir = filepath.Dir(filename)
+	}
+
+	fBytes, err := readConfigSource(filename)
+	if err != nil {
+		return doc, nil, err
+	}
+	if doc, err = parseConfigFile(filename, fBytes); err != nil {
+		return doc, nil, err
+	}
+	for _, c := range doc.Customers {
+		if err := m.claim(c, filename); err != nil {
+			return doc, nil, err
+		}
+	}
+	var files []string
+	for _, pattern := range doc.Include {
+		expand := expandInclude
+		if isRemoteConfig(filename) {
+			dir, expand = filename, resolveRemoteInclude
+		}
+		matches, err := expand(dir, pattern)
+		if err != nil {
+			return doc, nil, fmt.Errorf("include %q: %w", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+	doc.Include = nil
+	return doc, fBytes, m.mergeAll(&doc, filename, files)
+}
+
+// Merge the files a source includes, in order
+func (m *configMerge) mergeAll(doc *configDoc, filename string, files []string) error {
+	abs, _ := filepath.Abs(filename)
+	m.stack[abs] = true
+	defer delete(m.stack, abs)
+	for _, f := range files {
+		if err := m.merge(doc, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merge an included file into the document including it
+func (m *configMerge) merge(doc *configDoc, filename string) error {
+	abs, _ := filepath.Abs(filename)
+	if m.stack[abs] {
+		return fmt.Errorf("%s: include cycle", filename)
+	}
+	sub, fBytes, err := m.load(filename)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if fBytes != nil {
+		m.files = append(m.files, includedFile{name: filename, sum: sha256.Sum256(fBytes)})
+	}
+	// Notifications and credentials are set once, wherever they are
+	if sub.Notifications.SMTP != nil {
+		if doc.Notifications.SMTP != nil {
+			return fmt.Errorf("%s: notifications are already set by another file", filename)
+		}
+		doc.Notifications = sub.Notifications
+	}
+	if sub.Credentials != nil {
+		if doc.Credentials != nil {
+			return fmt.Errorf("%s: credentials are already set by another file", filename)
+		}
+		doc.Credentials = sub.Credentials
+	}
+	doc.Firewalls = append(doc.Firewalls, sub.Firewalls...)
+	doc.Customers = append(doc.Customers, sub.Customers...)
+	return checkNameCollisions(doc.Customers)
+}
+
+// Record where a customer is defined, reporting one defined in two files
+func (m *configMerge) claim(c customer, filename string) error {
+	if c.key() == "" {
+		return nil
+	}
+	if prev, ok := m.origin[c.key()]; ok && prev != filename {
+		return fmt.Errorf("customer %q in %s is also defined in %s", c.Name, filename, prev)
+	}
+	m.origin[c.key()] = filename
+	return nil
+}
+
+// Files an include pattern names, relative to the including file's directory, in lexical order.
+// A pattern without wildcards must match a file.
+func expandInclude(dir, pattern string) ([]string, error) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(dir, pattern)
+	}
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		return nil, fmt.Errorf("%s: %w", pattern, os.ErrNotExist)
+	}
+	sort.Strings(files)
+	var out []string
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil && info.Mode().IsRegular() {
+			out = append(out, f)
+		} else if errors.Is(err, os.ErrPermission) {
+			return nil, err
+		}
+	}
+	return out, nil
+}
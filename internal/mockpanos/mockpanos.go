@@ -0,0 +1,446 @@
+/*
+ * Filename: mockpanos.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: A mock PAN-OS SSH server speaking enough of the CLI to run tfresh against.
+ */
+
+// Package mockpanos serves an imitation PAN-OS operational CLI over SSH, so
+// configurations and tfresh itself can be exercised without a firewall. It
+// can answer slowly, reject logins and keep tunnels down.
+package mockpanos
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 'Config' type represents the mock firewall's behavior
+type Config struct {
+	Hostname     string                 // shown in the prompt, default PA-VM
+	Users        map[string]string      // username to password; empty accepts any login
+	Delay        time.Duration          // added before every response
+	RefreshDelay time.Duration          // added to 'test vpn' commands
+	Gateways     map[string]string      // IKE gateway name to peer address; empty accepts any name
+	Tunnels      map[string]string      // IPsec tunnel name to its gateway name; empty accepts any name
+	Down         []string               // gateways and tunnels whose SAs never come up
+	Routes       map[string][]string    // interface to the prefixes routed over it
+	HAState      string                 // 'show high-availability state', e.g. active; empty reports HA disabled
+	OnCommand    func(user, cmd string) // called for every command received
+}
+
+// 'Server' type represents a running mock firewall
+type Server struct {
+	config Config
+	signer ssh.Signer
+
+	mu         sync.Mutex
+	listener   net.Listener
+	up         map[string]bool // gateways and tunnels with SAs
+	down       map[string]bool
+	rejectAuth bool
+	logins     int
+	commands   []string
+	conns      map[net.Conn]bool
+	closed     bool
+}
+
+// Create a mock firewall with a fresh host key. Every configured gateway and tunnel
+// not listed as down starts with its SAs established.
+func New(config Config) (*Server, error) {
+	if config.Hostname == "" {
+		config.Hostname = "PA-VM"
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{config: config, signer: signer, up: map[string]bool{}, down: map[string]bool{}, conns: map[net.Conn]bool{}}
+	for _, name := range config.Down {
+		s.down[name] = true
+	}
+	for name := range config.Gateways {
+		s.up[name] = !s.down[name]
+	}
+	for name := range config.Tunnels {
+		s.up[name] = !s.down[name]
+	}
+	return s, nil
+}
+
+// Listen on addr, e.g. 127.0.0.1:0, and serve in the background
+func (s *Server) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	go s.Serve(l)
+	return nil
+}
+
+// Serve SSH connections on a listener until it is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	s.listener = l
+	s.mu.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// Address the server listens on, once Listen or Serve has started
+func (s *Server) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return ""
+	}
+	return s.listener.Addr().String()
+}
+
+// Public host key, for a known_hosts file
+func (s *Server) HostKey() ssh.PublicKey {
+	return s.signer.PublicKey()
+}
+
+// Stop listening and drop every connection
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// Take a gateway or tunnel down, clearing its SAs, or let it come back up with the next refresh
+func (s *Server) SetDown(name string, down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down[name] = down
+	if down {
+		s.up[name] = false
+	}
+}
+
+// Reject every login, as when the account is locked or the password changed
+func (s *Server) SetRejectAuth(reject bool) {
+	s.mu.Lock()
+	s.rejectAuth = reject
+	s.mu.Unlock()
+}
+
+// Password logins attempted so far, rejected or not
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+// Commands received so far, in order
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Check a password login
+func (s *Server) password(meta ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logins++
+	if s.rejectAuth {
+		return nil, errors.New("authentication failed")
+	}
+	if len(s.config.Users) == 0 {
+		return nil, nil
+	}
+	if want, ok := s.config.Users[meta.User()]; ok && want == string(pass) {
+		return nil, nil
+	}
+	return nil, errors.New("authentication failed")
+}
+
+// Check a key login: any key is accepted when any login is
+func (s *Server) publicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rejectAuth || len(s.config.Users) > 0 {
+		return nil, errors.New("authentication failed")
+	}
+	return nil, nil
+}
+
+// Serve one SSH connection's sessions
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	config := &ssh.ServerConfig{PasswordCallback: s.password, PublicKeyCallback: s.publicKey}
+	config.AddHostKey(s.signer)
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			// pty-req and shell are all a CLI session asks for
+			for r := range chReqs {
+				r.Reply(r.Type == "pty-req" || r.Type == "shell", nil)
+			}
+		}()
+		go s.shell(ch, sconn.User())
+	}
+}
+
+// Run the operational CLI on a session
+func (s *Server) shell(ch ssh.Channel, user string) {
+	defer ch.Close()
+	prompt := fmt.Sprintf("%s@%s> ", user, s.config.Hostname)
+	if s.config.HAState != "" {
+		prompt = fmt.Sprintf("%s@%s(%s)> ", user, s.config.Hostname, s.config.HAState)
+	}
+	fmt.Fprint(ch, "\r\nWelcome to the mock PAN-OS CLI\r\n\r\n"+prompt)
+
+	scanner := bufio.NewScanner(ch)
+	for scanner.Scan() {
+		cmd := strings.Join(strings.Fields(scanner.Text()), " ")
+		if cmd == "exit" || cmd == "quit" {
+			return
+		}
+		if cmd == "" {
+			fmt.Fprint(ch, prompt)
+			continue
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		s.mu.Unlock()
+		if s.config.OnCommand != nil {
+			s.config.OnCommand(user, cmd)
+		}
+
+		time.Sleep(s.config.Delay)
+		if strings.HasPrefix(cmd, "test ") {
+			time.Sleep(s.config.RefreshDelay)
+		}
+		out := s.run(cmd)
+		if out != "" && !strings.HasSuffix(out, "\n") {
+			out += "\n"
+		}
+		// Echo the command the way a terminal does, then the output and the next prompt
+		if _, err := io.WriteString(ch, cmd+"\r\n"+strings.ReplaceAll(out, "\n", "\r\n")+prompt); err != nil {
+			return
+		}
+	}
+}
+
+// Answer one command
+func (s *Server) run(cmd string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	arg := func(prefix string) string { return strings.TrimSpace(strings.TrimPrefix(cmd, prefix)) }
+
+	switch {
+	case cmd == "set cli pager off":
+		return ""
+	case cmd == "show clock":
+		return time.Now().UTC().Format("Mon Jan _2 15:04:05 MST 2006")
+	case cmd == "show high-availability state":
+		if s.config.HAState == "" {
+			return "HA not enabled"
+		}
+		return "Group 1:\n  Mode: Active-Passive\n  Local Information:\n    State: " + s.config.HAState + " (last 1 days)"
+
+	case strings.HasPrefix(cmd, "test vpn ike-sa gateway "):
+		return s.initiate(arg("test vpn ike-sa gateway"), s.config.Gateways, "IKE")
+	case strings.HasPrefix(cmd, "test vpn ipsec-sa tunnel "):
+		return s.initiate(arg("test vpn ipsec-sa tunnel"), s.config.Tunnels, "IPSec")
+	case cmd == "test vpn ike-sa":
+		return fmt.Sprintf("Initiate %d IKE SA.", s.initiateAll(s.config.Gateways))
+	case cmd == "test vpn ipsec-sa":
+		return fmt.Sprintf("Initiate %d IPSec SA.", s.initiateAll(s.config.Tunnels))
+	case strings.HasPrefix(cmd, "debug software restart process "):
+		return fmt.Sprintf("Process %s was restarted by user admin", arg("debug software restart process"))
+
+	case cmd == "show vpn gateway":
+		return s.gatewayTable()
+	case cmd == "show vpn tunnel":
+		return s.tunnelTable()
+	case strings.HasPrefix(cmd, "show vpn ike-sa gateway "):
+		return s.ikeSATable(arg("show vpn ike-sa gateway"))
+	case strings.HasPrefix(cmd, "show vpn ipsec-sa tunnel "):
+		return s.ipsecSATable(arg("show vpn ipsec-sa tunnel"))
+	case cmd == "show vpn ipsec-sa":
+		return s.ipsecSATable("")
+	case strings.HasPrefix(cmd, "show routing route interface "):
+		return s.routeTable(arg("show routing route interface"))
+	}
+	return fmt.Sprintf("Unknown command: %s", strings.Fields(cmd)[0])
+}
+
+// Jumpstart one gateway's or tunnel's SA
+func (s *Server) initiate(name string, known map[string]string, kind string) string {
+	if _, ok := known[name]; len(known) > 0 && !ok {
+		return fmt.Sprintf("Server error : %s %s not found", strings.ToLower(kind), name)
+	}
+	if s.down[name] {
+		return fmt.Sprintf("Initiate 0 %s SA.", kind)
+	}
+	s.up[name] = true
+	return fmt.Sprintf("Start time: %s\nInitiate 1 %s SA.", time.Now().Format("Jan.02 15:04:05"), kind)
+}
+
+// Jumpstart every SA, returning how many came up
+func (s *Server) initiateAll(known map[string]string) int {
+	n := 0
+	for name := range known {
+		if !s.down[name] {
+			s.up[name] = true
+			n++
+		}
+	}
+	return n
+}
+
+// Names of a map in order, so tables are stable
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 'show vpn gateway'
+func (s *Server) gatewayTable() string {
+	var b strings.Builder
+	b.WriteString("GwID      Name                 Peer-Address/ID      Local Address/ID     Protocol  Proposals\n")
+	b.WriteString("--------  ----                 ---------------      ----------------     --------  ---------\n")
+	for i, name := range sortedKeys(s.config.Gateways) {
+		fmt.Fprintf(&b, "%-9d %-20s %-20s %-20s %-9s %s\n", i+1, name, s.config.Gateways[name], "192.0.2.1", "IKEv2", "[PSK][DH14][AES128][SHA256]")
+	}
+	return b.String()
+}
+
+// 'show vpn tunnel'
+func (s *Server) tunnelTable() string {
+	var b strings.Builder
+	b.WriteString("TnID      Name                 Gateway              Local Proxy IP       Ptl:Port    Remote Proxy IP      Proposals\n")
+	b.WriteString("--------  ----                 -------              --------------       --------    ---------------      ---------\n")
+	for i, name := range sortedKeys(s.config.Tunnels) {
+		fmt.Fprintf(&b, "%-9d %-20s %-20s %-20s %-11s %-20s %s\n", i+1, name, s.config.Tunnels[name], "0.0.0.0/0", "0:0", "0.0.0.0/0", "[ESP][AES128][SHA256]")
+	}
+	return b.String()
+}
+
+// 'show vpn ike-sa gateway <name>', with a row only when the SA is up
+func (s *Server) ikeSATable(name string) string {
+	var b strings.Builder
+	b.WriteString("IKEv2 SAs\n")
+	b.WriteString("Gateway ID      Peer-Address           Gateway Name           Role SN       Algorithm          Established     Expiration      Xt Child  ST\n")
+	b.WriteString("----------      ------------           ------------           ---- --       ---------          -----------     ----------      -- -----  --\n")
+	if s.up[name] || len(s.config.Gateways) == 0 && !s.down[name] {
+		peer := s.config.Gateways[name]
+		if peer == "" {
+			peer = "198.51.100.1"
+		}
+		now := time.Now()
+		fmt.Fprintf(&b, "%-15d %-22s %-22s Init %-8d %-18s %-15s %-15s %-2d %-6d Established\n",
+			1, peer, name, 1, "PSK/DH14/A128/SHA256", now.Format("Jan.02 15:04"), now.Add(8*time.Hour).Format("Jan.02 15:04"), 0, 1)
+	}
+	return b.String()
+}
+
+// 'show vpn ipsec-sa [tunnel <name>]', listing established SAs
+func (s *Server) ipsecSATable(name string) string {
+	var b strings.Builder
+	b.WriteString("GwID/client IP  TnID   Peer-Address           Tunnel(Gateway)                                Algorithm          SPI(in)  SPI(out) life(Sec/KB)             remain-time(Sec)\n")
+	b.WriteString("--------------  ----   ------------           ---------------                                ---------          -------  -------- ------------             ----------------\n")
+	names := sortedKeys(s.config.Tunnels)
+	if name != "" {
+		names = []string{name}
+	}
+	for i, tunnel := range names {
+		up := s.up[tunnel] || len(s.config.Tunnels) == 0 && !s.down[tunnel]
+		if !up {
+			continue
+		}
+		gw := s.config.Tunnels[tunnel]
+		if gw == "" {
+			gw = "gw"
+		}
+		peer := s.config.Gateways[gw]
+		if peer == "" {
+			peer = "198.51.100.1"
+		}
+		fmt.Fprintf(&b, "%-15d %-6d %-22s %-46s %-18s %-8s %-8s %-24s %d\n",
+			i+1, i+1, peer, tunnel+"("+gw+")", "ESP/A128/SHA256", "9A8B7C6D", "1A2B3C4D", "3600/Unlimited", 3000)
+	}
+	return b.String()
+}
+
+// 'show routing route interface <name>'
+func (s *Server) routeTable(iface string) string {
+	var b strings.Builder
+	b.WriteString("flags: A:active, ?:loose, C:connect, H:host, S:static, ~:internal, R:rip, O:ospf, B:bgp\n\n")
+	b.WriteString("destination         nexthop         metric flags      age   interface          next-AS\n")
+	for _, prefix := range s.config.Routes[iface] {
+		fmt.Fprintf(&b, "%-19s %-15s %-6d %-10s %-5s %s\n", prefix, "0.0.0.0", 10, "A S", "", iface)
+	}
+	return b.String()
+}
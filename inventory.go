@@ -0,0 +1,165 @@
+/*
+ * Filename: inventory.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Consolidated tunnel inventory across all firewalls ('tfresh inventory').
+ */
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 'inventoryEntry' type represents one tunnel configured on a firewall
+type inventoryEntry struct {
+	Env      string        `json:"environment"`
+	Firewall string        `json:"firewall"`
+	Tunnel   string        `json:"tunnel"`
+	Gateway  string        `json:"gateway"`
+	State    string        `json:"state"` // up, down
+	SAAge    time.Duration `json:"sa_age_seconds"`
+	Managed  bool          `json:"managed"`
+	Customer string        `json:"customer,omitempty"`
+}
+
+// Collect every tunnel configured on a firewall with its SA state
+func inventoryFirewall(env, host, username, password string, customers []customer) ([]inventoryEntry, error) {
+	cli, err := connectCLI(host, username, password)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	_, tuns, err := listVPN(cli)
+	if err != nil {
+		return nil, err
+	}
+	sas, err := listIPsecSAs(cli)
+	if err != nil {
+		return nil, err
+	}
+
+	managedBy := map[string]string{}
+	for _, c := range customers {
+		if c.Firewall == "" || c.Firewall == env {
+			managedBy[c.Tunnel] = c.Name
+		}
+	}
+
+	var entries []inventoryEntry
+	for _, t := range tuns {
+		name, _, _ := strings.Cut(t.Name, ":")
+		e := inventoryEntry{Env: env, Firewall: host, Tunnel: name, Gateway: t.Gateway, State: "down"}
+		if sa, ok := sas[name]; ok {
+			e.State = "up"
+			e.SAAge = sa.Age
+		}
+		e.Customer, e.Managed = managedBy[name]
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Write the inventory as an aligned table
+func writeInventoryTable(w io.Writer, entries []inventoryEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENV\tFIREWALL\tTUNNEL\tGATEWAY\tSTATE\tSA AGE\tMANAGED\tCUSTOMER")
+	for _, e := range entries {
+		age := "-"
+		if e.State == "up" {
+			age = e.SAAge.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%t\t%s\n", e.Env, e.Firewall, e.Tunnel, e.Gateway, e.State, age, e.Managed, e.Customer)
+	}
+	return tw.Flush()
+}
+
+// Write the inventory as CSV
+func writeInventoryCSV(w io.Writer, entries []inventoryEntry) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"environment", "firewall", "tunnel", "gateway", "state", "sa_age_seconds", "managed", "customer"})
+	for _, e := range entries {
+		cw.Write([]string{e.Env, e.Firewall, e.Tunnel, e.Gateway, e.State, fmt.Sprint(int(e.SAAge.Seconds())), fmt.Sprint(e.Managed), e.Customer})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Write the inventory as JSON
+func writeInventoryJSON(w io.Writer, entries []inventoryEntry) error {
+	type jsonEntry inventoryEntry
+	out := make([]jsonEntry, len(entries))
+	for i, e := range entries {
+		out[i] = jsonEntry(e)
+		out[i].SAAge = e.SAAge / time.Second // report whole seconds rather than nanoseconds
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// Handle 'tfresh inventory'
+func inventoryCommand(args []string) {
+	fs := flag.NewFlagSet("inventory", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fwEnv := fs.String("e", "", "Firewall name or environment; all when empty")
+	format := fs.String("format", "table", "Output format (table, json, csv)")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.Parse(args)
+
+	write := map[string]func(io.Writer, []inventoryEntry) error{
+		"table": writeInventoryTable,
+		"json":  writeInventoryJSON,
+		"csv":   writeInventoryCSV,
+	}[*format]
+	if write == nil {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown output format %q.\n", *format)
+		os.Exit(1)
+	}
+
+	customers, _, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	envs, err := selectFirewalls(*fwEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	username, password := checkEnvVars()
+
+	var entries []inventoryEntry
+	failed := false
+	for _, env := range envs {
+		e, err := inventoryFirewall(env, firewalls[env], username, password, customers)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ERROR]: %s (%s): %v\n", env, firewalls[env], err)
+			failed = true
+			continue
+		}
+		entries = append(entries, e...)
+	}
+
+	if err = write(os.Stdout, entries); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Filename: journal.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Write-ahead journal of in-progress iterations, so a restarted tfresh resumes instead of re-kicking tunnels.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	// Journal file to load/save
+	journalFile = "tfresh.journal.json"
+
+	// Open journal; nil when journaling is disabled
+	jrnl *journal
+)
+
+// 'journal' type represents the in-progress iterations of every firewall
+type journal struct {
+	mu         sync.Mutex
+	path       string
+	Iterations map[string]*iterationJournal `json:"iterations"` // by firewall
+}
+
+// 'iterationJournal' type represents the progress of one firewall's iteration
+type iterationJournal struct {
+	Iteration  int       `json:"iteration"`
+	ConfigHash string    `json:"config_hash"`
+	Started    time.Time `json:"started"`
+	Done       []string  `json:"done"` // refreshStep keys
+}
+
+// Load the journal, starting empty if it doesn't exist yet
+func openJournal(filename string) (*journal, error) {
+	j := &journal{path: filename, Iterations: map[string]*iterationJournal{}}
+	fBytes, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(fBytes, j); err != nil {
+		// A torn journal only costs a redundant refresh
+		logger.Warn(fmt.Sprintf("%s: %v, ignoring", filename, err), "error", err)
+		j.Iterations = map[string]*iterationJournal{}
+	}
+	if j.Iterations == nil {
+		j.Iterations = map[string]*iterationJournal{}
+	}
+	return j, nil
+}
+
+// Drop steps an interrupted iteration already completed. The journal is only
+// honored for the same config and while those refreshes are within one interval.
+func (j *journal) resume(firewall, configHash string, steps []refreshStep, log *blockLog) (remaining, skipped []refreshStep) {
+	if j == nil {
+		return steps, nil
+	}
+	j.mu.Lock()
+	it := j.Iterations[firewall]
+	j.mu.Unlock()
+	if !it.resumable(configHash) {
+		return steps, nil
+	}
+
+	done := map[string]bool{}
+	for _, k := range it.Done {
+		done[k] = true
+	}
+	for _, step := range steps {
+		if done[step.key()] {
+			skipped = append(skipped, step)
+			continue
+		}
+		remaining = append(remaining, step)
+	}
+	if len(skipped) > 0 {
+		log.Printf("Resuming interrupted iteration # %d from %s: skipping %d steps already refreshed", it.Iteration, it.Started.Format(time.RFC3339), len(skipped))
+	}
+	return remaining, skipped
+}
+
+// Report whether an interrupted iteration can be resumed under the given config
+func (it *iterationJournal) resumable(configHash string) bool {
+	return it != nil && it.ConfigHash == configHash && time.Since(it.Started) <= time.Duration(iTime)*time.Minute
+}
+
+// Record the start of an iteration
+func (j *journal) begin(firewall string, iteration int, configHash string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// A resumed iteration keeps its record so a second crash still skips its steps
+	if iteration == 1 && j.Iterations[firewall].resumable(configHash) {
+		return
+	}
+	j.Iterations[firewall] = &iterationJournal{Iteration: iteration, ConfigHash: configHash, Started: time.Now()}
+	j.write()
+}
+
+// Record a completed step
+func (j *journal) done(firewall string, step refreshStep) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	it := j.Iterations[firewall]
+	if it == nil {
+		return
+	}
+	it.Done = append(it.Done, step.key())
+	j.write()
+}
+
+// Record the end of an iteration
+func (j *journal) finish(firewall string) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.Iterations, firewall)
+	j.write()
+}
+
+// Durably replace the journal file; called with mu held
+func (j *journal) write() {
+	if err := j.sync(); err != nil {
+		logger.Warn(fmt.Sprint("journal: ", err), "error", err)
+	}
+}
+
+func (j *journal) sync() error {
+	fBytes, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".tfresh-journal-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(fBytes); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), j.path)
+}
@@ -0,0 +1,113 @@
+/*
+ * Filename: jump.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Dials firewalls through an SSH bastion, like ProxyJump.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// Bastion firewalls are dialed through, 'user@host:port'; empty dials directly
+	jumpHost string
+
+	// Bastions set by the config's firewalls section, by host; 'none' dials directly
+	firewallJumps = map[string]string{}
+)
+
+// 'jumpSpec' type represents a bastion to tunnel through
+type jumpSpec struct {
+	user string // empty uses the firewall username
+	addr string
+}
+
+// Parse '[user@]host[:port]'
+func parseJump(s string) (jumpSpec, error) {
+	var j jumpSpec
+	hostport := s
+	if u, h, ok := strings.Cut(s, "@"); ok {
+		j.user, hostport = u, h
+	}
+	if hostport == "" || j.user == "" && strings.Contains(s, "@") {
+		return j, fmt.Errorf("jump host %q: want [user@]host[:port]", s)
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = net.JoinHostPort(hostport, "22")
+	}
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		return j, fmt.Errorf("jump host %q: %w", s, err)
+	}
+	j.addr = hostport
+	return j, nil
+}
+
+// The bastion for a firewall host, if any
+func jumpFor(host string) string {
+	if j, ok := firewallJumps[host]; ok {
+		if j == "none" {
+			return ""
+		}
+		return j
+	}
+	return jumpHost
+}
+
+// 'jumpConn' type represents a connection tunneled through a bastion, closing the bastion with it
+type jumpConn struct {
+	net.Conn
+	bastion *ssh.Client
+}
+
+func (c jumpConn) Close() error {
+	err := c.Conn.Close()
+	c.bastion.Close()
+	return err
+}
+
+// Open the TCP connection to a firewall's SSH service at addr, through its bastion when it has one.
+// The bastion authenticates with the SSH agent or $TFRESH_JUMP_PASSWORD.
+func dialSSH(host, addr, username string) (net.Conn, error) {
+	spec := jumpFor(host)
+	if spec == "" {
+		return dialTCP(host, addr)
+	}
+
+	j, err := parseJump(spec)
+	if err != nil {
+		return nil, err
+	}
+	if j.user == "" {
+		j.user = username
+	}
+	config := ssh.ClientConfig{
+		User:            j.user,
+		Auth:            authMethods(os.Getenv("TFRESH_JUMP_PASSWORD")),
+		HostKeyCallback: hostKeyCallback(),
+	}
+	// A proxy carries the connection to the bastion
+	conn, err := dialTCP(host, j.addr)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", j.addr, err)
+	}
+	bastion, err := sshHandshake(conn, j.addr, &config)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %w", j.addr, err)
+	}
+	tunnel, err := bastion.Dial("tcp", addr)
+	if err != nil {
+		bastion.Close()
+		return nil, fmt.Errorf("jump host %s: forwarding to %s: %w", j.addr, addr, err)
+	}
+	return jumpConn{Conn: tunnel, bastion: bastion}, nil
+}
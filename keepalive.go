@@ -0,0 +1,102 @@
+/*
+ * Filename: keepalive.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: SSH keepalives and reconnection after the firewall connection dies.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// Interval between keepalive requests; 0 disables them
+	keepaliveInterval = 30 * time.Second
+
+	// Missed keepalives before the connection is declared dead
+	keepaliveMax = 3
+)
+
+// Time to wait for a keepalive reply
+const keepaliveTimeout = 15 * time.Second
+
+// Send one keepalive request. Servers reject the unknown request type, which still proves the connection works.
+func ping(client *ssh.Client) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(keepaliveTimeout):
+		return errors.New("keepalive timed out")
+	}
+}
+
+// Send keepalives until the client is replaced or declared dead
+func (sc *scheduler) keepalive(client *ssh.Client) {
+	t := time.NewTicker(keepaliveInterval)
+	defer t.Stop()
+	missed := 0
+	for range t.C {
+		sc.mu.Lock()
+		replaced := sc.client != client
+		sc.mu.Unlock()
+		if replaced {
+			return
+		}
+		err := ping(client)
+		if err == nil {
+			missed = 0
+			continue
+		}
+		if missed++; missed < keepaliveMax {
+			continue
+		}
+		notify(event{Type: "connection_lost", Severity: sevError, Firewall: sc.firewall,
+			Message: fmt.Sprintf("connection dead after %d missed keepalives: %v", missed, err)})
+		sc.dead.Store(true)
+		client.Close()
+		current.setConnection(sc.firewall, "disconnected")
+		return
+	}
+}
+
+// Whether the SSH connection still answers
+func (sc *scheduler) alive() bool {
+	sc.mu.Lock()
+	client := sc.client
+	sc.mu.Unlock()
+	return client != nil && !sc.dead.Load() && ping(client) == nil
+}
+
+// Re-dial the firewall if the connection was declared dead, or its HA member went passive
+func (sc *scheduler) ensureConnected() error {
+	if sc.api != nil {
+		return sc.ensureActiveAPI()
+	}
+	if !sc.dead.Load() && !sc.failedOver() {
+		return nil
+	}
+	sc.mu.Lock()
+	if sc.client != nil {
+		sc.client.Close()
+	}
+	sc.mu.Unlock()
+	if err := sc.connect(); err != nil {
+		return err
+	}
+	sc.dead.Store(false)
+	logger.Info(fmt.Sprintf("Reconnected to %s.", sc.firewall), "firewall", sc.firewall)
+	return nil
+}
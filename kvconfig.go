@@ -0,0 +1,323 @@
+/*
+ * Filename: kvconfig.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Configuration kept in Consul or etcd ('-c consul://host:8500/tfresh/config.yml'), watched for changes.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long one watch request blocks before it is renewed
+const kvWatchWait = 5 * time.Minute
+
+// Watches block, so they can't share a client with a timeout
+var kvHTTP = &http.Client{}
+
+// Report whether a configuration source is a Consul or etcd key
+func isKVConfig(source string) bool {
+	return strings.HasPrefix(source, "consul://") || strings.HasPrefix(source, "etcd://")
+}
+
+// 'kvSource' type represents a key in a Consul or etcd cluster
+type kvSource struct {
+	kind  string // consul or etcd
+	base  string // http(s)://host:port
+	key   string
+	query url.Values
+}
+
+// Parse consul://host:port/key or etcd://host:port/key. TLS is chosen the way the
+// clients choose it: CONSUL_HTTP_SSL for Consul, an https ETCDCTL_ENDPOINTS for etcd.
+func parseKVSource(source string) (kvSource, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return kvSource{}, err
+	}
+	s := kvSource{kind: u.Scheme, key: strings.TrimPrefix(u.Path, "/"), query: u.Query()}
+	if s.key == "" {
+		return s, fmt.Errorf("%s: missing key (%s://host:port/key)", source, u.Scheme)
+	}
+	scheme := "http"
+	switch u.Scheme {
+	case "consul":
+		if ssl, _ := strconv.ParseBool(os.Getenv("CONSUL_HTTP_SSL")); ssl {
+			scheme = "https"
+		}
+	case "etcd":
+		if strings.HasPrefix(os.Getenv("ETCDCTL_ENDPOINTS"), "https://") {
+			scheme = "https"
+		}
+	}
+	s.base = scheme + "://" + u.Host
+	return s, nil
+}
+
+// Keys under the configuration's directory, which holds the files it includes
+func (s kvSource) prefix() string {
+	if dir := path.Dir(s.key); dir != "." {
+		return dir + "/"
+	}
+	return ""
+}
+
+// Read a configuration key
+func fetchKVConfig(ctx context.Context, source string) ([]byte, error) {
+	s, err := parseKVSource(source)
+	if err != nil {
+		return nil, err
+	}
+	if s.kind == "consul" {
+		body, _, err := s.consulGet(ctx, s.key, url.Values{"raw": {""}})
+		return body, err
+	}
+	kvs, _, err := s.etcdRange(ctx, s.key, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(kvs) == 0 {
+		return nil, fmt.Errorf("%s: %w", source, os.ErrNotExist)
+	}
+	return base64.StdEncoding.DecodeString(kvs[0].Value)
+}
+
+// Block until a key under the configuration's directory changes, or the wait runs out,
+// returning the index to wait from next. Index 0 returns the current index at once.
+func (s kvSource) wait(ctx context.Context, index uint64) (uint64, error) {
+	if s.kind == "consul" {
+		q := url.Values{"keys": {""}, "index": {strconv.FormatUint(index, 10)}, "wait": {kvWatchWait.String()}}
+		_, next, err := s.consulGet(ctx, s.prefix(), q)
+		// The index may go backwards, e.g. when the cluster is restored; start over then
+		if next < index {
+			next = 0
+		}
+		return next, err
+	}
+	if index == 0 {
+		_, rev, err := s.etcdRange(ctx, s.key, "")
+		return rev, err
+	}
+	return s.etcdWatch(ctx, index+1)
+}
+
+// ---- Consul ----
+
+// GET /v1/kv/<key>, returning the body and X-Consul-Index
+func (s kvSource) consulGet(ctx context.Context, key string, q url.Values) ([]byte, uint64, error) {
+	if dc := s.query.Get("dc"); dc != "" {
+		q.Set("dc", dc)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.base+"/v1/kv/"+key+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := kvHTTP.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, index, err
+	}
+	// A prefix without keys yet is 404 too, and still has an index to wait on
+	if resp.StatusCode == http.StatusNotFound && q.Has("keys") {
+		return nil, index, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, index, fmt.Errorf("GET %s: %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, index, nil
+}
+
+// ---- etcd (v3 JSON gateway) ----
+
+// 'etcdKV' type represents a key-value pair in an etcd response
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// 'etcdHeader' type represents the header of every etcd response
+type etcdHeader struct {
+	Revision string `json:"revision"`
+}
+
+// POST a JSON request to the gateway, authenticating with ETCDCTL_USER ('user:password') if set
+func (s kvSource) etcdPost(ctx context.Context, endpoint string, in any) (*http.Response, error) {
+	header := http.Header{"Content-Type": {"application/json"}}
+	if user, password, ok := strings.Cut(os.Getenv("ETCDCTL_USER"), ":"); ok {
+		token, err := s.etcdAuthenticate(ctx, user, password)
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Authorization", token)
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	resp, err := kvHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("POST %s: %s: %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// Exchange a user and password for a token
+func (s kvSource) etcdAuthenticate(ctx context.Context, user, password string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"name": user, "password": password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.base+"/v3/auth/authenticate", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := kvHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("etcd authentication as %s: %s", user, resp.Status)
+	}
+	var out struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", err
+	}
+	return out.Token, nil
+}
+
+// Read a key, or the keys from key up to rangeEnd, returning them and the store's revision
+func (s kvSource) etcdRange(ctx context.Context, key, rangeEnd string) ([]etcdKV, uint64, error) {
+	in := map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))}
+	if rangeEnd != "" {
+		in["range_end"] = base64.StdEncoding.EncodeToString([]byte(rangeEnd))
+	}
+	resp, err := s.etcdPost(ctx, "/v3/kv/range", in)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Header etcdHeader `json:"header"`
+		KVs    []etcdKV   `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, 0, err
+	}
+	rev, _ := strconv.ParseUint(out.Header.Revision, 10, 64)
+	return out.KVs, rev, nil
+}
+
+// Watch the configuration's directory from a revision until an event arrives or the wait runs out
+func (s kvSource) etcdWatch(ctx context.Context, from uint64) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, kvWatchWait)
+	defer cancel()
+	key, end := s.key, s.key+"\x00"
+	if p := s.prefix(); p != "" {
+		key, end = p, p[:len(p)-1]+string(p[len(p)-1]+1)
+	}
+	resp, err := s.etcdPost(ctx, "/v3/watch", map[string]any{"create_request": map[string]string{
+		"key":            base64.StdEncoding.EncodeToString([]byte(key)),
+		"range_end":      base64.StdEncoding.EncodeToString([]byte(end)),
+		"start_revision": strconv.FormatUint(from, 10),
+	}})
+	if err != nil {
+		return from - 1, err
+	}
+	defer resp.Body.Close()
+	// The gateway streams one JSON object per watch response
+	dec := json.NewDecoder(bufio.NewReader(resp.Body))
+	for {
+		var msg struct {
+			Result struct {
+				Header          etcdHeader        `json:"header"`
+				Events          []json.RawMessage `json:"events"`
+				Canceled        bool              `json:"canceled"`
+				CompactRevision string            `json:"compact_revision"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return from - 1, nil
+			}
+			return from - 1, err
+		}
+		rev, _ := strconv.ParseUint(msg.Result.Header.Revision, 10, 64)
+		switch {
+		case msg.Result.CompactRevision != "":
+			// The revision was compacted away; reload and watch from now
+			return 0, nil
+		case msg.Result.Canceled:
+			return from - 1, errors.New("etcd watch canceled")
+		case len(msg.Result.Events) > 0:
+			return rev, nil
+		}
+	}
+}
+
+// Watch the configuration key for changes, reloading so schedulers apply them on their next iteration
+func watchKVConfig() {
+	s, err := parseKVSource(configFile)
+	if err != nil {
+		logger.Error(err.Error(), "error", err)
+		return
+	}
+	var index uint64
+	for rootCtx.Err() == nil {
+		next, err := s.wait(rootCtx, index)
+		if err != nil {
+			if rootCtx.Err() != nil {
+				return
+			}
+			logger.Warn(fmt.Sprint("config watch: ", err), "config", configFile, "error", err)
+			if !sleepCtx(10 * time.Second) {
+				return
+			}
+			continue
+		}
+		// Index 0 only establishes where to wait from, but a change may have landed since startup
+		if next != index {
+			if err := reloadChangedConfig(); err != nil {
+				logger.Error(fmt.Sprintf("config reload failed, keeping the current customers: %v", err), "config", configFile, "error", err)
+				notify(event{Type: "config_reload_failed", Severity: sevError, Message: err.Error()})
+			}
+		}
+		index = next
+	}
+}
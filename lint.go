@@ -0,0 +1,206 @@
+/*
+ * Filename: lint.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Best-practice lint rules for configuration files ('tfresh lint').
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Lint severities, in increasing order
+const (
+	sevOff = iota
+	sevInfo
+	sevWarning
+	sevError
+)
+
+var severityNames = map[string]int{"off": sevOff, "info": sevInfo, "warning": sevWarning, "error": sevError}
+
+// 'lintRule' type represents a single best-practice check
+type lintRule struct {
+	Name     string
+	Severity int // default severity
+	Check    func(customers []customer) []string
+}
+
+// 'lintFinding' type represents a rule violation
+type lintFinding struct {
+	Rule     string
+	Severity int
+	Message  string
+}
+
+// Registered lint rules
+var lintRules = []lintRule{
+	{
+		Name:     "interval-too-short",
+		Severity: sevError,
+		Check: func(customers []customer) []string {
+			// Every customer costs two commands at the fixed post-command wait
+			est := time.Duration(len(customers)*2) * cmdWait
+			interval := time.Duration(iTime) * time.Minute
+			if est > interval {
+				return []string{fmt.Sprintf("iteration interval (%v) is shorter than the estimated iteration time (%v for %d customers)", interval, est, len(customers))}
+			}
+			return nil
+		},
+	},
+	{
+		Name:     "duplicate-target",
+		Severity: sevWarning,
+		Check: func(customers []customer) []string {
+			var msgs []string
+			gateways := map[string]string{}
+			tunnels := map[string]string{}
+			for _, c := range customers {
+				if c.isGlobalProtect() {
+					continue
+				}
+				if prev, ok := gateways[c.Gateway]; ok && c.Gateway != "" {
+					msgs = append(msgs, fmt.Sprintf("customers %q and %q refresh the same gateway %q", prev, c.Name, c.Gateway))
+				} else {
+					gateways[c.Gateway] = c.Name
+				}
+				if prev, ok := tunnels[c.Tunnel]; ok && c.Tunnel != "" {
+					msgs = append(msgs, fmt.Sprintf("customers %q and %q refresh the same tunnel %q", prev, c.Name, c.Tunnel))
+				} else {
+					tunnels[c.Tunnel] = c.Name
+				}
+			}
+			return msgs
+		},
+	},
+	{
+		Name:     "missing-tags",
+		Severity: sevWarning,
+		Check: func(customers []customer) []string {
+			var msgs []string
+			for _, c := range customers {
+				if len(c.Tags) == 0 {
+					msgs = append(msgs, fmt.Sprintf("customer %q has no tags", c.Name))
+				}
+			}
+			return msgs
+		},
+	},
+	{
+		Name:     "missing-description",
+		Severity: sevInfo,
+		Check: func(customers []customer) []string {
+			var msgs []string
+			for _, c := range customers {
+				if strings.TrimSpace(c.Description) == "" {
+					msgs = append(msgs, fmt.Sprintf("customer %q has no description", c.Name))
+				}
+			}
+			return msgs
+		},
+	},
+}
+
+// Run all lint rules, applying severity overrides
+func lintConfig(customers []customer, overrides map[string]int) []lintFinding {
+	var findings []lintFinding
+	for _, rule := range lintRules {
+		sev := rule.Severity
+		if o, ok := overrides[rule.Name]; ok {
+			sev = o
+		}
+		if sev == sevOff {
+			continue
+		}
+		for _, msg := range rule.Check(customers) {
+			findings = append(findings, lintFinding{Rule: rule.Name, Severity: sev, Message: msg})
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Severity > findings[j].Severity })
+	return findings
+}
+
+// Parse severity overrides of the form 'rule=level,rule=level'
+func parseSeverities(s string) (map[string]int, error) {
+	overrides := map[string]int{}
+	if s == "" {
+		return overrides, nil
+	}
+	known := map[string]bool{}
+	for _, rule := range lintRules {
+		known[rule.Name] = true
+	}
+	for _, kv := range strings.Split(s, ",") {
+		name, level, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid severity override %q (expected rule=level)", kv)
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown lint rule %q", name)
+		}
+		sev, ok := severityNames[level]
+		if !ok {
+			return nil, fmt.Errorf("unknown severity %q for rule %q (off, info, warning, error)", level, name)
+		}
+		overrides[name] = sev
+	}
+	return overrides, nil
+}
+
+// Return the name of a severity level
+func severityName(sev int) string {
+	for name, v := range severityNames {
+		if v == sev {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// Handle 'tfresh lint'
+func lintCommand(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fs.IntVar(&iTime, "i", iTime, "Iteration interval to lint against (default 15 minutes)")
+	rules := fs.String("rules", "", "Severity overrides. Example: 'missing-tags=off,duplicate-target=error'")
+	failOn := fs.String("fail-on", "error", "Lowest severity that causes a non-zero exit (info, warning, error)")
+	fs.Parse(args)
+
+	overrides, err := parseSeverities(*rules)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	threshold, ok := severityNames[*failOn]
+	if !ok || threshold == sevOff {
+		fmt.Fprintf(os.Stderr, "[ERROR]: invalid -fail-on severity %q\n", *failOn)
+		os.Exit(1)
+	}
+
+	customers, _, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, f := range lintConfig(customers, overrides) {
+		fmt.Printf("[%s] %s: %s\n", strings.ToUpper(severityName(f.Severity)), f.Rule, f.Message)
+		if f.Severity >= threshold {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	fmt.Println("Lint complete for:", configFile)
+}
@@ -0,0 +1,151 @@
+/*
+ * Filename: list.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Parsed customer table ('tfresh list').
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+)
+
+// 'customerFilter' type represents the 'tfresh list' selection flags
+type customerFilter struct {
+	env    string // customer_firewall, or "default" for customers without one
+	name   string // glob, case-insensitive
+	tag    string
+	kind   string // customer_type
+	status string // enabled, disabled, all
+}
+
+// Report whether a customer passes the filter
+func (f customerFilter) match(c customer) bool {
+	if f.env != "" {
+		if fw := c.Firewall; !(fw == f.env || (fw == "" && f.env == "default")) {
+			return false
+		}
+	}
+	if f.name != "" {
+		if ok, _ := path.Match(strings.ToLower(f.name), c.key()); !ok {
+			return false
+		}
+	}
+	if f.tag != "" {
+		found := false
+		for _, t := range c.Tags {
+			found = found || strings.EqualFold(t, f.tag)
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.kind != "" {
+		kind := c.Type
+		if kind == "" {
+			kind = typeSiteToSite
+		}
+		if kind != f.kind {
+			return false
+		}
+	}
+	switch f.status {
+	case "enabled":
+		return !c.Disabled
+	case "disabled":
+		return c.Disabled
+	}
+	return true
+}
+
+// Write customers as an aligned table
+func writeCustomerTable(w io.Writer, customers []customer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tGATEWAY\tTUNNEL\tFIREWALL\tTAGS\tENABLED")
+	for _, c := range customers {
+		fw := c.Firewall
+		if fw == "" {
+			fw = "(default)"
+		}
+		gw, tun := dash(c.Gateway), dash(c.Tunnel)
+		if c.isGlobalProtect() {
+			gw, tun = "globalprotect "+c.gpComponent(), "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%t\n", c.Name, gw, tun, fw, dash(strings.Join(c.Tags, ",")), !c.Disabled)
+	}
+	return tw.Flush()
+}
+
+// Write customers as JSON
+func writeCustomerJSON(w io.Writer, customers []customer) error {
+	if customers == nil {
+		customers = []customer{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(customers)
+}
+
+// Placeholder for empty table cells
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Handle 'tfresh list'
+func listCommand(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	var f customerFilter
+	fs.StringVar(&f.env, "e", "", "Only customers with this customer_firewall ('default' for customers without one)")
+	fs.StringVar(&f.name, "name", "", "Only customers whose name matches this glob, e.g. 'acme*'")
+	fs.StringVar(&f.tag, "tag", "", "Only customers with this tag")
+	fs.StringVar(&f.kind, "type", "", "Only customers of this type (site-to-site, globalprotect)")
+	fs.StringVar(&f.status, "status", "all", "Only enabled, disabled or all customers")
+	format := fs.String("format", "table", "Output format (table, json)")
+	fs.Parse(args)
+
+	write := map[string]func(io.Writer, []customer) error{
+		"table": writeCustomerTable,
+		"json":  writeCustomerJSON,
+	}[*format]
+	if write == nil {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown output format %q.\n", *format)
+		os.Exit(1)
+	}
+	switch f.status {
+	case "enabled", "disabled", "all":
+	default:
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown status %q (enabled, disabled, all).\n", f.status)
+		os.Exit(1)
+	}
+
+	customers, _, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var selected []customer
+	for _, c := range customers {
+		if f.match(c) {
+			selected = append(selected, c)
+		}
+	}
+	if err = write(os.Stdout, selected); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,57 @@
+//go:build unix
+
+/*
+ * Filename: lock.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Instance lock that keeps two daemons from refreshing the same tunnels.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// Take an exclusive lock on a file for the life of the process.
+// The kernel releases it when tfresh exits, however it exits.
+func acquireLock(filename string) error {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		holder, _ := os.ReadFile(filename)
+		f.Close()
+		if pid := string(bytes.TrimSpace(holder)); pid != "" {
+			return fmt.Errorf("another tfresh (pid %s) holds %s", pid, filename)
+		}
+		return fmt.Errorf("another tfresh holds %s", filename)
+	}
+
+	// Record the holder for the error above; the descriptor stays open until exit
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	lockFile = f
+	return nil
+}
+
+// Hold an exclusive lock on filename+".save.lock" until unlock is called, waiting for
+// another tfresh command to finish its read-modify-write of filename first
+func lockForUpdate(filename string) (unlock func(), err error) {
+	f, err := os.OpenFile(filename+".save.lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %w", f.Name(), err)
+	}
+	return func() { f.Close() }, nil
+}
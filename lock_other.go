@@ -0,0 +1,28 @@
+//go:build !unix
+
+/*
+ * Filename: lock_other.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Instance lock fallback for platforms without flock.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Only the control listener guards against duplicates here
+func acquireLock(filename string) error {
+	fmt.Fprintln(os.Stderr, "[WARN]: instance lock is not supported on this platform")
+	return nil
+}
+
+// Updates of shared files are only serialized within the process here
+func lockForUpdate(filename string) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -0,0 +1,80 @@
+/*
+ * Filename: logging.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Daemon logging through slog, as human-readable lines or JSON records ('--log-format').
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+var (
+	// Log format, text or json
+	logFormat = "text"
+
+	// Minimum level logged
+	logLevel = new(slog.LevelVar)
+
+	// Daemon logger; attributes are only rendered by the json format
+	logger = slog.New(textHandler{})
+)
+
+// 'textHandler' type represents the classic tfresh output: informational lines on
+// humanOut, warnings and errors tagged on stderr
+type textHandler struct{}
+
+func (textHandler) Enabled(_ context.Context, l slog.Level) bool { return l >= logLevel.Level() }
+
+func (textHandler) Handle(_ context.Context, r slog.Record) error {
+	var w io.Writer = humanOut
+	prefix := ""
+	switch {
+	case r.Level >= slog.LevelError:
+		w, prefix = os.Stderr, "[ERROR]: "
+	case r.Level >= slog.LevelWarn:
+		w, prefix = os.Stderr, "[WARN]: "
+	case r.Level < slog.LevelInfo:
+		prefix = "[DEBUG]: "
+	}
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	_, err := fmt.Fprintln(w, prefix+r.Message)
+	return err
+}
+
+func (h textHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h textHandler) WithGroup(string) slog.Handler      { return h }
+
+// Select the log format and level; call after the output format is set
+func setupLogging(format, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q (debug, info, warn, error)", level)
+	}
+	logLevel.Set(l)
+
+	switch format {
+	case "text":
+		logger = slog.New(textHandler{})
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(humanOut, &slog.HandlerOptions{Level: logLevel}))
+	default:
+		return fmt.Errorf("unknown log format %q (text, json)", format)
+	}
+	logFormat = format
+	return nil
+}
+
+// Whether messages of a level are logged
+func logEnabled(l slog.Level) bool {
+	return logger.Enabled(context.Background(), l)
+}
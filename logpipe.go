@@ -0,0 +1,150 @@
+/*
+ * Filename: logpipe.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Per-customer prefixed, optionally buffered output that never interleaves mid-line.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+var (
+	// Prefix every refresh line with the customer name
+	logPrefix = false
+
+	// Hold each customer's output until its refresh finishes, then write it as one block
+	logBuffer = false
+
+	// Serializes writes to stdout across goroutines
+	outputMu sync.Mutex
+)
+
+// 'blockLog' type represents the output of one customer's refresh
+type blockLog struct {
+	firewall string
+	customer string
+	gateway  string
+	tunnel   string
+	prefix   string
+	out      io.Writer
+	tee      *bytes.Buffer // firewall transcript, when archiving
+	buf      bytes.Buffer
+}
+
+// Per-firewall transcripts of the current iteration, guarded by outputMu
+var transcripts = map[string]*bytes.Buffer{}
+
+// Start capturing a firewall's transcript
+func startTranscript(firewall string) {
+	outputMu.Lock()
+	transcripts[firewall] = &bytes.Buffer{}
+	outputMu.Unlock()
+}
+
+// Stop capturing a firewall's transcript and return it
+func takeTranscript(firewall string) []byte {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	t := transcripts[firewall]
+	delete(transcripts, firewall)
+	if t == nil {
+		return nil
+	}
+	return t.Bytes()
+}
+
+// Create the log for one customer (or firewall-wide output when name is empty)
+func newBlockLog(firewall, name string) *blockLog {
+	outputMu.Lock()
+	l := &blockLog{firewall: firewall, customer: name, out: humanOut, tee: transcripts[firewall]}
+	outputMu.Unlock()
+	if logPrefix && name != "" {
+		l.prefix = "[" + name + "] "
+	}
+	return l
+}
+
+// Create the log for one refresh step
+func newStepLog(firewall string, step refreshStep) *blockLog {
+	l := newBlockLog(firewall, step.customer)
+	l.gateway, l.tunnel = step.gateway, step.tunnel
+	return l
+}
+
+// Structured fields identifying the log's firewall and customer
+func (l *blockLog) fields() []any {
+	f := []any{"firewall", l.firewall, "iteration", current.iteration(l.firewall)}
+	for _, kv := range [][2]string{{"customer", l.customer}, {"gateway", l.gateway}, {"tunnel", l.tunnel}} {
+		if kv[1] != "" {
+			f = append(f, kv[0], kv[1])
+		}
+	}
+	return f
+}
+
+// Write one line, prefixed, directly or into the buffer
+func (l *blockLog) Println(a ...any) {
+	text := fmt.Sprintln(a...)
+	l.Log(strings.TrimSuffix(text, "\n"))
+}
+
+// Write one line with extra structured fields, which only the json log format shows
+func (l *blockLog) Log(msg string, attrs ...any) {
+	if !logEnabled(slog.LevelInfo) {
+		return
+	}
+	text := msg + "\n"
+	shipLine(l.firewall, l.customer, text)
+	line := l.prefix + text
+	if logFormat == "json" {
+		// Records are self-contained, so there is nothing to buffer, and separators are noise
+		if strings.Trim(msg, "-") != "" {
+			logger.Info(msg, append(l.fields(), attrs...)...)
+		}
+		outputMu.Lock()
+		if l.tee != nil {
+			l.tee.WriteString(line)
+		}
+		outputMu.Unlock()
+		return
+	}
+	if logBuffer {
+		l.buf.WriteString(line)
+		return
+	}
+	outputMu.Lock()
+	io.WriteString(l.out, line)
+	if l.tee != nil {
+		l.tee.WriteString(line)
+	}
+	outputMu.Unlock()
+}
+
+// Write one formatted line
+func (l *blockLog) Printf(format string, a ...any) {
+	l.Println(fmt.Sprintf(format, a...))
+}
+
+// Write the buffered block in one piece
+func (l *blockLog) Flush() {
+	if l.buf.Len() == 0 {
+		return
+	}
+	outputMu.Lock()
+	l.out.Write(l.buf.Bytes())
+	if l.tee != nil {
+		l.tee.Write(l.buf.Bytes())
+	}
+	outputMu.Unlock()
+	l.buf.Reset()
+}
@@ -0,0 +1,279 @@
+/*
+ * Filename: logship.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Native log shipping to Grafana Loki and Elasticsearch/OpenSearch.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Flush shipped logs at least this often
+	shipInterval = 5 * time.Second
+
+	// Flush early once this many records are pending
+	shipBatch = 500
+
+	// Records held while sinks are slow; newer records are dropped beyond this
+	shipQueue = 10000
+
+	// Timeout for one push to a sink
+	shipTimeout = 15 * time.Second
+)
+
+var (
+	// Loki tenant (X-Scope-OrgID), optional
+	lokiTenant = ""
+
+	// Elasticsearch index prefix
+	esIndex = "tfresh"
+
+	// Configured log sinks
+	logSinks []logSink
+
+	// Records waiting to be shipped; nil when no sinks are configured
+	shipCh chan logRecord
+
+	// Records dropped because the queue was full
+	shipDropped atomic.Int64
+)
+
+// 'logRecord' type represents one shipped log line with its labels
+type logRecord struct {
+	Time     time.Time `json:"@timestamp"`
+	Firewall string    `json:"firewall,omitempty"`
+	Env      string    `json:"env,omitempty"`
+	Customer string    `json:"customer,omitempty"`
+	Message  string    `json:"message"`
+}
+
+// 'logSink' interface is implemented by every log shipping backend
+type logSink interface {
+	Name() string
+	Ship(records []logRecord) error
+}
+
+// Start the background shipper when any sink is configured
+func startLogShipper() {
+	if len(logSinks) == 0 {
+		return
+	}
+	shipCh = make(chan logRecord, shipQueue)
+	go shipLoop()
+}
+
+// Queue one line for shipping, never blocking the refresh
+func shipLine(firewall, customer, text string) {
+	if shipCh == nil {
+		return
+	}
+	r := logRecord{
+		Time:     time.Now().UTC(),
+		Firewall: firewall,
+		Env:      envOf(firewall),
+		Customer: customer,
+		Message:  strings.TrimRight(text, "\n"),
+	}
+	select {
+	case shipCh <- r:
+	default:
+		shipDropped.Add(1)
+	}
+}
+
+// Batch queued records and push them to every sink
+func shipLoop() {
+	ticker := time.NewTicker(shipInterval)
+	defer ticker.Stop()
+	var pending []logRecord
+	flush := func() {
+		if n := shipDropped.Swap(0); n > 0 {
+			logger.Warn(fmt.Sprintf("log shipping dropped %d lines, sinks are too slow", n), "dropped", n)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		for _, s := range logSinks {
+			if err := s.Ship(pending); err != nil {
+				logger.Warn(fmt.Sprintf("log shipping to %s failed: %v", s.Name(), err), "sink", s.Name(), "error", err)
+			}
+		}
+		pending = nil
+	}
+	for {
+		select {
+		case r := <-shipCh:
+			pending = append(pending, r)
+			if len(pending) >= shipBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Return the environment name of a firewall host
+func envOf(firewall string) string {
+	for env, host := range firewalls {
+		if host == firewall {
+			return env
+		}
+	}
+	return ""
+}
+
+// POST a body to a sink, returning an error for non-2xx responses
+func shipPost(req *http.Request) ([]byte, error) {
+	resp, err := (&http.Client{Timeout: shipTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// 'lokiSink' ships to the Loki push API, authenticating with LOKI_USERNAME/LOKI_PASSWORD when set
+type lokiSink struct {
+	url string
+}
+
+func newLokiSink(base string) *lokiSink {
+	return &lokiSink{url: strings.TrimRight(base, "/") + "/loki/api/v1/push"}
+}
+
+func (s *lokiSink) Name() string { return "loki" }
+
+func (s *lokiSink) Ship(records []logRecord) error {
+	type stream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	// One stream per label set
+	streams := map[string]*stream{}
+	var order []string
+	for _, r := range records {
+		key := r.Firewall + "\x00" + r.Customer
+		st, ok := streams[key]
+		if !ok {
+			labels := map[string]string{"job": "tfresh"}
+			for k, v := range map[string]string{"firewall": r.Firewall, "env": r.Env, "customer": r.Customer} {
+				if v != "" {
+					labels[k] = v
+				}
+			}
+			st = &stream{Stream: labels}
+			streams[key] = st
+			order = append(order, key)
+		}
+		st.Values = append(st.Values, [2]string{strconv.FormatInt(r.Time.UnixNano(), 10), r.Message})
+	}
+	payload := struct {
+		Streams []*stream `json:"streams"`
+	}{}
+	for _, k := range order {
+		payload.Streams = append(payload.Streams, streams[k])
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if lokiTenant != "" {
+		req.Header.Set("X-Scope-OrgID", lokiTenant)
+	}
+	if user := os.Getenv("LOKI_USERNAME"); user != "" {
+		req.SetBasicAuth(user, os.Getenv("LOKI_PASSWORD"))
+	}
+	_, err = shipPost(req)
+	return err
+}
+
+// 'elasticSink' ships to the Elasticsearch/OpenSearch bulk API, authenticating with
+// ES_API_KEY or ES_USERNAME/ES_PASSWORD when set
+type elasticSink struct {
+	url string
+}
+
+func newElasticSink(base string) *elasticSink {
+	return &elasticSink{url: strings.TrimRight(base, "/") + "/_bulk"}
+}
+
+func (s *elasticSink) Name() string { return "elasticsearch" }
+
+func (s *elasticSink) Ship(records []logRecord) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range records {
+		action := map[string]map[string]string{"index": {"_index": esIndex + "-" + r.Time.Format("2006.01.02")}}
+		if err := enc.Encode(action); err != nil {
+			return err
+		}
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if key := os.Getenv("ES_API_KEY"); key != "" {
+		req.Header.Set("Authorization", "ApiKey "+key)
+	} else if user := os.Getenv("ES_USERNAME"); user != "" {
+		req.SetBasicAuth(user, os.Getenv("ES_PASSWORD"))
+	}
+	resp, err := shipPost(req)
+	if err != nil {
+		return err
+	}
+
+	// The bulk API reports per-document failures with a 200
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err = json.Unmarshal(resp, &result); err != nil || !result.Errors {
+		return nil
+	}
+	failed := 0
+	var first string
+	for _, item := range result.Items {
+		for _, res := range item {
+			if len(res.Error) > 0 {
+				if failed == 0 {
+					first = string(res.Error)
+				}
+				failed++
+			}
+		}
+	}
+	return fmt.Errorf("%d of %d documents rejected: %s", failed, len(records), first)
+}
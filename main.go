@@ -10,28 +10,23 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"log/slog"
 	"os"
 	"strings"
+	"sync"
 	"time"
-
-	"golang.org/x/crypto/ssh"
-	yaml "gopkg.in/yaml.v3"
 )
 
 const (
-	// Palo commands to jumpstart VPN tunnels
-	ikeSA   = "test vpn ike-sa gateway"
-	ipsecSA = "test vpn ipsec-sa tunnel"
-
 	// Palo Firewalls
 	testFW = "palo-test-fw01.****.com"
 	prodFW = "palo-prod-fw1.****.com"
 
-	// Default SSH port
-	sshPort = ":22"
+	// Typical time for the firewall to answer a command, used for run time estimates
+	cmdWait = 2 * time.Second
 )
 
 var (
@@ -40,140 +35,714 @@ var (
 
 	// Iteration time
 	iTime = 15 // 15 minutes
-)
 
-// 'customer' type represents a customer VPN connection
-type customer struct {
-	Name    string `yaml:"customer_name"`
-	Gateway string `yaml:"customer_gateway"`
-	Tunnel  string `yaml:"customer_tunnel"`
-}
+	// Run one iteration and exit
+	runOnce = false
+
+	// With runOnce, only refresh customers that are due
+	dueOnly = false
+
+	// State file to load/save
+	stateFile = "tfresh.state.json"
+
+	// Instance lock file, defaults to the state file with a .lock suffix
+	lockFilename = ""
+
+	// Held open while the daemon runs
+	lockFile *os.File
+
+	// Number of config versions kept in the state file
+	configHistory = 5
+
+	// Check for config/firewall drift every N iterations (0 disables)
+	driftEvery = 4
+
+	// Verify routes over tunnel interfaces after each refresh
+	routeCheck = false
+
+	// Firewall environments refreshed with blanket commands instead of per customer
+	batchEnvs = map[string]bool{}
+
+	// Firewalls by name; a 'firewalls' section in the config file replaces these
+	firewalls = map[string]string{
+		"prod": prodFW,
+		"test": testFW,
+	}
+
+	// Environment labels of config-defined firewalls, by name
+	firewallEnvs = map[string]string{}
+
+	// SSH port of firewalls without their own
+	sshPort = 22
+
+	// SSH ports other than -ssh-port, by host
+	sshPorts = map[string]int{}
+
+	// Management address of the other member of an HA pair, by host
+	haPeers = map[string]string{}
+)
 
 func main() {
-	// Check for required environment variables
-	username, password := checkEnvVars()
+	// Dispatch subcommands; 'run' and bare flags start the daemon
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		c, ok := lookupSubcommand(os.Args[1])
+		switch {
+		case os.Args[1] == "help":
+			if !helpCommand(os.Args[2:]) {
+				return
+			}
+			os.Args = []string{os.Args[0], "-h"}
+		case !ok:
+			fmt.Fprintf(os.Stderr, "[ERROR]: Unknown command %q.\n", os.Args[1])
+			printSubcommands()
+			os.Exit(1)
+		case c.run != nil:
+			c.run(os.Args[2:])
+			return
+		default:
+			os.Args = append(os.Args[:1:1], os.Args[2:]...)
+		}
+	}
+	// Report to the Windows service manager when it started us
+	startService()
+	flag.Usage = runUsage
+	// flag's own exit status for bad flags, 2, is taken by exitPartial
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
 
 	// Process CLI flags
-	flag.StringVar(&configFile, "c", configFile, fmt.Sprintf("Configuration filename (default is config.yml). Example: '%s -c custom.yml'", os.Args[0]))
-	flag.IntVar(&iTime, "i", iTime, "Iteration interval (default 15 minutes)")
-	fwEnv := flag.String("e", "", fmt.Sprintf("Firewall environment (prod, test). Example: '%s -e prod'", os.Args[0]))
-	flag.Parse()
+	flag.StringVar(&configFile, "c", configFile, fmt.Sprintf("Configuration filename, or http(s), s3, gs, consul or etcd URL (default is config.yml). Example: '%s -c custom.yml'", os.Args[0]))
+	flag.StringVar(&configFormat, "config-format", configFormat, "Configuration format (yaml, json, toml); default by file extension, else guessed from the contents")
+	flag.StringVar(&configToken, "config-token", configToken, "Bearer token for a -c https:// URL, sent to its host only (default $TFRESH_CONFIG_TOKEN); s3:// and gs:// use the standard cloud credentials")
+	flag.BoolVar(&configTokenHTTP, "config-token-http", false, "Send -config-token to an http:// -c too, unencrypted")
+	flag.DurationVar(&configRefresh, "config-refresh", configRefresh, "How often a remote -c is re-fetched and, when it changed, reloaded; 0 disables it (default 5m)")
+	configDir := flag.String("config-dir", "", "Merge every .yml and .yaml file in this directory, in name order, instead of -c; files may also 'include:' others")
+	flag.IntVar(&iTime, "i", iTime, "Default refresh interval in minutes; customer_interval and -tier override it per customer (default 15 minutes)")
+	flag.StringVar(&stateFile, "s", stateFile, "State file (default is tfresh.state.json)")
+	flag.IntVar(&configHistory, "versions", configHistory, "Number of config versions kept in the state file (default 5)")
+	flag.IntVar(&driftEvery, "drift-every", driftEvery, "Check for config/firewall drift every N iterations, 0 disables (default 4)")
+	flag.BoolVar(&routeCheck, "check-routes", routeCheck, "Verify routes over customer_tunnel_interface after each refresh")
+	batch := flag.String("batch", "", fmt.Sprintf("Comma-separated firewall environments to refresh with blanket 'test vpn' commands. Example: '%s -batch test'", os.Args[0]))
+	transport := flag.String("transport", "ssh", "Firewall transport (ssh, api). The api transport reads the key from PAN_API_KEY")
+	flag.IntVar(&apiParallel, "api-parallel", apiParallel, "Op commands in flight per firewall with the api transport (default 4)")
+	flag.StringVar(&listenAddr, "listen", listenAddr, "Control listener address for 'inspect', /metrics and the /healthz and /readyz probes; empty disables it")
+	archiveURL := flag.String("archive", "", "Upload per-iteration transcripts and reports to object storage (s3://bucket/prefix, gs://bucket/prefix, azblob://account/container/prefix)")
+	flag.IntVar(&archiveRetentionDays, "archive-retention-days", archiveRetentionDays, "Delete archived objects older than this many days, 0 keeps them forever (default 365)")
+	lokiURL := flag.String("loki", "", "Ship refresh logs to a Grafana Loki push API base URL (e.g. http://loki:3100)")
+	flag.StringVar(&lokiTenant, "loki-tenant", lokiTenant, "Loki tenant sent as X-Scope-OrgID")
+	esURL := flag.String("elasticsearch", "", "Ship refresh logs to an Elasticsearch/OpenSearch base URL with the bulk API")
+	flag.StringVar(&esIndex, "elasticsearch-index", esIndex, "Elasticsearch index prefix, a -YYYY.MM.DD suffix is added (default tfresh)")
+	splunkURL := flag.String("splunk", "", "Send refresh events and iteration summaries to a Splunk HTTP Event Collector base URL (e.g. https://splunk:8088). The token is read from SPLUNK_HEC_TOKEN")
+	flag.StringVar(&splunkIndex, "splunk-index", splunkIndex, "Splunk index, empty uses the token's default")
+	flag.StringVar(&splunkSourcetype, "splunk-sourcetype", splunkSourcetype, "Splunk sourcetype (default tfresh:event)")
+	flag.StringVar(&journalFile, "journal", journalFile, "Iteration journal used to resume after a crash, empty disables (default tfresh.journal.json)")
+	flag.IntVar(&watchdogMultiple, "watchdog", watchdogMultiple, "Abandon and restart an iteration that runs this many times past its deadline, 0 disables (default 3)")
+	flag.IntVar(&maxGoroutines, "max-goroutines", maxGoroutines, "Exit when more goroutines than this are running, 0 disables (default 1000)")
+	flag.IntVar(&maxSessions, "max-sessions", maxSessions, "Maximum concurrent SSH sessions per firewall, 0 disables (default 16)")
+	flag.IntVar(&maxMemoryMiB, "max-memory", maxMemoryMiB, "Exit when the heap grows past this many MiB, 0 disables (default 512)")
+	flag.BoolVar(&runOnce, "once", runOnce, "Run a single iteration on every firewall and exit, e.g. from cron")
+	flag.Var(globalSchedule, "schedule", "Cron expression for when customers are refreshed, e.g. '*/10 8-18 * * MON-FRI' in local time; overrides intervals, customer_schedule overrides it")
+	flag.Var(intervalTiers, "tier", "Refresh interval for customers with a tag, e.g. '-tier critical=5m,standard=15m,bulk=60m'; repeatable. customer_interval overrides it")
+	flag.BoolVar(&dueOnly, "due", dueOnly, "Refresh only customers whose customer_interval has elapsed since their last refresh, then exit (implies --once; for systemd timers)")
+	flag.StringVar(&pushgatewayURL, "pushgateway", pushgatewayURL, "Push final metrics to a Prometheus Pushgateway base URL (with --once)")
+	flag.StringVar(&pushJob, "push-job", pushJob, "Pushgateway job label (default tfresh)")
+	flag.StringVar(&pushInstance, "push-instance", pushInstance, "Pushgateway instance label (default is the hostname)")
+	flag.StringVar(&heartbeatURL, "heartbeat", heartbeatURL, "Ping this URL after each successful iteration ({firewall} is replaced per firewall), e.g. a healthchecks.io check")
+	flag.BoolVar(&heartbeatStart, "heartbeat-start", heartbeatStart, "Also ping <url>/start when an iteration begins and <url>/fail when it has failures")
+	flag.StringVar(&lockFilename, "lock", lockFilename, "Instance lock file (default is the state file with a .lock suffix)")
+	flag.StringVar(&verifyNames, "verify-names", verifyNames, "Before the first iteration and after each reload, check gateway/tunnel names exist on the firewall: off, warn, skip (drop those customers) or fail")
+	flag.StringVar(&canaryName, "canary", canaryName, "Refresh and verify this customer (or 'random') first each iteration, aborting the iteration if it fails")
+	flag.DurationVar(&canaryWait, "canary-wait", canaryWait, "How long the canary's IPsec SA has to come up with the ssh transport")
+	flag.StringVar(&rolloutBatch, "rollout-batch", rolloutBatch, "Refresh in batches of this many steps or percent (e.g. 10%), verifying each batch before the next")
+	flag.DurationVar(&rolloutPause, "rollout-pause", rolloutPause, "How long each rollout batch's tunnels have to come up")
+	flag.IntVar(&rolloutMaxFailure, "rollout-max-failure", rolloutMaxFailure, "Abort the iteration when more than this percent of a rollout batch fails (default 20)")
+	cutoverSpec := flag.String("cutover", "", "Migrate customers between firewall environments, e.g. 'prod=prod2'; shift the split at runtime with 'tfresh cutover'")
+	cutoverPercent := flag.Int("cutover-percent", 0, "Initial percentage of the old firewall's customers refreshed on the new one")
+	cutoverTag := flag.String("cutover-tag", "", "Customers with this tag are refreshed on the new firewall regardless of the percentage")
+	flag.StringVar(&historyDB, "history-db", historyDB, "SQLite database to record every refresh attempt to, for 'tfresh history' (default $TFRESH_HISTORY_DB)")
+	flag.StringVar(&reportFile, "report", reportFile, "Write a report of each firewall's latest iteration (customers processed, skipped, succeeded, failed, total time) after each iteration; .html, .csv or .json picks the format")
+	flag.StringVar(&resultFile, "result-file", resultFile, "Atomically write a JSON run result (exit reason, per-customer results) after each iteration and on exit")
+	flag.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	flag.BoolVar(&knownHostsTOFU, "known-hosts-tofu", knownHostsTOFU, "Trust and record host keys missing from the known_hosts file on first connect")
+	flag.StringVar(&apiKeyCache, "api-key-cache", apiKeyCache, "Cache of API keys generated when PAN_API_KEY is not set")
+	flag.StringVar(&panoramaHost, "panorama", panoramaHost, "Panorama host; refresh every tunnel on the firewalls it manages, in addition to the config file")
+	flag.BoolVar(&autoDiscover, "auto-discover", autoDiscover, "Also refresh every tunnel found on the -e firewalls, re-discovered each iteration")
+	discoverInclude := flag.String("discover-include", "", "With -auto-discover, only gateways or tunnels matching these comma-separated globs")
+	discoverExclude := flag.String("discover-exclude", "", "With -auto-discover, skip gateways or tunnels matching these comma-separated globs")
+	flag.BoolVar(&forceRefresh, "force", forceRefresh, "Refresh every customer, including those whose IKE and IPsec SAs are already established")
+	flag.Var(&dialRetry, "retry-dial", "Retry policy for SSH dials, e.g. 'attempts=5,base=1s,max=30s,jitter=0.2'")
+	flag.Var(&sessionRetry, "retry-session", "Retry policy for opening SSH sessions")
+	flag.Var(&refreshRetry, "retry-refresh", "Retry policy for failed customer refreshes; attempts=1 disables retries")
+	flag.DurationVar(&keepaliveInterval, "keepalive", keepaliveInterval, "Interval between SSH keepalives; 0 disables them")
+	flag.IntVar(&keepaliveMax, "keepalive-max", keepaliveMax, "Missed keepalives before the connection is re-dialed")
+	level := flag.String("log-level", "info", "Log level (debug, info, warn, error). debug includes every command sent and the firewall's raw output")
+	verbose := flag.Bool("v", false, "Verbose, same as -log-level debug")
+	quiet := flag.Bool("q", false, "Quiet, same as -log-level warn: only problems are logged")
+	logFmt := flag.String("log-format", logFormat, "Log format (text, json). json writes one record per line with firewall, customer, gateway, tunnel, iteration and duration fields")
+	flag.DurationVar(&readyWindow, "ready-window", readyWindow, "Longest time since a firewall's last iteration before /readyz fails (default twice -i plus a minute)")
+	slackWebhook := flag.String("slack-webhook", os.Getenv("SLACK_WEBHOOK_URL"), "Slack incoming webhook for notifications (default $SLACK_WEBHOOK_URL)")
+	slackSeverity := flag.String("slack-min-severity", "warning", "Least severe event posted to Slack (info, warning, error)")
+	var webhooks stringList
+	flag.Var(&webhooks, "webhook", "URL to post notification events to as JSON; repeatable")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("TFRESH_WEBHOOK_SECRET"), "HMAC-SHA256 key for the X-Tfresh-Signature header (default $TFRESH_WEBHOOK_SECRET)")
+	webhookSeverity := flag.String("webhook-min-severity", "warning", "Least severe event posted to webhooks (info, warning, error)")
+	flag.Var(&webhookRetry, "retry-webhook", "Retry policy for webhook posts")
+	flag.IntVar(&notifyAfter, "notify-after", notifyAfter, "Consecutive failures of a customer, across restarts, before refresh_failed is sent")
+	var onlyCustomers stringList
+	flag.Var(&onlyCustomers, "customer", "Refresh only these customers, e.g. '-customer acme,globex'; repeatable")
+	matchCustomers := flag.String("match", "", "Refresh only customers whose name matches this regular expression")
+	interactive := flag.Bool("interactive", false, "Choose the customers to refresh from a list, then run one iteration (implies --once)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "On SIGINT/SIGTERM, how long in-flight customers get to finish before exiting anyway")
+	flag.IntVar(&sshConcurrency, "concurrency", sshConcurrency, "SSH sessions refreshing each firewall's customers in parallel with the ssh transport; see -api-parallel for api (default 1)")
+	flag.DurationVar(&scheduleJitter, "jitter", scheduleJitter, "Add a random delay of up to this long to each sleep between iterations, so instances on the same interval drift apart")
+	flag.DurationVar(&staggerDelay, "stagger", staggerDelay, "Pause this long between customers within an iteration (per session with -concurrency), spreading out IKE negotiations")
+	flag.StringVar(&jumpHost, "jump", jumpHost, "Dial firewalls through this SSH bastion, '[user@]host[:port]' (default user is PAN_USERNAME); it authenticates with the agent or $TFRESH_JUMP_PASSWORD")
+	flag.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "Connect to firewalls over SSH and the XML API through this proxy, socks5://[user:pass@]host:port or http://host:port (default $TFRESH_PROXY)")
+	flag.IntVar(&sshPort, "ssh-port", sshPort, "SSH port of firewalls without a port in the firewalls section")
+	flag.DurationVar(&dialTimeout, "dial-timeout", dialTimeout, "Longest connecting to a firewall may take, including the SSH or TLS handshake")
+	flag.DurationVar(&commandTimeout, "command-timeout", commandTimeout, "Longest a refresh command may take before it fails (default 30s over SSH, 60s over the API)")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", breakerThreshold, "Consecutive failed customers on a firewall that open its circuit breaker, skipping the firewall for -breaker-cooldown; 0 disables it")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", breakerCooldown, "How long an open circuit skips its firewall before one customer is refreshed to probe recovery")
+	flag.Float64Var(&commandRate, "rate-limit", commandRate, "Refresh commands per second sent to each firewall, shared by its -concurrency sessions; 0 is unlimited")
+	flag.IntVar(&commandBurst, "rate-burst", commandBurst, "Refresh commands that may be sent back to back before -rate-limit applies (default 1)")
+	flag.DurationVar(&customerTimeout, "customer-timeout", customerTimeout, "Longest all of a customer's commands may take together over SSH before it fails; 0 is unlimited")
+	flag.DurationVar(&iterationTimeout, "iteration-timeout", iterationTimeout, "Longest an iteration's refreshes may take over SSH; customers not done by then fail and the next iteration runs as usual. 0 is unlimited")
+	flag.StringVar(&profileName, "profile", profileName, "Read the firewall credentials from this profile of the credentials file instead of PAN_USERNAME/PAN_PASSWORD/PAN_API_KEY (default $TFRESH_PROFILE)")
+	flag.StringVar(&credentialsFile, "credentials-file", credentialsFile, "Credentials file with [profile] sections of username, password and api_key (default $TFRESH_CREDENTIALS_FILE or ~/.tfresh/credentials)")
+	output := flag.String("output", outputFormat, "Output format (text, ndjson). ndjson writes events to stdout and logs to stderr")
+	flag.BoolVar(&logPrefix, "log-prefix", logPrefix, "Prefix refresh output with the customer name")
+	flag.BoolVar(&logBuffer, "log-buffer", logBuffer, "Write each customer's refresh output as one contiguous block")
+	flag.BoolVar(&apiInsecure, "api-insecure", apiInsecure, "Skip verification of the firewall management certificate with the api transport")
+	var fwEnvs stringList
+	flag.Var(&fwEnvs, "e", fmt.Sprintf("Firewall name or environment (e.g. prod, test, all) for customers without customer_firewall; repeatable. Example: '%s -e prod -e test'", os.Args[0]))
+	if err := flag.CommandLine.Parse(os.Args[1:]); errors.Is(err, flag.ErrHelp) {
+		os.Exit(exitOK)
+	} else if err != nil {
+		os.Exit(exitConfig)
+	}
+	if err := applyEnvFlags(flag.CommandLine); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(exitConfig)
+	}
+	if *configDir != "" {
+		configFile = *configDir
+	}
+	switch configFormat {
+	case "", "yaml", "json", "toml":
+	default:
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown -config-format %q.\n", configFormat)
+		os.Exit(exitConfig)
+	}
 
-	// Set firewall environment
-	var firewall string
+	switch *output {
+	case "text":
+	case "ndjson":
+		enableNDJSON()
+	default:
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown output format %q.\n", *output)
+		flag.Usage()
+		os.Exit(exitConfig)
+	}
 	switch {
-	case *fwEnv == "":
-		fmt.Fprintln(os.Stderr, "[ERROR]: Firewall environment needs to be set.")
+	case *verbose && *quiet:
+		fmt.Fprintln(os.Stderr, "[ERROR]: -v and -q are mutually exclusive.")
+		os.Exit(exitConfig)
+	case *verbose:
+		*level = "debug"
+	case *quiet:
+		*level = "warn"
+	}
+	if err := setupLogging(*logFmt, *level); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
 		flag.Usage()
-		os.Exit(1)
-	case *fwEnv == "prod":
-		firewall = prodFW
-	case *fwEnv == "test":
-		firewall = testFW
+		os.Exit(exitConfig)
+	}
+	logger = slog.New(serviceLogHandler(logger.Handler()))
+
+	if dueOnly {
+		runOnce = true
+	}
+	if sshConcurrency < 1 || (maxSessions > 0 && sshConcurrency >= maxSessions) {
+		fmt.Fprintf(os.Stderr, "[ERROR]: -concurrency must be between 1 and %d (the SSH session cap, less one for checks).\n", maxSessions-1)
+		os.Exit(exitConfig)
+	}
+	if jumpHost != "" {
+		if _, err := parseJump(jumpHost); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if proxyURL != "" && proxyURL != "none" {
+		if _, err := parseProxy(proxyURL); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if sshPort < 1 || sshPort > 65535 {
+		fmt.Fprintf(os.Stderr, "[ERROR]: invalid -ssh-port %d.\n", sshPort)
+		os.Exit(exitConfig)
+	}
+	if dialTimeout <= 0 || commandTimeout < 0 || customerTimeout < 0 || iterationTimeout < 0 {
+		fmt.Fprintln(os.Stderr, "[ERROR]: -dial-timeout must be positive and -command-timeout, -customer-timeout and -iteration-timeout cannot be negative.")
+		os.Exit(exitConfig)
+	}
+	if reportFile != "" {
+		if _, err := reportFormat(reportFile); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
+	}
+	if breakerThreshold < 0 || breakerCooldown <= 0 {
+		fmt.Fprintln(os.Stderr, "[ERROR]: -breaker-threshold cannot be negative and -breaker-cooldown must be positive.")
+		os.Exit(exitConfig)
+	}
+	if commandRate < 0 || commandBurst < 1 {
+		fmt.Fprintln(os.Stderr, "[ERROR]: -rate-limit cannot be negative and -rate-burst must be at least 1.")
+		os.Exit(exitConfig)
+	}
+	if scheduleJitter < 0 || staggerDelay < 0 {
+		fmt.Fprintln(os.Stderr, "[ERROR]: -jitter and -stagger cannot be negative.")
+		os.Exit(exitConfig)
+	}
+	if sshConcurrency > 1 {
+		// Parallel refreshes would interleave their output
+		logBuffer = true
+	}
+	if pushgatewayURL != "" && !runOnce {
+		fmt.Fprintln(os.Stderr, "[ERROR]: -pushgateway requires --once; long-running daemons are scraped at /metrics.")
+		os.Exit(exitConfig)
+	}
+
+	if rolloutBatch != "" {
+		if _, err := rolloutSize(100); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			flag.Usage()
+			os.Exit(exitConfig)
+		}
+	}
+	switch verifyNames {
+	case "off", "warn", "skip", "fail":
+	default:
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown -verify-names policy %q.\n", verifyNames)
+		flag.Usage()
+		os.Exit(exitConfig)
+	}
+
+	if *slackWebhook != "" {
+		slack, err := newSlackNotifier(*slackWebhook, *slackSeverity)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
+		notifiers = append(notifiers, slack)
+	}
+
+	if len(webhooks) > 0 {
+		hook, err := newWebhookNotifier(webhooks, *webhookSecret, *webhookSeverity)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
+		notifiers = append(notifiers, hook)
+	}
+
+	// A secret store in the config's credentials section replaces the environment variables
+	if err := loadCredentialSource(configFile); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(exitConfig)
+	}
+
+	// Check for required environment variables
+	var username, password, apiKey string
+	switch *transport {
+	case "ssh":
+		username, password = checkEnvVars()
+		if knownHostsFile == "" {
+			fmt.Fprintln(os.Stderr, "[WARN]: firewall host keys are not verified; set -known-hosts.")
+		}
+	case "api":
+		// Without PAN_API_KEY a key is generated from the credentials and cached
+		apiKey = envAPIKey()
+		if apiKey == "" {
+			var err error
+			if username, password, err = lookupCredentials(); err == nil && password == "" {
+				err = errors.New("PAN_PASSWORD environment variable not set.")
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "PAN_API_KEY environment variable not set, and no credentials to generate one:", err)
+				os.Exit(exitConfig)
+			}
+		}
+		if apiParallel < 1 {
+			apiParallel = 1
+		}
+		if routeCheck || driftEvery > 0 {
+			fmt.Fprintln(os.Stderr, "[WARN]: drift and route checks need the ssh transport and are disabled.")
+			routeCheck, driftEvery = false, 0
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown transport %q.\n", *transport)
+		flag.Usage()
+		os.Exit(exitConfig)
 	}
 
 	// Load configuration file
-	fBytes, err := os.ReadFile(configFile)
+	customers, fBytes, err := loadConfig(configFile)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+		os.Exit(exitConfig)
 	}
 
-	var customers []customer
+	// Add the firewalls and tunnels Panorama manages
+	var discovered []customer
+	if panoramaHost != "" {
+		key := apiKey
+		if key == "" {
+			key = envAPIKey()
+		}
+		if key == "" && password == "" {
+			fmt.Fprintln(os.Stderr, "[ERROR]: -panorama needs PAN_API_KEY or PAN_PASSWORD.")
+			os.Exit(exitConfig)
+		}
+		discovered, err = discoverPanorama(panoramaHost, key, username, password)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(connectExitCode(err))
+		}
+		customers = mergeDiscovered(customers, discovered)
+	}
 
-	if err = yaml.Unmarshal(fBytes, &customers); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if smtpSettings != nil && smtpSettings.Username != "" && smtpSettings.password() == "" {
+		fmt.Fprintln(os.Stderr, "[ERROR]: smtp: no password; set password_env's environment variable or password.")
+		os.Exit(exitConfig)
 	}
 
-	// SSH Connection Settings
-	config := ssh.ClientConfig{
-		User:            username,
-		Auth:            []ssh.AuthMethod{ssh.Password(password)},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	// Set default firewall environments
+	if len(fwEnvs) == 0 && envFirewalls() != nil {
+		fwEnvs = stringList{envFirewallName}
+	}
+	envs, err := expandEnvs(fwEnvs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		flag.Usage()
+		os.Exit(exitConfig)
 	}
 
-	client, err := ssh.Dial("tcp4", firewall+sshPort, &config)
+	// Validate gateway/tunnel references before sending anything
+	problems, warnings := validateCustomers(customers)
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "[WARN]:", w)
+	}
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", p)
+		}
+		os.Exit(exitConfig)
+	}
+
+	// Refresh a subset on demand
+	if customers, err = selectCustomers(customers, onlyCustomers, *matchCustomers); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(exitConfig)
+	}
+	if *interactive {
+		var enabled []customer
+		for _, c := range customers {
+			if !c.Disabled {
+				enabled = append(enabled, c)
+			}
+		}
+		if customers, err = pickCustomers(enabled, os.Stdin, os.Stderr); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
+		runOnce = true
+	}
+
+	// Map customers to the firewalls they live on
+	groups, err := groupByFirewall(customers, envs)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		flag.Usage()
+		os.Exit(exitConfig)
+	}
+
+	// Discovered firewalls need no configured customers
+	if autoDiscover {
+		if discovery, err = newDiscoverFilter(*discoverInclude, *discoverExclude); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
+		auto := map[string]bool{}
+		for _, env := range envs {
+			auto[env] = true
+		}
+		groups = addBatchGroups(groups, auto)
+	}
+
+	// Blanket refresh environments don't need customers
+	if *batch != "" {
+		for _, env := range strings.Split(*batch, ",") {
+			if _, ok := firewalls[env]; !ok {
+				fmt.Fprintf(os.Stderr, "[ERROR]: Unknown batch firewall environment %q.\n", env)
+				os.Exit(exitConfig)
+			}
+			batchEnvs[env] = true
+		}
+		groups = addBatchGroups(groups, batchEnvs)
+	}
+	if *cutoverSpec != "" {
+		if cutover, err = newCutoverPlan(*cutoverSpec, *cutoverPercent, *cutoverTag); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
+		groups = cutover.apply(groups)
+	}
+	if len(groups) == 0 {
+		fmt.Fprintln(os.Stderr, "[ERROR]: Nothing to refresh: no customers and no batch environments.")
+		os.Exit(exitConfig)
+	}
+
+	// Refuse to run alongside another daemon using the same state
+	if lockFilename == "" {
+		lockFilename = stateFile + ".lock"
+	}
+	if err = acquireLock(lockFilename); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
 		os.Exit(1)
 	}
 
-	counter := 1
-	for {
-		fmt.Println("Starting iteration #", counter)
+	// Record the loaded configuration version in the state store
+	st, err := loadState(stateFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	active := st.recordConfig(configFile, fBytes)
+	if err = st.save(stateFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	totals.restore(st)
+	enableHistory()
 
-		session, err := client.NewSession()
-		if err != nil {
+	// Open the iteration journal left by the previous run
+	if journalFile != "" {
+		if jrnl, err = openJournal(journalFile); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		defer session.Close()
+	}
 
-		pipe, err := session.StdinPipe()
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+	// Archive transcripts to object storage
+	if *archiveURL != "" {
+		if archive, err = newArchiver(*archiveURL); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
 		}
-		defer pipe.Close()
+	}
 
-		if err = session.Shell(); err != nil {
-			fmt.Fprintln(os.Stderr, err)
+	// Ship logs to centralized log stores
+	if *lokiURL != "" {
+		logSinks = append(logSinks, newLokiSink(*lokiURL))
+	}
+	if *esURL != "" {
+		logSinks = append(logSinks, newElasticSink(*esURL))
+	}
+	startLogShipper()
+	if *splunkURL != "" {
+		token := os.Getenv("SPLUNK_HEC_TOKEN")
+		if token == "" {
+			fmt.Fprintln(os.Stderr, "SPLUNK_HEC_TOKEN environment variable not set.")
+			os.Exit(exitConfig)
+		}
+		startSplunk(*splunkURL, token)
+	}
+
+	// Watch goroutines, sessions and memory
+	go checkResources()
+
+	// Serve runtime introspection
+	if listenAddr != "" {
+		if err = startControlServer(listenAddr); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
 			os.Exit(1)
 		}
+	}
 
-		// Loop over customers from configuration file and jumpstart the tunnels
-		for _, customer := range customers {
-			fmt.Println("Refreshing connection:", customer.Name)
-			runCMD(pipe, fmt.Sprintf("%s %s", ikeSA, customer.Gateway))
-			runCMD(pipe, fmt.Sprintf("%s %s", ipsecSA, customer.Tunnel))
-			fmt.Println("Refresh complete for:", customer.Name)
-			fmt.Println(strings.Repeat("-", 30))
+	// Report before exiting on SIGINT/SIGTERM
+	go handleSignals()
+
+	// Re-read the config on SIGHUP
+	if !runOnce {
+		reloadSpec.envs, reloadSpec.names, reloadSpec.match, reloadSpec.st = envs, onlyCustomers, *matchCustomers, st
+		reloadSpec.discovered = discovered
+		go handleReload()
+		if isKVConfig(configFile) {
+			go watchKVConfig()
+		} else if configRefresh > 0 && isRemoteConfig(configFile) {
+			go watchRemoteConfig(configRefresh)
+		}
+		if credentialSettings != nil && credentialSettings.Source != credsEnv && credentialSettings.Refresh > 0 {
+			go refreshSecretCredentials(credentialSettings.Refresh)
 		}
+	}
 
-		pipe.Close()
-		session.Close()
-		fmt.Printf("Processing Complete for iteration # %v.\n", counter)
-		counter++
-		fmt.Printf("Waiting for next iteration (%v)..\n", counter)
-		time.Sleep(time.Duration(iTime) * time.Minute)
+	// Other vendors' drivers only refresh tunnels over SSH
+	for _, g := range groups {
+		if err := checkDriver(firewalls[g.env], g.customers, *transport == "api", batchEnvs[g.env]); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(exitConfig)
+		}
 	}
+
+	// Under systemd, the watchdog is pinged while every scheduler keeps checking in
+	if !runOnce {
+		var fws []string
+		for _, g := range groups {
+			fws = append(fws, firewalls[g.env])
+		}
+		sdStartWatchdog(fws)
+	}
+
+	// Connect to every firewall with customers and start its scheduler
+	var wg sync.WaitGroup
+	for _, g := range groups {
+		if dueOnly {
+			due := st.dueCustomers(firewalls[g.env], g.customers, dueSlack)
+			if len(due) == 0 && !batchEnvs[g.env] && !autoDiscover {
+				logger.Info(fmt.Sprintf("Nothing due on %s (%d customers).", firewalls[g.env], len(g.customers)), "firewall", firewalls[g.env])
+				continue
+			}
+			g.customers = due
+		}
+		sc := &scheduler{
+			env:        g.env,
+			firewall:   firewalls[g.env],
+			customers:  g.customers,
+			configured: g.customers,
+			batch:      batchEnvs[g.env],
+			st:         st,
+			active:     active,
+		}
+		current.register(sc.firewall, sc.env)
+		reloadMu.Lock()
+		running[sc.env] = sc
+		reloadMu.Unlock()
+		// A firewall's own profile replaces the shared credentials
+		user, pass, key := username, password, apiKey
+		if p := firewallProfiles[sc.firewall]; p != "" {
+			c, err := profileCredentials(p)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "[ERROR]: %s: %v\n", sc.firewall, err)
+				os.Exit(exitConfig)
+			}
+			user, pass, key = c.Username, c.Password, c.APIKey
+		}
+		if *transport == "api" {
+			sc.api = newAPIClient(sc.firewall, key)
+			if serial, ok := panoramaTargets[sc.firewall]; ok {
+				sc.api = newAPIClient(panoramaHost, key)
+				sc.api.target = serial
+			}
+			if key == "" {
+				if err = sc.api.login(user, pass); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: api key generation failed: %v\n", sc.firewall, err)
+					os.Exit(connectExitCode(err))
+				}
+			}
+			current.setConnection(sc.firewall, "api")
+		} else {
+			sc.user, sc.pass = user, pass
+			if err = sc.connect(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", sc.firewall, err)
+				os.Exit(connectExitCode(err))
+			}
+		}
+		sdReady()
+
+		if err := sc.verifyNames(); err != nil {
+			shutdown(err.Error(), exitConfig)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sc.run()
+		}()
+	}
+	wg.Wait()
+
+	// Reached with --once, or once every scheduler stopped after a signal
+	if rootCtx.Err() != nil {
+		shutdown(stopReason, exitOK)
+	}
+	if totals.anyFailed() {
+		shutdown("completed one iteration with failures", exitPartial)
+	}
+	shutdown("completed one iteration", exitOK)
 }
 
 // Check if environment variables are set
 func checkEnvVars() (user, pass string) {
-	username, exist := os.LookupEnv("PAN_USERNAME")
-	if !exist {
-		fmt.Fprintln(os.Stderr, "PAN_USERNAME environment variable not set.")
-		os.Exit(1)
-	} else {
-		if username == "" {
-			fmt.Fprintln(os.Stderr, "PAN_USERNAME cannot be blank.")
-			os.Exit(1)
-		} else {
-			user = username
+	user, pass, err := lookupCredentials()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfig)
+	}
+	return
+}
+
+// Read the firewall credentials from the secret store, -profile or the environment,
+// falling back to the credentials file's default profile.
+func lookupCredentials() (user, pass string, err error) {
+	if c, ok := storedCredentials(); ok {
+		if c.Username == "" {
+			return "", "", errors.New("credentials: the secret has no username and PAN_USERNAME is not set.")
+		}
+		return c.Username, c.Password, nil
+	}
+	if profileName != "" {
+		c, err := profileCredentials(profileName)
+		return c.Username, c.Password, err
+	}
+	user, pass, err = envCredentials()
+	if err != nil {
+		if c, perr := profileCredentials("default"); perr == nil && c.Username != "" {
+			return c.Username, c.Password, nil
 		}
 	}
+	return user, pass, err
+}
 
-	password, exist := os.LookupEnv("PAN_PASSWORD")
-	if !exist {
-		fmt.Fprintln(os.Stderr, "PAN_PASSWORD environment variable not set.")
-		os.Exit(1)
-	} else {
-		if username == "" {
-			fmt.Fprintln(os.Stderr, "PAN_PASSWORD cannot be blank.")
-			os.Exit(1)
-		} else {
-			pass = password
+// Read the firewall credentials from the environment.
+// PAN_PASSWORD is optional when an SSH agent holds the keys.
+func envCredentials() (user, pass string, err error) {
+	for _, v := range []struct {
+		name string
+		dst  *string
+	}{{"PAN_USERNAME", &user}, {"PAN_PASSWORD", &pass}} {
+		value, exist := os.LookupEnv(v.name)
+		if !exist && v.name == "PAN_PASSWORD" && agentAvailable() {
+			continue
+		}
+		if !exist {
+			return "", "", fmt.Errorf("%s environment variable not set.", v.name)
+		}
+		if value == "" {
+			return "", "", fmt.Errorf("%s cannot be blank.", v.name)
 		}
+		*v.dst = value
 	}
 	return
 }
 
-// Utility function for executing shell commands
-func runCMD(w io.Writer, cmd string) {
-	fmt.Println("Executing:", cmd)
-	fmt.Fprint(w, cmd+"\n")
-	time.Sleep(2 * time.Second)
-	fmt.Println("Execution Complete")
+// Utility function for executing shell commands, returning the firewall's response
+func runCMD(log *blockLog, cli *cliSession, cmd string, timeout time.Duration) (string, error) {
+	log.Println("Executing:", cmd)
+	out, err := cli.exec(cmd, timeout)
+	if err != nil {
+		return out, err
+	}
+	log.Println("Execution Complete")
+	return out, nil
 }
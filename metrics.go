@@ -0,0 +1,127 @@
+/*
+ * Filename: metrics.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Prometheus metrics, served at /metrics or pushed to a Pushgateway after --once.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	// Pushgateway base URL; empty disables pushing
+	pushgatewayURL = ""
+
+	// Pushgateway grouping labels
+	pushJob      = "tfresh"
+	pushInstance = hostname()
+)
+
+// Return the hostname, used as the default instance label
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return h
+}
+
+// Escape a label value
+func labelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// Write every metric in the text exposition format
+func writeMetrics(w io.Writer) {
+	totals.mu.Lock()
+	defer totals.mu.Unlock()
+
+	fws := make([]string, 0, len(totals.iterations))
+	for fw := range totals.iterations {
+		fws = append(fws, fw)
+	}
+	sort.Strings(fws)
+
+	fmt.Fprintln(w, "# HELP tfresh_iterations_total Iterations completed.")
+	fmt.Fprintln(w, "# TYPE tfresh_iterations_total counter")
+	for _, fw := range fws {
+		fmt.Fprintf(w, "tfresh_iterations_total{firewall=\"%s\"} %d\n", labelValue(fw), totals.iterations[fw])
+	}
+
+	fmt.Fprintln(w, "# HELP tfresh_refresh_steps_total Refresh steps by result.")
+	fmt.Fprintln(w, "# TYPE tfresh_refresh_steps_total counter")
+	for _, result := range []string{resultSuccess, resultFailed, resultSent, resultSkipped, resultQuarantined, resultHealthy} {
+		fmt.Fprintf(w, "tfresh_refresh_steps_total{result=\"%s\"} %d\n", result, totals.counts[result])
+	}
+
+	fmt.Fprintln(w, "# HELP tfresh_last_iteration_duration_seconds Duration of the latest iteration.")
+	fmt.Fprintln(w, "# TYPE tfresh_last_iteration_duration_seconds gauge")
+	for _, fw := range fws {
+		fmt.Fprintf(w, "tfresh_last_iteration_duration_seconds{firewall=\"%s\"} %g\n", labelValue(fw), totals.last[fw].duration.Seconds())
+	}
+
+	fmt.Fprintln(w, "# HELP tfresh_last_iteration_timestamp_seconds When the latest iteration completed.")
+	fmt.Fprintln(w, "# TYPE tfresh_last_iteration_timestamp_seconds gauge")
+	for _, fw := range fws {
+		fmt.Fprintf(w, "tfresh_last_iteration_timestamp_seconds{firewall=\"%s\"} %d\n", labelValue(fw), totals.lastAt[fw].Unix())
+	}
+
+	fmt.Fprintln(w, "# HELP tfresh_failing_customers Customers whose latest refresh failed.")
+	fmt.Fprintln(w, "# TYPE tfresh_failing_customers gauge")
+	for _, fw := range fws {
+		fmt.Fprintf(w, "tfresh_failing_customers{firewall=\"%s\"} %d\n", labelValue(fw), len(totals.failing[fw]))
+	}
+
+	u := measureResources()
+	fmt.Fprintln(w, "# HELP tfresh_goroutines Goroutines running.")
+	fmt.Fprintln(w, "# TYPE tfresh_goroutines gauge")
+	fmt.Fprintf(w, "tfresh_goroutines %d\n", u.Goroutines)
+	fmt.Fprintln(w, "# HELP tfresh_ssh_sessions SSH sessions open.")
+	fmt.Fprintln(w, "# TYPE tfresh_ssh_sessions gauge")
+	fmt.Fprintf(w, "tfresh_ssh_sessions %d\n", u.Sessions)
+	fmt.Fprintln(w, "# HELP tfresh_heap_bytes Heap in use.")
+	fmt.Fprintln(w, "# TYPE tfresh_heap_bytes gauge")
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	fmt.Fprintf(w, "tfresh_heap_bytes %d\n", m.HeapAlloc)
+}
+
+// Replace this job/instance's metrics on a Pushgateway
+func pushMetrics(base string) error {
+	var body bytes.Buffer
+	writeMetrics(&body)
+
+	u := strings.TrimRight(base, "/") + "/metrics/job/" + url.PathEscape(pushJob) + "/instance/" + url.PathEscape(pushInstance)
+	req, err := http.NewRequest(http.MethodPut, u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", metricsContentType)
+	resp, err := (&http.Client{Timeout: 15 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
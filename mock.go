@@ -0,0 +1,118 @@
+/*
+ * Filename: mock.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: 'tfresh mock' serves a mock PAN-OS firewall for testing configurations without one.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"tfresh/internal/mockpanos"
+)
+
+// Handle 'tfresh mock'
+func mockCommand(args []string) {
+	fs := flag.NewFlagSet("mock", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:2222", "Address to serve SSH on")
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename; its customers' gateways, tunnels and routes exist on the mock (default is config.yml)")
+	fwEnv := fs.String("e", "", "Only the customers of this firewall name or environment")
+	user := fs.String("user", os.Getenv("PAN_USERNAME"), "Username logins must use; any login is accepted when it and -password are empty (default $PAN_USERNAME)")
+	password := fs.String("password", os.Getenv("PAN_PASSWORD"), "Password logins must use (default $PAN_PASSWORD)")
+	rejectAuth := fs.Bool("reject-auth", false, "Reject every login")
+	delay := fs.Duration("delay", 0, "Delay before every response, e.g. 500ms")
+	refreshDelay := fs.Duration("refresh-delay", 0, "Extra delay for 'test vpn' commands, to simulate slow SA negotiation")
+	down := fs.String("down", "", "Comma-separated gateways and tunnels whose SAs never come up")
+	haState := fs.String("ha", "", "HA state to report (active, passive); HA is disabled when empty")
+	hostname := fs.String("hostname", "PA-VM", "Hostname shown in the prompt")
+	knownHosts := fs.String("write-known-hosts", "", "Write the mock's host key to this known_hosts file for -known-hosts")
+	quiet := fs.Bool("q", false, "Don't print the commands received")
+	fs.Parse(args)
+
+	config := mockpanos.Config{
+		Hostname:     *hostname,
+		Delay:        *delay,
+		RefreshDelay: *refreshDelay,
+		Gateways:     map[string]string{},
+		Tunnels:      map[string]string{},
+		Routes:       map[string][]string{},
+		HAState:      *haState,
+	}
+	if *user != "" || *password != "" {
+		config.Users = map[string]string{*user: *password}
+	}
+	for _, name := range strings.Split(*down, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			config.Down = append(config.Down, name)
+		}
+	}
+	if !*quiet {
+		config.OnCommand = func(user, cmd string) {
+			fmt.Printf("%s %s> %s\n", time.Now().Format("15:04:05.000"), user, cmd)
+		}
+	}
+
+	// Without a config the mock accepts any gateway and tunnel name
+	if _, err := os.Stat(configFile); err == nil {
+		customers, _, err := loadConfig(configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(1)
+		}
+		for _, c := range customers {
+			if *fwEnv != "" && c.Firewall != "" && c.Firewall != *fwEnv {
+				continue
+			}
+			if c.Gateway != "" {
+				peer := c.Peer
+				if peer == "" {
+					peer = "198.51.100.1"
+				}
+				config.Gateways[c.Gateway] = peer
+			}
+			if c.Tunnel != "" {
+				config.Tunnels[c.Tunnel] = c.Gateway
+			}
+			if c.Interface != "" {
+				config.Routes[c.Interface] = append(config.Routes[c.Interface], c.Routes...)
+			}
+		}
+	}
+
+	srv, err := mockpanos.New(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	srv.SetRejectAuth(*rejectAuth)
+	if err = srv.Listen(*addr); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	if *knownHosts != "" {
+		line := knownhosts.Line([]string{knownhosts.Normalize(srv.Addr())}, srv.HostKey())
+		if err = os.WriteFile(*knownHosts, []byte(line+"\n"), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Mock PAN-OS firewall on %s with %d gateways and %d tunnels; Ctrl-C stops it.\n",
+		srv.Addr(), len(config.Gateways), len(config.Tunnels))
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	srv.Close()
+}
@@ -0,0 +1,73 @@
+/*
+ * Filename: notify.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Notification subsystem for events operators need to act on.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// 'event' type represents something worth telling an operator about
+type event struct {
+	Type     string    `json:"type"`
+	Severity int       `json:"severity"` // sevInfo, sevWarning, sevError
+	Firewall string    `json:"firewall,omitempty"`
+	Customer string    `json:"customer,omitempty"`
+	Gateway  string    `json:"gateway,omitempty"`
+	Tunnel   string    `json:"tunnel,omitempty"`
+	Result   string    `json:"result,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+}
+
+// 'notifier' interface is implemented by every notification backend
+type notifier interface {
+	Notify(e event) error
+}
+
+// Configured notification backends
+var notifiers = []notifier{stderrNotifier{}}
+
+// Consecutive failures of a customer before refresh_failed is sent; the
+// streak is kept in the state store, so a restart doesn't start it over
+var notifyAfter = 1
+
+// Send an event to every notifier, logging backend failures
+func notify(e event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, n := range notifiers {
+		if err := n.Notify(e); err != nil {
+			logger.Error(fmt.Sprintf("notification failed: %v", err), "error", err)
+		}
+	}
+}
+
+// 'stderrNotifier' writes events to stderr; it is always enabled
+type stderrNotifier struct{}
+
+func (stderrNotifier) Notify(e event) error {
+	_, err := fmt.Fprintf(os.Stderr, "[%s] %s: %s\n", severityTag(e.Severity), e.Type, e.Message)
+	return err
+}
+
+// Return the uppercase log tag for a severity
+func severityTag(sev int) string {
+	switch sev {
+	case sevError:
+		return "ERROR"
+	case sevWarning:
+		return "WARN"
+	default:
+		return "INFO"
+	}
+}
@@ -0,0 +1,670 @@
+/*
+ * Filename: objstore.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Minimal S3, GCS and Azure Blob clients using the providers' standard credential sources.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout for a single object storage request
+const objTimeout = 60 * time.Second
+
+var objHTTP = &http.Client{Timeout: objTimeout}
+
+// 'objectInfo' type represents a stored object
+type objectInfo struct {
+	Key      string
+	Modified time.Time
+}
+
+// 'objectStore' interface is implemented by every object storage backend
+type objectStore interface {
+	Put(ctx context.Context, key string, body []byte, contentType string) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	List(ctx context.Context, prefix string) ([]objectInfo, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Open an object store from a URL, returning the store and the key prefix:
+// s3://bucket/prefix, gs://bucket/prefix or azblob://account/container/prefix
+func openObjectStore(rawURL string) (objectStore, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+	path := strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "s3":
+		return &s3Store{bucket: u.Host}, path, nil
+	case "gs":
+		return &gcsStore{bucket: u.Host}, path, nil
+	case "azblob":
+		container, prefix, _ := strings.Cut(path, "/")
+		if container == "" {
+			return nil, "", fmt.Errorf("%s: missing container (azblob://account/container/prefix)", rawURL)
+		}
+		return &azureStore{account: u.Host, container: container}, prefix, nil
+	}
+	return nil, "", fmt.Errorf("%s: unsupported object store (s3, gs, azblob)", rawURL)
+}
+
+// Send a request, returning the body of a 2xx response
+func objDo(req *http.Request) ([]byte, error) {
+	resp, err := objHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// ---- Amazon S3 ----
+
+// 'awsCredentials' type represents an AWS access key, optionally temporary
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+var (
+	awsCredsMu sync.Mutex
+	awsCreds   *awsCredentials
+)
+
+// Resolve AWS credentials from the environment, the ECS task role or the EC2 instance role
+func getAWSCredentials(ctx context.Context) (awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	awsCredsMu.Lock()
+	defer awsCredsMu.Unlock()
+	if awsCreds != nil && time.Until(awsCreds.Expiration) > 5*time.Minute {
+		return *awsCreds, nil
+	}
+
+	var c awsCredentials
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.170.2"+rel, nil)
+		body, err := objDo(req)
+		if err != nil {
+			return c, fmt.Errorf("ECS credentials: %w", err)
+		}
+		if err = json.Unmarshal(body, &c); err != nil {
+			return c, fmt.Errorf("ECS credentials: %w", err)
+		}
+	} else {
+		// IMDSv2
+		const imds = "http://169.254.169.254/latest"
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPut, imds+"/api/token", nil)
+		req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+		token, err := objDo(req)
+		if err != nil {
+			return c, fmt.Errorf("no AWS credentials in the environment and instance metadata unavailable: %w", err)
+		}
+		get := func(path string) ([]byte, error) {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, imds+path, nil)
+			req.Header.Set("X-aws-ec2-metadata-token", string(token))
+			return objDo(req)
+		}
+		role, err := get("/meta-data/iam/security-credentials/")
+		if err != nil {
+			return c, fmt.Errorf("instance role: %w", err)
+		}
+		name, _, _ := strings.Cut(strings.TrimSpace(string(role)), "\n")
+		body, err := get("/meta-data/iam/security-credentials/" + name)
+		if err != nil {
+			return c, fmt.Errorf("instance role %s: %w", name, err)
+		}
+		if err = json.Unmarshal(body, &c); err != nil {
+			return c, fmt.Errorf("instance role %s: %w", name, err)
+		}
+	}
+	awsCreds = &c
+	return c, nil
+}
+
+// AWS region from the environment
+func awsRegion() string {
+	for _, v := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if r := os.Getenv(v); r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+// Escape a string per the SigV4 rules; slashes are kept when encoding paths
+func awsEscape(s string, path bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && path:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign a request with AWS Signature Version 4
+func signV4(req *http.Request, body []byte, service, region string, c awsCredentials) {
+	signV4At(req, body, service, region, c, time.Now())
+}
+
+// Sign a request with AWS Signature Version 4 as of a given time
+func signV4At(req *http.Request, body []byte, service, region string, c awsCredentials, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	req.Header.Set("X-Amz-Date", now.UTC().Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.Token)
+	}
+	req.Header.Set("Authorization", v4Authorization(req, payloadHash, service, region, c))
+}
+
+// Compute the SigV4 Authorization header of a request that carries its X-Amz-Date
+func v4Authorization(req *http.Request, payloadHash, service, region string, c awsCredentials) string {
+	amzDate := req.Header.Get("X-Amz-Date")
+	date, _, _ := strings.Cut(amzDate, "T")
+
+	// Canonical headers: host plus every x-amz-* and content-type header
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var canonQuery []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			canonQuery = append(canonQuery, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		awsEscape(path, true),
+		strings.Join(canonQuery, "&"),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	crSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(crSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	return fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.AccessKeyID, scope, signedHeaders, sig)
+}
+
+// Send a signed AWS request
+func awsDo(ctx context.Context, method, rawURL string, body []byte, header http.Header, service string) ([]byte, error) {
+	c, err := getAWSCredentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	signV4(req, body, service, awsRegion(), c)
+	return objDo(req)
+}
+
+// 's3Store' type represents an S3 bucket
+type s3Store struct {
+	bucket string
+}
+
+// Object URL; AWS_ENDPOINT_URL_S3 selects a path-style, S3-compatible endpoint
+func (s *s3Store) url(key string, query url.Values) string {
+	var u string
+	if ep := os.Getenv("AWS_ENDPOINT_URL_S3"); ep != "" {
+		u = strings.TrimSuffix(ep, "/") + "/" + s.bucket + "/" + awsEscape(key, true)
+	} else {
+		u = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, awsRegion(), awsEscape(key, true))
+	}
+	if len(query) > 0 {
+		u += "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+	}
+	return u
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	_, err := awsDo(ctx, http.MethodPut, s.url(key, nil), body, http.Header{"Content-Type": {contentType}}, "s3")
+	return err
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	return awsDo(ctx, http.MethodGet, s.url(key, nil), nil, nil, "s3")
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	_, err := awsDo(ctx, http.MethodDelete, s.url(key, nil), nil, nil, "s3")
+	return err
+}
+
+func (s *s3Store) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var out []objectInfo
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		body, err := awsDo(ctx, http.MethodGet, s.url("", q), nil, nil, "s3")
+		if err != nil {
+			return nil, err
+		}
+		var r struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err = xml.Unmarshal(body, &r); err != nil {
+			return nil, err
+		}
+		for _, c := range r.Contents {
+			out = append(out, objectInfo{Key: c.Key, Modified: c.LastModified})
+		}
+		if !r.IsTruncated {
+			return out, nil
+		}
+		token = r.NextContinuationToken
+	}
+}
+
+// ---- Google Cloud Storage ----
+
+var (
+	gcsTokenMu  sync.Mutex
+	gcsToken    string
+	gcsTokenExp time.Time
+)
+
+// Get an OAuth token from GOOGLE_APPLICATION_CREDENTIALS or the metadata server
+func getGCSToken(ctx context.Context) (string, error) {
+	gcsTokenMu.Lock()
+	defer gcsTokenMu.Unlock()
+	if gcsToken != "" && time.Until(gcsTokenExp) > 5*time.Minute {
+		return gcsToken, nil
+	}
+
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		body, err := gcsServiceAccountToken(ctx, path)
+		if err != nil {
+			return "", err
+		}
+		if err = json.Unmarshal(body, &tok); err != nil {
+			return "", err
+		}
+	} else {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		body, err := objDo(req)
+		if err != nil {
+			return "", fmt.Errorf("no GOOGLE_APPLICATION_CREDENTIALS and metadata server unavailable: %w", err)
+		}
+		if err = json.Unmarshal(body, &tok); err != nil {
+			return "", err
+		}
+	}
+	gcsToken, gcsTokenExp = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return gcsToken, nil
+}
+
+// Exchange a signed service account JWT for an access token
+func gcsServiceAccountToken(ctx context.Context, path string) ([]byte, error) {
+	fBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sa struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err = json.Unmarshal(fBytes, &sa); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	block, _ := pem.Decode([]byte(sa.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("%s: no private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: private key is not RSA", path)
+	}
+	if sa.TokenURI == "" {
+		sa.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	enc := base64.RawURLEncoding
+	now := time.Now().Unix()
+	header := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   sa.ClientEmail,
+		"scope": "https://www.googleapis.com/auth/devstorage.read_write",
+		"aud":   sa.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	unsigned := header + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {unsigned + "." + enc.EncodeToString(sig)}}
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, sa.TokenURI, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return objDo(req)
+}
+
+// 'gcsStore' type represents a GCS bucket
+type gcsStore struct {
+	bucket string
+}
+
+func (s *gcsStore) do(ctx context.Context, method, rawURL string, body []byte, contentType string) ([]byte, error) {
+	token, err := getGCSToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return objDo(req)
+}
+
+func (s *gcsStore) object(key string) string {
+	return "https://storage.googleapis.com/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(key)
+}
+
+func (s *gcsStore) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	u := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + url.Values{"uploadType": {"media"}, "name": {key}}.Encode()
+	_, err := s.do(ctx, http.MethodPost, u, body, contentType)
+	return err
+}
+
+func (s *gcsStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, s.object(key)+"?alt=media", nil, "")
+}
+
+func (s *gcsStore) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, http.MethodDelete, s.object(key), nil, "")
+	return err
+}
+
+func (s *gcsStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var out []objectInfo
+	page := ""
+	for {
+		q := url.Values{"prefix": {prefix}}
+		if page != "" {
+			q.Set("pageToken", page)
+		}
+		body, err := s.do(ctx, http.MethodGet, "https://storage.googleapis.com/storage/v1/b/"+url.PathEscape(s.bucket)+"/o?"+q.Encode(), nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var r struct {
+			Items []struct {
+				Name    string    `json:"name"`
+				Updated time.Time `json:"updated"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err = json.Unmarshal(body, &r); err != nil {
+			return nil, err
+		}
+		for _, it := range r.Items {
+			out = append(out, objectInfo{Key: it.Name, Modified: it.Updated})
+		}
+		if r.NextPageToken == "" {
+			return out, nil
+		}
+		page = r.NextPageToken
+	}
+}
+
+// ---- Azure Blob Storage ----
+
+// Azure Storage REST API version
+const azureVersion = "2021-08-06"
+
+// 'azureStore' type represents an Azure Blob container, authenticated with
+// AZURE_STORAGE_SAS_TOKEN or the AZURE_STORAGE_KEY account key
+type azureStore struct {
+	account   string
+	container string
+}
+
+func (s *azureStore) do(ctx context.Context, method, blob string, query url.Values, body []byte, header http.Header) ([]byte, error) {
+	u := fmt.Sprintf("https://%s.blob.core.windows.net/%s", s.account, s.container)
+	if blob != "" {
+		u += "/" + awsEscape(blob, true)
+	}
+	sas := strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	rawQuery := query.Encode()
+	if sas != "" {
+		if rawQuery != "" {
+			rawQuery += "&"
+		}
+		rawQuery += sas
+	}
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureVersion)
+
+	if sas == "" {
+		key, err := base64.StdEncoding.DecodeString(os.Getenv("AZURE_STORAGE_KEY"))
+		if err != nil || len(key) == 0 {
+			return nil, errors.New("azure blob storage needs AZURE_STORAGE_SAS_TOKEN or AZURE_STORAGE_KEY")
+		}
+		s.signSharedKey(req, key, len(body), query)
+	}
+	return objDo(req)
+}
+
+// Sign a request with the storage account key (Shared Key authorization)
+func (s *azureStore) signSharedKey(req *http.Request, key []byte, length int, query url.Values) {
+	contentLength := ""
+	if length > 0 {
+		contentLength = fmt.Sprint(length)
+	}
+
+	var msHeaders []string
+	for k, v := range req.Header {
+		if lk := strings.ToLower(k); strings.HasPrefix(lk, "x-ms-") {
+			msHeaders = append(msHeaders, lk+":"+strings.TrimSpace(strings.Join(v, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + s.account + req.URL.EscapedPath()
+	qkeys := make([]string, 0, len(query))
+	for k := range query {
+		qkeys = append(qkeys, k)
+	}
+	sort.Strings(qkeys)
+	for _, k := range qkeys {
+		vals := append([]string(nil), query[k]...)
+		sort.Strings(vals)
+		resource += "\n" + strings.ToLower(k) + ":" + strings.Join(vals, ",")
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+	sig := base64.StdEncoding.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "SharedKey "+s.account+":"+sig)
+}
+
+func (s *azureStore) Put(ctx context.Context, key string, body []byte, contentType string) error {
+	_, err := s.do(ctx, http.MethodPut, key, nil, body, http.Header{"Content-Type": {contentType}, "X-Ms-Blob-Type": {"BlockBlob"}})
+	return err
+}
+
+func (s *azureStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, http.MethodGet, key, nil, nil, nil)
+}
+
+func (s *azureStore) Delete(ctx context.Context, key string) error {
+	_, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	return err
+}
+
+func (s *azureStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+	var out []objectInfo
+	marker := ""
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {prefix}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		body, err := s.do(ctx, http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var r struct {
+			Blobs []struct {
+				Name         string `xml:"Name"`
+				LastModified string `xml:"Properties>Last-Modified"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		if err = xml.Unmarshal(body, &r); err != nil {
+			return nil, err
+		}
+		for _, b := range r.Blobs {
+			modified, _ := http.ParseTime(b.LastModified)
+			out = append(out, objectInfo{Key: b.Name, Modified: modified})
+		}
+		if r.NextMarker == "" {
+			return out, nil
+		}
+		marker = r.NextMarker
+	}
+}
@@ -0,0 +1,558 @@
+/*
+ * Filename: operator.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: 'tfresh operator', a Kubernetes controller refreshing the tunnels of TunnelRefresh resources.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// TunnelRefresh custom resource API
+const (
+	crdGroup   = "tfresh.io"
+	crdVersion = "v1alpha1"
+	crdPlural  = "tunnelrefreshes"
+)
+
+// Where Kubernetes mounts the pod's service account
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// CustomResourceDefinition printed by 'tfresh operator -print-crd'
+const tunnelRefreshCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: tunnelrefreshes.tfresh.io
+spec:
+  group: tfresh.io
+  names:
+    kind: TunnelRefresh
+    listKind: TunnelRefreshList
+    plural: tunnelrefreshes
+    singular: tunnelrefresh
+    shortNames: [tfr]
+  scope: Namespaced
+  versions:
+    - name: v1alpha1
+      served: true
+      storage: true
+      subresources:
+        status: {}
+      additionalPrinterColumns:
+        - {name: Firewall, type: string, jsonPath: .spec.firewall}
+        - {name: Ready, type: string, jsonPath: '.status.conditions[?(@.type=="Ready")].status'}
+        - {name: Last Refresh, type: date, jsonPath: .status.lastRefreshTime}
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [firewall, customers]
+              properties:
+                firewall:
+                  type: string
+                  description: Firewall name or host from the operator's config; any other host needs a credentialsSecret and the operator's -known-hosts
+                interval:
+                  type: string
+                  description: Time between refreshes, e.g. 15m; defaults to the operator's -i
+                schedule:
+                  type: string
+                  description: Cron expression overriding the interval, e.g. '*/10 8-18 * * MON-FRI'
+                suspend:
+                  type: boolean
+                credentialsSecret:
+                  type: string
+                  description: Secret in the same namespace with username and password keys
+                customers:
+                  type: array
+                  description: Customer entries, as in the configuration file
+                  items:
+                    type: object
+                    x-kubernetes-preserve-unknown-fields: true
+            status:
+              type: object
+              x-kubernetes-preserve-unknown-fields: true
+`
+
+// 'tunnelRefresh' type represents a TunnelRefresh resource
+type tunnelRefresh struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec struct {
+		Firewall          string     `json:"firewall"`
+		Interval          string     `json:"interval,omitempty"`
+		Schedule          string     `json:"schedule,omitempty"`
+		Suspend           bool       `json:"suspend,omitempty"`
+		CredentialsSecret string     `json:"credentialsSecret,omitempty"`
+		Customers         []customer `json:"customers"`
+	} `json:"spec"`
+	Status tunnelRefreshStatus `json:"status"`
+}
+
+// 'tunnelRefreshStatus' type represents the status subresource the operator writes
+type tunnelRefreshStatus struct {
+	ObservedGeneration int64           `json:"observedGeneration,omitempty"`
+	LastRefreshTime    *time.Time      `json:"lastRefreshTime,omitempty"`
+	NextRefreshTime    *time.Time      `json:"nextRefreshTime,omitempty"`
+	Conditions         []kubeCondition `json:"conditions,omitempty"`
+	Tunnels            []tunnelStatus  `json:"tunnels,omitempty"`
+}
+
+// 'tunnelStatus' type represents one customer's tunnel in a TunnelRefresh status
+type tunnelStatus struct {
+	Customer   string          `json:"customer"`
+	Gateway    string          `json:"gateway,omitempty"`
+	Tunnel     string          `json:"tunnel,omitempty"`
+	Conditions []kubeCondition `json:"conditions"`
+}
+
+// 'kubeCondition' type represents a standard Kubernetes status condition
+type kubeCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"` // True, False or Unknown
+	Reason             string    `json:"reason"`
+	Message            string    `json:"message"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+	ObservedGeneration int64     `json:"observedGeneration,omitempty"`
+}
+
+// Set a condition, keeping its transition time when the status didn't change
+func setCondition(conds []kubeCondition, c kubeCondition) []kubeCondition {
+	for i, old := range conds {
+		if old.Type != c.Type {
+			continue
+		}
+		if old.Status == c.Status {
+			c.LastTransitionTime = old.LastTransitionTime
+		}
+		conds[i] = c
+		return conds
+	}
+	return append(conds, c)
+}
+
+// Status of a boolean condition
+func conditionStatus(ok bool) string {
+	if ok {
+		return "True"
+	}
+	return "False"
+}
+
+// 'kubeClient' type represents a minimal Kubernetes API client
+type kubeClient struct {
+	base      string
+	tokenFile string // re-read on every request, since projected tokens rotate
+	http      *http.Client
+}
+
+// Connect to the API server: the given URL (e.g. 'kubectl proxy' on http://127.0.0.1:8001)
+// or, when empty, the cluster the pod runs in with its service account
+func newKubeClient(apiURL string) (*kubeClient, error) {
+	if apiURL != "" {
+		return &kubeClient{base: strings.TrimSuffix(apiURL, "/"), http: &http.Client{Timeout: 30 * time.Second}}, nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod; set -kube-api")
+	}
+	ca, err := os.ReadFile(path.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("%s: no certificates", path.Join(serviceAccountDir, "ca.crt"))
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return &kubeClient{
+		base:      "https://" + strings.Trim(host, "[]") + ":" + port,
+		tokenFile: path.Join(serviceAccountDir, "token"),
+		http:      &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Send a request, decoding a JSON response into out when set
+func (k *kubeClient) do(ctx context.Context, method, p, contentType string, body, out any) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, k.base+p, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if k.tokenFile != "" {
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &status) == nil && status.Message != "" {
+			return fmt.Errorf("%s %s: %s: %s", method, p, resp.Status, status.Message)
+		}
+		return fmt.Errorf("%s %s: %s", method, p, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// List TunnelRefresh resources in a namespace, or in every namespace when empty
+func (k *kubeClient) listTunnelRefreshes(ctx context.Context, namespace string) ([]tunnelRefresh, error) {
+	p := "/apis/" + crdGroup + "/" + crdVersion + "/" + crdPlural
+	if namespace != "" {
+		p = "/apis/" + crdGroup + "/" + crdVersion + "/namespaces/" + namespace + "/" + crdPlural
+	}
+	var list struct {
+		Items []tunnelRefresh `json:"items"`
+	}
+	err := k.do(ctx, http.MethodGet, p, "", nil, &list)
+	return list.Items, err
+}
+
+// Replace a TunnelRefresh resource's status
+func (k *kubeClient) patchStatus(ctx context.Context, tr *tunnelRefresh) error {
+	p := "/apis/" + crdGroup + "/" + crdVersion + "/namespaces/" + tr.Metadata.Namespace + "/" + crdPlural + "/" + tr.Metadata.Name + "/status"
+	return k.do(ctx, http.MethodPatch, p, "application/merge-patch+json", map[string]any{"status": tr.Status}, nil)
+}
+
+// Read the username and password keys of a secret
+func (k *kubeClient) secretCredentials(ctx context.Context, namespace, name string) (user, pass string, err error) {
+	var secret struct {
+		Data map[string][]byte `json:"data"` // base64 in JSON
+	}
+	if err = k.do(ctx, http.MethodGet, "/api/v1/namespaces/"+namespace+"/secrets/"+name, "", nil, &secret); err != nil {
+		return "", "", err
+	}
+	if len(secret.Data["username"]) == 0 {
+		return "", "", fmt.Errorf("secret %s/%s has no username", namespace, name)
+	}
+	return string(secret.Data["username"]), string(secret.Data["password"]), nil
+}
+
+// 'operator' type represents the TunnelRefresh controller
+type operator struct {
+	kube       *kubeClient
+	namespace  string
+	user, pass string                  // credentials of resources without credentialsSecret
+	sessions   map[string]*replSession // firewall connections, by host and secret
+}
+
+// Reconcile every TunnelRefresh resource once
+func (o *operator) reconcileAll() {
+	trs, err := o.kube.listTunnelRefreshes(rootCtx, o.namespace)
+	if err != nil {
+		if rootCtx.Err() == nil {
+			logger.Error(fmt.Sprint("listing TunnelRefresh resources: ", err), "error", err)
+		}
+		return
+	}
+	for i := range trs {
+		if rootCtx.Err() != nil {
+			return
+		}
+		o.reconcile(&trs[i], time.Now())
+	}
+}
+
+// Refresh a resource's tunnels when they are due or its spec changed, and report the results in its status
+func (o *operator) reconcile(tr *tunnelRefresh, now time.Time) {
+	name := tr.Metadata.Namespace + "/" + tr.Metadata.Name
+	gen := tr.Metadata.Generation
+	st := &tr.Status
+	fail := func(reason string, err error) {
+		st.ObservedGeneration = gen
+		st.Conditions = setCondition(st.Conditions, kubeCondition{Type: "Ready", Status: "False", Reason: reason,
+			Message: err.Error(), LastTransitionTime: now, ObservedGeneration: gen})
+		logger.Warn(fmt.Sprintf("TunnelRefresh %s: %v", name, err), "resource", name, "reason", reason, "error", err)
+		if err := o.kube.patchStatus(rootCtx, tr); err != nil {
+			logger.Error(fmt.Sprintf("TunnelRefresh %s: status: %v", name, err), "resource", name, "error", err)
+		}
+	}
+
+	if tr.Spec.Suspend {
+		if st.ObservedGeneration != gen {
+			st.ObservedGeneration, st.NextRefreshTime = gen, nil
+			st.Conditions = setCondition(st.Conditions, kubeCondition{Type: "Ready", Status: "Unknown", Reason: "Suspended",
+				Message: "refreshes are suspended", LastTransitionTime: now, ObservedGeneration: gen})
+			if err := o.kube.patchStatus(rootCtx, tr); err != nil {
+				logger.Error(fmt.Sprintf("TunnelRefresh %s: status: %v", name, err), "resource", name, "error", err)
+			}
+		}
+		return
+	}
+
+	next, err := tr.nextRefresh(now)
+	if err != nil {
+		if st.ObservedGeneration != gen {
+			fail("InvalidSpec", err)
+		}
+		return
+	}
+	var customers []customer
+	for _, c := range tr.Spec.Customers {
+		c.Name = normalizeName(c.Name)
+		if !c.Disabled {
+			customers = append(customers, c)
+		}
+	}
+	if problems, _ := validateCustomers(customers); len(problems) > 0 {
+		if st.ObservedGeneration != gen {
+			fail("InvalidSpec", errors.New(strings.Join(problems, "; ")))
+		}
+		return
+	}
+	// A changed spec is refreshed right away
+	if st.ObservedGeneration == gen && next.After(now) {
+		return
+	}
+
+	host, err := tr.firewallHost()
+	if err != nil {
+		fail("UnknownFirewall", err)
+		return
+	}
+	r, err := o.session(tr, host)
+	if err != nil {
+		fail("CredentialsUnavailable", err)
+		return
+	}
+	logger.Info(fmt.Sprintf("TunnelRefresh %s: refreshing %d customers on %s", name, len(customers), host), "resource", name, "firewall", host)
+	var results []stepResult
+	steps := planRefresh(driverFor(host), customers, false)
+	if r.client == nil {
+		err = r.reconnect()
+	}
+	if err == nil {
+		results, err = refreshFirewall(r.client, host, steps, time.Time{})
+	}
+	if err != nil && rootCtx.Err() == nil {
+		// The connection may have dropped since the last refresh
+		if err = r.reconnect(); err == nil {
+			results, err = refreshFirewall(r.client, host, steps, time.Time{})
+		}
+	}
+	st.LastRefreshTime = &now
+	if next, _ = tr.nextRefresh(now); !next.IsZero() {
+		st.NextRefreshTime = &next
+	}
+	if err != nil {
+		fail("ConnectionFailed", err)
+		return
+	}
+
+	failed := 0
+	tunnels := map[string]tunnelStatus{}
+	for _, t := range st.Tunnels {
+		tunnels[t.Customer] = t
+	}
+	st.Tunnels = nil
+	for _, res := range results {
+		t := tunnels[res.step.customer]
+		t.Customer, t.Gateway, t.Tunnel = res.step.customer, res.step.gateway, res.step.tunnel
+		c := kubeCondition{Type: "Refreshed", Status: "True", Reason: "Succeeded", Message: "refresh commands accepted",
+			LastTransitionTime: now, ObservedGeneration: gen}
+		if res.result == resultFailed {
+			failed++
+			c.Status, c.Reason, c.Message = "False", "Failed", "refresh failed"
+			if res.err != nil {
+				c.Message = res.err.Error()
+			}
+		}
+		t.Conditions = setCondition(t.Conditions, c)
+		st.Tunnels = append(st.Tunnels, t)
+	}
+	ready := kubeCondition{Type: "Ready", Status: conditionStatus(failed == 0), Reason: "Refreshed",
+		Message: fmt.Sprintf("%d tunnels refreshed", len(results)), LastTransitionTime: now, ObservedGeneration: gen}
+	if failed > 0 {
+		ready.Reason, ready.Message = "RefreshFailed", fmt.Sprintf("%d of %d tunnels failed", failed, len(results))
+	}
+	st.ObservedGeneration = gen
+	st.Conditions = setCondition(st.Conditions, ready)
+	if err := o.kube.patchStatus(rootCtx, tr); err != nil {
+		logger.Error(fmt.Sprintf("TunnelRefresh %s: status: %v", name, err), "resource", name, "error", err)
+	}
+}
+
+// When the resource's tunnels are next due: the next cron fire time, or an interval after the last refresh
+func (tr *tunnelRefresh) nextRefresh(now time.Time) (time.Time, error) {
+	if tr.Spec.Schedule != "" {
+		sched, err := parseCron(tr.Spec.Schedule)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if last := tr.Status.LastRefreshTime; last != nil {
+			return sched.next(*last), nil
+		}
+		return sched.next(now), nil
+	}
+	interval := time.Duration(iTime) * time.Minute
+	if tr.Spec.Interval != "" {
+		d, err := time.ParseDuration(tr.Spec.Interval)
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("interval %q: must be a positive duration such as 15m", tr.Spec.Interval)
+		}
+		interval = d
+	}
+	if last := tr.Status.LastRefreshTime; last != nil {
+		return last.Add(interval), nil
+	}
+	return now, nil
+}
+
+// Resolve spec.firewall to a host. A host outside the firewalls section may be anyone's,
+// so it gets neither the operator's credentials nor an unverified host key.
+func (tr *tunnelRefresh) firewallHost() (string, error) {
+	fw := tr.Spec.Firewall
+	if h, ok := firewalls[fw]; ok {
+		return h, nil
+	}
+	for _, h := range firewalls {
+		if h == fw {
+			return h, nil
+		}
+	}
+	if tr.Spec.CredentialsSecret == "" {
+		return "", fmt.Errorf("firewall %q is not in the firewalls section; other hosts need a credentialsSecret", fw)
+	}
+	if knownHostsFile == "" {
+		return "", fmt.Errorf("firewall %q is not in the firewalls section; other hosts need -known-hosts to verify their host key", fw)
+	}
+	return fw, nil
+}
+
+// The connection to a resource's firewall, shared by resources with the same credentials
+func (o *operator) session(tr *tunnelRefresh, host string) (*replSession, error) {
+	key := host
+	user, pass := o.user, o.pass
+	if s := tr.Spec.CredentialsSecret; s != "" {
+		key += " " + tr.Metadata.Namespace + "/" + s
+		var err error
+		if user, pass, err = o.kube.secretCredentials(rootCtx, tr.Metadata.Namespace, s); err != nil {
+			return nil, err
+		}
+	} else if user == "" {
+		return nil, errors.New("no credentialsSecret and PAN_USERNAME is not set")
+	}
+	r := o.sessions[key]
+	if r == nil || r.user != user || r.pass != pass {
+		if r != nil && r.client != nil {
+			r.client.Close()
+		}
+		r = &replSession{env: host, firewall: host, user: user, pass: pass}
+		o.sessions[key] = r
+	}
+	r.customers = tr.Spec.Customers
+	return r, nil
+}
+
+// Handle 'tfresh operator'
+func operatorCommand(args []string) {
+	fs := flag.NewFlagSet("operator", flag.ExitOnError)
+	printCRD := fs.Bool("print-crd", false, "Print the TunnelRefresh CustomResourceDefinition and exit")
+	kubeAPI := fs.String("kube-api", "", "Kubernetes API server URL, e.g. 'kubectl proxy' on http://127.0.0.1:8001 (default is the pod's cluster)")
+	namespace := fs.String("namespace", os.Getenv("TFRESH_NAMESPACE"), "Namespace to watch; every namespace when empty (default $TFRESH_NAMESPACE)")
+	resync := fs.Duration("resync", 30*time.Second, "How often TunnelRefresh resources are listed and reconciled")
+	fs.IntVar(&iTime, "i", iTime, "Refresh interval in minutes of resources without interval or schedule (default 15 minutes)")
+	fs.StringVar(&configFile, "c", configFile, "Configuration file whose firewalls section spec.firewall may name; other hosts need a credentialsSecret and -known-hosts")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.Parse(args)
+
+	if *printCRD {
+		fmt.Print(tunnelRefreshCRD)
+		return
+	}
+	if *resync <= 0 {
+		fmt.Fprintln(os.Stderr, "[ERROR]: -resync must be positive.")
+		os.Exit(1)
+	}
+	if err := loadFirewalls(configFile); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	kube, err := newKubeClient(*kubeAPI)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	// Resources may bring their own credentials instead
+	o := &operator{kube: kube, namespace: *namespace, sessions: map[string]*replSession{}}
+	o.user, o.pass, _ = lookupCredentials()
+	enableHistory()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		stopRoot()
+	}()
+	defer func() {
+		for _, r := range o.sessions {
+			if r.client != nil {
+				r.client.Close()
+			}
+		}
+	}()
+
+	scope := "every namespace"
+	if o.namespace != "" {
+		scope = "namespace " + o.namespace
+	}
+	logger.Info(fmt.Sprintf("Reconciling TunnelRefresh resources in %s every %v", scope, *resync), "namespace", o.namespace)
+	for {
+		o.reconcileAll()
+		if !sleepCtx(*resync) {
+			return
+		}
+	}
+}
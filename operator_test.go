@@ -0,0 +1,40 @@
+/*
+ * Filename: operator_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the Kubernetes operator's firewall resolution.
+ */
+
+package main
+
+import "testing"
+
+func TestOperatorFirewallHost(t *testing.T) {
+	oldFirewalls, oldKnown := firewalls, knownHostsFile
+	firewalls = map[string]string{"fw-prod": "10.0.0.1"}
+	t.Cleanup(func() { firewalls, knownHostsFile = oldFirewalls, oldKnown })
+
+	resource := func(fw, secret string) *tunnelRefresh {
+		tr := &tunnelRefresh{}
+		tr.Spec.Firewall, tr.Spec.CredentialsSecret = fw, secret
+		return tr
+	}
+	for _, tc := range []struct {
+		fw, secret, knownHosts, want string
+	}{
+		{"fw-prod", "", "", "10.0.0.1"},
+		{"10.0.0.1", "", "", "10.0.0.1"},
+		{"evil.example.com", "creds", "/etc/tfresh/known_hosts", "evil.example.com"},
+		// Unlisted hosts never get the operator's credentials or an unchecked key
+		{"evil.example.com", "", "/etc/tfresh/known_hosts", ""},
+		{"evil.example.com", "creds", "", ""},
+	} {
+		knownHostsFile = tc.knownHosts
+		got, err := resource(tc.fw, tc.secret).firewallHost()
+		if got != tc.want || (err == nil) != (tc.want != "") {
+			t.Errorf("%s secret %q known hosts %q: got %q, %v; want %q", tc.fw, tc.secret, tc.knownHosts, got, err, tc.want)
+		}
+	}
+}
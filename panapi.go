@@ -0,0 +1,265 @@
+/*
+ * Filename: panapi.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: PAN-OS XML API transport with keep-alive connections and batched op commands.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout for a single XML API request
+const apiTimeout = 60 * time.Second
+
+// The firewall rejected the API key
+var errAPIForbidden = errors.New("API key rejected")
+
+var (
+	// Number of op commands in flight per firewall
+	apiParallel = 4
+
+	// Skip verification of the firewall's management certificate
+	apiInsecure = false
+)
+
+// 'apiClient' type represents an XML API connection pool to one firewall
+type apiClient struct {
+	host  string
+	keyMu sync.RWMutex
+	key   string
+	http  *http.Client
+
+	user, pass string // renew the key when it is rejected, if set
+	target     string // serial of the firewall Panorama forwards requests to, if set
+}
+
+// 'apiResponse' type represents the XML API response envelope
+type apiResponse struct {
+	Status string `xml:"status,attr"`
+	Result struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"result"`
+	Msg struct {
+		Inner string `xml:",innerxml"`
+	} `xml:"msg"`
+}
+
+// Create an XML API client that keeps up to 'parallel' connections alive
+func newAPIClient(host, key string) *apiClient {
+	transport := &http.Transport{
+		Proxy:               apiProxy(host),
+		DialContext:         apiDialer(host, &net.Dialer{Timeout: dialTimeout}),
+		TLSHandshakeTimeout: dialTimeout,
+		MaxIdleConnsPerHost: apiParallel,
+		MaxConnsPerHost:     apiParallel,
+		IdleConnTimeout:     90 * time.Second,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: apiInsecure},
+	}
+	return &apiClient{host: host, key: key, http: &http.Client{Transport: transport, Timeout: cmdTimeout(apiTimeout)}}
+}
+
+// XML form of an op command, e.g. 'test vpn ike-sa gateway gw1' -> '<test><vpn><ike-sa><gateway>gw1</gateway></ike-sa></vpn></test>'
+func (c opCommand) xml() string {
+	words := strings.Fields(c.path)
+	var b strings.Builder
+	for _, w := range words {
+		b.WriteString("<" + w + ">")
+	}
+	xml.EscapeText(&b, []byte(c.arg))
+	for i := len(words) - 1; i >= 0; i-- {
+		b.WriteString("</" + words[i] + ">")
+	}
+	return b.String()
+}
+
+// Run an op command, returning the inner XML of the result.
+// A rejected generated key is renewed once from the credentials.
+func (a *apiClient) op(cmd opCommand) (string, error) {
+	key := a.apiKey()
+	out, err := a.opWith(cmd, key)
+	if errors.Is(err, errAPIForbidden) && a.user != "" {
+		if err := a.renew(key); err != nil {
+			return "", err
+		}
+		out, err = a.opWith(cmd, a.apiKey())
+	}
+	return out, err
+}
+
+// Send an op command with the given key
+func (a *apiClient) opWith(cmd opCommand, key string) (string, error) {
+	form := url.Values{"type": {"op"}, "cmd": {cmd.xml()}}
+	if a.target != "" {
+		form.Set("target", a.target)
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://"+a.host+"/api/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-PAN-KEY", key)
+	logger.Debug(fmt.Sprintf("Sent API op %s to %s", cmd, a.host), "command", cmd.String(), "target", a.target)
+	out, err := a.do(req)
+	if err == nil {
+		logger.Debug(fmt.Sprintf("API op %s on %s returned: %s", cmd, a.host, out), "command", cmd.String(), "output", out)
+	}
+	return out, err
+}
+
+// Send a request and unwrap the response envelope
+func (a *apiClient) do(req *http.Request) (string, error) {
+	resp, err := a.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection is reused
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return "", fmt.Errorf("%s: %w", a.host, errAPIForbidden)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: HTTP %s", a.host, resp.Status)
+	}
+
+	var r apiResponse
+	if err = xml.Unmarshal(body, &r); err != nil {
+		return "", fmt.Errorf("%s: malformed API response: %w", a.host, err)
+	}
+	if r.Status != "success" {
+		msg := stripTags(r.Msg.Inner)
+		if msg == "" {
+			msg = stripTags(r.Result.Inner)
+		}
+		return "", fmt.Errorf("%s: API error: %s", a.host, msg)
+	}
+	return r.Result.Inner, nil
+}
+
+// Run op commands with bounded parallelism and the firewall's rate limit, returning
+// results and errors in command order
+func (a *apiClient) opBatch(firewall string, cmds []opCommand) ([]string, []error) {
+	results := make([]string, len(cmds))
+	errs := make([]error, len(cmds))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, apiParallel)
+	for i, cmd := range cmds {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, cmd opCommand) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if !limiterFor(firewall).wait() {
+				errs[i] = fmt.Errorf("%s: not sent, stopping", cmd)
+				return
+			}
+			current.addOutstanding(1)
+			results[i], errs[i] = a.op(cmd)
+			current.addOutstanding(-1)
+		}(i, cmd)
+	}
+	wg.Wait()
+	return results, errs
+}
+
+var tagRE = regexp.MustCompile(`<[^>]*>`)
+
+// Flatten XML to its text
+func stripTags(s string) string {
+	return strings.Join(strings.Fields(tagRE.ReplaceAllString(s, " ")), " ")
+}
+
+// Run the refresh steps of one firewall over the XML API
+func refreshFirewallAPI(api *apiClient, firewall string, steps []refreshStep) ([]stepResult, error) {
+	// Stopping: commands already in flight finish, no new batch starts
+	if rootCtx.Err() != nil {
+		return nil, nil
+	}
+	start := time.Now()
+	var errs []error
+	if staggerDelay > 0 {
+		// One customer at a time, spaced out; stopping drops the rest
+		for i, step := range steps {
+			if !stagger(i) {
+				steps = steps[:i]
+				break
+			}
+			emitRefreshStart(firewall, step)
+			current.setQueue(firewall, len(steps)-i)
+			_, stepErrs := api.opBatch(firewall, step.cmds)
+			errs = append(errs, stepErrs...)
+		}
+	} else {
+		var cmds []opCommand
+		for _, step := range steps {
+			emitRefreshStart(firewall, step)
+			cmds = append(cmds, step.cmds...)
+		}
+		current.setQueue(firewall, len(steps))
+		_, errs = api.opBatch(firewall, cmds)
+	}
+	current.setQueue(firewall, 0)
+	elapsed := time.Since(start)
+
+	var results []stepResult
+	failed := 0
+	i := 0
+	for _, step := range steps {
+		log := newStepLog(firewall, step)
+		log.Println(step)
+		var stepErrs []error
+		for _, cmd := range step.cmds {
+			log.Println("Executed:", cmd)
+			if errs[i] != nil {
+				failed++
+				stepErrs = append(stepErrs, errs[i])
+			}
+			i++
+		}
+
+		// Commands run concurrently, so each step reports the batch duration
+		r := stepResult{step: step, firewall: firewall, result: resultSuccess, duration: elapsed}
+		switch {
+		case len(stepErrs) > 0:
+			r.result, r.err = resultFailed, errors.Join(stepErrs...)
+			log.Log(fmt.Sprintf("Refresh failed for: %s: %v", step.customer, strings.ReplaceAll(r.err.Error(), "\n", "; ")),
+				"result", r.result, "duration_ms", r.duration.Milliseconds(), "error", r.err.Error())
+		case step.kind == stepTunnel:
+			log.Log("Refresh complete for: "+step.customer, "result", r.result, "duration_ms", r.duration.Milliseconds())
+		}
+		if r.err == nil {
+			jrnl.done(firewall, step)
+		}
+		log.Println(strings.Repeat("-", 30))
+		log.Flush()
+		emitRefreshResult(r)
+		breakerFor(firewall).record(r.result)
+		results = append(results, r)
+	}
+
+	if len(errs) > 0 && failed == len(errs) {
+		return results, errors.Join(errs...)
+	}
+	return results, nil
+}
@@ -0,0 +1,161 @@
+/*
+ * Filename: panorama.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Builds the refresh list from the firewalls managed by Panorama.
+ */
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Environment label of firewalls discovered through Panorama
+const panoramaEnv = "panorama"
+
+var (
+	// Panorama host to discover managed firewalls from; discovery is off when empty
+	panoramaHost string
+
+	// Serial numbers of discovered firewalls by host, for API requests proxied through Panorama
+	panoramaTargets = map[string]string{}
+)
+
+// 'panoramaDevice' type represents a firewall connected to Panorama
+type panoramaDevice struct {
+	Serial    string `xml:"serial"`
+	Hostname  string `xml:"hostname"`
+	Address   string `xml:"ip-address"`
+	Connected string `xml:"connected"`
+}
+
+// Panorama op commands
+var (
+	showDevices     = opCommand{path: "show devices connected"}
+	showGatewaysAPI = opCommand{path: "show vpn gateway"}
+	showTunnelsAPI  = opCommand{path: "show vpn tunnel"}
+)
+
+// Discover the gateways and tunnels of every firewall connected to Panorama, registering
+// the firewalls and returning a customer for each tunnel
+func discoverPanorama(host, key, user, pass string) ([]customer, error) {
+	pano := newAPIClient(host, key)
+	if key == "" {
+		if err := pano.login(user, pass); err != nil {
+			return nil, fmt.Errorf("panorama %s: %w", host, err)
+		}
+	}
+	out, err := pano.op(showDevices)
+	if err != nil {
+		return nil, fmt.Errorf("panorama %s: %w", host, err)
+	}
+	var r struct {
+		Devices []panoramaDevice `xml:"devices>entry"`
+	}
+	if err := xml.Unmarshal([]byte("<result>"+out+"</result>"), &r); err != nil {
+		return nil, fmt.Errorf("panorama %s: malformed device list: %w", host, err)
+	}
+
+	var customers []customer
+	for _, d := range r.Devices {
+		if d.Connected != "yes" || d.Address == "" {
+			continue
+		}
+		name := d.Hostname
+		if name == "" {
+			name = d.Serial
+		}
+		gws, tuns, err := listVPNAPI(pano.proxy(d.Serial))
+		if err != nil {
+			// One unreachable firewall shouldn't hide the others
+			logger.Warn(fmt.Sprintf("panorama: skipping %s (%s): %v", name, d.Serial, err), "firewall", name, "serial", d.Serial, "error", err)
+			continue
+		}
+
+		firewalls[name], firewallEnvs[name] = d.Address, panoramaEnv
+		panoramaTargets[d.Address] = d.Serial
+		for _, c := range importCustomers(name, gws, tuns) {
+			c.Firewall = name
+			c.Tags = append(c.Tags, panoramaEnv)
+			customers = append(customers, c)
+		}
+		logger.Info(fmt.Sprintf("Panorama: %s has %d gateways and %d tunnels.", name, len(gws), len(tuns)), "firewall", name, "gateways", len(gws), "tunnels", len(tuns))
+	}
+	return customers, nil
+}
+
+// Client for requests Panorama forwards to a managed firewall
+func (a *apiClient) proxy(serial string) *apiClient {
+	return &apiClient{host: a.host, key: a.apiKey(), http: a.http, user: a.user, pass: a.pass, target: serial}
+}
+
+// List gateways and tunnels over the XML API
+func listVPNAPI(a *apiClient) ([]vpnGateway, []vpnTunnel, error) {
+	out, err := a.op(showGatewaysAPI)
+	if err != nil {
+		return nil, nil, err
+	}
+	var g struct {
+		Entries []struct {
+			ID     string `xml:"gwid"`
+			Name   string `xml:"name"`
+			Peer   string `xml:"peer-ip"`
+			PeerID string `xml:"peer"`
+		} `xml:"entries>entry"`
+	}
+	if err := xml.Unmarshal([]byte("<result>"+out+"</result>"), &g); err != nil {
+		return nil, nil, fmt.Errorf("malformed gateway list: %w", err)
+	}
+	var gws []vpnGateway
+	for _, e := range g.Entries {
+		peer := e.Peer
+		if peer == "" {
+			peer = e.PeerID
+		}
+		gws = append(gws, vpnGateway{ID: e.ID, Name: e.Name, Peer: peer})
+	}
+
+	out, err = a.op(showTunnelsAPI)
+	if err != nil {
+		return nil, nil, err
+	}
+	var t struct {
+		Entries []struct {
+			ID      string `xml:"id"`
+			Name    string `xml:"name"`
+			Gateway string `xml:"gw"`
+		} `xml:"entries>entry"`
+	}
+	if err := xml.Unmarshal([]byte("<result>"+out+"</result>"), &t); err != nil {
+		return nil, nil, fmt.Errorf("malformed tunnel list: %w", err)
+	}
+	var tuns []vpnTunnel
+	for _, e := range t.Entries {
+		tuns = append(tuns, vpnTunnel{ID: e.ID, Name: e.Name, Gateway: e.Gateway})
+	}
+	return gws, tuns, nil
+}
+
+// Add discovered customers to the configured ones. A configured customer for the same
+// firewall, gateway and tunnel wins, and clashing discovered names are numbered.
+func mergeDiscovered(configured, discovered []customer) []customer {
+	seen := map[string]bool{}
+	for _, c := range configured {
+		seen[c.Firewall+"\x00"+c.Gateway+"\x00"+c.Tunnel] = true
+	}
+	all := configured
+	for _, c := range discovered {
+		k := c.Firewall + "\x00" + c.Gateway + "\x00" + c.Tunnel
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		all = append(all, c)
+	}
+	dedupeNames(all)
+	return all
+}
@@ -0,0 +1,262 @@
+/*
+ * Filename: panos.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Interactive PAN-OS CLI sessions over SSH with prompt detection.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Default time to wait for the PAN-OS prompt
+const promptTimeout = 30 * time.Second
+
+var (
+	// Longest a TCP connect plus SSH handshake may take, through any proxy or bastion
+	dialTimeout = 15 * time.Second
+
+	// Longest a refresh command may take before it fails; 0 uses promptTimeout over SSH and apiTimeout over the API
+	commandTimeout time.Duration
+
+	// Longest all of one customer's commands may take together over SSH; 0 is unlimited
+	customerTimeout time.Duration
+
+	// Longest an iteration's refreshes may take over SSH; customers not done by then fail. 0 is unlimited
+	iterationTimeout time.Duration
+)
+
+// A refresh command's timeout, given the transport's default
+func cmdTimeout(def time.Duration) time.Duration {
+	if commandTimeout > 0 {
+		return commandTimeout
+	}
+	return def
+}
+
+// Finish an SSH handshake on conn within dialTimeout
+func sshHandshake(conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	deadline := time.Now().Add(dialTimeout)
+	conn.SetDeadline(deadline)
+	cfg := *config
+	cfg.HostKeyAlgorithms = hostKeyAlgorithms(addr)
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &cfg)
+	if err != nil {
+		conn.Close()
+		// The ssh package doesn't wrap the i/o timeout
+		if !time.Now().Before(deadline) {
+			err = fmt.Errorf("SSH handshake with %s timed out after %v", addr, dialTimeout)
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// PAN-OS operational mode prompt, e.g. 'admin@palo-fw01(active)> '
+var promptRE = regexp.MustCompile(`[\w.\-]+@[\w.\-]+(\([\w\-]+\))?[>#] ?$`)
+
+var errPromptTimeout = errors.New("timed out waiting for PAN-OS prompt")
+
+// 'cliSession' type represents an interactive PAN-OS CLI shell
+type cliSession struct {
+	client  *ssh.Client // closed with the session when owned
+	session *trackedSession
+	stdin   io.WriteCloser
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	notify   chan struct{}
+	done     bool
+	prompt   string
+	promptRE *regexp.Regexp // the vendor's CLI prompt
+}
+
+// Dial a firewall's SSH service, failing over between its management addresses
+func dialFirewall(host, username, password string) (*ssh.Client, error) {
+	config := ssh.ClientConfig{
+		User:            username,
+		Auth:            authMethods(password),
+		HostKeyCallback: hostKeyCallback(),
+	}
+	return dialEndpoints(host, func(address string) (*ssh.Client, error) {
+		addr := endpointAddr(host, address)
+		conn, err := dialSSH(host, addr, username)
+		if err != nil {
+			return nil, err
+		}
+		return sshHandshake(conn, addr, &config)
+	})
+}
+
+// Open an interactive PAN-OS shell and wait for the first prompt
+func openCLI(client *ssh.Client) (*cliSession, error) {
+	// Disable paging so long output never blocks on '--more--'
+	return openShell(client, promptRE, "set cli pager off")
+}
+
+// Open an interactive shell, wait for the first prompt and run the setup commands
+func openShell(client *ssh.Client, prompt *regexp.Regexp, setup ...string) (*cliSession, error) {
+	session, err := newSession(client)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &cliSession{session: session, notify: make(chan struct{}, 1), promptRE: prompt}
+	if s.stdin, err = session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	// A wide terminal keeps PAN-OS from wrapping long commands
+	modes := ssh.TerminalModes{ssh.ECHO: 0}
+	if err = session.RequestPty("vt100", 200, 512, modes); err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err = session.Shell(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	go s.read(stdout)
+
+	out, err := s.waitPrompt(promptTimeout)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.prompt = lastLine(out)
+
+	for _, cmd := range setup {
+		if _, err = s.exec(cmd, promptTimeout); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Copy session output into the buffer
+func (s *cliSession) read(r io.Reader) {
+	chunk := make([]byte, 4096)
+	for {
+		n, err := r.Read(chunk)
+		s.mu.Lock()
+		s.buf.Write(chunk[:n])
+		if err != nil {
+			s.done = true
+		}
+		s.mu.Unlock()
+
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Wait until the buffered output ends with a prompt, consuming it
+func (s *cliSession) waitPrompt(timeout time.Duration) (string, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		s.mu.Lock()
+		out := strings.ReplaceAll(s.buf.String(), "\r", "")
+		if s.promptRE.MatchString(strings.TrimRight(out, " ")) {
+			s.buf.Reset()
+			s.mu.Unlock()
+			return out, nil
+		}
+		done := s.done
+		s.mu.Unlock()
+
+		if done {
+			return out, io.ErrUnexpectedEOF
+		}
+		select {
+		case <-s.notify:
+		case <-deadline.C:
+			return out, errPromptTimeout
+		}
+	}
+}
+
+// Run a command and return its output without the echoed command or trailing prompt
+func (s *cliSession) exec(cmd string, timeout time.Duration) (string, error) {
+	if _, err := fmt.Fprint(s.stdin, cmd+"\n"); err != nil {
+		return "", err
+	}
+	out, err := s.waitPrompt(timeout)
+	if logEnabled(slog.LevelDebug) {
+		logger.Debug(fmt.Sprintf("Sent %q, received:\n%s", cmd, strings.TrimRight(out, "\n")), "command", cmd, "output", out)
+	}
+	if err != nil {
+		return out, fmt.Errorf("%s: %w", cmd, err)
+	}
+
+	lines := strings.Split(out, "\n")
+	if len(lines) > 0 && strings.HasSuffix(strings.TrimSpace(lines[0]), cmd) {
+		lines = lines[1:]
+	}
+	if len(lines) > 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+// Dial a firewall and open a CLI session that owns the connection
+func connectCLI(host, username, password string) (*cliSession, error) {
+	client, err := dialFirewall(host, username, password)
+	if err != nil {
+		return nil, err
+	}
+	s, err := openCLI(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	s.client = client
+	return s, nil
+}
+
+// Close the shell
+func (s *cliSession) Close() error {
+	s.stdin.Close()
+	err := s.session.Close()
+	if s.client != nil {
+		s.client.Close()
+	}
+	return err
+}
+
+// Return the last line of some output
+func lastLine(out string) string {
+	out = strings.TrimRight(out, " \n")
+	if i := strings.LastIndex(out, "\n"); i >= 0 {
+		return out[i+1:]
+	}
+	return out
+}
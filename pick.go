@@ -0,0 +1,114 @@
+/*
+ * Filename: pick.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Interactive customer selection for one-off runs ('tfresh run --interactive').
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Prompt shown under the customer list
+const pickHelp = "Toggle numbers or ranges (e.g. 2,5-7), /text to toggle names containing it, 'all', 'none'; Enter runs, 'q' aborts: "
+
+// Let the operator tick which customers this run refreshes
+func pickCustomers(customers []customer, in io.Reader, out io.Writer) ([]customer, error) {
+	if len(customers) == 0 {
+		return nil, errors.New("no customers to choose from")
+	}
+	picked := make([]bool, len(customers))
+	r := bufio.NewReader(in)
+	for {
+		n := 0
+		for i, c := range customers {
+			box := "[ ]"
+			if picked[i] {
+				box = "[x]"
+				n++
+			}
+			where := c.Tunnel
+			if c.Gateway != "" {
+				where = c.Gateway + " / " + c.Tunnel
+			}
+			if c.Firewall != "" {
+				where += " on " + c.Firewall
+			}
+			fmt.Fprintf(out, "%s %3d  %-30s %s\n", box, i+1, c.Name, where)
+		}
+		fmt.Fprintf(out, "%d of %d selected. %s", n, len(customers), pickHelp)
+
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if err != nil && line == "" {
+			return nil, errors.New("selection aborted")
+		}
+		switch {
+		case line == "" && n > 0:
+			var selected []customer
+			for i, c := range customers {
+				if picked[i] {
+					selected = append(selected, c)
+				}
+			}
+			return selected, nil
+		case line == "":
+			fmt.Fprintln(out, "Nothing selected.")
+		case line == "q":
+			return nil, errors.New("selection aborted")
+		case line == "all" || line == "none":
+			for i := range picked {
+				picked[i] = line == "all"
+			}
+		case strings.HasPrefix(line, "/"):
+			text := strings.ToLower(line[1:])
+			for i, c := range customers {
+				if strings.Contains(strings.ToLower(c.Name), text) {
+					picked[i] = !picked[i]
+				}
+			}
+		default:
+			idx, err := parsePicks(line, len(customers))
+			if err != nil {
+				fmt.Fprintln(out, "[ERROR]:", err)
+				continue
+			}
+			for _, i := range idx {
+				picked[i] = !picked[i]
+			}
+		}
+	}
+}
+
+// Parse '2,5-7' into zero-based indexes below n
+func parsePicks(s string, n int) ([]int, error) {
+	var idx []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(strings.TrimSpace(lo))
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(strings.TrimSpace(hi))
+		}
+		if err != nil || first < 1 || last > n || first > last {
+			return nil, fmt.Errorf("%q is not a number or range between 1 and %d", part, n)
+		}
+		for i := first; i <= last; i++ {
+			idx = append(idx, i-1)
+		}
+	}
+	return idx, nil
+}
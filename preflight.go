@@ -0,0 +1,100 @@
+/*
+ * Filename: preflight.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Per-firewall readiness checks that never touch a tunnel ('tfresh preflight').
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// 'preflightResult' type represents the readiness of one firewall
+type preflightResult struct {
+	Env     string
+	Host    string
+	Stage   string // last stage reached: dial, shell, command, ready
+	Prompt  string
+	Clock   string
+	Elapsed time.Duration
+	Err     error
+}
+
+// Connect to a firewall, authenticate, and run a harmless command
+func preflight(env, host, username, password string) preflightResult {
+	r := preflightResult{Env: env, Host: host, Stage: "dial"}
+	start := time.Now()
+	defer func() { r.Elapsed = time.Since(start) }()
+
+	client, err := dialFirewall(host, username, password)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	defer client.Close()
+
+	r.Stage = "shell"
+	cli, err := openCLI(client)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	defer cli.Close()
+	r.Prompt = cli.prompt
+
+	r.Stage = "command"
+	out, err := cli.exec("show clock", promptTimeout)
+	if err != nil {
+		r.Err = err
+		return r
+	}
+	r.Clock = strings.TrimSpace(out)
+	r.Stage = "ready"
+	return r
+}
+
+// Handle 'tfresh preflight'
+func preflightCommand(args []string) {
+	fs := flag.NewFlagSet("preflight", flag.ExitOnError)
+	fwEnv := fs.String("e", "", fmt.Sprintf("Firewall name or environment; all when empty. Example: '%s preflight -e prod'", os.Args[0]))
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename, for its firewalls section (default is config.yml)")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.BoolVar(&knownHostsTOFU, "known-hosts-tofu", knownHostsTOFU, "Trust and record host keys missing from the known_hosts file")
+	fs.Parse(args)
+
+	if err := loadFirewalls(configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	envs, err := selectFirewalls(*fwEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	username, password := checkEnvVars()
+
+	failed := false
+	for _, env := range envs {
+		r := preflight(env, firewalls[env], username, password)
+		if r.Err != nil {
+			failed = true
+			fmt.Printf("[NOT READY] %s (%s): failed at %s after %v: %v\n", r.Env, r.Host, r.Stage, r.Elapsed.Round(time.Millisecond), r.Err)
+			continue
+		}
+		fmt.Printf("[READY] %s (%s): prompt %q, clock %q (%v)\n", r.Env, r.Host, r.Prompt, r.Clock, r.Elapsed.Round(time.Millisecond))
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Filename: probes.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Liveness and readiness endpoints on the control listener ('/healthz', '/readyz').
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Longest time since a firewall's last completed iteration before it is not ready; 0 uses twice the interval plus slack
+var readyWindow time.Duration
+
+// Window in which each firewall must complete an iteration
+func readinessWindow() time.Duration {
+	if readyWindow > 0 {
+		return readyWindow
+	}
+	return 2*time.Duration(iTime)*time.Minute + watchdogSlack
+}
+
+// Reasons each firewall is not ready, empty when all are
+func readinessProblems(now time.Time) []string {
+	window := readinessWindow()
+
+	current.mu.Lock()
+	conns := map[string]string{}
+	sleeping := map[string]bool{}
+	for fw, fa := range current.Firewalls {
+		conns[fw] = fa.Connection
+		// A cron schedule may leave hours between iterations
+		sleeping[fw] = fa.Phase == phaseSleeping && fa.NextIteration != nil && fa.NextIteration.After(now)
+	}
+	started := current.Started
+	current.mu.Unlock()
+
+	totals.mu.Lock()
+	defer totals.mu.Unlock()
+	var problems []string
+	for fw, conn := range conns {
+		if conn != "connected" && conn != "api" {
+			problems = append(problems, fmt.Sprintf("%s: connection is %s", fw, dash(conn)))
+			continue
+		}
+		// Until the first iteration completes, the window counts from startup
+		last, ok := totals.lastAt[fw]
+		if !ok {
+			last = started
+		}
+		if age := now.Sub(last); age > window && !sleeping[fw] {
+			problems = append(problems, fmt.Sprintf("%s: no completed iteration for %v (window %v)", fw, age.Round(time.Second), window))
+		}
+	}
+	if len(conns) == 0 {
+		problems = append(problems, "no firewalls registered yet")
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func init() {
+	// Liveness: the process is serving requests
+	controlMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	// Readiness: every firewall is reachable and refreshing on schedule
+	controlMux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		problems := readinessProblems(time.Now())
+		if len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -0,0 +1,267 @@
+/*
+ * Filename: proxy.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: SOCKS5 and HTTP CONNECT proxies for firewall SSH and XML API connections.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Proxy firewall connections go through, socks5://[user:pass@]host:port or http://host:port
+	proxyURL string
+
+	// Proxies set by the config's firewalls section, by host; 'none' connects directly
+	firewallProxies = map[string]string{}
+)
+
+// Parse and check a proxy URL
+func parseProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		// url.Error quotes the URL as given, password and all
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, fmt.Errorf("proxy %q: %w", redactProxy(s), err)
+	}
+	// Redacted misses a password in an opaque URL, e.g. one missing its scheme
+	name := redactProxy(u.Redacted())
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, fmt.Errorf("proxy %q: scheme must be socks5, socks5h or http", name)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %q: port is required", name)
+	}
+	return u, nil
+}
+
+// A proxy URL that didn't parse with its password masked, as (*url.URL).Redacted masks it
+func redactProxy(s string) string {
+	scheme, rest, ok := strings.Cut(s, "://")
+	if !ok {
+		scheme, rest = "", s
+	}
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return s
+	}
+	user, _, hasPass := strings.Cut(rest[:at], ":")
+	if !hasPass {
+		return s
+	}
+	if ok {
+		scheme += "://"
+	}
+	return scheme + user + ":xxxxx" + rest[at:]
+}
+
+// The proxy for a firewall host, nil to connect directly
+func proxyFor(host string) *url.URL {
+	s := proxyURL
+	if p, ok := firewallProxies[host]; ok {
+		s = p
+	}
+	if s == "" || s == "none" {
+		return nil
+	}
+	u, err := parseProxy(s)
+	if err != nil {
+		// Checked at startup and when the config is loaded
+		return nil
+	}
+	return u
+}
+
+// Proxy selection for the XML API's HTTP transport; the environment's proxy applies without one
+func apiProxy(host string) func(*http.Request) (*url.URL, error) {
+	if u := proxyFor(host); u != nil {
+		return http.ProxyURL(u)
+	}
+	if _, ok := firewallProxies[host]; ok || proxyURL == "none" {
+		return nil
+	}
+	return http.ProxyFromEnvironment
+}
+
+// Open a TCP connection to addr on behalf of a firewall host, through its proxy when it has one.
+// Dialing gives up when the daemon is stopping.
+func dialTCP(host, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	u := proxyFor(host)
+	if u == nil {
+		return d.DialContext(rootCtx, "tcp4", addr)
+	}
+	conn, err := d.DialContext(rootCtx, "tcp4", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %s: %w", u.Redacted(), err)
+	}
+	// The handshake can't outlive a stopping daemon or the dial timeout either
+	stop := context.AfterFunc(rootCtx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if u.Scheme == "http" {
+		err = httpConnect(conn, u, addr)
+	} else {
+		err = socks5Connect(conn, u, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %w", u.Redacted(), err)
+	}
+	return conn, nil
+}
+
+// Ask an HTTP proxy to tunnel to addr
+func httpConnect(conn net.Conn, u *url.URL, addr string) error {
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: http.Header{}}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// Read the response a byte at a time: what follows it already belongs to the tunnel
+	var head []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) > 8192 {
+			return errors.New("CONNECT response headers too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		head = append(head, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	return nil
+}
+
+// SOCKS5 reply codes (RFC 1928)
+var socksReplies = map[byte]string{
+	1: "general failure", 2: "connection not allowed", 3: "network unreachable", 4: "host unreachable",
+	5: "connection refused", 6: "TTL expired", 7: "command not supported", 8: "address type not supported",
+}
+
+// Ask a SOCKS5 proxy to connect to addr, with username/password authentication (RFC 1929) when the URL has them
+func socks5Connect(conn net.Conn, u *url.URL, addr string) error {
+	method := byte(0) // no authentication
+	if u.User != nil {
+		method = 2
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return errors.New("socks5: no acceptable authentication method")
+	}
+	if method == 2 {
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("socks5: username or password too long")
+		}
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	req := []byte{5, 1, 0}
+	switch ip := net.ParseIP(host); {
+	case ip.To4() != nil:
+		req = append(append(req, 1), ip.To4()...)
+	case ip != nil:
+		req = append(append(req, 4), ip...)
+	default:
+		// The proxy resolves names, so management hostnames only need to resolve on its side
+		if len(host) > 255 {
+			return errors.New("socks5: hostname too long")
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// VER REP RSV ATYP, then the bound address, which is discarded
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		msg, ok := socksReplies[head[1]]
+		if !ok {
+			msg = fmt.Sprintf("reply %d", head[1])
+		}
+		return fmt.Errorf("socks5: connecting to %s: %s", addr, msg)
+	}
+	var n int
+	switch head[3] {
+	case 1:
+		n = net.IPv4len
+	case 4:
+		n = net.IPv6len
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		n = int(l[0])
+	default:
+		return fmt.Errorf("socks5: unknown address type %d", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
@@ -0,0 +1,76 @@
+/*
+ * Filename: ratelimit.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Token bucket limiting the rate refresh commands are sent to each firewall.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// Refresh commands per second sent to each firewall; 0 is unlimited
+	commandRate = 0.0
+
+	// Commands that may be sent back to back before -rate-limit applies
+	commandBurst = 1
+)
+
+// 'limiter' type represents the token bucket of one firewall, shared by all its sessions
+type limiter struct {
+	mu       sync.Mutex
+	firewall string
+	tokens   float64 // negative when callers are queued for tokens not yet earned
+	last     time.Time
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*limiter{} // by firewall
+)
+
+// The firewall's limiter, nil when commands aren't rate limited
+func limiterFor(firewall string) *limiter {
+	if commandRate <= 0 {
+		return nil
+	}
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l := limiters[firewall]
+	if l == nil {
+		l = &limiter{firewall: firewall, tokens: float64(commandBurst), last: time.Now()}
+		limiters[firewall] = l
+	}
+	return l
+}
+
+// Take a token, sleeping until it is earned. Callers are served in the order they
+// reserve, so parallel sessions share the rate. False when the daemon is stopping.
+func (l *limiter) wait() bool {
+	if l == nil {
+		return rootCtx.Err() == nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*commandRate, float64(commandBurst))
+	l.last = now
+	l.tokens--
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / commandRate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if d <= 0 {
+		return rootCtx.Err() == nil
+	}
+	logger.Debug(fmt.Sprintf("Rate limit on %s: waiting %v", l.firewall, d.Round(time.Millisecond)), "firewall", l.firewall, "wait_ms", d.Milliseconds())
+	return sleepCtx(d)
+}
@@ -0,0 +1,327 @@
+/*
+ * Filename: refresh.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Builds the commands that jumpstart a firewall's tunnels and runs them over SSH.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Palo commands to jumpstart VPN tunnels
+var (
+	ikeSA   = opCommand{path: "test vpn ike-sa gateway"}
+	ipsecSA = opCommand{path: "test vpn ipsec-sa tunnel"}
+
+	// Jumpstart every VPN tunnel on a firewall
+	ikeSAAll   = opCommand{path: "test vpn ike-sa"}
+	ipsecSAAll = opCommand{path: "test vpn ipsec-sa"}
+)
+
+// SSH sessions refreshing one firewall's customers in parallel
+var sshConcurrency = 1
+
+// 'opCommand' type represents a PAN-OS operational command: a keyword path and an optional target
+type opCommand struct {
+	path string
+	arg  string
+}
+
+// Return a copy of the command with a target
+func (c opCommand) with(arg string) opCommand {
+	c.arg = arg
+	return c
+}
+
+// CLI form of the command
+func (c opCommand) String() string {
+	if c.arg == "" {
+		return c.path
+	}
+	return c.path + " " + c.arg
+}
+
+// Refresh step kinds
+const (
+	stepTunnel        = "tunnel"
+	stepAll           = "all"
+	stepGlobalProtect = "globalprotect"
+)
+
+// 'refreshStep' type represents the commands sent for one customer (or the whole firewall)
+type refreshStep struct {
+	kind     string
+	customer string
+	gateway  string
+	tunnel   string
+	cmds     []opCommand
+}
+
+// Identity of the step within an iteration, used by the journal
+func (s refreshStep) key() string {
+	return s.kind + ":" + s.customer
+}
+
+// Describe the step before running it
+func (s refreshStep) String() string {
+	switch s.kind {
+	case stepAll:
+		return "Refreshing all tunnels"
+	case stepGlobalProtect:
+		return "Restarting GlobalProtect for: " + s.customer
+	default:
+		return "Refreshing connection: " + s.customer
+	}
+}
+
+// Build the refresh steps for the customers on one firewall in its vendor's commands.
+// In batch mode every tunnel is jumpstarted at once and only GlobalProtect entries are handled per customer.
+func planRefresh(drv driver, customers []customer, batch bool) []refreshStep {
+	var steps []refreshStep
+	if batch {
+		steps = append(steps, refreshStep{kind: stepAll, cmds: []opCommand{ikeSAAll, ipsecSAAll}})
+	}
+
+	gpRestarted := map[string]bool{}
+	for _, c := range customers {
+		if c.isGlobalProtect() {
+			// GlobalProtect restarts are firewall-wide, so each component restarts once per iteration
+			cmd := globalProtectCommands[c.gpComponent()]
+			if gpRestarted[cmd.String()] {
+				continue
+			}
+			gpRestarted[cmd.String()] = true
+			steps = append(steps, refreshStep{kind: stepGlobalProtect, customer: c.Name, cmds: []opCommand{cmd}})
+			continue
+		}
+		if batch {
+			continue
+		}
+
+		step := refreshStep{kind: stepTunnel, customer: c.Name, gateway: c.Gateway, tunnel: c.Tunnel}
+		if c.Gateway != "" {
+			step.cmds = append(step.cmds, drv.RefreshIKE(c.Gateway))
+		}
+		if c.Tunnel != "" {
+			step.cmds = append(step.cmds, drv.RefreshIPsec(c.Tunnel))
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// PAN-OS responses that mean a command was rejected or did nothing
+var cmdFailures = []string{"invalid syntax", "unknown command", "server error", "not found", "error:", "failed", "initiate 0 "}
+
+// Check a command's response, returning the offending line when the firewall rejected it
+func checkOutput(out string) error {
+	for _, line := range strings.Split(out, "\n") {
+		lower := strings.ToLower(strings.TrimSpace(line))
+		for _, f := range cmdFailures {
+			if strings.Contains(lower, f) {
+				return fmt.Errorf("firewall responded: %s", strings.TrimSpace(line))
+			}
+		}
+	}
+	return nil
+}
+
+// Run the refresh steps of one firewall over SSH, checking each command's response.
+// With sshConcurrency above 1, steps are spread over that many sessions. Steps not
+// finished by the deadline fail; the zero deadline has no limit.
+func refreshFirewall(client *ssh.Client, firewall string, steps []refreshStep, deadline time.Time) ([]stepResult, error) {
+	workers := min(sshConcurrency, len(steps))
+	if workers <= 1 {
+		cli, err := driverFor(firewall).Connect(client)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { cli.Close() }()
+		return refreshSteps(client, &cli, firewall, steps, deadline)
+	}
+
+	// Workers take the next step from a shared index; results stay in step order
+	var mu sync.Mutex
+	next := 0
+	take := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		i := next
+		if i < len(steps) {
+			next++
+			current.setQueue(firewall, len(steps)-i)
+		}
+		return i
+	}
+	results := make([]*stepResult, len(steps))
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			cli, err := driverFor(firewall).Connect(client)
+			if err != nil {
+				errs[w] = err
+				return
+			}
+			defer func() { cli.Close() }()
+			for n, i := 0, take(); i < len(steps) && stagger(n); n, i = n+1, take() {
+				if !breakerFor(firewall).allow() {
+					r := skipOpenCircuit(firewall, steps[i])
+					results[i] = &r
+					continue
+				}
+				r, err := runStep(client, &cli, firewall, steps[i], deadline)
+				if err != nil {
+					// The step in hand fails so it is retried and reported; the workers
+					// still running take the steps this one won't get to
+					r = stepResult{step: steps[i], firewall: firewall, result: resultFailed, err: err}
+					emitRefreshResult(r)
+					results[i] = &r
+					errs[w] = err
+					return
+				}
+				results[i] = &r
+			}
+		}(w)
+	}
+	wg.Wait()
+	current.setQueue(firewall, 0)
+
+	var done []stepResult
+	for _, r := range results {
+		if r != nil {
+			done = append(done, *r)
+		}
+	}
+	// The connection is only lost when every worker failed or a session died
+	var err error
+	failed := 0
+	for _, e := range errs {
+		if e == nil {
+			continue
+		}
+		failed++
+		if err == nil || errors.Is(e, io.ErrUnexpectedEOF) {
+			err = e
+		}
+	}
+	if failed < workers && !errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+	return done, err
+}
+
+// Run steps one after another on a CLI session
+func refreshSteps(client *ssh.Client, cli **cliSession, firewall string, steps []refreshStep, deadline time.Time) ([]stepResult, error) {
+	var results []stepResult
+	for i, step := range steps {
+		if !stagger(i) {
+			// Stopping: the rest is left to the next run, which resumes from the journal
+			break
+		}
+		current.setQueue(firewall, len(steps)-i)
+		if !breakerFor(firewall).allow() {
+			results = append(results, skipOpenCircuit(firewall, step))
+			continue
+		}
+		r, err := runStep(client, cli, firewall, step, deadline)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, r)
+	}
+	current.setQueue(firewall, 0)
+	return results, nil
+}
+
+// Run one step, returning an error only when the session is gone. A command that
+// times out leaves the session mid-command, so it is replaced for the next one.
+func runStep(client *ssh.Client, cli **cliSession, firewall string, step refreshStep, deadline time.Time) (stepResult, error) {
+	drv := driverFor(firewall)
+	start := time.Now()
+	emitRefreshStart(firewall, step)
+	log := newStepLog(firewall, step)
+	log.Println(step)
+
+	// The customer's own limit, unless the iteration's comes first
+	limit, limitFlag := deadline, "-iteration-timeout"
+	if customerTimeout > 0 && (limit.IsZero() || start.Add(customerTimeout).Before(limit)) {
+		limit, limitFlag = start.Add(customerTimeout), "-customer-timeout"
+	}
+	var stepErrs []error
+	for _, cmd := range step.cmds {
+		timeout := cmdTimeout(promptTimeout)
+		if !limit.IsZero() {
+			left := time.Until(limit)
+			if left <= 0 {
+				stepErrs = append(stepErrs, fmt.Errorf("%s: not sent, %s reached", cmd, limitFlag))
+				continue
+			}
+			timeout = min(timeout, left)
+		}
+		if !limiterFor(firewall).wait() {
+			stepErrs = append(stepErrs, fmt.Errorf("%s: not sent, stopping", cmd))
+			continue
+		}
+		current.setStep(firewall, step.customer, cmd.String())
+		current.addOutstanding(1)
+		out, err := runCMD(log, *cli, cmd.String(), timeout)
+		current.addOutstanding(-1)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// The session is gone; later steps can't run either
+			log.Flush()
+			breakerFor(firewall).record(resultFailed)
+			return stepResult{}, err
+		}
+		if errors.Is(err, errPromptTimeout) {
+			(*cli).Close()
+			fresh, rerr := drv.Connect(client)
+			if rerr != nil {
+				log.Flush()
+				breakerFor(firewall).record(resultFailed)
+				return stepResult{}, fmt.Errorf("reopening the CLI after %v: %w", err, rerr)
+			}
+			*cli = fresh
+		}
+		if err == nil {
+			if err = drv.Check(out); err != nil {
+				err = fmt.Errorf("%s: %w", cmd, err)
+			}
+		}
+		if err != nil {
+			stepErrs = append(stepErrs, err)
+		}
+	}
+
+	r := stepResult{step: step, firewall: firewall, result: resultSuccess, duration: time.Since(start)}
+	switch {
+	case len(stepErrs) > 0:
+		r.result, r.err = resultFailed, errors.Join(stepErrs...)
+		log.Log(fmt.Sprintf("Refresh failed for: %s: %v", step.customer, strings.ReplaceAll(r.err.Error(), "\n", "; ")),
+			"result", r.result, "duration_ms", r.duration.Milliseconds(), "error", r.err.Error())
+	case step.kind == stepTunnel:
+		log.Log("Refresh complete for: "+step.customer, "result", r.result, "duration_ms", r.duration.Milliseconds())
+	}
+	if r.err == nil {
+		jrnl.done(firewall, step)
+	}
+	log.Println(strings.Repeat("-", 30))
+	log.Flush()
+	breakerFor(firewall).record(r.result)
+	emitRefreshResult(r)
+	return r, nil
+}
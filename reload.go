@@ -0,0 +1,157 @@
+/*
+ * Filename: reload.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Re-reads the configuration on SIGHUP without dropping firewall connections.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// 'reloadedConfig' type represents a validated config waiting for a scheduler's next iteration
+type reloadedConfig struct {
+	customers []customer
+	active    configVersion
+}
+
+// How the daemon selected and grouped customers at startup, reused by reloads
+var reloadSpec struct {
+	envs  []string // -e
+	names []string // -customer
+	match string   // -match
+	st    *state
+
+	// Customers Panorama reported at startup, merged into every reloaded config
+	discovered []customer
+}
+
+var (
+	// Serializes reloads
+	reloadMu sync.Mutex
+
+	// Running schedulers, by firewall environment
+	running = map[string]*scheduler{}
+)
+
+// Reload the config on every SIGHUP
+func handleReload() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	for range sigs {
+		if err := reloadConfig(); err != nil {
+			logger.Error(fmt.Sprintf("config reload failed, keeping the current customers: %v", err), "config", configFile, "error", err)
+			notify(event{Type: "config_reload_failed", Severity: sevError, Message: err.Error()})
+		}
+	}
+}
+
+// Re-read and validate the config, handing each scheduler its new customers for
+// its next iteration. Firewalls are not re-read: adding one needs a restart.
+func reloadConfig() error {
+	return reload(false)
+}
+
+// Reload only when the config differs from the active version, for polled sources
+func reloadChangedConfig() error {
+	return reload(true)
+}
+
+func reload(changedOnly bool) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	doc, fBytes, err := readConfigTree(configFile)
+	if _, ok := err.(*os.PathError); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", configFile, err)
+	}
+	if changedOnly {
+		sum := sha256.Sum256(fBytes)
+		stateMu.Lock()
+		versions := reloadSpec.st.ConfigVersions
+		same := len(versions) > 0 && versions[len(versions)-1].Hash == hex.EncodeToString(sum[:])
+		stateMu.Unlock()
+		if same {
+			return nil
+		}
+	}
+	// Panorama's firewalls would otherwise be left without customers
+	customers := mergeDiscovered(doc.Customers, reloadSpec.discovered)
+	if customers, err = selectCustomers(customers, reloadSpec.names, reloadSpec.match); err != nil {
+		return err
+	}
+	problems, warnings := validateCustomers(customers)
+	for _, w := range warnings {
+		logger.Warn(w, "config", configFile)
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	groups, err := groupByFirewall(customers, reloadSpec.envs)
+	if err != nil {
+		return err
+	}
+
+	stateMu.Lock()
+	active := reloadSpec.st.recordConfig(configFile, fBytes)
+	err = reloadSpec.st.save(stateFile)
+	stateMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	byEnv := map[string][]customer{}
+	for _, g := range groups {
+		byEnv[g.env] = g.customers
+	}
+	if cutover != nil {
+		cutover.setCustomers(byEnv[cutover.Old])
+		delete(byEnv, cutover.Old)
+	}
+	for env, cs := range byEnv {
+		if running[env] == nil && len(cs) > 0 {
+			logger.Warn(fmt.Sprintf("%d customers on %s are not refreshed until restart: no connection to it is open", len(cs), env), "environment", env)
+		}
+	}
+	for env, sc := range running {
+		sc.pending.Store(&reloadedConfig{customers: byEnv[env], active: active})
+	}
+
+	msg := fmt.Sprintf("Reloaded %s as config version %.12s (%d customers), applying from the next iteration", configFile, active.Hash, len(customers))
+	logger.Info(msg, "config", configFile, "version", active.Hash)
+	notify(event{Type: "config_reloaded", Severity: sevInfo, Message: msg})
+	return nil
+}
+
+// Switch to a reloaded config, if one is waiting
+func (sc *scheduler) applyReload(log *blockLog) {
+	r := sc.pending.Swap(nil)
+	if r == nil {
+		return
+	}
+	prevCustomers, prevConfigured, prevActive, prevUnverified := sc.customers, sc.configured, sc.active, sc.unverified
+	sc.customers, sc.configured, sc.active = r.customers, r.customers, r.active
+	// Reloaded customers are checked like those at startup, but a failure keeps the running config
+	if err := sc.verifyNames(); err != nil {
+		sc.customers, sc.configured, sc.active, sc.unverified = prevCustomers, prevConfigured, prevActive, prevUnverified
+		logger.Error(fmt.Sprintf("config reload failed, keeping the current customers: %v", err), "firewall", sc.firewall, "error", err)
+		notify(event{Type: "config_reload_failed", Severity: sevError, Firewall: sc.firewall, Message: err.Error()})
+		return
+	}
+	log.Println("Applied reloaded config version:", sc.active)
+}
@@ -0,0 +1,158 @@
+/*
+ * Filename: remoteconfig.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Configuration fetched from a URL ('-c https://...', s3://, gs://), re-fetched periodically.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Bearer token sent with requests to the scheme and host of -c only
+	configToken = os.Getenv("TFRESH_CONFIG_TOKEN")
+
+	// Also send the token over plain http
+	configTokenHTTP bool
+
+	// How often a remote configuration is re-fetched, 0 disables it
+	configRefresh = 5 * time.Minute
+)
+
+// Timeout for one configuration request
+const remoteConfigTimeout = 30 * time.Second
+
+// 'cachedConfig' type represents the last copy of a remote configuration
+type cachedConfig struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+var (
+	remoteConfigMu    sync.Mutex
+	remoteConfigCache = map[string]*cachedConfig{} // by URL
+	remoteConfigHTTP  = &http.Client{Timeout: remoteConfigTimeout}
+)
+
+// Report whether a configuration source is fetched rather than read from disk
+func isRemoteConfig(source string) bool {
+	scheme, _, ok := strings.Cut(source, "://")
+	if !ok {
+		return false
+	}
+	switch scheme {
+	case "http", "https", "s3", "gs", "azblob", "consul", "etcd":
+		return true
+	}
+	return false
+}
+
+// Fetch a remote configuration: over HTTP(S), or an object with credentials from the environment
+func fetchRemoteConfig(source string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(rootCtx, remoteConfigTimeout)
+	defer cancel()
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		return fetchHTTPConfig(ctx, source)
+	}
+	if isKVConfig(source) {
+		return fetchKVConfig(ctx, source)
+	}
+	store, key, err := openObjectStore(source)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		return nil, fmt.Errorf("%s: names a prefix, not a configuration object", source)
+	}
+	return store.Get(ctx, key)
+}
+
+// GET a configuration over HTTP(S), revalidating the cached copy with its ETag
+func fetchHTTPConfig(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "tfresh")
+	if configToken != "" && sameOrigin(req.URL, configFile) {
+		if req.URL.Scheme != "https" && !configTokenHTTP {
+			return nil, fmt.Errorf("%s: refusing to send -config-token over %s; use https or -config-token-http", req.URL.Redacted(), req.URL.Scheme)
+		}
+		req.Header.Set("Authorization", "Bearer "+configToken)
+	}
+	remoteConfigMu.Lock()
+	cached := remoteConfigCache[rawURL]
+	remoteConfigMu.Unlock()
+	if cached != nil {
+		if cached.etag != "" {
+			req.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.lastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.lastModified)
+		}
+	}
+
+	resp, err := remoteConfigHTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.body, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("GET %s: %s", req.URL.Redacted(), resp.Status)
+	}
+	remoteConfigMu.Lock()
+	remoteConfigCache[rawURL] = &cachedConfig{etag: resp.Header.Get("ETag"), lastModified: resp.Header.Get("Last-Modified"), body: body}
+	remoteConfigMu.Unlock()
+	return body, nil
+}
+
+// Report whether a URL has the scheme and host of a configuration source, so an
+// include elsewhere doesn't receive the token meant for -c
+func sameOrigin(u *url.URL, source string) bool {
+	s, err := url.Parse(source)
+	return err == nil && strings.EqualFold(u.Scheme, s.Scheme) && strings.EqualFold(u.Host, s.Host)
+}
+
+// Resolve an include of a remote configuration against its URL; remote includes can't be globs
+func resolveRemoteInclude(base, ref string) ([]string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	r, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	return []string{b.ResolveReference(r).String()}, nil
+}
+
+// Re-fetch the configuration every interval, reloading when it changed
+func watchRemoteConfig(every time.Duration) {
+	for sleepCtx(every) {
+		if err := reloadChangedConfig(); err != nil {
+			logger.Error(fmt.Sprintf("config refresh failed, keeping the current customers: %v", err), "config", configFile, "error", err)
+			notify(event{Type: "config_reload_failed", Severity: sevError, Message: err.Error()})
+		}
+	}
+}
@@ -0,0 +1,198 @@
+/*
+ * Filename: report.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Iteration report in HTML, CSV or JSON for attaching to change tickets.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Report file to write after each iteration; empty disables it
+var reportFile = ""
+
+var (
+	reportMu sync.Mutex
+	reports  = map[string]iterationReport{} // latest iteration, by firewall
+)
+
+// 'runReport' type represents the content of the report: the latest iteration of every firewall
+type runReport struct {
+	Generated time.Time        `json:"generated"`
+	Config    string           `json:"config"`
+	Firewalls []firewallReport `json:"firewalls"`
+	Totals    reportCounts     `json:"totals"`
+	Duration  float64          `json:"total_seconds"` // from the first iteration's start to the last one's end
+}
+
+// 'firewallReport' type represents one firewall's iteration in the report
+type firewallReport struct {
+	iterationReport
+	reportCounts
+}
+
+// 'reportCounts' type represents the customer tallies of the report
+type reportCounts struct {
+	Processed int `json:"processed"`
+	Succeeded int `json:"succeeded"` // refreshed, or sent where output isn't read
+	Failed    int `json:"failed"`
+	Skipped   int `json:"skipped"` // healthy, quarantined or already done by an interrupted run
+}
+
+// Report format for a filename's extension
+func reportFormat(filename string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".html", ".htm":
+		return "html", nil
+	case ".csv":
+		return "csv", nil
+	case ".json":
+		return "json", nil
+	default:
+		return "", fmt.Errorf("report %s: unknown extension %q (.html, .csv, .json)", filename, ext)
+	}
+}
+
+// Tally an iteration's customer results
+func countResults(r iterationReport) reportCounts {
+	var c reportCounts
+	for _, res := range r.Results {
+		if res.Customer == "" {
+			continue
+		}
+		c.Processed++
+		switch res.Result {
+		case resultSuccess, resultSent:
+			c.Succeeded++
+		case resultFailed:
+			c.Failed++
+		default:
+			c.Skipped++
+		}
+	}
+	return c
+}
+
+// Record a completed iteration and rewrite the report
+func recordReport(r iterationReport) {
+	if reportFile == "" {
+		return
+	}
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	reports[r.Firewall] = r
+
+	rep := runReport{Generated: time.Now(), Config: configFile}
+	fws := make([]string, 0, len(reports))
+	for fw := range reports {
+		fws = append(fws, fw)
+	}
+	sort.Strings(fws)
+	var first, last time.Time
+	for _, fw := range fws {
+		fr := firewallReport{iterationReport: reports[fw], reportCounts: countResults(reports[fw])}
+		rep.Firewalls = append(rep.Firewalls, fr)
+		rep.Totals.Processed += fr.Processed
+		rep.Totals.Succeeded += fr.Succeeded
+		rep.Totals.Failed += fr.Failed
+		rep.Totals.Skipped += fr.Skipped
+		end := fr.Started.Add(time.Duration(fr.Duration * float64(time.Second)))
+		if first.IsZero() || fr.Started.Before(first) {
+			first = fr.Started
+		}
+		if end.After(last) {
+			last = end
+		}
+	}
+	rep.Duration = last.Sub(first).Seconds()
+
+	format, _ := reportFormat(reportFile)
+	var content []byte
+	var err error
+	switch format {
+	case "html":
+		content, err = rep.html()
+	case "csv":
+		content, err = rep.csv()
+	default:
+		content, err = json.MarshalIndent(rep, "", "  ")
+	}
+	if err == nil {
+		err = writeFileAtomic(reportFile, content, ".tfresh-report-*")
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprint("report: ", err), "error", err)
+	}
+}
+
+// One row per customer result
+func (rep runReport) csv() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"firewall", "iteration", "started", "customer", "kind", "result", "duration_seconds", "error", "commands"})
+	for _, fr := range rep.Firewalls {
+		for _, res := range fr.Results {
+			w.Write([]string{fr.Firewall, strconv.Itoa(fr.Iteration), fr.Started.Format(time.RFC3339), res.Customer, res.Kind, res.Result,
+				strconv.FormatFloat(res.Duration, 'f', 3, 64), res.Error, strings.Join(res.Commands, "; ")})
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"seconds": func(s float64) string {
+		return (time.Duration(s * float64(time.Second))).Round(time.Millisecond).String()
+	},
+	"time": func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>tfresh report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+.failed { color: #b00; font-weight: bold; }
+.success, .sent { color: #070; }
+</style>
+</head>
+<body>
+<h1>tfresh report</h1>
+<p>Generated {{time .Generated}} from {{.Config}}.</p>
+<table>
+<tr><th>Firewall</th><th>Iteration</th><th>Started</th><th>Processed</th><th>Succeeded</th><th>Failed</th><th>Skipped</th><th>Total time</th></tr>
+{{range .Firewalls}}<tr><td>{{.Firewall}}</td><td>{{.Iteration}}</td><td>{{time .Started}}</td><td>{{.Processed}}</td><td>{{.Succeeded}}</td><td{{if .Failed}} class="failed"{{end}}>{{.Failed}}</td><td>{{.Skipped}}</td><td>{{seconds .Duration}}</td></tr>
+{{end}}<tr><th colspan="3">Total</th><th>{{.Totals.Processed}}</th><th>{{.Totals.Succeeded}}</th><th>{{.Totals.Failed}}</th><th>{{.Totals.Skipped}}</th><th>{{seconds .Duration}}</th></tr>
+</table>
+{{range .Firewalls}}<h2>{{.Firewall}}, iteration {{.Iteration}}</h2>
+<table>
+<tr><th>Customer</th><th>Result</th><th>Duration</th><th>Commands</th><th>Error</th></tr>
+{{range .Results}}<tr><td>{{.Customer}}</td><td class="{{.Result}}">{{.Result}}</td><td>{{seconds .Duration}}</td><td>{{range .Commands}}<code>{{.}}</code><br>{{end}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}</body>
+</html>
+`))
+
+func (rep runReport) html() ([]byte, error) {
+	var buf bytes.Buffer
+	err := reportTemplate.Execute(&buf, rep)
+	return buf.Bytes(), err
+}
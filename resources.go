@@ -0,0 +1,148 @@
+/*
+ * Filename: resources.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Resource caps, periodic self-checks and SSH session leak detection.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// Caps, 0 disables each; the session cap is per firewall connection
+	maxGoroutines = 1000
+	maxSessions   = 16
+	maxMemoryMiB  = 512
+
+	// SSH sessions currently open, in total and by connection
+	openSessions   atomic.Int64
+	sessionsMu     sync.Mutex
+	clientSessions = map[*ssh.Client]int{}
+)
+
+const (
+	// How often resources are checked
+	resourceCheckEvery = 30 * time.Second
+
+	// Consecutive idle checks with open sessions before reporting a leak
+	leakChecks = 2
+)
+
+// 'resourceUsage' type represents one resource self-check
+type resourceUsage struct {
+	Goroutines int       `json:"goroutines"`
+	Sessions   int       `json:"ssh_sessions"`
+	HeapMiB    int       `json:"heap_mib"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// 'trackedSession' type is an SSH session counted against its connection's session cap
+type trackedSession struct {
+	*ssh.Session
+	client *ssh.Client
+	once   sync.Once
+}
+
+// Open an SSH session, refusing past the connection's session cap. Each firewall has its
+// own connection, so the cap bounds one firewall's sessions however many are refreshed.
+func newSession(client *ssh.Client) (*trackedSession, error) {
+	sessionsMu.Lock()
+	if maxSessions > 0 && clientSessions[client] >= maxSessions {
+		sessionsMu.Unlock()
+		return nil, fmt.Errorf("SSH session cap of %d per firewall reached, sessions are probably leaking", maxSessions)
+	}
+	clientSessions[client]++
+	sessionsMu.Unlock()
+	openSessions.Add(1)
+	s := &trackedSession{client: client}
+	err := sessionRetry.do("SSH session", func() (err error) {
+		s.Session, err = client.NewSession()
+		return err
+	})
+	if err != nil {
+		s.release()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close the session, releasing its slot once
+func (s *trackedSession) Close() error {
+	s.once.Do(s.release)
+	return s.Session.Close()
+}
+
+// Give back the session's slot, forgetting connections without sessions
+func (s *trackedSession) release() {
+	openSessions.Add(-1)
+	sessionsMu.Lock()
+	if clientSessions[s.client]--; clientSessions[s.client] <= 0 {
+		delete(clientSessions, s.client)
+	}
+	sessionsMu.Unlock()
+}
+
+// Take a resource snapshot
+func measureResources() resourceUsage {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return resourceUsage{
+		Goroutines: runtime.NumGoroutine(),
+		Sessions:   int(openSessions.Load()),
+		HeapMiB:    int(m.HeapAlloc >> 20),
+		CheckedAt:  time.Now(),
+	}
+}
+
+// Periodically check resources, exiting loudly when a cap is exceeded
+func checkResources() {
+	current.setResources(measureResources())
+	leaking := 0
+	for range time.Tick(resourceCheckEvery) {
+		u := measureResources()
+		current.setResources(u)
+
+		var exceeded string
+		switch {
+		case maxGoroutines > 0 && u.Goroutines > maxGoroutines:
+			exceeded = fmt.Sprintf("%d goroutines running, cap is %d", u.Goroutines, maxGoroutines)
+		case maxMemoryMiB > 0 && u.HeapMiB > maxMemoryMiB:
+			exceeded = fmt.Sprintf("heap is %d MiB, cap is %d MiB", u.HeapMiB, maxMemoryMiB)
+		}
+		if exceeded != "" {
+			resourceFailure(exceeded)
+		}
+
+		// No session should outlive an iteration
+		if u.Sessions > 0 && current.idle() {
+			leaking++
+		} else {
+			leaking = 0
+		}
+		if leaking == leakChecks {
+			msg := fmt.Sprintf("%d SSH sessions open while every firewall is idle, sessions are leaking", u.Sessions)
+			notify(event{Type: "resource_leak", Severity: sevError, Message: msg})
+		}
+	}
+}
+
+// Dump diagnostics, notify and exit so a supervisor restarts tfresh
+func resourceFailure(reason string) {
+	msg := "resource cap exceeded: " + reason
+	if path, err := writeWatchdogDump("resources", 0, msg); err == nil {
+		msg += ", diagnostics in " + path
+	}
+	notify(event{Type: "resource_cap", Severity: sevError, Message: msg})
+	shutdown(msg, exitFailure)
+}
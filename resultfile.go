@@ -0,0 +1,69 @@
+/*
+ * Filename: resultfile.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Machine-readable run result file for wrapper scripts and external schedulers.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Result file to write; empty disables it
+var resultFile = ""
+
+// 'runResult' type represents the content of the result file
+type runResult struct {
+	Status     string                     `json:"status"` // running, exited
+	ExitReason string                     `json:"exit_reason,omitempty"`
+	ExitCode   *int                       `json:"exit_code,omitempty"`
+	Started    time.Time                  `json:"started"`
+	Updated    time.Time                  `json:"updated"`
+	Firewalls  map[string]iterationReport `json:"firewalls"` // latest iteration, by firewall
+}
+
+var (
+	resultMu sync.Mutex
+	results  = runResult{Status: "running", Firewalls: map[string]iterationReport{}}
+)
+
+// Record a completed iteration
+func recordResult(r iterationReport) {
+	if resultFile == "" {
+		return
+	}
+	resultMu.Lock()
+	defer resultMu.Unlock()
+	results.Firewalls[r.Firewall] = r
+	writeResultFile()
+}
+
+// Record why the daemon is exiting
+func recordExit(reason string, code int) {
+	if resultFile == "" {
+		return
+	}
+	resultMu.Lock()
+	defer resultMu.Unlock()
+	results.Status, results.ExitReason, results.ExitCode = "exited", reason, &code
+	writeResultFile()
+}
+
+// Atomically replace the result file; called with resultMu held
+func writeResultFile() {
+	results.Started, results.Updated = current.Started, time.Now()
+	fBytes, err := json.MarshalIndent(results, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(resultFile, fBytes, ".tfresh-result-*")
+	}
+	if err != nil {
+		logger.Warn(fmt.Sprint("result file: ", err), "error", err)
+	}
+}
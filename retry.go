@@ -0,0 +1,123 @@
+/*
+ * Filename: retry.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Retry policies with exponential backoff for SSH dials, sessions and customer refreshes.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 'retryPolicy' type represents how often and how patiently an operation is retried.
+// Set from flags as 'attempts=5,base=1s,max=30s,jitter=0.2'.
+type retryPolicy struct {
+	attempts int           // total tries, 1 disables retries
+	base     time.Duration // delay before the first retry, doubled after each
+	max      time.Duration // cap on the delay
+	jitter   float64       // random fraction added to or removed from each delay
+}
+
+// Retry policies by operation
+var (
+	dialRetry    = retryPolicy{attempts: 5, base: time.Second, max: 30 * time.Second, jitter: 0.2}
+	sessionRetry = retryPolicy{attempts: 3, base: 500 * time.Millisecond, max: 5 * time.Second, jitter: 0.2}
+	refreshRetry = retryPolicy{attempts: 2, base: 5 * time.Second, max: 30 * time.Second, jitter: 0.2}
+)
+
+func (p *retryPolicy) String() string {
+	return fmt.Sprintf("attempts=%d,base=%v,max=%v,jitter=%v", p.attempts, p.base, p.max, p.jitter)
+}
+
+func (p *retryPolicy) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("%q: expected key=value", s)
+		}
+		var err error
+		switch strings.TrimSpace(key) {
+		case "attempts":
+			if p.attempts, err = strconv.Atoi(value); err == nil && p.attempts < 1 {
+				err = fmt.Errorf("must be at least 1")
+			}
+		case "base":
+			p.base, err = time.ParseDuration(value)
+		case "max":
+			p.max, err = time.ParseDuration(value)
+		case "jitter":
+			if p.jitter, err = strconv.ParseFloat(value, 64); err == nil && (p.jitter < 0 || p.jitter > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		default:
+			return fmt.Errorf("%q: unknown key (attempts, base, max, jitter)", key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Delay before retry number n (1-based), before jitter
+func (p *retryPolicy) backoff(n int) time.Duration {
+	d := p.base
+	for i := 1; i < n && d < p.max; i++ {
+		d *= 2
+	}
+	if p.max > 0 && d > p.max {
+		d = p.max
+	}
+	return d
+}
+
+// Delay before retry number n (1-based)
+func (p *retryPolicy) delay(n int) time.Duration {
+	d := p.backoff(n)
+	if p.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.jitter * float64(d))
+	}
+	return d
+}
+
+// Longest time the policy can spend waiting between tries
+func (p *retryPolicy) budget() time.Duration {
+	var total time.Duration
+	for n := 1; n < p.attempts; n++ {
+		d := time.Duration(float64(p.backoff(n)) * (1 + p.jitter))
+		if d < 0 || total > math.MaxInt64-d {
+			return math.MaxInt64
+		}
+		total += d
+	}
+	return total
+}
+
+// Run fn until it succeeds or the attempts run out, returning the last error. Rejected
+// credentials and host keys are returned at once: retrying them can lock the account.
+func (p *retryPolicy) do(what string, fn func() error) error {
+	var err error
+	for n := 1; ; n++ {
+		if err = fn(); err == nil || n >= p.attempts || isAuthError(err) || isHostKeyError(err) {
+			return err
+		}
+		d := p.delay(n)
+		logger.Warn(fmt.Sprintf("%s failed (attempt %d of %d), retrying in %v: %v", what, n, p.attempts, d.Round(time.Millisecond), err),
+			"operation", what, "attempt", n, "error", err)
+		if !sleepCtx(d) {
+			return err
+		}
+	}
+}
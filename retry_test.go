@@ -0,0 +1,53 @@
+/*
+ * Filename: retry_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the retry policies.
+ */
+
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRetryStopsOnRejectedLogin(t *testing.T) {
+	p := retryPolicy{attempts: 5, base: time.Millisecond, max: time.Millisecond}
+	for _, err := range []error{
+		errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none password], no supported methods remain"),
+		errors.New("ssh: handshake failed: HOST KEY CHANGED for fw1:22: got ssh-ed25519 SHA256:x"),
+		errors.New("ssh: handshake failed: unknown host key for fw1:22 (ssh-ed25519 SHA256:x)"),
+	} {
+		tries := 0
+		if got := p.do("dial", func() error { tries++; return err }); got != err || tries != 1 {
+			t.Errorf("%v: %d tries, want 1", err, tries)
+		}
+	}
+
+	tries := 0
+	p.do("dial", func() error { tries++; return errors.New("connection refused") })
+	if tries != 5 {
+		t.Errorf("connection refused: %d tries, want 5", tries)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	p := retryPolicy{attempts: 4, base: time.Second, max: 3 * time.Second}
+	if got := p.budget(); got != 6*time.Second {
+		t.Errorf("budget %v, want 6s", got)
+	}
+	// Attempt counts past the width of a Duration saturate instead of overflowing
+	for _, p := range []retryPolicy{
+		{attempts: 200, base: time.Second, max: 30 * time.Second, jitter: 0.2},
+		{attempts: math.MaxInt32, base: time.Hour, max: 24 * time.Hour},
+	} {
+		if got := p.budget(); got <= 0 {
+			t.Errorf("%v: budget %v", &p, got)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Filename: rollout.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Progressive rollout of an iteration in verified batches.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// Batch size, a step count or a percentage ("10%"); empty refreshes everything at once
+	rolloutBatch = ""
+
+	// How long each batch's tunnels have to come up before the next batch
+	rolloutPause = 30 * time.Second
+
+	// Abort the iteration when more than this percentage of a batch fails
+	rolloutMaxFailure = 20
+)
+
+// Parse -rollout-batch into a number of steps per batch
+func rolloutSize(total int) (int, error) {
+	spec := strings.TrimSpace(rolloutBatch)
+	if pct, ok := strings.CutSuffix(spec, "%"); ok {
+		p, err := strconv.Atoi(pct)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("invalid -rollout-batch %q", rolloutBatch)
+		}
+		n := total * p / 100
+		if n < 1 {
+			n = 1
+		}
+		return n, nil
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid -rollout-batch %q", rolloutBatch)
+	}
+	return n, nil
+}
+
+// Refresh steps in batches, verifying each batch before the next. When a batch's
+// failure rate exceeds the threshold the remaining steps are skipped and aborted is set.
+func (sc *scheduler) rollout(steps []refreshStep, log *blockLog) (results []stepResult, aborted bool, err error) {
+	if rolloutBatch == "" {
+		results, err = sc.refresh(steps)
+		return results, false, err
+	}
+	size, err := rolloutSize(len(steps))
+	if err != nil {
+		return nil, false, err
+	}
+
+	for start := 0; start < len(steps); start += size {
+		// Shutting down: the remaining batches are left for the next run
+		if rootCtx.Err() != nil {
+			return results, false, nil
+		}
+		end := start + size
+		if end > len(steps) {
+			end = len(steps)
+		}
+		log.Printf("Rollout batch %d-%d of %d on %s", start+1, end, len(steps), sc.firewall)
+		log.Flush()
+		batch, err := sc.refresh(steps[start:end])
+		if err != nil {
+			return append(results, batch...), false, err
+		}
+		if end < len(steps) {
+			sc.verifyBatch(batch)
+		}
+		results = append(results, batch...)
+		// Nothing ran, e.g. when shutdown interrupted the batch, so there is no failure rate
+		if len(batch) == 0 {
+			continue
+		}
+
+		failed := 0
+		for _, r := range batch {
+			if r.result == resultFailed {
+				failed++
+			}
+		}
+		if rate := 100 * failed / len(batch); end < len(steps) && rate > rolloutMaxFailure {
+			msg := fmt.Sprintf("rollout on %s aborted: %d of %d steps in the batch failed (%d%% > %d%%), skipping %d steps",
+				sc.firewall, failed, len(batch), rate, rolloutMaxFailure, len(steps)-end)
+			notify(event{Type: "rollout_aborted", Severity: sevError, Firewall: sc.firewall, Message: msg})
+			for _, s := range steps[end:] {
+				results = append(results, stepResult{step: s, firewall: sc.firewall, result: resultSkipped, err: fmt.Errorf("rollout aborted")})
+			}
+			return results, true, nil
+		}
+	}
+	return results, false, nil
+}
+
+// Over SSH, where commands are only sent, mark batch steps failed whose IPsec SA didn't come up
+func (sc *scheduler) verifyBatch(batch []stepResult) {
+	if sc.api != nil {
+		return
+	}
+	tunnels := map[string]int{}
+	var names []string
+	for i, r := range batch {
+		if r.step.kind != stepTunnel || r.result == resultFailed {
+			continue
+		}
+		if c, ok := sc.customer(r.step.customer); ok && c.Tunnel != "" {
+			tunnels[c.Tunnel] = i
+			names = append(names, c.Tunnel)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	down, err := sc.waitTunnels(names, rolloutPause)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("rollout verification on %s failed: %v", sc.firewall, err), "firewall", sc.firewall, "error", err)
+		return
+	}
+	for _, t := range down {
+		i := tunnels[t]
+		batch[i].result, batch[i].err = resultFailed, fmt.Errorf("no IPsec SA for tunnel %s after %v", t, rolloutPause)
+	}
+}
@@ -0,0 +1,42 @@
+/*
+ * Filename: rollout_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the progressive rollout.
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"tfresh/internal/mockpanos"
+)
+
+// Stop the daemon for the rest of a test
+func stopForTest(t *testing.T) {
+	oldCtx, oldStop := rootCtx, stopRoot
+	rootCtx, stopRoot = context.WithCancel(context.Background())
+	stopRoot()
+	t.Cleanup(func() { rootCtx, stopRoot = oldCtx, oldStop })
+}
+
+func TestRolloutStopsOnShutdown(t *testing.T) {
+	old := rolloutBatch
+	rolloutBatch = "1"
+	t.Cleanup(func() { rolloutBatch = old })
+
+	srv, client := startMock(t, mockpanos.Config{})
+	stopForTest(t)
+	sc := &scheduler{firewall: "mock-e2e", client: client, customers: e2eCustomers}
+	results, aborted, err := sc.rollout(planRefresh(panosDriver{}, e2eCustomers, false), newBlockLog("mock-e2e", ""))
+	if err != nil || aborted || len(results) != 0 {
+		t.Errorf("got %+v, aborted %v, %v; want nothing refreshed", results, aborted, err)
+	}
+	if got := srv.Commands(); len(got) != 0 {
+		t.Errorf("commands sent while stopping: %v", got)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Filename: routes.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Post-refresh check that expected routes exist over each customer's tunnel interface.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Palo command to list routes over an interface
+const showRoutes = "show routing route interface"
+
+// Parse 'show routing route' output into the set of destination prefixes
+func parseRoutes(out string) map[string]bool {
+	routes := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if _, prefix, err := net.ParseCIDR(fields[0]); err == nil {
+			routes[prefix.String()] = true
+		}
+	}
+	return routes
+}
+
+// Return the expected routes missing over a customer's tunnel interface.
+// With no expected routes configured, at least one route must exist.
+func missingRoutes(c customer, routes map[string]bool) []string {
+	if len(c.Routes) == 0 {
+		if len(routes) == 0 {
+			return []string{"any route"}
+		}
+		return nil
+	}
+	var missing []string
+	for _, r := range c.Routes {
+		_, prefix, err := net.ParseCIDR(r)
+		if err != nil || !routes[prefix.String()] {
+			missing = append(missing, r)
+		}
+	}
+	return missing
+}
+
+// Verify routes for every customer with a tunnel interface, notifying on missing routes
+func checkRoutes(client *ssh.Client, firewall string, customers []customer) error {
+	cli, err := openCLI(client)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	for _, c := range customers {
+		if c.Interface == "" || c.isGlobalProtect() {
+			continue
+		}
+		out, err := cli.exec(fmt.Sprintf("%s %s", showRoutes, c.Interface), promptTimeout)
+		if err != nil {
+			return err
+		}
+		if missing := missingRoutes(c, parseRoutes(out)); len(missing) > 0 {
+			notify(event{
+				Type:     "routes_missing",
+				Severity: sevError,
+				Firewall: firewall,
+				Customer: c.Name,
+				Message:  fmt.Sprintf("%s: SA refreshed but %s missing over %s", c.Name, strings.Join(missing, ", "), c.Interface),
+			})
+			continue
+		}
+		fmt.Fprintf(humanOut, "Routes present for: %s (%s)\n", c.Name, c.Interface)
+	}
+	return nil
+}
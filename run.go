@@ -0,0 +1,423 @@
+/*
+ * Filename: run.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Per-firewall refresh scheduler run by the daemon.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Serializes state store updates across schedulers
+var stateMu sync.Mutex
+
+// 'scheduler' type represents the independent refresh loop of one firewall
+type scheduler struct {
+	env        string
+	firewall   string
+	customers  []customer
+	configured []customer      // customers from the config file, before discovery
+	unverified map[string]bool // customers -verify-names=skip holds back, by name
+	batch      bool
+
+	user, pass string
+	mu         sync.Mutex  // guards client against the watchdog
+	client     *ssh.Client // ssh transport
+	api        *apiClient  // api transport
+	member     string      // HA member last found active, when the firewall has a peer
+
+	tripped atomic.Bool                    // set by the watchdog when the iteration is abandoned
+	dead    atomic.Bool                    // set when the SSH connection stopped answering
+	pending atomic.Pointer[reloadedConfig] // set on SIGHUP, applied by the next iteration
+
+	blackout string    // the firewall blackout window refreshes are suppressed in, if any
+	deadline time.Time // when the current iteration's refreshes must be done, with -iteration-timeout
+
+	st     *state
+	active configVersion
+}
+
+// Refresh the firewall's customers forever
+func (sc *scheduler) run() {
+	defer sc.close()
+	counter := 1
+	for rootCtx.Err() == nil {
+		sdDog.beat(sc.firewall, dialBudget()+watchdogSlack)
+		// A dropped connection is re-dialed here, resuming the refreshes one iteration late
+		if err := sc.ensureConnected(); err != nil {
+			if runOnce {
+				shutdown(fmt.Sprintf("fatal error on %s: reconnect failed: %v", sc.firewall, err), connectExitCode(err))
+			}
+			logger.Warn(fmt.Sprintf("%s: reconnect failed, retrying next iteration: %v", sc.firewall, err), "firewall", sc.firewall, "error", err)
+			counter++
+			sc.wait(counter)
+			continue
+		}
+
+		iterStart := time.Now()
+		// At the latest, the iteration watchdog restarts the iteration and reconnects
+		all := planRefresh(driverFor(sc.firewall), sc.assigned(), sc.batch)
+		sdDog.beat(sc.firewall, time.Duration(max(watchdogMultiple, 1))*iterationDeadline(all)+dialBudget()+watchdogSlack)
+		sc.deadline = time.Time{}
+		if iterationTimeout > 0 {
+			sc.deadline = iterStart.Add(iterationTimeout)
+		}
+		if archive != nil {
+			startTranscript(sc.firewall)
+		}
+		log := newBlockLog(sc.firewall, "")
+		current.startIteration(sc.firewall, counter)
+		emit(ndjsonEvent{Event: evIterationStart, Iteration: counter, Firewall: sc.firewall})
+		go heartbeat(sc.firewall, "/start")
+		log.Log(fmt.Sprintf("Starting iteration # %v on %s (%s)", counter, sc.firewall, sc.env), "environment", sc.env)
+		sc.applyReload(log)
+		log.Println("Active config version:", sc.active)
+
+		if autoDiscover && isPANOS(sc.firewall) {
+			sc.discover(log)
+		}
+
+		stateMu.Lock()
+		if err := sc.st.reloadQuarantine(stateFile); err != nil {
+			logger.Warn(fmt.Sprint("quarantine reload: ", err), "firewall", sc.firewall, "error", err)
+		}
+		customers, held := sc.st.splitQuarantined(sc.assigned())
+		if !runOnce && !sc.batch && sc.perCustomer() {
+			// Customers with their own intervals are refreshed when due; the loop wakes at the shortest
+			customers = sc.st.dueCustomers(sc.firewall, customers, min(dueSlack, sc.tick()/2))
+		}
+		stateMu.Unlock()
+		for _, c := range held {
+			log.Println("Skipping quarantined customer:", c.Name)
+		}
+		customers = sc.splitBlackedOut(customers, log)
+		customers = sc.splitOpenCircuit(customers, log)
+
+		log.Printf("Refreshing %d customers on %s", len(customers), sc.firewall)
+		log.Flush()
+		current.setPhase(sc.firewall, phaseRefreshing)
+		steps := planRefresh(driverFor(sc.firewall), customers, sc.batch)
+		var skipped []refreshStep
+		if counter == 1 {
+			// Skip what an interrupted run already refreshed
+			steps, skipped = jrnl.resume(sc.firewall, sc.active.Hash, steps, log)
+			log.Flush()
+		}
+		var healthy []refreshStep
+		if !forceRefresh {
+			steps, healthy = sc.skipHealthy(steps, log)
+			log.Flush()
+		}
+		jrnl.begin(sc.firewall, counter, sc.active.Hash)
+		stop := sc.watch(counter, iterStart, iterationDeadline(steps))
+		var results []stepResult
+		var aborted bool
+		var err error
+		if canaryName != "" {
+			steps, results, aborted, err = sc.canary(steps, log)
+			log.Flush()
+		}
+		if err == nil && !aborted {
+			var rest []stepResult
+			rest, aborted, err = sc.rollout(steps, log)
+			results = append(results, rest...)
+		}
+		if err != nil && !sc.tripped.Load() {
+			if sc.api != nil || runOnce || sc.alive() {
+				shutdown(fmt.Sprintf("fatal error on %s: %v", sc.firewall, err), connectExitCode(err))
+			}
+			notify(event{Type: "connection_lost", Severity: sevError, Firewall: sc.firewall,
+				Message: fmt.Sprintf("connection lost, reconnecting next iteration: %v", err)})
+			sc.dead.Store(true)
+		}
+		// A stopped iteration stays in the journal for the next run to resume
+		if err == nil && rootCtx.Err() == nil {
+			jrnl.finish(sc.firewall)
+		}
+		// Checks are pointless when the canary found the firewall unusable
+		if err == nil && !aborted && rootCtx.Err() == nil {
+			current.setPhase(sc.firewall, phaseChecking)
+			if routeCheck && isPANOS(sc.firewall) {
+				if err := checkRoutes(sc.client, sc.firewall, sc.assigned()); err != nil {
+					logger.Warn(fmt.Sprint("route check failed: ", err), "firewall", sc.firewall, "error", err)
+				}
+			}
+
+			// Periodically reconcile the customer list against the firewall; batch mode covers every tunnel
+			if driftEvery > 0 && !sc.batch && isPANOS(sc.firewall) && (counter-1)%driftEvery == 0 {
+				sc.reconcile()
+			}
+		}
+		stop()
+
+		// Reconnect after the watchdog fired, restarting the iteration if the refresh was abandoned
+		if sc.tripped.Swap(false) {
+			if err := sc.recover(); err != nil {
+				shutdown(fmt.Sprintf("fatal error on %s: reconnect failed: %v", sc.firewall, err), connectExitCode(err))
+			}
+			if err != nil {
+				log.Flush()
+				takeTranscript(sc.firewall)
+				continue
+			}
+		}
+
+		for _, step := range skipped {
+			results = append(results, stepResult{step: step, firewall: sc.firewall, result: resultSkipped})
+		}
+		for _, step := range healthy {
+			results = append(results, stepResult{step: step, firewall: sc.firewall, result: resultHealthy})
+		}
+		for _, c := range held {
+			results = append(results, stepResult{step: refreshStep{kind: stepTunnel, customer: c.Name}, firewall: sc.firewall, result: resultQuarantined})
+		}
+		stateMu.Lock()
+		failing, recovered := sc.st.recordRefreshes(sc.firewall, results)
+		err = sc.st.save(stateFile)
+		stateMu.Unlock()
+		if err != nil {
+			logger.Error(err.Error(), "firewall", sc.firewall, "error", err)
+		}
+
+		for _, r := range results {
+			switch {
+			case r.result == resultFailed && failing[r.step.customer] >= notifyAfter:
+				msg := "refresh failed"
+				if r.err != nil {
+					msg = r.err.Error()
+				}
+				if n := failing[r.step.customer]; n > 1 {
+					msg += fmt.Sprintf(" (%d consecutive)", n)
+				}
+				notify(event{Type: "refresh_failed", Severity: sevError, Firewall: sc.firewall, Customer: r.step.customer,
+					Gateway: r.step.gateway, Tunnel: r.step.tunnel, Result: r.result, Message: msg})
+			case recovered[r.step.customer] >= notifyAfter:
+				notify(event{Type: "refresh_recovered", Severity: sevInfo, Firewall: sc.firewall, Customer: r.step.customer,
+					Gateway: r.step.gateway, Tunnel: r.step.tunnel, Result: r.result,
+					Message: fmt.Sprintf("%s recovered after %d consecutive failures", r.step.customer, recovered[r.step.customer])})
+			}
+		}
+
+		mailDigest(sc.firewall, counter, results)
+
+		summary := summarizeIteration(sc.firewall, counter, results, time.Since(iterStart))
+		emitIterationSummary(summary)
+		totals.record(summary, results)
+		report := newIterationReport(sc.firewall, counter, iterStart, results)
+		recordResult(report)
+		recordReport(report)
+		if summary.counts[resultFailed] > 0 {
+			heartbeat(sc.firewall, "/fail")
+		} else {
+			heartbeat(sc.firewall, "")
+		}
+		log.Log(summary.String(), "duration_ms", summary.duration.Milliseconds(), "succeeded", summary.counts[resultSuccess],
+			"failed", summary.counts[resultFailed], "skipped", summary.counts[resultSkipped], "healthy", summary.counts[resultHealthy])
+		log.Flush()
+		if archive != nil {
+			archive.upload(sc.firewall, counter, iterStart, takeTranscript(sc.firewall), results)
+		}
+		if runOnce {
+			current.setPhase(sc.firewall, phaseDone)
+			return
+		}
+		counter++
+		sc.wait(counter)
+	}
+}
+
+// Sleep until the next iteration, or until the daemon is stopping
+func (sc *scheduler) wait(counter int) {
+	if rootCtx.Err() != nil {
+		return
+	}
+	logger.Info(fmt.Sprintf("Waiting for next iteration (%v) on %s..", counter, sc.firewall), "firewall", sc.firewall, "iteration", counter)
+	d := jittered(sc.tick())
+	sdDog.beat(sc.firewall, d+watchdogSlack)
+	current.sleepUntil(sc.firewall, time.Now().Add(d))
+	sleepCtx(d)
+}
+
+// Time until the next iteration: the shortest interval among the customers or the
+// soonest cron fire time, -i without any
+func (sc *scheduler) tick() time.Duration {
+	d := time.Duration(0)
+	now := time.Now()
+	for _, c := range sc.assigned() {
+		i, _ := c.interval()
+		if sched := c.schedule(); sched != nil {
+			next := sched.next(now)
+			if next.IsZero() {
+				continue
+			}
+			i = next.Sub(now)
+		}
+		if d == 0 || i < d {
+			d = i
+		}
+	}
+	if d == 0 || sc.batch {
+		d = time.Duration(iTime) * time.Minute
+	}
+	return d
+}
+
+// Whether any customer has a schedule or an interval other than -i, so iterations refresh only those due
+func (sc *scheduler) perCustomer() bool {
+	for _, c := range sc.assigned() {
+		if i, _ := c.interval(); i != time.Duration(iTime)*time.Minute || c.schedule() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Close the connection once the scheduler stops
+func (sc *scheduler) close() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.client != nil {
+		sc.client.Close()
+	}
+	current.setConnection(sc.firewall, "disconnected")
+}
+
+// Customers the scheduler refreshes this iteration, after any cutover split and without
+// those -verify-names=skip held back
+func (sc *scheduler) assigned() []customer {
+	customers := cutover.customersFor(sc.env, sc.customers)
+	if len(sc.unverified) == 0 {
+		return customers
+	}
+	var kept []customer
+	for _, c := range customers {
+		if !sc.unverified[c.Name] {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// Look up one of the scheduler's customers by name
+func (sc *scheduler) customer(name string) (customer, bool) {
+	for _, c := range sc.assigned() {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return customer{}, false
+}
+
+// Run refresh steps over the scheduler's transport, retrying failed customers
+func (sc *scheduler) refresh(steps []refreshStep) ([]stepResult, error) {
+	results, err := sc.refreshOnce(steps)
+	for n := 1; err == nil && n < refreshRetry.attempts; n++ {
+		var failed []refreshStep
+		var at []int
+		for i, r := range results {
+			if r.result == resultFailed {
+				failed = append(failed, r.step)
+				at = append(at, i)
+			}
+		}
+		if len(failed) == 0 || sc.tripped.Load() || (!sc.deadline.IsZero() && time.Now().After(sc.deadline)) {
+			break
+		}
+		d := refreshRetry.delay(n)
+		logger.Warn(fmt.Sprintf("%d customers failed on %s (attempt %d of %d), retrying in %v", len(failed), sc.firewall, n, refreshRetry.attempts, d.Round(time.Millisecond)),
+			"firewall", sc.firewall, "failed", len(failed), "attempt", n)
+		if !sleepCtx(d) {
+			break
+		}
+
+		var retried []stepResult
+		if retried, err = sc.refreshOnce(failed); err != nil {
+			break
+		}
+		for i, r := range retried {
+			// A retry the open circuit held back leaves the failure standing
+			if r.result != resultSkipped {
+				results[at[i]] = r
+			}
+		}
+	}
+	return results, err
+}
+
+// Run refresh steps once over the scheduler's transport
+func (sc *scheduler) refreshOnce(steps []refreshStep) ([]stepResult, error) {
+	if sc.api != nil {
+		return refreshFirewallAPI(sc.api, sc.firewall, steps)
+	}
+	return refreshFirewall(sc.client, sc.firewall, steps, sc.deadline)
+}
+
+// Longest a connect can take: each try dials every address of both HA members, then backs off
+func dialBudget() time.Duration {
+	return 2*time.Duration(dialRetry.attempts)*dialTimeout + dialRetry.budget()
+}
+
+// Dial the firewall over SSH
+func (sc *scheduler) connect() error {
+	current.setPhase(sc.firewall, phaseConnecting)
+	current.setConnection(sc.firewall, "connecting")
+	var client *ssh.Client
+	err := dialRetry.do("dial "+sc.firewall, func() (err error) {
+		client, err = sc.dialActive()
+		return err
+	})
+	if err != nil {
+		current.setConnection(sc.firewall, "disconnected")
+		return err
+	}
+	sc.mu.Lock()
+	sc.client = client
+	sc.mu.Unlock()
+	current.setConnection(sc.firewall, "connected")
+	if keepaliveInterval > 0 {
+		go sc.keepalive(client)
+	}
+	return nil
+}
+
+// Check for drift, record it in the state store and notify when config and firewall disagree
+func (sc *scheduler) reconcile() {
+	cli, err := openCLI(sc.client)
+	if err != nil {
+		logger.Warn(fmt.Sprint("drift check skipped: ", err), "firewall", sc.firewall, "error", err)
+		return
+	}
+	report, err := checkDrift(cli, sc.firewall, sc.assigned())
+	cli.Close()
+	if err != nil {
+		logger.Warn(fmt.Sprint("drift check failed: ", err), "firewall", sc.firewall, "error", err)
+		return
+	}
+
+	stateMu.Lock()
+	if sc.st.Drift == nil {
+		sc.st.Drift = map[string]driftReport{}
+	}
+	sc.st.Drift[sc.firewall] = report
+	err = sc.st.save(stateFile)
+	stateMu.Unlock()
+	if err != nil {
+		logger.Error(err.Error(), "firewall", sc.firewall, "error", err)
+	}
+
+	if report.clean() {
+		logger.Info(fmt.Sprint("Drift check: ", report), "firewall", sc.firewall)
+		return
+	}
+	notify(event{Type: "drift", Severity: sevWarning, Firewall: sc.firewall, Message: report.String()})
+}
@@ -0,0 +1,235 @@
+/*
+ * Filename: secrets.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Firewall credentials from AWS Secrets Manager or SSM Parameter Store.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential sources
+const (
+	credsEnv            = "env"
+	credsSecretsManager = "aws-secrets-manager"
+	credsSSM            = "aws-ssm"
+)
+
+// 'credentialsConfig' type represents the 'credentials' section of the config file
+type credentialsConfig struct {
+	Source  string        `yaml:"source"`            // env (default), aws-secrets-manager or aws-ssm
+	ID      string        `yaml:"id"`                // secret name or ARN, or parameter name
+	Region  string        `yaml:"region,omitempty"`  // defaults to $AWS_REGION
+	Refresh time.Duration `yaml:"refresh,omitempty"` // how often the daemon re-reads the secret, 0 only at startup
+}
+
+// 'secretCredentials' type represents the secret's value: a JSON object, or a bare password
+type secretCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	APIKey   string `json:"api_key"`
+}
+
+var (
+	// Credentials settings from the config file, nil when not configured
+	credentialSettings *credentialsConfig
+
+	// Credentials read from the secret store, nil with the env source
+	secretMu    sync.RWMutex
+	secretCreds *secretCredentials
+)
+
+// Check the settings
+func (c *credentialsConfig) validate() error {
+	switch c.Source {
+	case "", credsEnv:
+		c.Source = credsEnv
+		return nil
+	case credsSecretsManager, credsSSM:
+	default:
+		return fmt.Errorf("credentials: unknown source %q (%s, %s, %s)", c.Source, credsEnv, credsSecretsManager, credsSSM)
+	}
+	if c.ID == "" {
+		return fmt.Errorf("credentials: %s needs an id", c.Source)
+	}
+	if c.Refresh < 0 {
+		return errors.New("credentials: refresh cannot be negative")
+	}
+	return nil
+}
+
+// Read the config file's credentials section and, for a secret store, fetch the credentials.
+// A missing config file is reported when the customers are loaded.
+func loadCredentialSource(filename string) error {
+	doc, _, err := readConfigTree(filename)
+	if _, ok := err.(*os.PathError); ok && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err != nil || doc.Credentials == nil {
+		return nil
+	}
+	if err := doc.Credentials.validate(); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	credentialSettings = doc.Credentials
+	if credentialSettings.Source == credsEnv {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(rootCtx, objTimeout)
+	defer cancel()
+	creds, err := fetchSecret(ctx, credentialSettings)
+	if err != nil {
+		return err
+	}
+	secretMu.Lock()
+	secretCreds = &creds
+	secretMu.Unlock()
+	return nil
+}
+
+// Current credentials from the secret store, if one is configured
+func storedCredentials() (secretCredentials, bool) {
+	secretMu.RLock()
+	defer secretMu.RUnlock()
+	if secretCreds == nil {
+		return secretCredentials{}, false
+	}
+	return *secretCreds, true
+}
+
+// The API key from the secret store, -profile, PAN_API_KEY or the default profile
+func envAPIKey() string {
+	if c, ok := storedCredentials(); ok && c.APIKey != "" {
+		return c.APIKey
+	}
+	if profileName != "" {
+		return profileAPIKey()
+	}
+	if key := os.Getenv("PAN_API_KEY"); key != "" {
+		return key
+	}
+	return profileAPIKey()
+}
+
+// Fetch and parse the secret
+func fetchSecret(ctx context.Context, c *credentialsConfig) (secretCredentials, error) {
+	region := c.Region
+	if region == "" {
+		region = awsRegion()
+	}
+
+	var service, target, endpointEnv string
+	var body any
+	switch c.Source {
+	case credsSecretsManager:
+		service, target, endpointEnv = "secretsmanager", "secretsmanager.GetSecretValue", "AWS_ENDPOINT_URL_SECRETS_MANAGER"
+		body = map[string]any{"SecretId": c.ID}
+	case credsSSM:
+		service, target, endpointEnv = "ssm", "AmazonSSM.GetParameter", "AWS_ENDPOINT_URL_SSM"
+		body = map[string]any{"Name": c.ID, "WithDecryption": true}
+	}
+	endpoint := os.Getenv(endpointEnv)
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com/", service, region)
+	}
+
+	aws, err := getAWSCredentials(ctx)
+	if err != nil {
+		return secretCredentials{}, fmt.Errorf("credentials: %w", err)
+	}
+	payload, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return secretCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signV4(req, payload, service, region, aws)
+	respBody, err := objDo(req)
+	if err != nil {
+		return secretCredentials{}, fmt.Errorf("credentials: %s %s: %w", c.Source, c.ID, err)
+	}
+
+	var resp struct {
+		SecretString string
+		Parameter    struct{ Value string }
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return secretCredentials{}, fmt.Errorf("credentials: %s %s: %w", c.Source, c.ID, err)
+	}
+	value := resp.SecretString
+	if c.Source == credsSSM {
+		value = resp.Parameter.Value
+	}
+	return parseSecret(value)
+}
+
+// Parse a secret value: {"username": ..., "password": ..., "api_key": ...}, or a bare password
+func parseSecret(value string) (secretCredentials, error) {
+	var creds secretCredentials
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		creds.Password = value
+	} else if err := json.Unmarshal([]byte(value), &creds); err != nil {
+		return creds, fmt.Errorf("credentials: secret is not a JSON object: %w", err)
+	}
+	if creds.Username == "" {
+		// The environment may supply the username alongside a secret password
+		creds.Username = os.Getenv("PAN_USERNAME")
+	}
+	if creds.Password == "" && creds.APIKey == "" {
+		return creds, errors.New("credentials: secret has neither a password nor an api_key")
+	}
+	return creds, nil
+}
+
+// Re-read the secret every interval, handing changed credentials to the running schedulers
+func refreshSecretCredentials(every time.Duration) {
+	for sleepCtx(every) {
+		ctx, cancel := context.WithTimeout(rootCtx, objTimeout)
+		creds, err := fetchSecret(ctx, credentialSettings)
+		cancel()
+		if err != nil {
+			logger.Warn(fmt.Sprintf("%v; keeping the current credentials", err), "source", credentialSettings.Source, "error", err)
+			notify(event{Type: "credentials_refresh_failed", Severity: sevWarning, Message: err.Error()})
+			continue
+		}
+		old, _ := storedCredentials()
+		if creds == old {
+			continue
+		}
+		secretMu.Lock()
+		secretCreds = &creds
+		secretMu.Unlock()
+		logger.Info(fmt.Sprintf("Credentials in %s changed, using them from the next connection", credentialSettings.ID), "source", credentialSettings.Source)
+
+		reloadMu.Lock()
+		for _, sc := range running {
+			if sc.api != nil && creds.APIKey != "" && creds.APIKey != old.APIKey {
+				sc.api.setKey(creds.APIKey)
+			}
+		}
+		reloadMu.Unlock()
+	}
+}
+
+// SSH credentials for the scheduler's next connection: the secret store's current ones when configured
+func (sc *scheduler) credentials() (user, pass string) {
+	if c, ok := storedCredentials(); ok && c.Username != "" {
+		return c.Username, c.Password
+	}
+	return sc.user, sc.pass
+}
@@ -0,0 +1,484 @@
+/*
+ * Filename: serve.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: 'tfresh serve', an HTTP API for refreshing customers on demand.
+ */
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 'serveFirewall' type represents one firewall's connection, shared by the API's requests
+type serveFirewall struct {
+	mu sync.Mutex // one refresh at a time per firewall
+	r  *replSession
+}
+
+// 'serveResult' type represents the outcome of one refreshed customer
+type serveResult struct {
+	Customer   string    `json:"customer"`
+	Firewall   string    `json:"firewall"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	Time       time.Time `json:"time"`
+}
+
+// 'serveCustomerStatus' type represents a customer in 'GET /status'
+type serveCustomerStatus struct {
+	Customer      string       `json:"customer"`
+	Environment   string       `json:"environment"`
+	Firewall      string       `json:"firewall"`
+	LastRefreshed *time.Time   `json:"last_refreshed,omitempty"`
+	Quarantined   *quarantine  `json:"quarantined,omitempty"`
+	LastResult    *serveResult `json:"last_result,omitempty"` // the latest refresh through the API
+}
+
+// 'apiServer' type represents the 'tfresh serve' HTTP API
+type apiServer struct {
+	token     string
+	firewalls map[string]*serveFirewall // by environment
+	envs      []string
+
+	mu   sync.Mutex
+	last map[string]serveResult // by customer key
+}
+
+// Check the bearer token, when one is required
+func (s *apiServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(s.token)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="tfresh"`)
+	writeAPIError(w, http.StatusUnauthorized, "missing or wrong bearer token")
+	return false
+}
+
+// Reply with JSON
+func writeAPIJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// Reply with a JSON error
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	writeAPIJSON(w, code, map[string]string{"error": msg})
+}
+
+// Refuse POSTs a web page could send: a browser only sends a JSON Content-Type to
+// another origin after a preflight the API never answers, and names the page's Origin
+func sameSiteRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return true
+	}
+	if mt, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); !strings.EqualFold(strings.TrimSpace(mt), "application/json") {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "POST requests need Content-Type: application/json")
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			writeAPIError(w, http.StatusForbidden, "cross-origin request from "+origin)
+			return false
+		}
+	}
+	return true
+}
+
+// Wrap a handler with the method, origin and token checks
+func (s *apiServer) handle(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAPIError(w, http.StatusMethodNotAllowed, "use "+method)
+			return
+		}
+		if !sameSiteRequest(w, r) || !s.authorized(w, r) {
+			return
+		}
+		logger.Info(fmt.Sprintf("API %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr), "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		h(w, r)
+	}
+}
+
+// Refresh customers on one firewall, dialing it when not yet connected or the connection dropped
+func (s *apiServer) refresh(env string, customers []customer) ([]serveResult, error) {
+	fw := s.firewalls[env]
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	stateMu.Lock()
+	st, err := loadState(stateFile)
+	stateMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	customers, held := st.splitQuarantined(customers)
+
+	var results []stepResult
+	steps := planRefresh(driverFor(fw.r.firewall), customers, false)
+	if len(steps) > 0 {
+		if fw.r.client == nil {
+			err = fw.r.reconnect()
+		}
+		if err == nil {
+			results, err = refreshFirewall(fw.r.client, fw.r.firewall, steps, time.Time{})
+		}
+		if err != nil && rootCtx.Err() == nil {
+			if err = fw.r.reconnect(); err == nil {
+				results, err = refreshFirewall(fw.r.client, fw.r.firewall, steps, time.Time{})
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		stateMu.Lock()
+		err = updateState(func(st *state) { st.recordRefreshes(fw.r.firewall, results) })
+		stateMu.Unlock()
+		if err != nil {
+			logger.Warn(fmt.Sprint("state file: ", err), "error", err)
+		}
+	}
+
+	var out []serveResult
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range results {
+		sr := serveResult{Customer: r.step.customer, Firewall: r.firewall, Result: r.result, DurationMS: r.duration.Milliseconds(), Time: time.Now()}
+		if r.err != nil {
+			sr.Error = r.err.Error()
+		}
+		if c, ok := fw.r.lookupCustomer(r.step.customer); ok {
+			s.last[c.key()] = sr
+		}
+		out = append(out, sr)
+	}
+	for _, c := range held {
+		out = append(out, serveResult{Customer: c.Name, Firewall: fw.r.firewall, Result: resultSkipped, Error: "quarantined", Time: time.Now()})
+	}
+	return out, nil
+}
+
+// Find a customer on the firewall by exact name
+func (r *replSession) lookupCustomer(name string) (customer, bool) {
+	for _, c := range r.customers {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return customer{}, false
+}
+
+var (
+	errNoCustomer = errors.New("no such customer")
+	errNoFirewall = errors.New("no such firewall")
+)
+
+// Resolve the firewalls to refresh: one by name, or every one
+func (s *apiServer) selectEnvs(env string) ([]string, error) {
+	if env == "" {
+		return s.envs, nil
+	}
+	if _, ok := s.firewalls[env]; !ok {
+		return nil, fmt.Errorf("%w %q", errNoFirewall, env)
+	}
+	return []string{env}, nil
+}
+
+// Customers to refresh on each firewall, by environment: those named, or every one
+func (s *apiServer) selectCustomers(envs, names []string) (map[string][]customer, error) {
+	selected := map[string][]customer{}
+	for _, name := range names {
+		found := false
+		for _, env := range envs {
+			if c, err := s.firewalls[env].r.lookup(name); err == nil {
+				selected[env] = append(selected[env], c)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w %q", errNoCustomer, name)
+		}
+	}
+	if len(names) == 0 {
+		for _, env := range envs {
+			selected[env] = s.firewalls[env].r.customers
+		}
+	}
+	return selected, nil
+}
+
+// Refresh the selected customers, every firewall in parallel, returning the firewalls that failed
+func (s *apiServer) refreshSelected(selected map[string][]customer) ([]serveResult, map[string]string) {
+	var mu sync.Mutex
+	results := []serveResult{}
+	errs := map[string]string{}
+	var wg sync.WaitGroup
+	for env, customers := range selected {
+		wg.Add(1)
+		go func(env string, customers []customer) {
+			defer wg.Done()
+			rs, err := s.refresh(env, customers)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[env] = err.Error()
+				return
+			}
+			results = append(results, rs...)
+		}(env, customers)
+	}
+	wg.Wait()
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Customer < results[j].Customer })
+	return results, errs
+}
+
+// POST /refresh/{customer}
+func (s *apiServer) refreshOne(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/refresh/")
+	if name == "" {
+		writeAPIError(w, http.StatusBadRequest, "no customer in the path")
+		return
+	}
+	selected, err := s.selectCustomers(s.envs, []string{name})
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	results, errs := s.refreshSelected(selected)
+	for env, msg := range errs {
+		writeAPIError(w, http.StatusBadGateway, fmt.Sprintf("%s: %s", env, msg))
+		return
+	}
+	writeAPIJSON(w, resultStatus(results), results)
+}
+
+// POST /refresh-all[?firewall=<env>], every firewall in parallel
+func (s *apiServer) refreshAll(w http.ResponseWriter, r *http.Request) {
+	envs, err := s.selectEnvs(r.URL.Query().Get("firewall"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	selected, _ := s.selectCustomers(envs, nil)
+	results, errs := s.refreshSelected(selected)
+
+	code := resultStatus(results)
+	if len(errs) > 0 {
+		code = http.StatusBadGateway
+	}
+	writeAPIJSON(w, code, map[string]any{"results": results, "errors": errs})
+}
+
+// 200 when every customer was refreshed, 207 when some failed
+func resultStatus(results []serveResult) int {
+	for _, r := range results {
+		if r.Result == resultFailed {
+			return http.StatusMultiStatus
+		}
+	}
+	return http.StatusOK
+}
+
+// GET /status
+func (s *apiServer) status(w http.ResponseWriter, r *http.Request) {
+	out, err := s.statuses()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAPIJSON(w, http.StatusOK, out)
+}
+
+// Every customer's status
+func (s *apiServer) statuses() ([]serveCustomerStatus, error) {
+	stateMu.Lock()
+	st, err := loadState(stateFile)
+	stateMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []serveCustomerStatus{}
+	for _, env := range s.envs {
+		fw := s.firewalls[env].r
+		for _, c := range fw.customers {
+			cs := serveCustomerStatus{Customer: c.Name, Environment: env, Firewall: fw.firewall}
+			if t, ok := st.LastRefreshed[fw.firewall][c.key()]; ok {
+				cs.LastRefreshed = &t
+			}
+			if q, ok := st.Quarantined[c.key()]; ok {
+				cs.Quarantined = &q
+			}
+			if last, ok := s.last[c.key()]; ok {
+				cs.LastResult = &last
+			}
+			out = append(out, cs)
+		}
+	}
+	return out, nil
+}
+
+// GET /customers
+func (s *apiServer) customers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	writeCustomerJSON(w, s.allCustomers())
+}
+
+// Customers of every served firewall
+func (s *apiServer) allCustomers() []customer {
+	var all []customer
+	for _, env := range s.envs {
+		all = append(all, s.firewalls[env].r.customers...)
+	}
+	return all
+}
+
+// Handle 'tfresh serve'
+func serveCommand(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9480", "Address to serve the HTTP API on; empty disables it")
+	grpcAddr := fs.String("grpc", "", "Address to serve the gRPC API on, e.g. 127.0.0.1:9481; empty disables it")
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fs.StringVar(&stateFile, "s", stateFile, "State file; the daemon must not be running on it (default is tfresh.state.json)")
+	fs.StringVar(&lockFilename, "lock", lockFilename, "Instance lock file, the daemon's (default is the state file with a .lock suffix)")
+	fs.StringVar(&historyDB, "history-db", historyDB, "SQLite database to record refresh attempts to, shareable with the daemon (default $TFRESH_HISTORY_DB)")
+	env := fs.String("e", "", "Comma-separated firewall names or environments for customers without customer_firewall (default is $TFRESH_FIREWALL_HOST's firewall, if set)")
+	token := fs.String("token", os.Getenv("TFRESH_API_TOKEN"), "Bearer token requests must carry (default $TFRESH_API_TOKEN)")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.Parse(args)
+
+	customers := loadCustomersOrExit()
+	// Like the daemon, customers are refreshed on their own customer_firewall and only
+	// the others on the -e firewalls
+	var values []string
+	if *env != "" {
+		values = strings.Split(*env, ",")
+	} else if envFirewalls() != nil {
+		values = []string{envFirewallName}
+	}
+	envs, err := expandEnvs(values)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	groups, err := groupByFirewall(customers, envs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	// Refreshes and state updates would race the daemon's
+	if lockFilename == "" {
+		lockFilename = stateFile + ".lock"
+	}
+	if err = acquireLock(lockFilename); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	user, pass := checkEnvVars()
+	enableHistory()
+
+	s := &apiServer{token: *token, firewalls: map[string]*serveFirewall{}, last: map[string]serveResult{}}
+	for _, g := range groups {
+		if err := checkDriver(firewalls[g.env], g.customers, false, false); err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(1)
+		}
+		s.firewalls[g.env] = &serveFirewall{r: &replSession{env: g.env, firewall: firewalls[g.env], user: user, pass: pass, customers: g.customers}}
+		s.envs = append(s.envs, g.env)
+	}
+	sort.Strings(s.envs)
+	if len(s.envs) == 0 {
+		fmt.Fprintln(os.Stderr, "[ERROR]: No customers to serve.")
+		os.Exit(1)
+	}
+
+	if *addr == "" && *grpcAddr == "" {
+		fmt.Fprintln(os.Stderr, "[ERROR]: Nothing to serve; set -addr or -grpc.")
+		os.Exit(1)
+	}
+	for _, a := range []string{*addr, *grpcAddr} {
+		if host, _, err := net.SplitHostPort(a); err == nil && s.token == "" {
+			if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+				fmt.Fprintf(os.Stderr, "[WARN]: %s is reachable from other hosts without a token; set -token.\n", a)
+			}
+		}
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		stopRoot()
+	}()
+	defer func() {
+		for _, fw := range s.firewalls {
+			if fw.r.client != nil {
+				fw.r.client.Close()
+			}
+		}
+	}()
+
+	if *grpcAddr != "" {
+		gs, err := startGRPCServer(*grpcAddr, s)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+			os.Exit(1)
+		}
+		defer gs.Stop()
+	}
+	if *addr == "" {
+		<-rootCtx.Done()
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/refresh/", s.handle(http.MethodPost, s.refreshOne))
+	mux.HandleFunc("/refresh-all", s.handle(http.MethodPost, s.refreshAll))
+	mux.HandleFunc("/status", s.handle(http.MethodGet, s.status))
+	mux.HandleFunc("/customers", s.handle(http.MethodGet, s.customers))
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	logger.Info(fmt.Sprintf("Serving the API on %s for %d firewalls", ln.Addr(), len(s.envs)), "addr", ln.Addr().String())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-rootCtx.Done()
+		srv.Close()
+	}()
+	if err = srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+}
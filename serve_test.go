@@ -0,0 +1,54 @@
+/*
+ * Filename: serve_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the 'tfresh serve' request checks.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeRefusesCrossSiteRequests(t *testing.T) {
+	s := &apiServer{}
+	h := s.handle(http.MethodPost, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	for _, tc := range []struct {
+		name, contentType, origin string
+		want                      int
+	}{
+		{"curl", "application/json", "", http.StatusNoContent},
+		{"same origin", "application/json; charset=utf-8", "http://127.0.0.1:9480", http.StatusNoContent},
+		{"form post", "application/x-www-form-urlencoded", "https://evil.example", http.StatusUnsupportedMediaType},
+		{"text/plain", "text/plain", "", http.StatusUnsupportedMediaType},
+		{"no content type", "", "", http.StatusUnsupportedMediaType},
+		{"foreign origin", "application/json", "https://evil.example", http.StatusForbidden},
+		{"null origin", "application/json", "null", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "http://127.0.0.1:9480/refresh-all", nil)
+		if tc.contentType != "" {
+			req.Header.Set("Content-Type", tc.contentType)
+		}
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+
+	// GETs have no side effects and need no Content-Type
+	get := s.handle(http.MethodGet, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	w := httptest.NewRecorder()
+	get(w, httptest.NewRequest(http.MethodGet, "http://127.0.0.1:9480/status", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("GET /status: got %d", w.Code)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Filename: service.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: 'tfresh service', installing and controlling the daemon as a Windows service.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Default Windows service and event log source name
+const serviceName = "tfresh"
+
+// Handle 'tfresh service'
+func serviceCommand(args []string) {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s service <install|uninstall|start|stop> [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s service install [-name tfresh] [daemon flags]\n\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "The daemon flags after 'install' are passed to 'tfresh run' when the service starts.")
+		fmt.Fprintln(os.Stderr, "Relative paths in them are resolved against the directory of the executable.")
+	}
+	if len(args) == 0 {
+		usage()
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("service "+args[0], flag.ExitOnError)
+	fs.Usage = usage
+	name := fs.String("name", serviceName, "Service name, also the event log source")
+	// The daemon's flags follow install and are not ours to parse
+	rest := args[1:]
+	switch {
+	case args[0] != "install":
+		fs.Parse(rest)
+	case len(rest) > 1 && (rest[0] == "-name" || rest[0] == "--name"):
+		fs.Parse(rest[:2])
+		rest = rest[2:]
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		if err = installService(*name, rest); err == nil {
+			fmt.Printf("Installed service %s; start it with '%s service start'.\n", *name, os.Args[0])
+		}
+	case "uninstall":
+		if err = uninstallService(*name); err == nil {
+			fmt.Printf("Removed service %s.\n", *name)
+		}
+	case "start":
+		if err = controlService(*name, args[0]); err == nil {
+			fmt.Printf("Started service %s.\n", *name)
+		}
+	case "stop":
+		if err = controlService(*name, args[0]); err == nil {
+			fmt.Printf("Stopped service %s.\n", *name)
+		}
+	default:
+		usage()
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+}
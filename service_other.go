@@ -0,0 +1,28 @@
+//go:build !windows
+
+/*
+ * Filename: service_other.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Windows service stubs for other platforms, where systemd runs the daemon instead.
+ */
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+)
+
+var errNoServiceManager = errors.New("Windows services are only supported on Windows; run the daemon under systemd instead")
+
+func installService(name string, args []string) error { return errNoServiceManager }
+func uninstallService(name string) error              { return errNoServiceManager }
+func controlService(name, action string) error        { return errNoServiceManager }
+
+// Not a Windows service: nothing to report to
+func startService()                                 {}
+func serviceLogHandler(h slog.Handler) slog.Handler { return h }
+func serviceExit(code int)                          {}
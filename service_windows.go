@@ -0,0 +1,280 @@
+//go:build windows
+
+/*
+ * Filename: service_windows.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Running the daemon under the Windows service manager, with its log in the event log.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Event IDs written to the event log, by severity
+const (
+	eventInfo    = 1
+	eventWarning = 2
+	eventError   = 3
+)
+
+// 'windowsService' type represents the daemon running under the service manager
+type windowsService struct {
+	name string
+	elog *eventlog.Log
+	exit chan uint32   // the daemon's exit code, reported when the service stops
+	done chan struct{} // closed once the service manager knows it stopped
+}
+
+// The running service, nil when started from a console
+var winService *windowsService
+
+// Register the service with the service manager, passing args to 'tfresh run'
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "tfresh VPN tunnel refresher",
+		Description: "Refreshes customer VPN tunnels on Palo Alto firewalls",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"run"}, args...)...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	// Restart after crashes, like systemd's Restart=on-failure
+	if err = s.SetRecoveryActions([]mgr.RecoveryAction{
+		{Type: mgr.ServiceRestart, Delay: time.Minute},
+		{Type: mgr.ServiceRestart, Delay: 5 * time.Minute},
+	}, uint32((24 * time.Hour).Seconds())); err != nil {
+		s.Delete()
+		return err
+	}
+	if err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("event log source: %w", err)
+	}
+	return nil
+}
+
+// Remove the service and its event log source
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return err
+	}
+	return eventlog.Remove(name)
+}
+
+// Start or stop the service, waiting for it to get there
+func controlService(name, action string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+
+	want := svc.Running
+	if action == "start" {
+		err = s.Start()
+	} else {
+		want = svc.Stopped
+		_, err = s.Control(svc.Stop)
+	}
+	if err != nil {
+		return err
+	}
+	// The daemon finishes in-flight customers before stopping
+	deadline := time.Now().Add(shutdownTimeout + 30*time.Second)
+	for {
+		status, err := s.Query()
+		if err != nil {
+			return err
+		}
+		if status.State == want {
+			return nil
+		}
+		if status.State == svc.Stopped {
+			return fmt.Errorf("service %s stopped with exit code %d; see the Application event log", name, status.ServiceSpecificExitCode)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service %s did not reach the %s state in time", name, map[svc.State]string{svc.Running: "running", svc.Stopped: "stopped"}[want])
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+}
+
+// When started by the service manager, report to it and log to the event log.
+// Relative paths in the daemon's flags resolve against the executable's directory,
+// since services start in the system directory.
+func startService() {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return
+	}
+	if exe, err := os.Executable(); err == nil {
+		os.Chdir(filepath.Dir(exe))
+	}
+	// The service name is the event log source
+	name := serviceName
+	if s, err := currentServiceName(); err == nil {
+		name = s
+	}
+	ws := &windowsService{name: name, exit: make(chan uint32, 1), done: make(chan struct{})}
+	if ws.elog, err = eventlog.Open(name); err != nil {
+		ws.elog = nil
+	}
+	winService = ws
+	go func() {
+		defer close(ws.done)
+		if err := svc.Run(name, ws); err != nil && ws.elog != nil {
+			ws.elog.Error(eventError, fmt.Sprint("service: ", err))
+		}
+	}()
+}
+
+// Name the service manager started this process under
+func currentServiceName() (string, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", err
+	}
+	defer m.Disconnect()
+	names, err := m.ListServices()
+	if err != nil {
+		return "", err
+	}
+	pid := uint32(os.Getpid())
+	for _, n := range names {
+		s, err := m.OpenService(n)
+		if err != nil {
+			continue
+		}
+		status, err := s.Query()
+		s.Close()
+		if err == nil && status.ProcessId == pid {
+			return n, nil
+		}
+	}
+	return "", errors.New("service not found")
+}
+
+// Handle service control requests; a stop request stops the daemon as SIGTERM does
+func (ws *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.StartPending}
+	changes <- svc.Status{State: svc.Running, Accepts: accepted}
+	for {
+		select {
+		case code := <-ws.exit:
+			changes <- svc.Status{State: svc.StopPending}
+			return code != 0, code
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				changes <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 5*time.Second).Milliseconds())}
+				if rootCtx.Err() == nil {
+					stopReason = "service stop requested"
+					logger.Info(fmt.Sprintf("%s, finishing in-flight customers (up to %v)", stopReason, shutdownTimeout))
+					stopRoot()
+					go func() {
+						time.Sleep(shutdownTimeout)
+						shutdown(fmt.Sprintf("%s, in-flight customers didn't finish within %v", stopReason, shutdownTimeout), exitFailure)
+					}()
+				}
+			}
+		}
+	}
+}
+
+// Report the daemon's exit to the service manager before the process ends
+func serviceExit(code int) {
+	ws := winService
+	if ws == nil {
+		return
+	}
+	ws.exit <- uint32(code)
+	select {
+	case <-ws.done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// Copy log records to the event log when running as a service
+func serviceLogHandler(h slog.Handler) slog.Handler {
+	if winService == nil || winService.elog == nil {
+		return h
+	}
+	return eventLogHandler{next: h, elog: winService.elog}
+}
+
+// 'eventLogHandler' type represents a slog handler that also writes to the Windows event log
+type eventLogHandler struct {
+	next slog.Handler
+	elog *eventlog.Log
+}
+
+func (h eventLogHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	return h.next.Enabled(ctx, l)
+}
+
+func (h eventLogHandler) Handle(ctx context.Context, r slog.Record) error {
+	switch {
+	case r.Level >= slog.LevelError:
+		h.elog.Error(eventError, r.Message)
+	case r.Level >= slog.LevelWarn:
+		h.elog.Warning(eventWarning, r.Message)
+	case r.Level >= slog.LevelInfo:
+		h.elog.Info(eventInfo, r.Message)
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return eventLogHandler{next: h.next.WithAttrs(attrs), elog: h.elog}
+}
+
+func (h eventLogHandler) WithGroup(name string) slog.Handler {
+	return eventLogHandler{next: h.next.WithGroup(name), elog: h.elog}
+}
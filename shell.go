@@ -0,0 +1,278 @@
+/*
+ * Filename: shell.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Interactive incident shell over one firewall connection ('tfresh shell').
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 'replSession' type represents an interactive shell against one firewall
+type replSession struct {
+	env        string
+	firewall   string
+	user, pass string
+	client     *ssh.Client
+	customers  []customer // customers on this firewall
+}
+
+// Shell help text
+const replHelp = `Commands:
+  list                        customers on this firewall
+  status [customer]           quarantine and last refresh; live SA state for one customer
+  refresh <customer>          refresh one customer now
+  quarantine <customer> [why] hold a customer back from daemon refreshes
+  release <customer>          end a quarantine
+  help                        this text
+  exit                        leave the shell`
+
+// Find a customer on the firewall by name
+func (r *replSession) lookup(name string) (customer, error) {
+	want := customer{Name: normalizeName(name)}.key()
+	for _, c := range r.customers {
+		if c.key() == want {
+			return c, nil
+		}
+	}
+	return customer{}, fmt.Errorf("no customer %q on %s", name, r.env)
+}
+
+// Find the customer named by the longest prefix of the arguments, returning the rest
+func (r *replSession) lookupPrefix(args []string) (customer, string, error) {
+	for i := len(args); i > 0; i-- {
+		if c, err := r.lookup(strings.Join(args[:i], " ")); err == nil {
+			return c, strings.Join(args[i:], " "), nil
+		}
+	}
+	return customer{}, "", fmt.Errorf("no customer %q on %s", strings.Join(args, " "), r.env)
+}
+
+// Redial when the connection has dropped
+func (r *replSession) reconnect() error {
+	if r.client != nil {
+		r.client.Close()
+	}
+	client, err := dialFirewall(r.firewall, r.user, r.pass)
+	if err != nil {
+		return err
+	}
+	r.client = client
+	return nil
+}
+
+// Open a CLI session, redialing once if the connection dropped
+func (r *replSession) cli() (*cliSession, error) {
+	cli, err := openCLI(r.client)
+	if err == nil {
+		return cli, nil
+	}
+	if err = r.reconnect(); err != nil {
+		return nil, err
+	}
+	return openCLI(r.client)
+}
+
+// Update the state file under the daemon's feet; the daemon reloads quarantine each iteration
+func updateState(f func(st *state)) error {
+	return updateStateFile(stateFile, f)
+}
+
+// Run one shell command, returning false to leave the shell
+func (r *replSession) exec(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	cmd, args := fields[0], fields[1:]
+	name := strings.Join(args, " ")
+
+	switch cmd {
+	case "help", "?":
+		fmt.Println(replHelp)
+	case "exit", "quit":
+		return false
+	case "list":
+		writeCustomerTable(os.Stdout, r.customers)
+	case "status":
+		st, err := loadState(stateFile)
+		if err != nil {
+			fmt.Println("[ERROR]:", err)
+			return true
+		}
+		if name == "" {
+			for _, c := range r.customers {
+				r.printStatus(c, st)
+			}
+			return true
+		}
+		c, err := r.lookup(name)
+		if err != nil {
+			fmt.Println("[ERROR]:", err)
+			return true
+		}
+		r.printStatus(c, st)
+		r.printSA(c)
+	case "refresh":
+		c, err := r.lookup(name)
+		if err != nil {
+			fmt.Println("[ERROR]:", err)
+			return true
+		}
+		results, err := refreshFirewall(r.client, r.firewall, planRefresh(driverFor(r.firewall), []customer{c}, false), time.Time{})
+		if err != nil {
+			if err = r.reconnect(); err == nil {
+				results, err = refreshFirewall(r.client, r.firewall, planRefresh(driverFor(r.firewall), []customer{c}, false), time.Time{})
+			}
+		}
+		if err != nil {
+			fmt.Println("[ERROR]:", err)
+			return true
+		}
+		stateMu.Lock()
+		err = updateState(func(st *state) { st.recordRefreshes(r.firewall, results) })
+		stateMu.Unlock()
+		if err != nil {
+			fmt.Println("[ERROR]:", err)
+		}
+	case "quarantine", "release":
+		if len(args) == 0 {
+			fmt.Printf("Usage: %s <customer>\n", cmd)
+			return true
+		}
+		c, reason, err := r.lookupPrefix(args)
+		if err != nil {
+			fmt.Println("[ERROR]:", err)
+			return true
+		}
+		err = updateState(func(st *state) {
+			if cmd == "release" {
+				delete(st.Quarantined, c.key())
+				return
+			}
+			if st.Quarantined == nil {
+				st.Quarantined = map[string]quarantine{}
+			}
+			st.Quarantined[c.key()] = quarantine{Since: time.Now(), Reason: reason}
+		})
+		if err != nil {
+			fmt.Println("[ERROR]:", err)
+			return true
+		}
+		if cmd == "release" {
+			fmt.Printf("Released %s; the daemon refreshes it from its next iteration.\n", c.Name)
+		} else {
+			fmt.Printf("Quarantined %s; the daemon skips it from its next iteration.\n", c.Name)
+		}
+	default:
+		fmt.Printf("Unknown command %q, try 'help'.\n", cmd)
+	}
+	return true
+}
+
+// Print a customer's quarantine and last refresh
+func (r *replSession) printStatus(c customer, st *state) {
+	status := "active"
+	if q, ok := st.Quarantined[c.key()]; ok {
+		status = "quarantined since " + q.Since.Format(time.RFC3339)
+		if q.Reason != "" {
+			status += " (" + q.Reason + ")"
+		}
+	}
+	last := "never"
+	if t, ok := st.LastRefreshed[r.firewall][c.key()]; ok {
+		last = fmt.Sprintf("%s (%v ago)", t.Format(time.RFC3339), time.Since(t).Round(time.Second))
+	}
+	fmt.Printf("%s: %s, last refreshed %s\n", c.Name, status, last)
+}
+
+// Print the live IPsec SA of a customer's tunnel
+func (r *replSession) printSA(c customer) {
+	if c.Tunnel == "" {
+		return
+	}
+	cli, err := r.cli()
+	if err != nil {
+		fmt.Println("[ERROR]:", err)
+		return
+	}
+	defer cli.Close()
+	sas, err := listIPsecSAs(cli)
+	if err != nil {
+		fmt.Println("[ERROR]:", err)
+		return
+	}
+	sa, ok := sas[c.Tunnel]
+	if !ok {
+		fmt.Printf("  tunnel %s: down (no IPsec SA)\n", c.Tunnel)
+		return
+	}
+	fmt.Printf("  tunnel %s: up, peer %s, SA age %v, %v remaining\n", c.Tunnel, sa.Peer, sa.Age, sa.Remain)
+}
+
+// Handle 'tfresh shell'
+func shellCommand(args []string) {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fs.StringVar(&stateFile, "s", stateFile, "State file shared with the daemon (default is tfresh.state.json)")
+	fs.StringVar(&historyDB, "history-db", historyDB, "SQLite database to record refresh attempts to, shareable with the daemon (default $TFRESH_HISTORY_DB)")
+	env := fs.String("e", "", "Firewall name (e.g. prod, test)")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.Parse(args)
+
+	customers := loadCustomersOrExit()
+	host, ok := firewalls[*env]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown firewall environment %q.\n", *env)
+		fs.Usage()
+		os.Exit(1)
+	}
+	groups, err := groupByFirewall(customers, []string{*env})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+
+	r := &replSession{env: *env, firewall: host}
+	for _, g := range groups {
+		if g.env == *env {
+			r.customers = g.customers
+		}
+	}
+	r.user, r.pass = checkEnvVars()
+	enableHistory()
+	fmt.Printf("Connecting to %s..\n", host)
+	if err = r.reconnect(); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	defer r.client.Close()
+	fmt.Printf("Connected, %d customers. Type 'help' for commands.\n", len(r.customers))
+
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("tfresh(%s)> ", *env)
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		if !r.exec(in.Text()) {
+			return
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * Filename: shutdown.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Lifetime totals and the report printed when the daemon exits.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 'runTotals' type represents what the daemon has done since it started
+type runTotals struct {
+	mu         sync.Mutex
+	iterations map[string]int              // completed, by firewall
+	counts     map[string]int              // step results, by result
+	failing    map[string]map[string]int   // consecutive failures, by firewall and customer
+	last       map[string]iterationSummary // latest iteration, by firewall
+	lastAt     map[string]time.Time        // when it completed
+}
+
+// The running daemon's totals
+var totals = &runTotals{
+	iterations: map[string]int{},
+	counts:     map[string]int{},
+	failing:    map[string]map[string]int{},
+	last:       map[string]iterationSummary{},
+	lastAt:     map[string]time.Time{},
+}
+
+// Ensures the report is written once even if several goroutines exit
+var shutdownOnce sync.Once
+
+var (
+	// Cancelled on SIGINT/SIGTERM: schedulers finish the customer in hand and stop
+	rootCtx, stopRoot = context.WithCancel(context.Background())
+
+	// Why the daemon is stopping, set before rootCtx is cancelled
+	stopReason string
+
+	// How long schedulers get to finish before the daemon exits anyway
+	shutdownTimeout = 30 * time.Second
+)
+
+// Sleep for d, returning false early when the daemon is stopping
+func sleepCtx(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-rootCtx.Done():
+		return false
+	}
+}
+
+// Add a completed iteration
+func (t *runTotals) record(s iterationSummary, results []stepResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.iterations[s.firewall]++
+	t.last[s.firewall], t.lastAt[s.firewall] = s, time.Now()
+	for result, n := range s.counts {
+		t.counts[result] += n
+	}
+	fails := t.failing[s.firewall]
+	if fails == nil {
+		fails = map[string]int{}
+		t.failing[s.firewall] = fails
+	}
+	for _, r := range results {
+		switch r.result {
+		case resultFailed:
+			fails[r.step.customer]++
+		case resultSuccess, resultSent, resultHealthy:
+			delete(fails, r.step.customer)
+		}
+	}
+}
+
+// Pick up the failure streaks saved by the previous run
+func (t *runTotals) restore(st *state) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for fw, byKey := range st.Customers {
+		for _, cs := range byKey {
+			if cs.Failures == 0 {
+				continue
+			}
+			if t.failing[fw] == nil {
+				t.failing[fw] = map[string]int{}
+			}
+			t.failing[fw][cs.Name] = cs.Failures
+		}
+	}
+}
+
+// Report whether any refresh of this run failed; streaks restored from the
+// state store belong to earlier runs
+func (t *runTotals) anyFailed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.counts[resultFailed] > 0
+}
+
+// Stop on SIGINT/SIGTERM once in-flight customers are done; main writes the report
+// and exits 0. A second signal or the timeout exits at once with exitFailure.
+func handleSignals() {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	stopReason = "received " + sig.String()
+	logger.Info(fmt.Sprintf("%s, finishing in-flight customers (up to %v); repeat to exit now", stopReason, shutdownTimeout), "signal", sig.String())
+	stopRoot()
+
+	select {
+	case sig = <-sigs:
+		shutdown(fmt.Sprintf("%s, then %s before in-flight customers finished", stopReason, sig), exitFailure)
+	case <-time.After(shutdownTimeout):
+		shutdown(fmt.Sprintf("%s, in-flight customers didn't finish within %v", stopReason, shutdownTimeout), exitFailure)
+	}
+}
+
+// Write the shutdown report and exit
+func shutdown(reason string, code int) {
+	shutdownOnce.Do(func() {
+		sdSend("STOPPING=1\nSTATUS=" + reason)
+		// Short-lived runs hand their results to the Pushgateway however they end
+		if pushgatewayURL != "" {
+			if err := pushMetrics(pushgatewayURL); err != nil {
+				logger.Error(fmt.Sprint("pushgateway: ", err), "error", err)
+			}
+		}
+		writeShutdownReport(reason, code)
+		recordExit(reason, code)
+		serviceExit(code)
+		os.Exit(code)
+	})
+	// Another goroutine is already exiting
+	select {}
+}
+
+// Print and emit the final report
+func writeShutdownReport(reason string, code int) {
+	totals.mu.Lock()
+	defer totals.mu.Unlock()
+
+	iterations := 0
+	for _, n := range totals.iterations {
+		iterations += n
+	}
+	ok := totals.counts[resultSuccess] + totals.counts[resultSent]
+	attempted := ok + totals.counts[resultFailed]
+	rate := "n/a"
+	if attempted > 0 {
+		rate = fmt.Sprintf("%.1f%%", 100*float64(ok)/float64(attempted))
+	}
+
+	var failing []string
+	for fw, fails := range totals.failing {
+		for c, n := range fails {
+			failing = append(failing, fmt.Sprintf("%s on %s (%d consecutive)", c, fw, n))
+		}
+	}
+	sort.Strings(failing)
+
+	uptime := time.Since(current.Started).Round(time.Second)
+	if logFormat == "json" {
+		logger.Info("tfresh shutting down: "+reason, "reason", reason, "uptime_s", int64(uptime.Seconds()),
+			"iterations", iterations, "succeeded", ok, "attempted", attempted, "failing", failing)
+	} else if logEnabled(slog.LevelInfo) || code != 0 || ok < attempted || len(failing) > 0 {
+		// Quiet deployments only hear about runs with failures
+		printShutdownReport(reason, uptime, iterations, rate, ok, attempted, failing)
+	}
+
+	sent := totals.counts[resultSent]
+	succeeded := totals.counts[resultSuccess]
+	failed := totals.counts[resultFailed]
+	emit(ndjsonEvent{
+		Event:      evShutdown,
+		Iteration:  iterations,
+		Reason:     reason,
+		Failing:    failing,
+		DurationMS: uptime.Milliseconds(),
+		Succeeded:  &succeeded,
+		Failed:     &failed,
+		Sent:       &sent,
+	})
+}
+
+// Print the final report for humans
+func printShutdownReport(reason string, uptime time.Duration, iterations int, rate string, ok, attempted int, failing []string) {
+	fmt.Fprintln(os.Stderr, "tfresh shutting down:", reason)
+	fmt.Fprintf(os.Stderr, "  Uptime:       %v\n", uptime)
+	fmt.Fprintf(os.Stderr, "  Iterations:   %d completed\n", iterations)
+	fmt.Fprintf(os.Stderr, "  Success rate: %s (%d of %d refresh steps)\n", rate, ok, attempted)
+	if len(failing) == 0 {
+		fmt.Fprintln(os.Stderr, "  Failing:      none")
+	} else {
+		fmt.Fprintln(os.Stderr, "  Failing:")
+		for _, f := range failing {
+			fmt.Fprintln(os.Stderr, "    "+f)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Filename: slack.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Slack incoming webhook notifications.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timeout for one Slack post
+const slackTimeout = 10 * time.Second
+
+// 'slackNotifier' type represents a Slack incoming webhook
+type slackNotifier struct {
+	url         string
+	minSeverity int // events below this are not posted
+	http        *http.Client
+}
+
+// Create a Slack notifier for events at or above a severity name (info, warning, error)
+func newSlackNotifier(url, minSeverity string) (*slackNotifier, error) {
+	sev, ok := severityNames[minSeverity]
+	if !ok || sev == sevOff {
+		return nil, fmt.Errorf("unknown Slack severity %q (info, warning, error)", minSeverity)
+	}
+	return &slackNotifier{url: url, minSeverity: sev, http: &http.Client{Timeout: slackTimeout}}, nil
+}
+
+// Slack emoji per severity
+func slackIcon(sev int) string {
+	switch sev {
+	case sevError:
+		return ":red_circle:"
+	case sevWarning:
+		return ":warning:"
+	default:
+		return ":information_source:"
+	}
+}
+
+// Format an event as a Slack message
+func slackText(e event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s *tfresh %s*", slackIcon(e.Severity), strings.ReplaceAll(e.Type, "_", " "))
+	if e.Firewall != "" {
+		fmt.Fprintf(&b, " on `%s`", e.Firewall)
+	}
+	b.WriteString("\n")
+	for _, f := range [][2]string{{"Customer", e.Customer}, {"Gateway", e.Gateway}, {"Tunnel", e.Tunnel}} {
+		if f[1] != "" {
+			fmt.Fprintf(&b, "*%s:* %s\n", f[0], f[1])
+		}
+	}
+	fmt.Fprintf(&b, "```%s```", e.Message)
+	return b.String()
+}
+
+func (s *slackNotifier) Notify(e event) error {
+	if e.Severity < s.minSeverity {
+		return nil
+	}
+	body, err := json.Marshal(map[string]string{"text": slackText(e)})
+	if err != nil {
+		return err
+	}
+	resp, err := s.http.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("slack: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("slack: webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+/*
+ * Filename: smtp.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Email digest of failed refreshes, sent over SMTP at the end of each iteration.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 'smtpConfig' type represents the 'notifications: smtp:' section of the config file
+type smtpConfig struct {
+	Host        string   `yaml:"host"`
+	Port        int      `yaml:"port,omitempty"`         // defaults to 587, or 465 with tls: tls
+	TLS         string   `yaml:"tls,omitempty"`          // starttls (default), tls or none
+	Username    string   `yaml:"username,omitempty"`     // no authentication when empty
+	Password    string   `yaml:"password,omitempty"`     // prefer password_env
+	PasswordEnv string   `yaml:"password_env,omitempty"` // environment variable holding the password
+	From        string   `yaml:"from"`
+	To          []string `yaml:"to"`
+	Subject     string   `yaml:"subject,omitempty"` // prefix, defaults to '[tfresh]'
+}
+
+// 'notificationConfig' type represents the 'notifications' section of the config file
+type notificationConfig struct {
+	SMTP *smtpConfig `yaml:"smtp,omitempty"`
+}
+
+// SMTP settings from the last loaded config file, nil when not configured
+var smtpSettings *smtpConfig
+
+// Check the settings and fill in defaults
+func (c *smtpConfig) validate() error {
+	switch {
+	case c.Host == "":
+		return errors.New("smtp: host is blank")
+	case c.From == "":
+		return errors.New("smtp: from is blank")
+	case len(c.To) == 0:
+		return errors.New("smtp: no recipients in to")
+	}
+	switch c.TLS {
+	case "":
+		c.TLS = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return fmt.Errorf("smtp: unknown tls mode %q (starttls, tls, none)", c.TLS)
+	}
+	if c.Port == 0 {
+		c.Port = 587
+		if c.TLS == "tls" {
+			c.Port = 465
+		}
+	}
+	if c.Subject == "" {
+		c.Subject = "[tfresh]"
+	}
+	return nil
+}
+
+// SMTP password, read from the environment when password_env is set
+func (c *smtpConfig) password() string {
+	if c.PasswordEnv != "" {
+		return os.Getenv(c.PasswordEnv)
+	}
+	return c.Password
+}
+
+// Format the digest of an iteration's failed refreshes
+func failureDigest(firewall string, iteration int, failed []stepResult) (subject, body string) {
+	subject = fmt.Sprintf("%d failed refreshes on %s (iteration # %d)", len(failed), firewall, iteration)
+	var b strings.Builder
+	fmt.Fprintf(&b, "Iteration # %d on %s finished at %s with %d failed refreshes:\r\n\r\n",
+		iteration, firewall, time.Now().Format(time.RFC1123), len(failed))
+	for _, r := range failed {
+		fmt.Fprintf(&b, "Customer: %s\r\n", r.step.customer)
+		if r.step.gateway != "" {
+			fmt.Fprintf(&b, "Gateway:  %s\r\n", r.step.gateway)
+		}
+		if r.step.tunnel != "" {
+			fmt.Fprintf(&b, "Tunnel:   %s\r\n", r.step.tunnel)
+		}
+		if r.err != nil {
+			fmt.Fprintf(&b, "Error:    %s\r\n", strings.ReplaceAll(r.err.Error(), "\n", "; "))
+		}
+		b.WriteString("\r\n")
+	}
+	return subject, b.String()
+}
+
+// Email the digest of an iteration's failed refreshes, if there were any
+func mailDigest(firewall string, iteration int, results []stepResult) {
+	if smtpSettings == nil {
+		return
+	}
+	var failed []stepResult
+	for _, r := range results {
+		if r.result == resultFailed {
+			failed = append(failed, r)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+	subject, body := failureDigest(firewall, iteration, failed)
+	if err := smtpSettings.send(subject, body); err != nil {
+		logger.Error(fmt.Sprint("email digest: ", err), "firewall", firewall, "error", err)
+	}
+}
+
+// Send one message to every recipient
+func (c *smtpConfig) send(subject, body string) error {
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+	tlsConfig := &tls.Config{ServerName: c.Host}
+
+	var client *smtp.Client
+	if c.TLS == "tls" {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, tlsConfig)
+		if err != nil {
+			return err
+		}
+		if client, err = smtp.NewClient(conn, c.Host); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+		if err != nil {
+			return err
+		}
+		if client, err = smtp.NewClient(conn, c.Host); err != nil {
+			conn.Close()
+			return err
+		}
+		if c.TLS == "starttls" {
+			if err = client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return err
+			}
+		}
+	}
+	defer client.Close()
+
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.password(), c.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("%s: %w", to, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		c.From, strings.Join(c.To, ", "), c.Subject, subject, time.Now().Format(time.RFC1123Z), body)
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
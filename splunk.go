@@ -0,0 +1,118 @@
+/*
+ * Filename: splunk.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Splunk HTTP Event Collector output for refresh events.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Splunk index, empty uses the HEC token's default
+	splunkIndex = ""
+
+	// Splunk sourcetype
+	splunkSourcetype = "tfresh:event"
+
+	// Events waiting to be sent; nil when Splunk output is off
+	splunkCh chan hecEvent
+
+	// Events dropped because the queue was full
+	splunkDropped atomic.Int64
+)
+
+// 'hecEvent' type represents one event in the HEC wire format
+type hecEvent struct {
+	Time       float64     `json:"time"`
+	Host       string      `json:"host,omitempty"`
+	Source     string      `json:"source"`
+	Sourcetype string      `json:"sourcetype"`
+	Index      string      `json:"index,omitempty"`
+	Event      ndjsonEvent `json:"event"`
+}
+
+// Start sending events to a HEC endpoint
+func startSplunk(base, token string) {
+	splunkCh = make(chan hecEvent, shipQueue)
+	go splunkLoop(strings.TrimRight(base, "/")+"/services/collector/event", token)
+}
+
+// Queue one event for Splunk, never blocking the refresh
+func splunkEvent(t time.Time, e ndjsonEvent) {
+	if splunkCh == nil {
+		return
+	}
+	select {
+	case splunkCh <- hecEvent{
+		Time:       float64(t.UnixMilli()) / 1000,
+		Host:       e.Firewall,
+		Source:     "tfresh",
+		Sourcetype: splunkSourcetype,
+		Index:      splunkIndex,
+		Event:      e,
+	}:
+	default:
+		splunkDropped.Add(1)
+	}
+}
+
+// Batch queued events and post them to the collector
+func splunkLoop(url, token string) {
+	ticker := time.NewTicker(shipInterval)
+	defer ticker.Stop()
+	var pending []hecEvent
+	flush := func() {
+		if n := splunkDropped.Swap(0); n > 0 {
+			logger.Warn(fmt.Sprintf("Splunk output dropped %d events, the collector is too slow", n), "dropped", n)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		if err := sendHEC(url, token, pending); err != nil {
+			logger.Warn(fmt.Sprint("Splunk HEC delivery failed: ", err), "error", err)
+		}
+		pending = nil
+	}
+	for {
+		select {
+		case e := <-splunkCh:
+			pending = append(pending, e)
+			if len(pending) >= shipBatch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Post a batch of events; HEC accepts concatenated JSON objects
+func sendHEC(url, token string, events []hecEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+token)
+	req.Header.Set("Content-Type", "application/json")
+	_, err = shipPost(req)
+	return err
+}
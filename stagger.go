@@ -0,0 +1,39 @@
+/*
+ * Filename: stagger.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Jitter and stagger spreading IKE negotiations out over time.
+ */
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+var (
+	// Random extra sleep of up to this long between iterations, so instances drift apart
+	scheduleJitter time.Duration
+
+	// Pause between consecutive customers within an iteration
+	staggerDelay time.Duration
+)
+
+// Add a random share of -jitter to a sleep
+func jittered(d time.Duration) time.Duration {
+	if scheduleJitter <= 0 {
+		return d
+	}
+	return d + time.Duration(rand.Int63n(int64(scheduleJitter)))
+}
+
+// Pause before the i'th customer of a session, except the first. False when stopping.
+func stagger(i int) bool {
+	if i == 0 || staggerDelay <= 0 {
+		return rootCtx.Err() == nil
+	}
+	return sleepCtx(staggerDelay)
+}
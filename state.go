@@ -0,0 +1,335 @@
+/*
+ * Filename: state.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Persistent state store shared between tfresh runs.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Tolerance when deciding whether a customer is due with -due
+const dueSlack = time.Minute
+
+// 'state' type represents everything tfresh persists between runs
+type state struct {
+	ConfigVersions []configVersion        `json:"config_versions"`
+	Drift          map[string]driftReport `json:"drift,omitempty"` // by firewall
+
+	// Last successful refresh, by firewall and customer key
+	LastRefreshed map[string]map[string]time.Time `json:"last_refreshed,omitempty"`
+
+	// Customers held back from refreshes, by customer key
+	Quarantined map[string]quarantine `json:"quarantined,omitempty"`
+
+	// Last SA state and failure streak, by firewall and customer key
+	Customers map[string]map[string]*customerState `json:"customers,omitempty"`
+}
+
+// 'customerState' type represents what tfresh last saw of a customer's tunnel on one firewall
+type customerState struct {
+	Name         string     `json:"name"`
+	SA           string     `json:"sa,omitempty"` // up or down, as of SACheckedAt
+	SACheckedAt  *time.Time `json:"sa_checked_at,omitempty"`
+	Failures     int        `json:"failures,omitempty"` // consecutive failed refreshes
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+}
+
+// 'quarantine' type represents an operator's hold on a customer
+type quarantine struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// 'configVersion' type represents one loaded revision of the configuration file
+type configVersion struct {
+	Hash     string    `json:"hash"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Source   string    `json:"source"`
+	Content  []byte    `json:"content"`
+}
+
+func (v configVersion) String() string {
+	return fmt.Sprintf("%.12s (loaded %s)", v.Hash, v.LoadedAt.Format(time.RFC3339))
+}
+
+// Load the state file, returning an empty state if it doesn't exist yet
+func loadState(filename string) (*state, error) {
+	st := &state{}
+	fBytes, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(fBytes, st); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return st, nil
+}
+
+// Atomically write the state file, first merging in what other tfresh commands saved
+// since it was loaded so their quarantines and refreshes aren't overwritten
+func (s *state) save(filename string) error {
+	unlock, err := lockForUpdate(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	disk, err := loadState(filename)
+	if err != nil {
+		return err
+	}
+	s.merge(disk)
+	return s.write(filename)
+}
+
+// Load the state file, change it and write it back, holding the update lock throughout
+func updateStateFile(filename string, f func(st *state)) error {
+	unlock, err := lockForUpdate(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	st, err := loadState(filename)
+	if err != nil {
+		return err
+	}
+	f(st)
+	return st.write(filename)
+}
+
+// Fold the state on disk into s. Only the shell changes quarantines, so the disk's are
+// kept; refresh times take the later of the two, SA states the later check, and
+// customers and drift reports only on disk are added.
+func (s *state) merge(disk *state) {
+	s.Quarantined = disk.Quarantined
+	for fw, byKey := range disk.LastRefreshed {
+		for key, t := range byKey {
+			if cur, ok := s.LastRefreshed[fw][key]; ok && !t.After(cur) {
+				continue
+			}
+			if s.LastRefreshed == nil {
+				s.LastRefreshed = map[string]map[string]time.Time{}
+			}
+			if s.LastRefreshed[fw] == nil {
+				s.LastRefreshed[fw] = map[string]time.Time{}
+			}
+			s.LastRefreshed[fw][key] = t
+		}
+	}
+	for fw, byKey := range disk.Customers {
+		for key, cs := range byKey {
+			cur := s.Customers[fw][key]
+			if cur == nil {
+				if s.Customers == nil {
+					s.Customers = map[string]map[string]*customerState{}
+				}
+				if s.Customers[fw] == nil {
+					s.Customers[fw] = map[string]*customerState{}
+				}
+				s.Customers[fw][key] = cs
+				continue
+			}
+			if cs.SACheckedAt != nil && (cur.SACheckedAt == nil || cs.SACheckedAt.After(*cur.SACheckedAt)) {
+				cur.SA, cur.SACheckedAt = cs.SA, cs.SACheckedAt
+			}
+		}
+	}
+	for fw, report := range disk.Drift {
+		if _, ok := s.Drift[fw]; !ok {
+			if s.Drift == nil {
+				s.Drift = map[string]driftReport{}
+			}
+			s.Drift[fw] = report
+		}
+	}
+}
+
+// Atomically write the state as it is
+func (s *state) write(filename string) error {
+	fBytes, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, fBytes, ".tfresh-state-*")
+}
+
+// Write a file through a temporary file in the same directory and rename it into place
+func writeFileAtomic(filename string, data []byte, pattern string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), pattern)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// Record a loaded configuration, returning the now active version.
+// Reloading an unchanged config keeps the existing version.
+func (s *state) recordConfig(source string, content []byte) configVersion {
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	if n := len(s.ConfigVersions); n > 0 && s.ConfigVersions[n-1].Hash == hash {
+		return s.ConfigVersions[n-1]
+	}
+
+	v := configVersion{Hash: hash, LoadedAt: time.Now(), Source: source, Content: content}
+	s.ConfigVersions = append(s.ConfigVersions, v)
+	if configHistory > 0 && len(s.ConfigVersions) > configHistory {
+		s.ConfigVersions = s.ConfigVersions[len(s.ConfigVersions)-configHistory:]
+	}
+	return v
+}
+
+// Drop the active configuration version and return the previous one
+func (s *state) rollbackConfig() (configVersion, error) {
+	if len(s.ConfigVersions) < 2 {
+		return configVersion{}, errors.New("no previous config version to roll back to")
+	}
+	s.ConfigVersions = s.ConfigVersions[:len(s.ConfigVersions)-1]
+	return s.ConfigVersions[len(s.ConfigVersions)-1], nil
+}
+
+// Return a customer's entry, creating it on first use
+func (s *state) customerState(firewall, name string) *customerState {
+	if s.Customers == nil {
+		s.Customers = map[string]map[string]*customerState{}
+	}
+	byKey := s.Customers[firewall]
+	if byKey == nil {
+		byKey = map[string]*customerState{}
+		s.Customers[firewall] = byKey
+	}
+	key := customer{Name: name}.key()
+	cs := byKey[key]
+	if cs == nil {
+		cs = &customerState{}
+		byKey[key] = cs
+	}
+	cs.Name = name
+	return cs
+}
+
+// Record whether a customer's SAs were up when last checked
+func (s *state) recordSA(firewall, name string, up bool) {
+	cs := s.customerState(firewall, name)
+	now := time.Now()
+	cs.SA, cs.SACheckedAt = "down", &now
+	if up {
+		cs.SA = "up"
+	}
+}
+
+// Record the customers refreshed by an iteration and their failure streaks. Returns the
+// streak of every customer that failed and of every one whose streak a success or
+// established SAs ended.
+func (s *state) recordRefreshes(firewall string, results []stepResult) (failing, recovered map[string]int) {
+	if s.LastRefreshed == nil {
+		s.LastRefreshed = map[string]map[string]time.Time{}
+	}
+	last := s.LastRefreshed[firewall]
+	if last == nil {
+		last = map[string]time.Time{}
+		s.LastRefreshed[firewall] = last
+	}
+	now := time.Now()
+	for _, r := range results {
+		if r.step.customer == "" || (r.result != resultSuccess && r.result != resultSent) {
+			continue
+		}
+		last[customer{Name: r.step.customer}.key()] = now
+	}
+
+	failing, recovered = map[string]int{}, map[string]int{}
+	for _, r := range results {
+		if r.step.customer == "" {
+			continue
+		}
+		switch r.result {
+		case resultFailed:
+			cs := s.customerState(firewall, r.step.customer)
+			if cs.Failures == 0 {
+				cs.FailingSince = &now
+			}
+			cs.Failures++
+			failing[r.step.customer] = cs.Failures
+		case resultSuccess, resultSent, resultHealthy:
+			if cs := s.Customers[firewall][customer{Name: r.step.customer}.key()]; cs != nil && cs.Failures > 0 {
+				recovered[r.step.customer] = cs.Failures
+				cs.Failures, cs.FailingSince = 0, nil
+			}
+		}
+	}
+	return failing, recovered
+}
+
+// Return the customers whose interval has elapsed since their last refresh.
+// The slack absorbs timer jitter so a customer isn't skipped by seconds.
+func (s *state) dueCustomers(firewall string, customers []customer, slack time.Duration) []customer {
+	var due []customer
+	now := time.Now()
+	for _, c := range customers {
+		last, ok := s.LastRefreshed[firewall][c.key()]
+		if sched := c.schedule(); sched != nil {
+			// Due once a fire time has passed since the last refresh, or within the slack when never refreshed
+			if !ok {
+				last = now.Add(-slack)
+			}
+			if next := sched.next(last); !next.IsZero() && !next.After(now) {
+				due = append(due, c)
+			}
+			continue
+		}
+		interval, _ := c.interval()
+		if !ok || time.Since(last) >= interval-slack {
+			due = append(due, c)
+		}
+	}
+	return due
+}
+
+// Split customers into those to refresh and those held in quarantine
+func (s *state) splitQuarantined(customers []customer) (active, held []customer) {
+	for _, c := range customers {
+		if _, ok := s.Quarantined[c.key()]; ok {
+			held = append(held, c)
+			continue
+		}
+		active = append(active, c)
+	}
+	return active, held
+}
+
+// Pick up quarantine changes saved by 'tfresh shell' since the state was loaded
+func (s *state) reloadQuarantine(filename string) error {
+	disk, err := loadState(filename)
+	if err != nil {
+		return err
+	}
+	s.Quarantined = disk.Quarantined
+	return nil
+}
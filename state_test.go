@@ -0,0 +1,68 @@
+/*
+ * Filename: state_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the state file shared between the daemon and the other commands.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The daemon's save keeps what the shell wrote to the file during its iteration
+func TestStateSaveMergesOtherWriters(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "state.json")
+	earlier := time.Now().Add(-time.Hour)
+
+	daemon, err := loadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.LastRefreshed = map[string]map[string]time.Time{"fw1": {"globex": earlier}}
+	if err := daemon.save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// The shell quarantines Acme and refreshes Globex while the daemon iterates
+	shellAt := time.Now().Add(-time.Minute).Round(0)
+	err = updateStateFile(filename, func(st *state) {
+		st.Quarantined = map[string]quarantine{customer{Name: "Acme"}.key(): {Since: shellAt, Reason: "maintenance"}}
+		st.LastRefreshed["fw1"][customer{Name: "Globex"}.key()] = shellAt
+		st.LastRefreshed["fw2"] = map[string]time.Time{customer{Name: "Initech"}.key(): shellAt}
+		st.recordSA("fw2", "Initech", true)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	daemon.recordRefreshes("fw1", []stepResult{{step: refreshStep{kind: stepTunnel, customer: "Umbrella"}, result: resultSuccess}})
+	if err := daemon.save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadState(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got.Quarantined[customer{Name: "Acme"}.key()]; !ok {
+		t.Error("the shell's quarantine was overwritten")
+	}
+	if last := got.LastRefreshed["fw1"][customer{Name: "Globex"}.key()]; !last.Equal(shellAt) {
+		t.Errorf("Globex last refreshed %v, want the shell's %v", last, shellAt)
+	}
+	if _, ok := got.LastRefreshed["fw1"][customer{Name: "Umbrella"}.key()]; !ok {
+		t.Error("the daemon's refresh was lost")
+	}
+	if _, ok := got.LastRefreshed["fw2"][customer{Name: "Initech"}.key()]; !ok {
+		t.Error("the shell's refresh on another firewall was lost")
+	}
+	if cs := got.Customers["fw2"][customer{Name: "Initech"}.key()]; cs == nil || cs.SA != "up" {
+		t.Errorf("the shell's SA check was lost: %+v", cs)
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Filename: status.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Reports what the state store knows about the daemon, or live SA states ('tfresh status').
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// Handle 'tfresh status'
+func statusCommand(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	fs.StringVar(&stateFile, "s", stateFile, "State file (default is tfresh.state.json)")
+	live := fs.Bool("live", false, "Query each customer's IKE and IPsec SAs on the firewall instead, without refreshing")
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename for -live (default is config.yml)")
+	var fwEnvs stringList
+	fs.Var(&fwEnvs, "e", "With -live, firewall names or environments for customers without customer_firewall; repeatable")
+	var names stringList
+	fs.Var(&names, "customer", "With -live, only these customers; repeatable")
+	match := fs.String("match", "", "With -live, only customers whose name matches this regular expression")
+	transport := fs.String("transport", "ssh", "Firewall transport for -live (ssh, api)")
+	fs.BoolVar(&apiInsecure, "api-insecure", apiInsecure, "Skip verification of the firewall management certificate with the api transport")
+	fs.StringVar(&apiKeyCache, "api-key-cache", apiKeyCache, "Cache of API keys generated when PAN_API_KEY is not set")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.Parse(args)
+
+	if *live {
+		if !liveStatus(fwEnvs, names, *match, *transport) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	st, err := loadState(stateFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if n := len(st.ConfigVersions); n > 0 {
+		fmt.Printf("Active config version: %s from %s\n", st.ConfigVersions[n-1], st.ConfigVersions[n-1].Source)
+	} else {
+		fmt.Println("Active config version: none recorded")
+	}
+
+	if len(st.Drift) == 0 {
+		fmt.Println("Drift: not checked yet")
+	}
+	fws := make([]string, 0, len(st.Drift))
+	for fw := range st.Drift {
+		fws = append(fws, fw)
+	}
+	sort.Strings(fws)
+	for _, fw := range fws {
+		fmt.Println("Drift:", st.Drift[fw])
+	}
+}
+
+// 'saStatus' type represents the live SA state of one customer
+type saStatus struct {
+	customer, firewall string
+	up                 bool
+	err                error
+}
+
+// Print every selected customer's SA state, reporting whether all are up
+func liveStatus(fwEnvs, names []string, match, transport string) bool {
+	if transport != "ssh" && transport != "api" {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown transport %q (ssh, api).\n", transport)
+		os.Exit(1)
+	}
+	if err := loadFirewalls(configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	envs, err := expandEnvs(fwEnvs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	customers, err := selectCustomers(loadCustomersOrExit(), names, match)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	groups, err := groupByFirewall(customers, envs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	var username, password string
+	if transport == "ssh" || envAPIKey() == "" {
+		username, password = checkEnvVars()
+	}
+
+	var statuses []saStatus
+	for _, g := range groups {
+		statuses = append(statuses, probeGroup(g, transport, username, password)...)
+	}
+
+	allUp := true
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CUSTOMER\tFIREWALL\tSAS")
+	for _, s := range statuses {
+		state := "up"
+		switch {
+		case s.err != nil:
+			state = "unknown: " + s.err.Error()
+		case !s.up:
+			state = "down"
+		}
+		if state != "up" {
+			allUp = false
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", s.customer, s.firewall, state)
+	}
+	tw.Flush()
+	return allUp
+}
+
+// Probe the SAs of one firewall's customers over the given transport
+func probeGroup(g firewallGroup, transport, username, password string) []saStatus {
+	sc := &scheduler{env: g.env, firewall: firewalls[g.env], customers: g.customers, user: username, pass: password}
+	var statuses []saStatus
+	fail := func(err error) []saStatus {
+		for _, c := range g.customers {
+			statuses = append(statuses, saStatus{customer: c.Name, firewall: sc.firewall, err: err})
+		}
+		return statuses
+	}
+
+	if transport == "api" {
+		key := envAPIKey()
+		sc.api = newAPIClient(sc.firewall, key)
+		if key == "" {
+			if err := sc.api.login(username, password); err != nil {
+				return fail(fmt.Errorf("api key generation failed: %w", err))
+			}
+		}
+	} else if err := sc.connect(); err != nil {
+		return fail(err)
+	} else {
+		defer sc.client.Close()
+	}
+
+	probe, done, err := sc.saProbe()
+	if err != nil {
+		return fail(err)
+	}
+	defer done()
+	for _, c := range g.customers {
+		s := saStatus{customer: c.Name, firewall: sc.firewall}
+		if c.Gateway == "" && c.Tunnel == "" {
+			s.err = fmt.Errorf("no gateway or tunnel configured")
+		} else {
+			s.up, s.err = probe(c)
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
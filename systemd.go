@@ -0,0 +1,132 @@
+/*
+ * Filename: systemd.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: sd_notify readiness, status and watchdog messages when run as a systemd Type=notify service.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 'sdWatchdog' type represents the scheduler heartbeats WATCHDOG=1 is sent on
+type sdWatchdog struct {
+	mu    sync.Mutex
+	due   map[string]time.Time // by firewall, when its scheduler must check in again
+	stale map[string]bool      // firewalls already reported overdue
+}
+
+var (
+	// Sends READY=1 once, after the first firewall connected
+	sdReadyOnce sync.Once
+
+	// Scheduler heartbeats for WATCHDOG=1, nil unless systemd asked for a watchdog
+	sdDog *sdWatchdog
+)
+
+// Send a state to the service manager's $NOTIFY_SOCKET; a no-op outside systemd
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract socket namespace
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Log a failed notification rather than failing the daemon
+func sdSend(state string) {
+	if err := sdNotify(state); err != nil {
+		logger.Warn(fmt.Sprint("sd_notify: ", err), "error", err)
+	}
+}
+
+// The watchdog interval systemd expects pings within, zero when it isn't enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Start pinging the watchdog every half interval for as long as every firewall's scheduler
+// keeps checking in. The ping doesn't wait for iterations, so long intervals, cron
+// schedules and blackouts are fine; a scheduler stuck past its check-in stops it.
+func sdStartWatchdog(firewalls []string) {
+	d := sdWatchdogInterval()
+	if d == 0 || len(firewalls) == 0 {
+		return
+	}
+	sdDog = &sdWatchdog{due: map[string]time.Time{}, stale: map[string]bool{}}
+	for _, fw := range firewalls {
+		sdDog.beat(fw, d)
+	}
+	go func() {
+		t := time.NewTicker(d / 2)
+		defer t.Stop()
+		for range t.C {
+			if sdDog.alive() {
+				sdSend("WATCHDOG=1")
+			}
+		}
+	}()
+}
+
+// Record that a firewall's scheduler is working and will check in again within d
+func (w *sdWatchdog) beat(firewall string, d time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	w.due[firewall] = time.Now().Add(d)
+	delete(w.stale, firewall)
+	w.mu.Unlock()
+}
+
+// Whether every scheduler checked in when it said it would
+func (w *sdWatchdog) alive() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	ok := true
+	for fw, due := range w.due {
+		if now.Before(due) {
+			continue
+		}
+		ok = false
+		if !w.stale[fw] {
+			w.stale[fw] = true
+			logger.Error(fmt.Sprintf("scheduler for %s is %v overdue, no longer pinging the systemd watchdog", fw, now.Sub(due).Round(time.Second)), "firewall", fw)
+		}
+	}
+	return ok
+}
+
+// Tell systemd the daemon is up, once
+func sdReady() {
+	sdReadyOnce.Do(func() {
+		sdSend("READY=1\nSTATUS=Connected, refreshing tunnels")
+	})
+}
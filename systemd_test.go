@@ -0,0 +1,38 @@
+/*
+ * Filename: systemd_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the systemd watchdog heartbeats.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSdWatchdogHeartbeats(t *testing.T) {
+	w := &sdWatchdog{due: map[string]time.Time{}, stale: map[string]bool{}}
+	// A scheduler asleep until a far-off cron fire time is still alive
+	w.beat("fw1", 6*time.Hour)
+	w.beat("fw2", time.Minute)
+	if !w.alive() {
+		t.Error("fresh heartbeats: not alive")
+	}
+
+	// One overdue scheduler stops the pings until it checks in again
+	w.beat("fw2", -time.Second)
+	if w.alive() {
+		t.Error("overdue scheduler: alive")
+	}
+	w.beat("fw2", time.Minute)
+	if !w.alive() || w.stale["fw2"] {
+		t.Error("scheduler checked in again: not alive")
+	}
+
+	var nilDog *sdWatchdog
+	nilDog.beat("fw1", time.Minute)
+}
@@ -0,0 +1,472 @@
+/*
+ * Filename: toml.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: A TOML reader covering what configuration files use, decoding into plain maps and slices.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// 'tomlParser' type represents a TOML document being read
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+	root map[string]any
+	cur  map[string]any      // table key/value pairs go to
+	defs map[string]bool     // tables defined with a [header], by dotted path
+	arrs map[string]struct{} // arrays of tables, by dotted path
+}
+
+// Parse a TOML document. Dates and times are kept as their text, which the YAML decoder reads as times.
+func parseTOML(data []byte) (map[string]any, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("toml: not UTF-8")
+	}
+	p := &tomlParser{src: strings.ReplaceAll(string(data), "\r\n", "\n"), line: 1, root: map[string]any{},
+		defs: map[string]bool{}, arrs: map[string]struct{}{}}
+	p.cur = p.root
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.src) {
+			return p.root, nil
+		}
+		var err error
+		if p.src[p.pos] == '[' {
+			err = p.header()
+		} else {
+			err = p.keyValue(p.cur)
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("toml: line %d: %w", p.line, err)
+		}
+	}
+}
+
+// Skip spaces and comments, and newlines too when multiline
+func (p *tomlParser) skipSpace(multiline bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n' && multiline:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+// Require the rest of the line to be blank or a comment
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace(false)
+	if p.pos < len(p.src) && p.src[p.pos] != '\n' {
+		return fmt.Errorf("unexpected %q after value", p.src[p.pos])
+	}
+	return nil
+}
+
+// Read a [table] or [[array of tables]] header and make it the current table
+func (p *tomlParser) header() error {
+	array := strings.HasPrefix(p.src[p.pos:], "[[")
+	if array {
+		p.pos += 2
+	} else {
+		p.pos++
+	}
+	p.skipSpace(false)
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpace(false)
+	closing := "]"
+	if array {
+		closing = "]]"
+	}
+	if !strings.HasPrefix(p.src[p.pos:], closing) {
+		return fmt.Errorf("expected %q to close the table header", closing)
+	}
+	p.pos += len(closing)
+
+	path := strings.Join(keys, ".")
+	parent, err := p.descend(p.root, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if array {
+		list, _ := parent[last].([]any)
+		if _, ok := p.arrs[path]; !ok && parent[last] != nil {
+			return fmt.Errorf("%s is not an array of tables", path)
+		}
+		p.arrs[path] = struct{}{}
+		p.cur = map[string]any{}
+		parent[last] = append(list, p.cur)
+		return nil
+	}
+	if _, ok := p.arrs[path]; ok || p.defs[path] {
+		return fmt.Errorf("table %s is defined twice", path)
+	}
+	p.defs[path] = true
+	t, err := p.table(parent, last)
+	p.cur = t
+	return err
+}
+
+// Walk to a nested table, creating implicit ones; a path through an array of tables uses its last element
+func (p *tomlParser) descend(t map[string]any, keys []string) (map[string]any, error) {
+	for _, k := range keys {
+		var err error
+		if t, err = p.table(t, k); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// The table under a key, created when missing
+func (p *tomlParser) table(t map[string]any, k string) (map[string]any, error) {
+	switch v := t[k].(type) {
+	case nil:
+		sub := map[string]any{}
+		t[k] = sub
+		return sub, nil
+	case map[string]any:
+		return v, nil
+	case []any:
+		if len(v) > 0 {
+			if last, ok := v[len(v)-1].(map[string]any); ok {
+				return last, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("key %q is already a value, not a table", k)
+}
+
+// Read a key = value pair into a table
+func (p *tomlParser) keyValue(t map[string]any) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpace(false)
+	if p.pos >= len(p.src) || p.src[p.pos] != '=' {
+		return fmt.Errorf("expected '=' after key %s", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipSpace(false)
+	v, err := p.value()
+	if err != nil {
+		return err
+	}
+	if t, err = p.descend(t, keys[:len(keys)-1]); err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, dup := t[last]; dup {
+		return fmt.Errorf("key %s is set twice", strings.Join(keys, "."))
+	}
+	t[last] = v
+	return nil
+}
+
+// Read a dotted key of bare or quoted parts
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("unexpected end of file in key")
+		}
+		switch p.src[p.pos] {
+		case '"', '\'':
+			s, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, s)
+		default:
+			start := p.pos
+			for p.pos < len(p.src) && isBareKeyChar(p.src[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, fmt.Errorf("unexpected %q in key", p.src[p.pos])
+			}
+			keys = append(keys, p.src[start:p.pos])
+		}
+		p.skipSpace(false)
+		if p.pos >= len(p.src) || p.src[p.pos] != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// Read a value
+func (p *tomlParser) value() (any, error) {
+	if p.pos >= len(p.src) {
+		return nil, fmt.Errorf("missing value")
+	}
+	switch c := p.src[p.pos]; c {
+	case '"', '\'':
+		return p.str()
+	case '[':
+		return p.array()
+	case '{':
+		return p.inlineTable()
+	}
+	// Booleans, numbers, dates and times run to a delimiter
+	start := p.pos
+	for p.pos < len(p.src) && !strings.ContainsRune(" \t\n#,]}", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	// A date and time may be separated by a space
+	if p.pos+1 < len(p.src) && p.src[p.pos] == ' ' && isDate(p.src[start:p.pos]) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9' {
+		p.pos++
+		for p.pos < len(p.src) && !strings.ContainsRune(" \t\n#,]}", rune(p.src[p.pos])) {
+			p.pos++
+		}
+	}
+	tok := p.src[start:p.pos]
+	switch {
+	case tok == "true":
+		return true, nil
+	case tok == "false":
+		return false, nil
+	case tok == "":
+		return nil, fmt.Errorf("missing value")
+	case isDate(tok):
+		return strings.Replace(tok, " ", "T", 1), nil
+	}
+	return tomlNumber(tok)
+}
+
+// TOML integers and floats: no leading zeros, underscores only between digits,
+// and no sign on 0x, 0o and 0b integers
+var (
+	tomlDecIntRE  = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)$`)
+	tomlPrefixRE  = regexp.MustCompile(`^0(x[0-9A-Fa-f](_?[0-9A-Fa-f])*|o[0-7](_?[0-7])*|b[01](_?[01])*)$`)
+	tomlFloatRE   = regexp.MustCompile(`^[+-]?(0|[1-9](_?[0-9])*)(\.[0-9](_?[0-9])*([eE][+-]?[0-9](_?[0-9])*)?|[eE][+-]?[0-9](_?[0-9])*)$`)
+	tomlSpecialRE = regexp.MustCompile(`^[+-]?(inf|nan)$`)
+)
+
+// Read an integer or float token
+func tomlNumber(tok string) (any, error) {
+	num := strings.ReplaceAll(tok, "_", "")
+	switch {
+	case tomlDecIntRE.MatchString(tok):
+		n, err := strconv.ParseInt(num, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("integer %s is out of range", tok)
+		}
+		return n, nil
+	case tomlPrefixRE.MatchString(tok):
+		base := map[byte]int{'x': 16, 'o': 8, 'b': 2}[num[1]]
+		n, err := strconv.ParseInt(num[2:], base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("integer %s is out of range", tok)
+		}
+		return n, nil
+	case tomlSpecialRE.MatchString(tok) && strings.HasSuffix(tok, "nan"):
+		return math.NaN(), nil
+	case tomlFloatRE.MatchString(tok), tomlSpecialRE.MatchString(tok):
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, fmt.Errorf("float %s is out of range", tok)
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %q (strings need quotes)", tok)
+}
+
+// Report whether a token starts with a YYYY-MM-DD date or is an HH:MM:SS time
+func isDate(s string) bool {
+	digits := func(s string) bool {
+		for _, c := range s {
+			if c < '0' || c > '9' {
+				return false
+			}
+		}
+		return true
+	}
+	if len(s) >= 10 && s[4] == '-' && s[7] == '-' && digits(s[:4]) && digits(s[5:7]) && digits(s[8:10]) {
+		return true
+	}
+	return len(s) >= 8 && s[2] == ':' && s[5] == ':' && digits(s[:2]) && digits(s[3:5])
+}
+
+// Read a basic or literal string, single- or multi-line
+func (p *tomlParser) str() (string, error) {
+	q := p.src[p.pos]
+	multi := strings.HasPrefix(p.src[p.pos:], strings.Repeat(string(q), 3))
+	if multi {
+		p.pos += 3
+		// A newline right after the opening quotes is trimmed
+		if p.pos < len(p.src) && p.src[p.pos] == '\n' {
+			p.pos++
+			p.line++
+		}
+	} else {
+		p.pos++
+	}
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := p.src[p.pos]
+		switch {
+		case multi && strings.HasPrefix(p.src[p.pos:], strings.Repeat(string(q), 3)):
+			p.pos += 3
+			return b.String(), nil
+		case !multi && c == q:
+			p.pos++
+			return b.String(), nil
+		case c == '\n' && !multi:
+			return "", fmt.Errorf("newline in string")
+		case c == '\\' && q == '"':
+			if err := p.escape(&b, multi); err != nil {
+				return "", err
+			}
+			continue
+		case c == '\n':
+			p.line++
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+}
+
+// Read an escape sequence of a basic string
+func (p *tomlParser) escape(b *strings.Builder, multi bool) error {
+	p.pos++
+	if p.pos >= len(p.src) {
+		return fmt.Errorf("unterminated string")
+	}
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		n := 4
+		if c == 'U' {
+			n = 8
+		}
+		if p.pos+n > len(p.src) {
+			return fmt.Errorf("short unicode escape")
+		}
+		r, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return fmt.Errorf("invalid unicode escape \\%c%s", c, p.src[p.pos:p.pos+n])
+		}
+		b.WriteRune(rune(r))
+		p.pos += n
+	case ' ', '\t', '\n':
+		// A line-ending backslash in a multi-line string trims the whitespace after it
+		if !multi {
+			return fmt.Errorf("invalid escape \\%c", c)
+		}
+		p.pos--
+		for p.pos < len(p.src) && strings.ContainsRune(" \t\n", rune(p.src[p.pos])) {
+			if p.src[p.pos] == '\n' {
+				p.line++
+			}
+			p.pos++
+		}
+	default:
+		return fmt.Errorf("invalid escape \\%c", c)
+	}
+	return nil
+}
+
+// Read an array, which may span lines and end with a comma
+func (p *tomlParser) array() ([]any, error) {
+	p.pos++
+	list := []any{}
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		if p.src[p.pos] == ']' {
+			p.pos++
+			return list, nil
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		p.skipSpace(true)
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.src) && p.src[p.pos] != ']' {
+			return nil, fmt.Errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// Read an inline table, which stays on one line
+func (p *tomlParser) inlineTable() (map[string]any, error) {
+	p.pos++
+	t := map[string]any{}
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.src) {
+			return nil, fmt.Errorf("unterminated inline table")
+		}
+		if p.src[p.pos] == '}' {
+			p.pos++
+			return t, nil
+		}
+		if err := p.keyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if p.pos < len(p.src) && p.src[p.pos] == ',' {
+			p.pos++
+			// Unlike arrays, inline tables can't end with a comma
+			if p.skipSpace(false); p.pos < len(p.src) && p.src[p.pos] == '}' {
+				return nil, fmt.Errorf("trailing ',' in inline table")
+			}
+		} else if p.pos < len(p.src) && p.src[p.pos] != '}' {
+			return nil, fmt.Errorf("expected ',' or '}' in inline table")
+		}
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Filename: toml_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the TOML reader against the examples of the TOML v1.0.0 specification.
+ */
+
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestTOMLIntegers(t *testing.T) {
+	valid := map[string]int64{
+		"+99": 99, "42": 42, "0": 0, "-17": -17, "+0": 0, "-0": 0,
+		"1_000": 1000, "5_349_221": 5349221, "53_49_221": 5349221, "1_2_3_4_5": 12345,
+		"0xDEADBEEF": 0xDEADBEEF, "0xdeadbeef": 0xdeadbeef, "0xdead_beef": 0xdeadbeef,
+		"0o01234567": 01234567, "0o755": 0755, "0b11010110": 0xd6,
+		"9223372036854775807": math.MaxInt64, "-9223372036854775808": math.MinInt64,
+	}
+	for in, want := range valid {
+		got, err := parseTOML([]byte("n = " + in))
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if got["n"] != want {
+			t.Errorf("%s: got %#v, want %d", in, got["n"], want)
+		}
+	}
+	invalid := []string{
+		"010", "007", "+010", "1__000", "_1", "1_", "0x", "+0xFF", "-0o7", "0X1F", "0b102", "0o8",
+		"0x_1", "1e", "9223372036854775808", "0xffffffffffffffff", "1.2.3", "inf_", "bare",
+	}
+	for _, in := range invalid {
+		if got, err := parseTOML([]byte("n = " + in)); err == nil {
+			t.Errorf("%s: got %#v, want an error", in, got["n"])
+		}
+	}
+}
+
+func TestTOMLFloats(t *testing.T) {
+	valid := map[string]float64{
+		"+1.0": 1, "3.1415": 3.1415, "-0.01": -0.01, "5e+22": 5e22, "1e06": 1e6, "-2E-2": -0.02,
+		"6.626e-34": 6.626e-34, "224_617.445_991_228": 224617.445991228, "0.0": 0, "-0.0": 0, "1e1_0": 1e10,
+	}
+	for in, want := range valid {
+		got, err := parseTOML([]byte("f = " + in))
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if got["f"] != want {
+			t.Errorf("%s: got %#v, want %v", in, got["f"], want)
+		}
+	}
+	got, err := parseTOML([]byte("a = inf\nb = -inf\nc = nan\nd = +nan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := got["a"].(float64); !math.IsInf(a, 1) {
+		t.Errorf("inf: got %#v", got["a"])
+	}
+	if b, _ := got["b"].(float64); !math.IsInf(b, -1) {
+		t.Errorf("-inf: got %#v", got["b"])
+	}
+	if c, _ := got["c"].(float64); !math.IsNaN(c) {
+		t.Errorf("nan: got %#v", got["c"])
+	}
+
+	for _, in := range []string{".7", "7.", "3.e+20", "01.2", "1._2", "1.2_", "1e_2", "+.5", "Inf", "NaN"} {
+		if got, err := parseTOML([]byte("f = " + in)); err == nil {
+			t.Errorf("%s: got %#v, want an error", in, got["f"])
+		}
+	}
+}
+
+func TestTOMLDocument(t *testing.T) {
+	doc := `
+# A comment
+title = "TOML \"Example\"\t\u00e9"
+literal = 'C:\Users\nodejs'
+multi = """
+Roses are red
+Violets are blue"""
+trimmed = """\
+       The quick brown \
+       fox."""
+dotted.key = true
+"quoted key" = 1
+dob = 1979-05-27T07:32:00-08:00
+local = 1979-05-27 07:32:00
+
+[owner]
+name = "Tom"
+
+[servers.alpha]
+ip = "10.0.0.1"
+ports = [ 8000, 8001,
+  8002, ]
+
+[[products]]
+name = "Hammer"
+point = { x = 1, y = 2 }
+
+[[products]]
+
+[[products]]
+name = "Nail"
+`
+	want := map[string]any{
+		"title":      "TOML \"Example\"\t\u00e9",
+		"literal":    `C:\Users\nodejs`,
+		"multi":      "Roses are red\nViolets are blue",
+		"trimmed":    "The quick brown fox.",
+		"dotted":     map[string]any{"key": true},
+		"quoted key": int64(1),
+		"dob":        "1979-05-27T07:32:00-08:00",
+		"local":      "1979-05-27T07:32:00",
+		"owner":      map[string]any{"name": "Tom"},
+		"servers": map[string]any{"alpha": map[string]any{
+			"ip": "10.0.0.1", "ports": []any{int64(8000), int64(8001), int64(8002)},
+		}},
+		"products": []any{
+			map[string]any{"name": "Hammer", "point": map[string]any{"x": int64(1), "y": int64(2)}},
+			map[string]any{},
+			map[string]any{"name": "Nail"},
+		},
+	}
+	got, err := parseTOML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v\nwant %#v", got, want)
+	}
+}
+
+func TestTOMLInvalidDocuments(t *testing.T) {
+	invalid := map[string]string{
+		"duplicate key":            "a = 1\na = 2",
+		"table defined twice":      "[a]\nb = 1\n[a]\nc = 2",
+		"table after array":        "[[a]]\n[a]",
+		"array after value":        "a = 1\n[[a]]",
+		"value as table":           "a = 1\n[a.b]",
+		"missing value":            "a =",
+		"bare string":              "a = hello",
+		"two values on a line":     "a = 1 b = 2",
+		"newline in string":        "a = \"x\ny\"",
+		"unterminated string":      "a = \"x",
+		"invalid escape":           `a = "\q"`,
+		"inline table comma":       "a = { b = 1, }",
+		"unterminated array":       "a = [1, 2",
+		"unclosed header":          "[a",
+		"unclosed array of tables": "[[a]",
+	}
+	for name, in := range invalid {
+		if got, err := parseTOML([]byte(in)); err == nil {
+			t.Errorf("%s: got %#v, want an error", name, got)
+		}
+	}
+}
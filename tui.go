@@ -0,0 +1,306 @@
+/*
+ * Filename: tui.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Full-screen dashboard of one firewall's customers ('tfresh tui').
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Dashboard help line
+const tuiKeys = "↑/↓ or j/k select   r force-refresh   s refresh SAs now   q quit"
+
+// 'tuiRow' type represents one customer line of the dashboard
+type tuiRow struct {
+	c        customer
+	last     time.Time // last successful refresh, zero when never
+	sa       string    // up, down or '-' without a tunnel
+	failures int
+	held     bool // quarantined
+}
+
+// 'dashboard' type represents the dashboard's state
+type dashboard struct {
+	r        *replSession
+	rows     []tuiRow
+	selected int
+	polled   time.Time
+	message  string
+}
+
+// Rebuild the rows from the state file and the firewall's IPsec SAs
+func (d *dashboard) poll() {
+	st, err := loadState(stateFile)
+	if err != nil {
+		d.message = "state: " + err.Error()
+		return
+	}
+	var sas map[string]ipsecSAInfo
+	cli, err := d.r.cli()
+	if err == nil {
+		sas, err = listIPsecSAs(cli)
+		cli.Close()
+	}
+	if err != nil {
+		d.message = "SA query failed: " + err.Error()
+	}
+
+	d.rows = d.rows[:0]
+	for _, c := range d.r.customers {
+		row := tuiRow{c: c, sa: "-"}
+		row.last = st.LastRefreshed[d.r.firewall][c.key()]
+		if cs := st.Customers[d.r.firewall][c.key()]; cs != nil {
+			row.failures = cs.Failures
+			if cs.SA != "" {
+				row.sa = cs.SA
+			}
+		}
+		_, row.held = st.Quarantined[c.key()]
+		if c.Tunnel != "" && sas != nil {
+			row.sa = "down"
+			if _, ok := sas[c.Tunnel]; ok {
+				row.sa = "up"
+			}
+		}
+		d.rows = append(d.rows, row)
+	}
+	d.selected = max(0, min(d.selected, len(d.rows)-1))
+	d.polled = time.Now()
+}
+
+// Refresh the selected customer now, as 'refresh' in the shell does
+func (d *dashboard) refreshSelected() {
+	if len(d.rows) == 0 {
+		return
+	}
+	c := d.rows[d.selected].c
+	d.message = "Refreshing " + c.Name + ".."
+	d.draw()
+	steps := planRefresh(driverFor(d.r.firewall), []customer{c}, false)
+	results, err := refreshFirewall(d.r.client, d.r.firewall, steps, time.Time{})
+	if err != nil {
+		if err = d.r.reconnect(); err == nil {
+			results, err = refreshFirewall(d.r.client, d.r.firewall, steps, time.Time{})
+		}
+	}
+	if err == nil {
+		stateMu.Lock()
+		err = updateState(func(st *state) { st.recordRefreshes(d.r.firewall, results) })
+		stateMu.Unlock()
+	}
+	switch {
+	case err != nil:
+		d.message = fmt.Sprintf("%s: %v", c.Name, err)
+	case len(results) > 0 && results[0].result == resultFailed:
+		d.message = fmt.Sprintf("%s: refresh failed", c.Name)
+		if results[0].err != nil {
+			d.message += ": " + results[0].err.Error()
+		}
+	default:
+		d.message = fmt.Sprintf("%s: refreshed at %s", c.Name, time.Now().Format("15:04:05"))
+	}
+	d.poll()
+}
+
+// Redraw the whole screen. The terminal is in raw mode, so lines end in CRLF.
+func (d *dashboard) draw() {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 100, 30
+	}
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	line := func(s string) {
+		if r := []rune(s); len(r) > width {
+			s = string(r[:width])
+		}
+		b.WriteString(s + "\x1b[K\r\n")
+	}
+
+	up, down, failing := 0, 0, 0
+	for _, row := range d.rows {
+		switch row.sa {
+		case "up":
+			up++
+		case "down":
+			down++
+		}
+		if row.failures > 0 {
+			failing++
+		}
+	}
+	line(fmt.Sprintf("tfresh %s (%s)   %d customers, %d up, %d down, %d failing   updated %s",
+		d.r.env, d.r.firewall, len(d.rows), up, down, failing, d.polled.Format("15:04:05")))
+	line("")
+	line(fmt.Sprintf("  %-28s %-10s %-20s %-6s %-8s %s", "CUSTOMER", "SA", "LAST REFRESH", "FAILS", "STATUS", "TUNNEL"))
+
+	// Keep the selection on screen; header, footer and message take five lines
+	visible := max(1, height-6)
+	first := 0
+	if d.selected >= visible {
+		first = d.selected - visible + 1
+	}
+	for i := first; i < len(d.rows) && i < first+visible; i++ {
+		row := d.rows[i]
+		last := "never"
+		if !row.last.IsZero() {
+			last = fmt.Sprintf("%v ago", time.Since(row.last).Round(time.Second))
+		}
+		status := "active"
+		if row.held {
+			status = "held"
+		}
+		sa := row.sa
+		switch sa {
+		case "up":
+			sa = "\x1b[32mup\x1b[0m      "
+		case "down":
+			sa = "\x1b[31mdown\x1b[0m    "
+		default:
+			sa = fmt.Sprintf("%-8s", sa)
+		}
+		fails := fmt.Sprint(row.failures)
+		if row.failures > 0 {
+			fails = fmt.Sprintf("\x1b[31m%-6d\x1b[0m", row.failures)
+		} else {
+			fails = fmt.Sprintf("%-6s", fails)
+		}
+		cursor, reverse, reset := "  ", "", ""
+		if i == d.selected {
+			cursor, reverse, reset = "> ", "\x1b[7m", "\x1b[0m"
+		}
+		b.WriteString(fmt.Sprintf("%s%s%-28.28s%s   %s %-20s %s %-8s %s\x1b[K\r\n",
+			cursor, reverse, row.c.Name, reset, sa, last, fails, status, row.c.Tunnel))
+	}
+	line("")
+	line(d.message)
+	line(tuiKeys)
+	os.Stdout.WriteString(b.String())
+}
+
+// Handle 'tfresh tui'
+func tuiCommand(args []string) {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fs.StringVar(&stateFile, "s", stateFile, "State file shared with the daemon (default is tfresh.state.json)")
+	fs.StringVar(&historyDB, "history-db", historyDB, "SQLite database to record refresh attempts to, shareable with the daemon (default $TFRESH_HISTORY_DB)")
+	env := fs.String("e", "", "Firewall name (e.g. prod, test)")
+	every := fs.Duration("poll", 15*time.Second, "How often the state file and SAs are re-read")
+	fs.StringVar(&knownHostsFile, "known-hosts", knownHostsFile, "known_hosts file for verifying firewall host keys; not verified when empty")
+	fs.StringVar(&jumpHost, "jump", jumpHost, "SSH bastion firewalls are dialed through, '[user@]host[:port]'")
+	fs.StringVar(&proxyURL, "proxy", os.Getenv("TFRESH_PROXY"), "SOCKS5 or HTTP proxy for firewall connections (default $TFRESH_PROXY)")
+	fs.StringVar(&profileName, "profile", profileName, "Credentials file profile to use instead of PAN_USERNAME/PAN_PASSWORD (default $TFRESH_PROFILE)")
+	fs.Parse(args)
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Fprintln(os.Stderr, "[ERROR]: tui needs a terminal; use 'tfresh status' or 'tfresh inspect' in scripts.")
+		os.Exit(1)
+	}
+	if *every <= 0 {
+		fmt.Fprintln(os.Stderr, "[ERROR]: -poll must be positive.")
+		os.Exit(1)
+	}
+	customers := loadCustomersOrExit()
+	host, ok := firewalls[*env]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "[ERROR]: Unknown firewall environment %q.\n", *env)
+		fs.Usage()
+		os.Exit(1)
+	}
+	groups, err := groupByFirewall(customers, []string{*env})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+
+	r := &replSession{env: *env, firewall: host}
+	for _, g := range groups {
+		if g.env == *env {
+			r.customers = g.customers
+		}
+	}
+	r.user, r.pass = checkEnvVars()
+	enableHistory()
+	fmt.Printf("Connecting to %s..\n", host)
+	if err = r.reconnect(); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	defer r.client.Close()
+
+	// Refresh output and logs would scribble over the screen; results show in the message line
+	humanOut = io.Discard
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	old, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", err)
+		os.Exit(1)
+	}
+	// Alternate screen, hidden cursor; both restored on exit
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+		term.Restore(int(os.Stdin.Fd()), old)
+	}()
+
+	keys := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- string(buf[:n])
+		}
+	}()
+
+	d := &dashboard{r: r}
+	d.poll()
+	d.draw()
+	ticker := time.NewTicker(*every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.poll()
+		case k, ok := <-keys:
+			if !ok {
+				return
+			}
+			switch k {
+			case "q", "Q", "\x03", "\x1b":
+				return
+			case "j", "\x1b[B":
+				d.selected = min(d.selected+1, len(d.rows)-1)
+			case "k", "\x1b[A":
+				d.selected = max(d.selected-1, 0)
+			case "g", "\x1b[H":
+				d.selected = 0
+			case "G", "\x1b[F":
+				d.selected = max(len(d.rows)-1, 0)
+			case "r", "\r":
+				d.refreshSelected()
+			case "s":
+				d.message = ""
+				d.poll()
+			}
+		}
+		d.draw()
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Filename: validate.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Configuration validation ('tfresh validate').
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// DNS lookup timeout for network validation
+const resolveTimeout = 5 * time.Second
+
+// PAN-OS object names: letters, digits, '_', '-' and '.', starting with a letter,
+// digit or '_'. Spaces would split the CLI command.
+var objectNameRE = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.\-]{0,62}$`)
+
+// Check customers for problems that would make a refresh a no-op or malformed.
+// Warnings flag configs that are valid but probably unintended.
+func validateCustomers(customers []customer) (problems, warnings []string) {
+	return validateCustomersAt(customers, nil)
+}
+
+// Check customers, prefixing each finding with the line of the customer's entry when known
+func validateCustomersAt(customers []customer, lines []int) (problems, warnings []string) {
+	for i, c := range customers {
+		p, w := validateCustomer(i, c)
+		if i < len(lines) {
+			for j := range p {
+				p[j] = fmt.Sprintf("line %d: %s", lines[i], p[j])
+			}
+			for j := range w {
+				w[j] = fmt.Sprintf("line %d: %s", lines[i], w[j])
+			}
+		}
+		problems, warnings = append(problems, p...), append(warnings, w...)
+	}
+	return problems, warnings
+}
+
+// Check one customer, the i'th in the file
+func validateCustomer(i int, c customer) (problems, warnings []string) {
+	if c.Name == "" {
+		problems = append(problems, fmt.Sprintf("customer #%d: customer_name is blank", i+1))
+	}
+	for _, ref := range []struct{ field, name string }{{"customer_gateway", c.Gateway}, {"customer_tunnel", c.Tunnel}} {
+		if ref.name != "" && !objectNameRE.MatchString(ref.name) {
+			problems = append(problems, fmt.Sprintf("customer %q: malformed %s %q (up to 63 letters, digits, '_', '-' or '.')", c.Name, ref.field, ref.name))
+		}
+	}
+	switch c.Type {
+	case "", typeSiteToSite:
+		// Either reference alone is a partial refresh of just that SA
+		switch {
+		case c.Gateway == "" && c.Tunnel == "":
+			problems = append(problems, fmt.Sprintf("customer %q: at least one of customer_gateway and customer_tunnel is required", c.Name))
+		case c.Gateway == "":
+			warnings = append(warnings, fmt.Sprintf("customer %q: no customer_gateway, only the IPsec SA will be refreshed", c.Name))
+		case c.Tunnel == "":
+			warnings = append(warnings, fmt.Sprintf("customer %q: no customer_tunnel, only the IKE SA will be refreshed", c.Name))
+		}
+	case typeGlobalProtect:
+		if _, ok := globalProtectCommands[c.gpComponent()]; !ok {
+			problems = append(problems, fmt.Sprintf("customer %q: unknown customer_gp_component %q (gateway, portal)", c.Name, c.GPComponent))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("customer %q: unknown customer_type %q (%s, %s)", c.Name, c.Type, typeSiteToSite, typeGlobalProtect))
+	}
+	for _, r := range c.Routes {
+		if _, _, err := net.ParseCIDR(r); err != nil {
+			problems = append(problems, fmt.Sprintf("customer %q: invalid customer_routes entry %q", c.Name, r))
+		}
+	}
+	if len(c.Routes) > 0 && c.Interface == "" {
+		problems = append(problems, fmt.Sprintf("customer %q: customer_routes requires customer_tunnel_interface", c.Name))
+	}
+	if c.Schedule != "" {
+		if _, err := parseCron(c.Schedule); err != nil {
+			problems = append(problems, fmt.Sprintf("customer %q: customer_schedule: %v", c.Name, err))
+		}
+	}
+	for _, w := range c.Blackouts {
+		if err := w.check(); err != nil {
+			problems = append(problems, fmt.Sprintf("customer %q: customer_%v", c.Name, err))
+		}
+	}
+	if c.Interval < 0 {
+		problems = append(problems, fmt.Sprintf("customer %q: customer_interval cannot be negative", c.Name))
+	}
+	if _, ok := firewalls[c.Firewall]; c.Firewall != "" && !ok {
+		problems = append(problems, fmt.Sprintf("customer %q: unknown customer_firewall %q", c.Name, c.Firewall))
+	}
+	return problems, warnings
+}
+
+// Decode the configuration strictly, reporting unknown keys such as a misspelled
+// 'customer_gatway' that would otherwise be dropped silently
+func unknownKeys(fBytes []byte) []string {
+	var root yaml.Node
+	if err := yaml.Unmarshal(fBytes, &root); err != nil || len(root.Content) == 0 {
+		return nil
+	}
+	var v any = &configDoc{}
+	if root.Content[0].Kind != yaml.MappingNode {
+		v = &[]customer{}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(fBytes))
+	dec.KnownFields(true)
+	var typeErr *yaml.TypeError
+	if err := dec.Decode(v); errors.As(err, &typeErr) {
+		return typeErr.Errors
+	}
+	return nil
+}
+
+// Line of each customer entry in the configuration file, in file order
+func customerLines(fBytes []byte) []int {
+	var root yaml.Node
+	if err := yaml.Unmarshal(fBytes, &root); err != nil || len(root.Content) == 0 {
+		return nil
+	}
+	list := root.Content[0]
+	if list.Kind == yaml.MappingNode {
+		list = nil
+		for i := 0; i+1 < len(root.Content[0].Content); i += 2 {
+			if root.Content[0].Content[i].Value == "customers" {
+				list = root.Content[0].Content[i+1]
+			}
+		}
+	}
+	if list == nil || list.Kind != yaml.SequenceNode {
+		return nil
+	}
+	lines := make([]int, len(list.Content))
+	for i, n := range list.Content {
+		lines[i] = n.Line
+	}
+	return lines
+}
+
+// Resolve every firewall hostname and customer peer, returning any failures
+func validateNetwork(customers []customer) []string {
+	var problems []string
+
+	envs := make([]string, 0, len(firewalls))
+	for env := range firewalls {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		if err := resolveHost(firewalls[env]); err != nil {
+			problems = append(problems, fmt.Sprintf("firewall %q: %v", env, err))
+		}
+	}
+
+	for _, c := range customers {
+		if c.Peer == "" {
+			continue
+		}
+		if err := resolveHost(c.Peer); err != nil {
+			problems = append(problems, fmt.Sprintf("customer %q peer: %v", c.Name, err))
+		}
+	}
+	return problems
+}
+
+// Resolve a hostname; IP literals always succeed
+func resolveHost(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("%s resolved to no addresses", host)
+	}
+	return nil
+}
+
+// Handle 'tfresh validate'
+func validateCommand(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.StringVar(&configFile, "c", configFile, "Configuration filename (default is config.yml)")
+	fs.StringVar(&configFormat, "config-format", configFormat, "Configuration format (yaml, json, toml); default by file extension, else guessed from the contents")
+	fs.BoolVar(&configTokenHTTP, "config-token-http", false, "Send $TFRESH_CONFIG_TOKEN to an http:// -c too, unencrypted")
+	network := fs.Bool("network", false, "Also resolve firewall hostnames and customer peers")
+	fs.Parse(args)
+
+	customers, fBytes, err := loadConfig(configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Line numbers refer to the decrypted text when the file is encrypted
+	if fBytes, err = decryptConfig(fBytes); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// TOML is checked as the YAML it converts to, without line numbers
+	lines := customerLines(fBytes)
+	if format := configFormatOf(configFile, fBytes); format == "toml" {
+		lines = nil
+		if fBytes, err = configAsYAML(fBytes, format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	problems, warnings := validateCustomersAt(customers, lines)
+	problems = append(unknownKeys(fBytes), problems...)
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "[WARN]:", w)
+	}
+	if *network {
+		problems = append(problems, validateNetwork(customers)...)
+	}
+
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, "[ERROR]:", p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid (%d customers).\n", configFile, len(customers))
+}
@@ -0,0 +1,119 @@
+/*
+ * Filename: verify.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Verifies configured gateway and tunnel names exist on the firewall before refreshing.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// What to do about names missing on the firewall: off, warn, skip (drop the customer) or fail
+var verifyNames = "warn"
+
+// 'nameProblem' type represents a configured name the firewall doesn't have
+type nameProblem struct {
+	customer string
+	kind     string // gateway, tunnel
+	name     string
+}
+
+func (p nameProblem) String() string {
+	return fmt.Sprintf("customer %q: %s %q does not exist on the firewall", p.customer, p.kind, p.name)
+}
+
+// Find customers whose gateway or tunnel is missing on the firewall
+func verifyCustomerNames(cli *cliSession, customers []customer) ([]nameProblem, error) {
+	gws, tuns, err := listVPN(cli)
+	if err != nil {
+		return nil, err
+	}
+	return missingNames(customers, gws, tuns), nil
+}
+
+// Compare configured gateway and tunnel names with the firewall's
+func missingNames(customers []customer, gws []vpnGateway, tuns []vpnTunnel) []nameProblem {
+	onGateways := map[string]bool{}
+	for _, gw := range gws {
+		onGateways[gw.Name] = true
+	}
+	onTunnels := map[string]bool{}
+	for _, t := range tuns {
+		name, _, _ := strings.Cut(t.Name, ":")
+		onTunnels[name] = true
+	}
+
+	var problems []nameProblem
+	for _, c := range customers {
+		if c.isGlobalProtect() {
+			continue
+		}
+		if c.Gateway != "" && !onGateways[c.Gateway] {
+			problems = append(problems, nameProblem{c.Name, "gateway", c.Gateway})
+		}
+		if c.Tunnel != "" && !onTunnels[c.Tunnel] {
+			problems = append(problems, nameProblem{c.Name, "tunnel", c.Tunnel})
+		}
+	}
+	return problems
+}
+
+// Verify the scheduler's customers before its first iteration and after each reload, applying
+// the -verify-names policy. Under 'fail' the error stops the daemon at startup, while a
+// reload keeps the previous customers.
+func (sc *scheduler) verifyNames() error {
+	sc.unverified = nil
+	customers := sc.assigned()
+	if verifyNames == "off" || sc.batch || len(customers) == 0 {
+		return nil
+	}
+	if sc.api != nil {
+		logger.Warn("name verification needs the ssh transport, skipped on "+sc.firewall, "firewall", sc.firewall)
+		return nil
+	}
+	if !isPANOS(sc.firewall) {
+		logger.Info("name verification needs PAN-OS, skipped on "+sc.firewall, "firewall", sc.firewall)
+		return nil
+	}
+
+	cli, err := openCLI(sc.client)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("name verification skipped on %s: %v", sc.firewall, err), "firewall", sc.firewall, "error", err)
+		return nil
+	}
+	problems, err := verifyCustomerNames(cli, customers)
+	cli.Close()
+	if err != nil {
+		logger.Warn(fmt.Sprintf("name verification failed on %s: %v", sc.firewall, err), "firewall", sc.firewall, "error", err)
+		return nil
+	}
+
+	level := slog.LevelWarn
+	if verifyNames == "fail" {
+		level = slog.LevelError
+	}
+	bad := map[string]bool{}
+	for _, p := range problems {
+		logger.Log(context.Background(), level, fmt.Sprint(sc.firewall+": ", p), "firewall", sc.firewall, "customer", p.customer)
+		bad[p.customer] = true
+	}
+	switch {
+	case len(problems) == 0:
+		logger.Info(fmt.Sprintf("Verified %d customers' gateways and tunnels on %s", len(customers), sc.firewall), "firewall", sc.firewall)
+	case verifyNames == "fail":
+		return fmt.Errorf("%s: %d customers name gateways or tunnels the firewall doesn't have", sc.firewall, len(bad))
+	case verifyNames == "skip":
+		// Held back by assigned(), so discovery and cutovers don't bring them back
+		logger.Warn(fmt.Sprintf("%s: skipping %d customers with unknown names", sc.firewall, len(bad)), "firewall", sc.firewall)
+		sc.unverified = bad
+	}
+	return nil
+}
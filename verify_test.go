@@ -0,0 +1,71 @@
+/*
+ * Filename: verify_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the -verify-names policies against the mock PAN-OS firewall.
+ */
+
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"tfresh/internal/mockpanos"
+)
+
+var unknownCustomer = customer{Name: "Hooli", Gateway: "gw-hooli", Tunnel: "tun-hooli"}
+
+func names(customers []customer) []string {
+	var out []string
+	for _, c := range customers {
+		out = append(out, c.Name)
+	}
+	return out
+}
+
+func TestVerifyNamesSkipHoldsBack(t *testing.T) {
+	old := verifyNames
+	verifyNames = "skip"
+	t.Cleanup(func() { verifyNames = old })
+
+	_, client := startMock(t, mockpanos.Config{})
+	configured := append(slices.Clone(e2eCustomers), unknownCustomer)
+	sc := &scheduler{firewall: "mock-e2e", client: client, customers: configured, configured: configured}
+	if err := sc.verifyNames(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Acme", "Globex"}
+	if got := names(sc.assigned()); !slices.Equal(got, want) {
+		t.Errorf("assigned %v, want %v", got, want)
+	}
+	// Discovery rebuilds the list from the configured customers each iteration
+	sc.customers = mergeDiscovered(slices.Clone(sc.configured), nil)
+	if got := names(sc.assigned()); !slices.Equal(got, want) {
+		t.Errorf("after discovery: assigned %v, want %v", got, want)
+	}
+}
+
+func TestVerifyNamesFailedReloadKeepsCustomers(t *testing.T) {
+	old := verifyNames
+	verifyNames = "fail"
+	t.Cleanup(func() { verifyNames = old })
+
+	_, client := startMock(t, mockpanos.Config{})
+	running := configVersion{Hash: "running"}
+	sc := &scheduler{firewall: "mock-e2e", client: client, customers: e2eCustomers, configured: e2eCustomers, active: running}
+	sc.pending.Store(&reloadedConfig{customers: []customer{e2eCustomers[0], unknownCustomer}, active: configVersion{Hash: "reloaded"}})
+	sc.applyReload(newBlockLog("mock-e2e", ""))
+	if got := names(sc.assigned()); !slices.Equal(got, []string{"Acme", "Globex"}) || sc.active.Hash != "running" {
+		t.Errorf("after a failed reload: %v on %s, want the running customers", got, sc.active.Hash)
+	}
+
+	// A reload that verifies is applied
+	sc.pending.Store(&reloadedConfig{customers: e2eCustomers[:1], active: configVersion{Hash: "reloaded"}})
+	sc.applyReload(newBlockLog("mock-e2e", ""))
+	if got := names(sc.assigned()); !slices.Equal(got, []string{"Acme"}) || sc.active.Hash != "reloaded" {
+		t.Errorf("after a good reload: %v on %s", got, sc.active.Hash)
+	}
+}
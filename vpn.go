@@ -0,0 +1,153 @@
+/*
+ * Filename: vpn.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Parsers for PAN-OS 'show vpn' command output.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Palo commands to list configured VPN objects
+const (
+	showGateways = "show vpn gateway"
+	showTunnels  = "show vpn tunnel"
+)
+
+// 'vpnGateway' type represents a configured IKE gateway
+type vpnGateway struct {
+	ID   string
+	Name string
+	Peer string
+}
+
+// 'vpnTunnel' type represents a configured IPsec tunnel
+type vpnTunnel struct {
+	ID      string
+	Name    string
+	Gateway string
+}
+
+// Split tabular PAN-OS output into rows of fields, keeping only rows after the '----'
+// header underline that start with a numeric object ID
+func parseTable(out string) [][]string {
+	var rows [][]string
+	inBody := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "---") {
+			inBody = true
+			continue
+		}
+		if !inBody {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[0]); err != nil {
+			continue
+		}
+		rows = append(rows, fields)
+	}
+	return rows
+}
+
+// Parse 'show vpn gateway' output
+func parseGateways(out string) ([]vpnGateway, error) {
+	var gws []vpnGateway
+	for _, f := range parseTable(out) {
+		if len(f) < 3 {
+			return nil, fmt.Errorf("unexpected %q row: %q", showGateways, strings.Join(f, " "))
+		}
+		gws = append(gws, vpnGateway{ID: f[0], Name: f[1], Peer: f[2]})
+	}
+	return gws, nil
+}
+
+// Parse 'show vpn tunnel' output
+func parseTunnels(out string) ([]vpnTunnel, error) {
+	var tuns []vpnTunnel
+	for _, f := range parseTable(out) {
+		if len(f) < 3 {
+			return nil, fmt.Errorf("unexpected %q row: %q", showTunnels, strings.Join(f, " "))
+		}
+		tuns = append(tuns, vpnTunnel{ID: f[0], Name: f[1], Gateway: f[2]})
+	}
+	return tuns, nil
+}
+
+// List the gateways and tunnels configured on a firewall
+func listVPN(cli *cliSession) ([]vpnGateway, []vpnTunnel, error) {
+	out, err := cli.exec(showGateways, promptTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	gws, err := parseGateways(out)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err = cli.exec(showTunnels, promptTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	tuns, err := parseTunnels(out)
+	if err != nil {
+		return nil, nil, err
+	}
+	return gws, tuns, nil
+}
+
+// Palo command to list active IPsec SAs
+const showIPsecSAs = "show vpn ipsec-sa"
+
+// 'ipsecSAInfo' type represents an established IPsec SA
+type ipsecSAInfo struct {
+	Tunnel  string
+	Gateway string
+	Peer    string
+	Age     time.Duration // time since the SA was negotiated
+	Remain  time.Duration // time until the SA expires
+}
+
+// Parse 'show vpn ipsec-sa' output, keyed by tunnel name
+func parseIPsecSAs(out string) (map[string]ipsecSAInfo, error) {
+	sas := map[string]ipsecSAInfo{}
+	for _, f := range parseTable(out) {
+		if len(f) < 9 {
+			return nil, fmt.Errorf("unexpected %q row: %q", showIPsecSAs, strings.Join(f, " "))
+		}
+		// Tunnels are listed as 'tunnel(gateway)', optionally with a ':proxy-id' suffix on the tunnel
+		tunnel, gateway, _ := strings.Cut(strings.TrimSuffix(f[3], ")"), "(")
+		tunnel, _, _ = strings.Cut(tunnel, ":")
+
+		sa := ipsecSAInfo{Tunnel: tunnel, Gateway: gateway, Peer: f[2]}
+		lifeField, _, _ := strings.Cut(f[7], "/")
+		life, lerr := strconv.Atoi(lifeField)
+		remain, rerr := strconv.Atoi(f[8])
+		if lerr == nil && rerr == nil {
+			sa.Remain = time.Duration(remain) * time.Second
+			sa.Age = time.Duration(life-remain) * time.Second
+		}
+		sas[tunnel] = sa
+	}
+	return sas, nil
+}
+
+// List the IPsec SAs established on a firewall
+func listIPsecSAs(cli *cliSession) (map[string]ipsecSAInfo, error) {
+	out, err := cli.exec(showIPsecSAs, promptTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return parseIPsecSAs(out)
+}
@@ -0,0 +1,114 @@
+/*
+ * Filename: watchdog.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Watchdog that abandons iterations stuck well past their deadline.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"time"
+)
+
+var (
+	// Abandon an iteration after this multiple of its deadline (0 disables)
+	watchdogMultiple = 3
+
+	// Slack on top of the command time, covering connection setup and checks
+	watchdogSlack = time.Minute
+)
+
+// Expected duration of an iteration: every command's wait, retries, canary and rollout verification, plus slack
+func iterationDeadline(steps []refreshStep) time.Duration {
+	n := 0
+	for _, step := range steps {
+		n += len(step.cmds)
+	}
+	// Parallel sessions share the commands out
+	d := time.Duration((n+sshConcurrency-1)/max(sshConcurrency, 1))*cmdWait + watchdogSlack + refreshRetry.budget()
+	if canaryName != "" {
+		d += canaryWait
+	}
+	if len(steps) > 1 {
+		d += time.Duration((len(steps)-1)/max(sshConcurrency, 1)) * staggerDelay
+	}
+	if size, err := rolloutSize(len(steps)); rolloutBatch != "" && err == nil && len(steps) > 0 {
+		d += time.Duration((len(steps)-1)/size) * rolloutPause
+	}
+	return d
+}
+
+// Arm the watchdog for an iteration, returning the function that disarms it
+func (sc *scheduler) watch(iteration int, started time.Time, deadline time.Duration) (stop func()) {
+	if watchdogMultiple <= 0 {
+		return func() {}
+	}
+	limit := time.Duration(watchdogMultiple) * deadline
+	t := time.AfterFunc(limit-time.Since(started), func() { sc.trip(iteration, started, limit) })
+	return func() { t.Stop() }
+}
+
+// Abandon the iteration: dump diagnostics, notify and force-close the connection
+// so whatever is blocked on it returns
+func (sc *scheduler) trip(iteration int, started time.Time, limit time.Duration) {
+	sc.tripped.Store(true)
+
+	msg := fmt.Sprintf("iteration # %d on %s exceeded %v (running %v), restarting it",
+		iteration, sc.firewall, limit, time.Since(started).Round(time.Second))
+	if path, err := writeWatchdogDump(sc.firewall, iteration, msg); err != nil {
+		logger.Error(fmt.Sprint("watchdog dump failed: ", err), "firewall", sc.firewall, "error", err)
+	} else {
+		msg += ", diagnostics in " + path
+	}
+	notify(event{Type: "watchdog", Severity: sevError, Firewall: sc.firewall, Message: msg})
+
+	sc.mu.Lock()
+	if sc.client != nil {
+		sc.client.Close()
+	}
+	sc.mu.Unlock()
+	current.setConnection(sc.firewall, "disconnected")
+}
+
+// Reconnect after the watchdog abandoned an iteration. The api transport holds no
+// connection to replace; its requests are bounded by -command-timeout.
+func (sc *scheduler) recover() error {
+	if sc.api != nil {
+		current.setConnection(sc.firewall, "api")
+		return nil
+	}
+	return sc.connect()
+}
+
+// Write the daemon's activity and goroutine stacks next to the state file
+func writeWatchdogDump(firewall string, iteration int, reason string) (string, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tfresh watchdog dump %s\n%s\n\n", time.Now().Format(time.RFC3339), reason)
+
+	activity, _ := json.MarshalIndent(current, "", "  ")
+	fmt.Fprintf(&b, "Activity:\n%s\n\nGoroutines:\n", activity)
+	pprof.Lookup("goroutine").WriteTo(&b, 2)
+
+	name := fmt.Sprintf("tfresh-watchdog-%s-%d-%s.txt", safeFilename(firewall), iteration, time.Now().Format("20060102T150405"))
+	path := filepath.Join(filepath.Dir(stateFile), name)
+	return path, os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// Replace the characters Windows doesn't allow in file names, such as the colon of host:port
+func safeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
@@ -0,0 +1,40 @@
+/*
+ * Filename: watchdog_test.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Tests of the watchdog's diagnostic dump.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWatchdogDumpFilename(t *testing.T) {
+	old := stateFile
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+	t.Cleanup(func() { stateFile = old })
+
+	for _, firewall := range []string{"10.0.0.1:2222", "[2001:db8::1]:22", "fw-01.example.com"} {
+		path, err := writeWatchdogDump(firewall, 3, "iteration stuck")
+		if err != nil {
+			t.Fatalf("%s: %v", firewall, err)
+		}
+		name := filepath.Base(path)
+		if strings.ContainsAny(name, `<>:"/\|?*`) || !strings.HasPrefix(name, "tfresh-watchdog-") {
+			t.Errorf("%s: dump named %q", firewall, name)
+		}
+		if b, err := os.ReadFile(path); err != nil || !strings.Contains(string(b), "iteration stuck") {
+			t.Errorf("%s: dump %q: %v", firewall, b, err)
+		}
+	}
+	if got := safeFilename("[2001:db8::1]:22"); got != "[2001_db8__1]_22" {
+		t.Errorf("safeFilename: got %q", got)
+	}
+}
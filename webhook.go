@@ -0,0 +1,118 @@
+/*
+ * Filename: webhook.go
+ * Author: Bobby Williams <bobwilliams@####.com>
+ *
+ * Copyright (c) 2023 ######
+ *
+ * Description: Generic outbound webhook notifications with retries and HMAC-SHA256 signatures.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Timeout for one webhook post
+const webhookTimeout = 10 * time.Second
+
+// Retry policy for webhook posts
+var webhookRetry = retryPolicy{attempts: 3, base: 2 * time.Second, max: 30 * time.Second, jitter: 0.2}
+
+// 'webhookNotifier' type represents JSON posts to one or more URLs
+type webhookNotifier struct {
+	urls        []string
+	secret      []byte // signs the body when set
+	minSeverity int
+	http        *http.Client
+}
+
+// 'webhookPayload' type represents the JSON body of a webhook post
+type webhookPayload struct {
+	Event    string    `json:"event"`
+	Severity string    `json:"severity"`
+	Firewall string    `json:"firewall,omitempty"`
+	Customer string    `json:"customer,omitempty"`
+	Gateway  string    `json:"gateway,omitempty"`
+	Tunnel   string    `json:"tunnel,omitempty"`
+	Result   string    `json:"result,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`    // when the event happened
+	SentAt   time.Time `json:"sent_at"` // when this post was made
+}
+
+// Create a webhook notifier for events at or above a severity name (info, warning, error)
+func newWebhookNotifier(urls []string, secret, minSeverity string) (*webhookNotifier, error) {
+	sev, ok := severityNames[minSeverity]
+	if !ok || sev == sevOff {
+		return nil, fmt.Errorf("unknown webhook severity %q (info, warning, error)", minSeverity)
+	}
+	w := &webhookNotifier{urls: urls, minSeverity: sev, http: &http.Client{Timeout: webhookTimeout}}
+	if secret != "" {
+		w.secret = []byte(secret)
+	}
+	return w, nil
+}
+
+// Signature of a body: hex HMAC-SHA256 over '<timestamp>.<body>', so replays can be rejected by age
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhookNotifier) Notify(e event) error {
+	if e.Severity < w.minSeverity {
+		return nil
+	}
+	p := webhookPayload{Event: e.Type, Severity: severityName(e.Severity), Firewall: e.Firewall, Customer: e.Customer,
+		Gateway: e.Gateway, Tunnel: e.Tunnel, Result: e.Result, Message: e.Message, Time: e.Time}
+
+	var failed error
+	for _, u := range w.urls {
+		err := webhookRetry.do("webhook "+u, func() error {
+			p.SentAt = time.Now()
+			body, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			return w.post(u, body)
+		})
+		if err != nil {
+			failed = fmt.Errorf("webhook %s: %w", u, err)
+		}
+	}
+	return failed
+}
+
+// Post a signed body once
+func (w *webhookNotifier) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Tfresh-Timestamp", ts)
+		req.Header.Set("X-Tfresh-Signature", webhookSignature(w.secret, ts, body))
+	}
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("returned %s", resp.Status)
+	}
+	return nil
+}